@@ -0,0 +1,86 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/objectserver/engine/pack"
+)
+
+type DeviceModeCommand struct {
+	Ui cli.Ui
+}
+
+func (c *DeviceModeCommand) Help() string {
+	helpText := `
+Usage: auklet device-mode -d [device] [-policy index] [-mode mode]
+
+Show or change the mode of a pack device through the running object server.
+The mode is saved in the device and survives restarts.
+
+normal     serve reads and updates
+read-only  serve reads only, updates are rejected with 507
+drain      read-only, and the replicator pushes every partition of the
+           device to other nodes and removes it, as if it is a handoff
+
+auklet device-mode -d vde
+auklet device-mode -d vde -policy 1 -mode drain
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *DeviceModeCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("device-mode", flag.ExitOnError)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.String("c", conf.FindServerConfig("object"), "config file/directory")
+	flags.String("l", "", "zap yaml log config file")
+	flags.String("d", "", "device name")
+	flags.Int("policy", 0, "policy index")
+	flags.String("mode", "", "normal, read-only or drain, show the mode if empty")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.Lookup("d").Value.String() == "" || flags.NArg() > 0 {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	configs, err := conf.LoadConfigs(flags.Lookup("c").Value.String())
+	if err != nil || len(configs) == 0 {
+		c.Ui.Error(fmt.Sprintf("unable to load config, %v", err))
+		return EXIT_ERROR
+	}
+
+	mode, err := pack.SetDeviceMode(configs[0], flags)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to set device mode, %v", err))
+		return EXIT_ERROR
+	}
+
+	c.Ui.Output(fmt.Sprintf("mode: %s", mode))
+
+	return EXIT_OK
+}
+
+func (c *DeviceModeCommand) Synopsis() string {
+	return "show or change the mode of a pack device"
+}
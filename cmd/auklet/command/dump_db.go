@@ -16,6 +16,7 @@
 package command
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -62,36 +63,67 @@ func (c *DumpDBCommand) Run(args []string) int {
 
 	opts := rocksdb.NewDefaultOptions()
 
-	db, err := rocksdb.OpenDbForReadOnly(opts, dbPath, false)
+	// Pack meta DB may save indexes of each type in its own column family
+	cfNames, err := rocksdb.ListColumnFamilies(opts, dbPath)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to open RocksDB, %v\n", err))
+		return EXIT_ERROR
+	}
+	cfOpts := make([]*rocksdb.Options, len(cfNames))
+	for i := range cfOpts {
+		cfOpts[i] = opts
+	}
+
+	db, cfs, err := rocksdb.OpenDbForReadOnlyColumnFamilies(
+		opts, dbPath, cfNames, cfOpts, false)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("unable to open RocksDB, %v\n", err))
 		return EXIT_ERROR
 	}
 
+	// Prefixes dumped may cross the ones of the prefix extractor
 	ropt := rocksdb.NewDefaultReadOptions()
-	iter := db.NewIterator(ropt)
+	pack.SetTotalOrderSeek(ropt, true)
+	for _, cf := range cfs {
+		if err = dumpColumnFamily(db, ropt, cf, []byte(prefix), keyType); err != nil {
+			c.Ui.Error(fmt.Sprintf("unable to dump RocksDB, %v\n", err))
+			return EXIT_ERROR
+		}
+	}
+
+	return EXIT_OK
+}
+
+// Internal records of pack meta DB, e.g. suffix summaries and dedup
+// records, are not indexes, so they are skipped.
+func dumpColumnFamily(db *rocksdb.DB, ropt *rocksdb.ReadOptions,
+	cf *rocksdb.ColumnFamilyHandle, prefix []byte, keyType string) error {
+	iter := db.NewIteratorCF(ropt, cf)
 	defer iter.Close()
-	pre := []byte(prefix)
-	for iter.Seek(pre); iter.ValidForPrefix(pre); iter.Next() {
-		b := iter.Value().Data()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		if keyType == "index" && bytes.HasPrefix(iter.Key().Data(), []byte("/.")) {
+			continue
+		}
+
 		var obj proto.Message
 		if keyType == "index" {
 			obj = new(pack.DBIndex)
 		} else {
 			obj = new(objectserver.KVAsyncJob)
 		}
-		if err := proto.Unmarshal(b, obj); err != nil {
-			panic(err)
+		if err := proto.Unmarshal(iter.Value().Data(), obj); err != nil {
+			return fmt.Errorf("%s: %v", iter.Key().Data(), err)
 		}
 
-		if b, err = json.Marshal(obj); err != nil {
-			panic(err)
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return err
 		}
 
 		fmt.Println(string(b))
 	}
 
-	return EXIT_OK
+	return iter.Err()
 }
 
 func (c *DumpDBCommand) Synopsis() string {
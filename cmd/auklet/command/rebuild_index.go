@@ -0,0 +1,95 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/objectserver/engine/pack"
+)
+
+type RebuildIndexCommand struct {
+	Ui cli.Ui
+}
+
+func (c *RebuildIndexCommand) Help() string {
+	helpText := `
+Usage: auklet rebuild-index -d [device] [-policy index] [-partitions list] [-dry-run]
+
+Rebuild the meta index of pack engine from bundle files and large object
+files. Object server must be stopped before rebuilding.
+
+auklet rebuild-index -d vde -dry-run
+auklet rebuild-index -d vde -policy 1 -partitions 12,34
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RebuildIndexCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("rebuild-index", flag.ExitOnError)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.String("c", conf.FindServerConfig("object"), "config file/directory")
+	flags.String("l", "", "zap yaml log config file")
+	flags.String("d", "", "device to rebuild")
+	flags.Int("policy", 0, "policy index")
+	flags.String("partitions", "", "partition filter")
+	flags.Bool("dry-run", false, "only report differences from existing index")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.Lookup("d").Value.String() == "" || flags.NArg() > 0 {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	configs, err := conf.LoadConfigs(flags.Lookup("c").Value.String())
+	if err != nil || len(configs) == 0 {
+		c.Ui.Error(fmt.Sprintf("unable to load config, %v", err))
+		return EXIT_ERROR
+	}
+
+	stat, err := pack.RebuildDeviceIndex(configs[0], flags)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to rebuild index, %v", err))
+		return EXIT_ERROR
+	}
+
+	for _, diff := range stat.Diffs {
+		b, err := json.Marshal(diff)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("unable to marshal index diff, %v", err))
+			return EXIT_ERROR
+		}
+		c.Ui.Output(string(b))
+	}
+
+	c.Ui.Output(fmt.Sprintf(
+		"partitions: %d, needles: %d, files: %d, indexes: %d, diffs: %d, errors: %d",
+		stat.Partitions, stat.Needles, stat.Files,
+		stat.Indexes, len(stat.Diffs), stat.Errors))
+
+	return EXIT_OK
+}
+
+func (c *RebuildIndexCommand) Synopsis() string {
+	return "rebuild the pack meta index from bundle files"
+}
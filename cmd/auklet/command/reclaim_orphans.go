@@ -0,0 +1,94 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/objectserver/engine/pack"
+)
+
+type ReclaimOrphansCommand struct {
+	Ui cli.Ui
+}
+
+func (c *ReclaimOrphansCommand) Help() string {
+	helpText := `
+Usage: auklet reclaim-orphans -d [device] [-policy index] [-partitions list] [-grace seconds] [-dry-run]
+
+Reclaim the needles of pack engine which are not referenced by any index.
+Only needles of bundle segments not written within the grace period are
+reclaimed. Object server must be stopped before reclaiming.
+
+auklet reclaim-orphans -d vde -dry-run
+auklet reclaim-orphans -d vde -policy 1 -partitions 12,34 -grace 3600
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ReclaimOrphansCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("reclaim-orphans", flag.ExitOnError)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.String("c", conf.FindServerConfig("object"), "config file/directory")
+	flags.String("l", "", "zap yaml log config file")
+	flags.String("d", "", "device to scan")
+	flags.Int("policy", 0, "policy index")
+	flags.String("partitions", "", "partition filter")
+	flags.Int("grace", 86400, "grace period of orphan needles in seconds")
+	flags.Bool("dry-run", false, "only report orphan needles")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.Lookup("d").Value.String() == "" || flags.NArg() > 0 {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	configs, err := conf.LoadConfigs(flags.Lookup("c").Value.String())
+	if err != nil || len(configs) == 0 {
+		c.Ui.Error(fmt.Sprintf("unable to load config, %v", err))
+		return EXIT_ERROR
+	}
+
+	stats, err := pack.ReclaimDeviceOrphans(configs[0], flags)
+	var orphans, reclaimed int64
+	for _, stat := range stats {
+		c.Ui.Output(fmt.Sprintf(
+			"partition: %s, needles: %d, orphans: %d, reclaimed bytes: %d, errors: %d",
+			stat.Partition, stat.Needles, stat.Orphans,
+			stat.ReclaimedBytes, stat.Errors))
+		orphans += stat.Orphans
+		reclaimed += stat.ReclaimedBytes
+	}
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to reclaim orphan needles, %v", err))
+		return EXIT_ERROR
+	}
+
+	c.Ui.Output(fmt.Sprintf("partitions: %d, orphans: %d, reclaimed bytes: %d",
+		len(stats), orphans, reclaimed))
+
+	return EXIT_OK
+}
+
+func (c *ReclaimOrphansCommand) Synopsis() string {
+	return "reclaim the pack needles not referenced by index"
+}
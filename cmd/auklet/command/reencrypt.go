@@ -0,0 +1,93 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/objectserver/engine/pack"
+)
+
+type ReencryptCommand struct {
+	Ui cli.Ui
+}
+
+func (c *ReencryptCommand) Help() string {
+	helpText := `
+Usage: auklet reencrypt -d [device] [-policy index] [-partitions list]
+
+Encrypt the needles and large object files of pack engine with the active
+key of the policy, which is configured by encryption_key_id or the highest
+key id in the keyfile. Data in plain text is encrypted as well. Keys used
+before could be removed from the keyfile once all the devices of the
+policy are reencrypted. Object server must be stopped before reencrypting.
+
+auklet reencrypt -d vde
+auklet reencrypt -d vde -policy 1 -partitions 12,34
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ReencryptCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.String("c", conf.FindServerConfig("object"), "config file/directory")
+	flags.String("l", "", "zap yaml log config file")
+	flags.String("d", "", "device to reencrypt")
+	flags.Int("policy", 0, "policy index")
+	flags.String("partitions", "", "partition filter")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.Lookup("d").Value.String() == "" || flags.NArg() > 0 {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	configs, err := conf.LoadConfigs(flags.Lookup("c").Value.String())
+	if err != nil || len(configs) == 0 {
+		c.Ui.Error(fmt.Sprintf("unable to load config, %v", err))
+		return EXIT_ERROR
+	}
+
+	stats, err := pack.ReencryptDevice(configs[0], flags)
+	var segments, files int64
+	for _, stat := range stats {
+		c.Ui.Output(fmt.Sprintf(
+			"partition: %s, segments: %d, needles: %d, files: %d",
+			stat.Partition, stat.Segments, stat.Needles, stat.Files))
+		segments += stat.Segments
+		files += stat.Files
+	}
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to reencrypt device, %v", err))
+		return EXIT_ERROR
+	}
+
+	c.Ui.Output(fmt.Sprintf("partitions: %d, segments: %d, files: %d",
+		len(stats), segments, files))
+
+	return EXIT_OK
+}
+
+func (c *ReencryptCommand) Synopsis() string {
+	return "encrypt the pack data with the active key"
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/objectserver/engine/pack"
+)
+
+type SnapshotCommand struct {
+	Ui cli.Ui
+}
+
+func (c *SnapshotCommand) Help() string {
+	helpText := `
+Usage: auklet snapshot -d [device] [-policy index] [-name name] [-list] [-restore]
+
+Create a consistent snapshot of the meta index and bundle files of pack
+engine. Snapshots are created by the running object server and saved in
+directory snapshots of the device. Each snapshot is laid out like a device,
+so its meta index could be inspected by dump-db.
+
+Restoring replaces the objects and meta index of the device by the
+snapshot. Object server must be stopped before restoring.
+
+auklet snapshot -d vde -name before-upgrade
+auklet snapshot -d vde -list
+auklet snapshot -d vde -policy 1 -name before-upgrade -restore
+auklet dump-db -d /srv/node/vde/snapshots/before-upgrade/pack-meta -p /0/
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *SnapshotCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	flags.Usage = func() { c.Ui.Output(c.Help()) }
+	flags.String("c", conf.FindServerConfig("object"), "config file/directory")
+	flags.String("l", "", "zap yaml log config file")
+	flags.String("d", "", "device to snapshot")
+	flags.Int("policy", 0, "policy index")
+	flags.String("name", "", "snapshot name, current time by default")
+	flags.Bool("list", false, "list snapshots of the device")
+	flags.Bool("restore", false, "restore the device from the snapshot")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+
+	if flags.Lookup("d").Value.String() == "" || flags.NArg() > 0 {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	restore := flags.Lookup("restore").Value.(flag.Getter).Get() == true
+	if restore && flags.Lookup("name").Value.String() == "" {
+		c.Ui.Output(c.Help())
+		return EXIT_USAGE
+	}
+
+	configs, err := conf.LoadConfigs(flags.Lookup("c").Value.String())
+	if err != nil || len(configs) == 0 {
+		c.Ui.Error(fmt.Sprintf("unable to load config, %v", err))
+		return EXIT_ERROR
+	}
+
+	if flags.Lookup("list").Value.(flag.Getter).Get() == true {
+		snapshots, err := pack.ListSnapshots(
+			configs[0].GetDefault("app:object-server", "devices", "/srv/node"),
+			flags.Lookup("d").Value.String(),
+			flags.Lookup("policy").Value.(flag.Getter).Get().(int))
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("unable to list snapshots, %v", err))
+			return EXIT_ERROR
+		}
+		for _, name := range snapshots {
+			c.Ui.Output(name)
+		}
+		return EXIT_OK
+	}
+
+	stat, err := pack.SnapshotDevice(configs[0], flags)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("unable to snapshot device, %v", err))
+		return EXIT_ERROR
+	}
+
+	if restore {
+		c.Ui.Output(fmt.Sprintf("restored: %s", stat.Path))
+		return EXIT_OK
+	}
+
+	c.Ui.Output(fmt.Sprintf("snapshot: %s, segments: %d, reflinked: %d, files: %d",
+		stat.Path, stat.Segments, stat.Reflinked, stat.Files))
+
+	return EXIT_OK
+}
+
+func (c *SnapshotCommand) Synopsis() string {
+	return "snapshot the pack meta index and bundle files"
+}
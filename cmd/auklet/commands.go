@@ -94,5 +94,35 @@ func init() {
 				Ui: ui,
 			}, nil
 		},
+
+		"rebuild-index": func() (cli.Command, error) {
+			return &command.RebuildIndexCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"reclaim-orphans": func() (cli.Command, error) {
+			return &command.ReclaimOrphansCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"reencrypt": func() (cli.Command, error) {
+			return &command.ReencryptCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"snapshot": func() (cli.Command, error) {
+			return &command.SnapshotCommand{
+				Ui: ui,
+			}, nil
+		},
+
+		"device-mode": func() (cli.Command, error) {
+			return &command.DeviceModeCommand{
+				Ui: ui,
+			}, nil
+		},
 	}
 }
@@ -0,0 +1,44 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Request of ioctl_ficlone(2)
+const ficlone = 0x40049409
+
+// Reflink makes dst share the data blocks of src, e.g. on btrfs or XFS
+// with reflink enabled. ErrReflinkNotSupported is returned if the file
+// system doesn't support it.
+func Reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EINVAL,
+		syscall.EXDEV, syscall.ENOSYS:
+		return ErrReflinkNotSupported
+	}
+
+	return errno
+}
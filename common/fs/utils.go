@@ -16,8 +16,10 @@
 package fs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -128,3 +130,93 @@ func IsFileNotExist(path string) bool {
 
 	return os.IsNotExist(err)
 }
+
+var ErrReflinkNotSupported = errors.New("reflink not supported")
+
+// Size of the blocks skipped if they are all zero while copying files
+const sparseBlockSize = 4096
+
+// CloneFile creates dst with the content of src. The data blocks are
+// shared by reflink if possible, otherwise they are copied while the holes
+// of src are kept. True is returned if the file is reflinked.
+func CloneFile(src, dst string) (bool, error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer sf.Close()
+
+	info, err := sf.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return CloneFileSize(sf, dst, info.Size())
+}
+
+// CloneFileSize is like CloneFile, but only the first size bytes of the
+// opened src are kept in dst, even if src grows meanwhile.
+func CloneFileSize(src *os.File, dst string, size int64) (bool, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return false, err
+	}
+	defer df.Close()
+
+	reflinked := true
+	if err = Reflink(df, src); err == ErrReflinkNotSupported {
+		reflinked = false
+		err = copySparse(df, src, size)
+	} else if err == nil {
+		err = df.Truncate(size)
+	}
+	if err == nil {
+		err = df.Sync()
+	}
+	if err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+
+	return reflinked, nil
+}
+
+func copySparse(dst, src *os.File, size int64) error {
+	zero := make([]byte, sparseBlockSize)
+	buf := make([]byte, sparseBlockSize*256)
+	var offset int64
+	for offset < size {
+		// src may be larger than size
+		if size-offset < int64(len(buf)) {
+			buf = buf[:size-offset]
+		}
+		n, err := src.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+
+		for i := 0; i < n; i += sparseBlockSize {
+			end := i + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			if bytes.Equal(buf[i:end], zero[:end-i]) {
+				continue
+			}
+			if _, err = dst.WriteAt(buf[i:end], offset+int64(i)); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+	}
+
+	return dst.Truncate(size)
+}
@@ -79,3 +79,55 @@ func TestLockPath(t *testing.T) {
 	require.Nil(t, f)
 	require.NotNil(t, err)
 }
+
+func TestCloneFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Data with a hole in the middle and an unaligned tail
+	data := make([]byte, sparseBlockSize*3+100)
+	for i := range data[:sparseBlockSize] {
+		data[i] = 'a'
+	}
+	for i := range data[sparseBlockSize*2:] {
+		data[sparseBlockSize*2+i] = 'b'
+	}
+	src := tempDir + "/src"
+	require.Nil(t, ioutil.WriteFile(src, data, 0640))
+
+	dst := tempDir + "/dst"
+	_, err = CloneFile(src, dst)
+	require.Nil(t, err)
+	cloned, err := ioutil.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, data, cloned)
+
+	// Existing files are never overwritten
+	_, err = CloneFile(src, dst)
+	require.True(t, os.IsExist(err))
+}
+
+func TestCloneFileSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	data := make([]byte, sparseBlockSize*2)
+	for i := range data {
+		data[i] = 'a'
+	}
+	src := tempDir + "/src"
+	require.Nil(t, ioutil.WriteFile(src, data, 0640))
+	f, err := os.Open(src)
+	require.Nil(t, err)
+	defer f.Close()
+
+	// Only the prefix is kept
+	dst := tempDir + "/dst"
+	_, err = CloneFileSize(f, dst, sparseBlockSize+10)
+	require.Nil(t, err)
+	cloned, err := ioutil.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, data[:sparseBlockSize+10], cloned)
+}
@@ -36,6 +36,7 @@ const (
 	XBackendEtagIsAt           = "X-Backend-Etag-Is-At"
 	XBackendTimestamp          = "X-Backend-Timestamp"
 	XBackendReplicationHeaders = "X-Backend-Replication-Headers"
+	XBackendSuffixHash         = "X-Backend-Suffix-Hash"
 	XCopyFrom                  = "X-Copy-From"
 	XDeleteAtContainer         = "X-Delete-At-Container"
 	XDeleteAtPartition         = "X-Delete-At-Partition"
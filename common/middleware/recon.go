@@ -38,6 +38,9 @@ import (
 	"github.com/shirou/gopsutil/process"
 )
 
+// Directory of the recon cache files served by ReconHandler
+const ReconCachePath = "/var/cache/swift"
+
 func DumpReconCache(reconCachePath string, source string, cacheData map[string]interface{}) error {
 	reconFile := filepath.Join(reconCachePath, source+".recon")
 
@@ -208,7 +211,7 @@ func fromReconCache(source string, keys ...string) (interface{}, error) {
 	for _, key := range keys {
 		results[key] = nil
 	}
-	filedata, err := ioutil.ReadFile(fmt.Sprintf("/var/cache/swift/%s.recon", source))
+	filedata, err := ioutil.ReadFile(filepath.Join(ReconCachePath, source+".recon"))
 	if err != nil {
 		results["recon_error"] = fmt.Sprintf("Error: %s", err)
 		return results, nil
@@ -341,7 +344,7 @@ func ReconHandler(driveRoot string, writer http.ResponseWriter, request *http.Re
 		} else if vars["recon_type"] == "container" {
 			content, err = fromReconCache("container", "replication_time", "replication_stats", "replication_last")
 		} else if vars["recon_type"] == "object" {
-			content, err = fromReconCache("object", "object_replication_time", "object_replication_last")
+			content, err = fromReconCache("object", "replication_time", "replication_stats", "replication_last", "object_replication_time", "object_replication_last")
 		} else if vars["recon_type"] == "" {
 			// handle old style object replication requests
 			content, err = fromReconCache("object", "object_replication_time", "object_replication_last")
@@ -438,6 +441,27 @@ func ReconHandler(driveRoot string, writer http.ResponseWriter, request *http.Re
 	case "time":
 		//Similar to python time.time()
 		content = float64(time.Now().UnixNano()) / float64(time.Second)
+	case "rocksdb":
+		var err error
+		content, err = fromReconCache("object", "pack_rocksdb_stats")
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	case "pack":
+		var err error
+		content, err = fromReconCache("object", "pack_space_stats")
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	case "pack-partitions":
+		var err error
+		content, err = fromReconCache("pack-space", "pack_partition_space_stats")
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 	case "driveaudit":
 		var err error
 		content, err = fromReconCache("drive", "drive_audit_errors")
@@ -17,6 +17,7 @@ package middleware
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/uber-go/tally"
@@ -32,11 +33,32 @@ func (mw *recordStatusWriter) WriteHeader(status int) {
 	mw.ResponseWriter.WriteHeader(status)
 }
 
+// Write records the status 200 sent implicitly if no header is written.
+func (mw *recordStatusWriter) Write(b []byte) (int, error) {
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+	return mw.ResponseWriter.Write(b)
+}
+
+// ReadFrom is Write for io.Copy. Without it, the wrapper would hide the
+// ReadFrom of the underlying writer, which sends files by sendfile.
+func (mw *recordStatusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+	return io.Copy(mw.ResponseWriter, r)
+}
+
 func RequestMetrics(metricsScope tally.Scope) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			w := &recordStatusWriter{ResponseWriter: writer}
 			next.ServeHTTP(w, request)
+			// Nothing written at all is an empty 200 as well
+			if w.status == 0 {
+				w.status = http.StatusOK
+			}
 			metricsScope.Counter("requests").Inc(1)
 			metricsScope.Counter(request.Method + "_requests").Inc(1)
 			metricsScope.Counter(fmt.Sprintf("%d_responses", w.status)).Inc(1)
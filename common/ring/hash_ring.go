@@ -25,6 +25,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -34,7 +35,9 @@ type hashRing struct {
 	path   string
 	prefix string
 	suffix string
-	mtime  time.Time
+	// Guards mtime, which is updated by the reloader and Reload
+	lock  sync.Mutex
+	mtime time.Time
 }
 
 func (r *hashRing) getData() *ringData {
@@ -144,7 +147,29 @@ func (r *hashRing) reloader() error {
 		r.reload()
 	}
 }
+func (r *hashRing) Reload() (bool, error) {
+	mtime := r.ModTime()
+	if err := r.reload(); err != nil {
+		return false, err
+	}
+
+	return r.ModTime() != mtime, nil
+}
+
+func (r *hashRing) Version() int {
+	return r.getData().Version
+}
+
+func (r *hashRing) ModTime() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.mtime
+}
+
 func (r *hashRing) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	fi, err := os.Stat(r.path)
 	if err != nil {
 		return err
@@ -42,6 +42,21 @@ type Ring interface {
 	PartitionCount() (cnt uint64)
 }
 
+// Reloadable is implemented by rings loaded from ring files. Long running
+// daemons could reload them on demand rather than waiting for the periodic
+// reload.
+type Reloadable interface {
+	// Reload reads the ring file again if its mtime has changed, and
+	// reports whether the ring is reloaded.
+	Reload() (bool, error)
+
+	// Version saved by the ring builder, 0 if unknown
+	Version() int
+
+	// ModTime of the ring file loaded
+	ModTime() time.Time
+}
+
 type MoreNodes interface {
 	Next() *Device
 }
@@ -50,6 +65,7 @@ type ringData struct {
 	Devs               []*Device `json:"devs"`
 	ReplicaCount       int       `json:"replica_count"`
 	PartShift          uint64    `json:"part_shift"`
+	Version            int       `json:"version"`
 	replica2part2devId [][]uint16
 	regionCount        int
 	zoneCount          int
@@ -134,10 +134,16 @@ func TestRingReload(t *testing.T) {
 	require.Nil(t, writeARing(fp, 5, 3, 30))
 	// make sure the mtime has changed
 	os.Chtimes(fp.Name(), time.Now(), time.Now().Add(time.Second))
-	ring.reload()
+	reloaded, err := ring.Reload()
+	require.Nil(t, err)
+	require.True(t, reloaded)
 	require.Equal(t, 5, len(ring.getData().Devs))
 	require.Equal(t, 3, ring.getData().ReplicaCount)
 	require.Equal(t, uint64(30), ring.getData().PartShift)
+	// Unchanged ring file is not reloaded
+	reloaded, err = ring.Reload()
+	require.Nil(t, err)
+	require.False(t, reloaded)
 }
 
 func TestCounts(t *testing.T) {
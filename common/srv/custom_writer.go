@@ -17,6 +17,7 @@
 package srv
 
 import (
+	"io"
 	"net/http"
 )
 
@@ -29,6 +30,13 @@ func (w *customWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(w.f(w.ResponseWriter, status))
 }
 
+// ReadFrom passes the body to the underlying writer, so that io.Copy
+// still finds its ReadFrom through the wrapper. Like Write, it doesn't
+// call f for the implicit 200.
+func (w *customWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseWriter, r)
+}
+
 // NewCustomWriter creates an http.ResponseWriter wrapper that calls
 // your function on WriteHeader.
 func NewCustomWriter(w http.ResponseWriter,
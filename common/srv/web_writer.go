@@ -18,6 +18,7 @@ package srv
 
 import (
 	"bufio"
+	"io"
 	"net"
 	"net/http"
 )
@@ -35,6 +36,16 @@ func (w *WebWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+// ReadFrom marks the response as started before the body is copied, since
+// the header is sent with it. Files copied to a plain http.ResponseWriter
+// are then sent by sendfile.
+func (w *WebWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.ResponseStarted {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
 func (w WebWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
@@ -19,6 +19,8 @@ import (
 	"flag"
 	"sync"
 
+	"github.com/uber-go/tally"
+
 	"github.com/iqiyi/auklet/common/conf"
 )
 
@@ -30,6 +32,29 @@ type ObjectEngine interface {
 	Close() error
 }
 
+// MetricsReporter is implemented by engines which report their own metrics
+// through the metrics scope of object server.
+type MetricsReporter interface {
+	SetMetricsScope(scope tally.Scope)
+}
+
+// ReadOnlyChecker is implemented by engines whose devices could be set to
+// stop accepting updates while still serving reads.
+type ReadOnlyChecker interface {
+	IsReadOnly(device string) bool
+}
+
+// Suffix hash algorithm of SummaryHasher, requested and answered by
+// REPLICATE in header X-Backend-Suffix-Hash
+const SummarySuffixHash = "summary"
+
+// SummaryHasher is implemented by engines which keep incremental hashes of
+// suffixes. They are answered to REPLICATE only if requested, because
+// replicators of older versions compare the legacy hashes only.
+type SummaryHasher interface {
+	GetSummaryHashes(device, partition string) (map[string]string, error)
+}
+
 type ObjectEngineConstructor func(conf.Config, *conf.Policy, *flag.FlagSet, *sync.WaitGroup) (ObjectEngine, error)
 
 type engineFactoryEntry struct {
@@ -69,12 +69,13 @@ func (a *Auditor) listPartitions(policy int, device string) []string {
 	return partitions
 }
 
-func (a *Auditor) auditDevice(
-	policy int, device string, pool chan bool, wg *sync.WaitGroup) {
+func (a *Auditor) auditDevice(policy int, device string,
+	recon *auditRecon, pool chan bool, wg *sync.WaitGroup) {
 	defer func() {
 		<-pool
 		wg.Done()
 	}()
+	start := time.Now()
 
 	a.logger.Info("begin to audit device",
 		zap.String("device", device), zap.Int("policy", policy))
@@ -106,6 +107,25 @@ func (a *Auditor) auditDevice(
 		stat.ProcessedFiles += reply.ProcessedFiles
 		stat.Quarantines += reply.Quarantines
 		stat.Errors += reply.Errors
+		stat.Orphans += reply.Orphans
+		stat.ReclaimedBytes += reply.ReclaimedBytes
+		stat.ReapedTombstones += reply.ReapedTombstones
+
+		if reply.Orphans > 0 {
+			a.logger.Info("orphan needles reclaimed",
+				zap.Int("policy", policy),
+				zap.String("device", device),
+				zap.String("partition", p),
+				zap.Int64("orphans", reply.Orphans),
+				zap.Int64("reclaimed-bytes", reply.ReclaimedBytes))
+		}
+		if reply.ReapedTombstones > 0 {
+			a.logger.Info("expired tombstones reaped",
+				zap.Int("policy", policy),
+				zap.String("device", device),
+				zap.String("partition", p),
+				zap.Int64("tombstones", reply.ReapedTombstones))
+		}
 	}
 
 	a.logger.Info("device audited",
@@ -114,23 +134,29 @@ func (a *Auditor) auditDevice(
 		zap.Int64("bytes", stat.ProcessedBytes),
 		zap.Int64("files", stat.ProcessedFiles),
 		zap.Int64("errors", stat.Errors),
-		zap.Int64("quarantines", stat.Quarantines))
+		zap.Int64("quarantines", stat.Quarantines),
+		zap.Int64("orphans", stat.Orphans),
+		zap.Int64("reclaimed-bytes", stat.ReclaimedBytes),
+		zap.Int64("reaped-tombstones", stat.ReapedTombstones))
+	recon.add(device, start, stat)
 }
 
 func (a *Auditor) audit() {
 	pool := make(chan bool, a.concurrency)
 	wg := &sync.WaitGroup{}
+	recon := newAuditRecon()
 
 	for p, devs := range a.devices {
 		// TODO: shuffle the devices
 		for _, d := range devs {
 			pool <- true
 			wg.Add(1)
-			go a.auditDevice(p, d, pool, wg)
+			go a.auditDevice(p, d, recon, pool, wg)
 		}
 	}
 
 	wg.Wait()
+	a.dumpRecon(recon)
 }
 
 func (a *Auditor) Run() {
@@ -16,10 +16,13 @@
 package pack
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -27,14 +30,25 @@ import (
 type BundleVersion uint8
 
 const (
-	BundleVersion1       = BundleVersion(1)
-	CurrentBundleVersion = BundleVersion1
+	BundleVersion1 = BundleVersion(1)
+	// Needle header is extended to carry a checksum since version 2
+	BundleVersion2       = BundleVersion(2)
+	CurrentBundleVersion = BundleVersion2
+)
+
+type ChecksumType uint8
+
+const (
+	ChecksumNone   = ChecksumType(0)
+	ChecksumCRC32C = ChecksumType(1)
 )
 
 const (
 	SuperBlockSize     = 64
 	SuperBlockDiskSize = NeedleAlignment
 	BundleFileMode     = 0644
+	BundleFileName     = "bundle.data"
+	CompactedFileName  = "bundle.compact"
 )
 
 const (
@@ -48,32 +62,144 @@ const (
 * the first 4K of every bundle will be dedicated to superblock.
 * This means there a lot of space "reserved" for superblock and should be
 * sufficient for later extending.
+* Since version 2, the second byte tracks the checksum algorithm of needles.
  */
 type SuperBlock struct {
-	Version BundleVersion
+	Version  BundleVersion
+	Checksum ChecksumType
 }
 
 func (s *SuperBlock) Bytes() []byte {
 	header := make([]byte, SuperBlockSize)
 	header[0] = byte(s.Version)
+	header[1] = byte(s.Checksum)
 
 	return header
 }
 
 func NewSuperBlock(header []byte) *SuperBlock {
 	sb := &SuperBlock{
-		Version: BundleVersion(header[0]),
+		Version:  BundleVersion(header[0]),
+		Checksum: ChecksumType(header[1]),
 	}
 
 	return sb
 }
 
+func (s *SuperBlock) needleHeaderSize() int32 {
+	if s.Version >= BundleVersion2 {
+		return NeedleHeaderSizeV2
+	}
+
+	return NeedleHeaderSize
+}
+
+func (s *SuperBlock) hasChecksum() bool {
+	return s.Version >= BundleVersion2 && s.Checksum == ChecksumCRC32C
+}
+
+// Writes the header to the needle which consists of the header, data and
+// meta. The checksum is calculated as well if the bundle requires.
+func (s *SuperBlock) sealNeedle(nh *NeedleHeader, needle []byte) {
+	hs := s.needleHeaderSize()
+	nh.Checksum = 0
+	if s.hasChecksum() {
+		nh.WriteToBuffer(needle[0:hs])
+		nh.Checksum = NeedleChecksum(needle)
+	}
+	nh.WriteToBuffer(needle[0:hs])
+}
+
+// Verifies the needle which consists of the header, data and meta.
+func (s *SuperBlock) verifyNeedle(needle []byte) error {
+	nh := &NeedleHeader{}
+	nh.DeserializeFrom(needle[0:s.needleHeaderSize()])
+	if nh.MagicNumber != NeedleMagicNumber {
+		return ErrNeedleCorrupted
+	}
+
+	if s.hasChecksum() && nh.Checksum != NeedleChecksum(needle) {
+		return ErrNeedleChecksumMismatch
+	}
+
+	return nil
+}
+
 type Bundle struct {
 	*SuperBlock
 	*os.File
 	sync.Mutex
 
 	partition string
+	segment   int32
+
+	// Objects pinning the segment, and whether the segment has been
+	// replaced by compaction. A replaced segment is closed once it is not
+	// pinned any more.
+	pmu     sync.Mutex
+	pins    int64
+	retired bool
+	closed  bool
+
+	// Unix time in nanoseconds when needles were appended last time,
+	// accessed atomically. Segments opened are taken as appended at their
+	// mtime.
+	appended int64
+}
+
+// touch records that needles are being appended to the segment
+func (b *Bundle) touch() {
+	atomic.StoreInt64(&b.appended, time.Now().UnixNano())
+}
+
+// appendedSince reports whether any needle has been appended to the segment
+// after t, whose index may not be written yet.
+func (b *Bundle) appendedSince(t time.Time) bool {
+	return atomic.LoadInt64(&b.appended) > t.UnixNano()
+}
+
+// pin keeps the segment open until unpin is called. False is returned if
+// the segment has been closed after being replaced.
+func (b *Bundle) pin() bool {
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+	if b.closed {
+		return false
+	}
+
+	b.pins++
+	return true
+}
+
+func (b *Bundle) unpin() {
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+	b.pins--
+	b.closeRetired()
+}
+
+// retire closes the segment replaced by compaction once no one pins it.
+// The file is unlinked already, so nothing is flushed.
+func (b *Bundle) retire() {
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+	b.retired = true
+	b.closeRetired()
+}
+
+// Must be called with pmu held
+func (b *Bundle) closeRetired() {
+	if !b.retired || b.closed || b.pins > 0 {
+		return
+	}
+
+	b.closed = true
+	if err := b.Close(); err != nil {
+		glogger.Error("unable to close replaced bundle",
+			zap.String("partition", b.partition),
+			zap.Int32("segment", b.segment),
+			zap.Error(err))
+	}
 }
 
 func (b *Bundle) FlushSuperBlock() error {
@@ -100,6 +226,12 @@ func (b *Bundle) PunchHole(offset, len int64) error {
 		int(b.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, len)
 }
 
+// Reopen opens the bundle file again with an independent file offset. It
+// works even if the bundle has been replaced by compaction.
+func (b *Bundle) Reopen() (*os.File, error) {
+	return os.Open(fmt.Sprintf("/proc/self/fd/%d", b.Fd()))
+}
+
 func (b *Bundle) BundleSize() int64 {
 	info, err := b.Stat()
 	if err != nil {
@@ -113,6 +245,12 @@ func (b *Bundle) Cleanup() error {
 		return err
 	}
 
+	if err := b.Sync(); err != nil {
+		glogger.Error("unable to sync bundle",
+			zap.String("partition", b.partition), zap.Error(err))
+		return err
+	}
+
 	if err := b.Close(); err != nil {
 		glogger.Error("unable to close bundle",
 			zap.String("partition", b.partition), zap.Error(err))
@@ -143,7 +281,8 @@ func formatBundleFile(bundlePath string) error {
 	defer vf.Close()
 
 	sb := &SuperBlock{
-		Version: CurrentBundleVersion,
+		Version:  CurrentBundleVersion,
+		Checksum: ChecksumCRC32C,
 	}
 
 	b := sb.Bytes()
@@ -162,7 +301,12 @@ func formatBundleFile(bundlePath string) error {
 	return nil
 }
 
+// OpenBundle opens the first segment of the bundle of the partition
 func OpenBundle(devPath, partition string) (*Bundle, error) {
+	return OpenBundleSegment(devPath, partition, 0)
+}
+
+func OpenBundleSegment(devPath, partition string, segment int32) (*Bundle, error) {
 	vpd := filepath.Join(devPath, partition)
 	if err := os.MkdirAll(vpd, 0755); err != nil {
 		glogger.Error("unable to create bundle directory",
@@ -170,13 +314,20 @@ func OpenBundle(devPath, partition string) (*Bundle, error) {
 		return nil, err
 	}
 
-	vp := filepath.Join(vpd, "bundle.data")
+	name, _ := segmentFileNames(segment)
+	vp := filepath.Join(vpd, name)
 
 	if err := formatBundleFile(vp); err != nil {
 		return nil, err
 	}
 
-	vf, err := os.OpenFile(vp, os.O_RDWR|os.O_SYNC, BundleFileMode)
+	// Needles committed in groups are synced by fdatasync once per group
+	flag := os.O_RDWR | os.O_SYNC
+	if gconf != nil && gconf.GroupCommitWindow > 0 {
+		flag = os.O_RDWR
+	}
+
+	vf, err := os.OpenFile(vp, flag, BundleFileMode)
 	if err != nil {
 		glogger.Error("unable to open bundle",
 			zap.String("bundle-file", vp), zap.Error(err))
@@ -197,10 +348,18 @@ func OpenBundle(devPath, partition string) (*Bundle, error) {
 	}
 	sb := NewSuperBlock(header)
 
+	info, err := vf.Stat()
+	if err != nil {
+		glogger.Error("unable to stat bundle",
+			zap.String("bundle-file", vp), zap.Error(err))
+		return nil, err
+	}
+
 	return &Bundle{
-		sb,
-		vf,
-		sync.Mutex{},
-		partition,
+		SuperBlock: sb,
+		File:       vf,
+		partition:  partition,
+		segment:    segment,
+		appended:   info.ModTime().UnixNano(),
 	}, nil
 }
@@ -0,0 +1,278 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+// Segment 0 keeps the file names of single file bundles, so bundles
+// created by older versions are read as the first segment.
+const (
+	segmentFilePrefix      = "bundle."
+	segmentFileSuffix      = ".data"
+	compactedSegmentSuffix = ".compact"
+)
+
+// Returns the file name of the segment and of its compacted copy.
+func segmentFileNames(id int32) (string, string) {
+	if id == 0 {
+		return BundleFileName, CompactedFileName
+	}
+
+	name := fmt.Sprintf("%s%04d", segmentFilePrefix, id)
+	return name + segmentFileSuffix, name + compactedSegmentSuffix
+}
+
+// Parses the segment id from the file name of a segment or a compacted
+// segment. ok is false if the name is neither.
+func parseSegmentFileName(name string) (id int32, compacted bool, ok bool) {
+	switch name {
+	case BundleFileName:
+		return 0, false, true
+	case CompactedFileName:
+		return 0, true, true
+	}
+
+	if !strings.HasPrefix(name, segmentFilePrefix) {
+		return 0, false, false
+	}
+	s := strings.TrimPrefix(name, segmentFilePrefix)
+	if strings.HasSuffix(s, compactedSegmentSuffix) {
+		compacted = true
+		s = strings.TrimSuffix(s, compactedSegmentSuffix)
+	} else if strings.HasSuffix(s, segmentFileSuffix) {
+		s = strings.TrimSuffix(s, segmentFileSuffix)
+	} else {
+		return 0, false, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n <= 0 {
+		return 0, false, false
+	}
+
+	return int32(n), compacted, true
+}
+
+// Returns the ids of the segments found in the partition directory in
+// ascending order.
+func listSegments(dir string) ([]int32, error) {
+	names, err := fs.ReadDirNames(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int32
+	for _, name := range names {
+		if id, compacted, ok := parseSegmentFileName(name); ok && !compacted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// BundleSet is the sequence of bundle segments of a partition. Needles are
+// appended to the last segment, which is rolled over to a new one once it
+// grows beyond the segment size.
+// A set is never modified once published. Rolling over and compaction
+// publish new sets instead, so that a set pinned by readers always matches
+// the needle indexes loaded with it.
+type BundleSet struct {
+	partition string
+	segments  map[int32]*Bundle
+	// Segment which needles are appended to
+	active *Bundle
+
+	// Shared by all the sets of the same partition
+	wmu *sync.Mutex // serializes appending and rolling over
+	// Not nil if small objects are committed in groups
+	group *groupCommitter
+}
+
+func OpenBundleSet(devPath, partition string) (*BundleSet, error) {
+	vpd := filepath.Join(devPath, partition)
+	if err := os.MkdirAll(vpd, 0755); err != nil {
+		glogger.Error("unable to create bundle directory",
+			zap.String("bundle-dir", vpd), zap.Error(err))
+		return nil, err
+	}
+
+	ids, err := listSegments(vpd)
+	if err != nil {
+		glogger.Error("unable to list bundle segments",
+			zap.String("bundle-dir", vpd), zap.Error(err))
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []int32{0}
+	}
+
+	set := &BundleSet{
+		partition: partition,
+		segments:  make(map[int32]*Bundle),
+		wmu:       &sync.Mutex{},
+	}
+	if gconf != nil && gconf.GroupCommitWindow > 0 {
+		set.group = newGroupCommitter()
+	}
+
+	for _, id := range ids {
+		b, err := OpenBundleSegment(devPath, partition, id)
+		if err != nil {
+			for _, opened := range set.segments {
+				opened.Close()
+			}
+			return nil, err
+		}
+		set.segments[id] = b
+	}
+	set.active = set.segments[ids[len(ids)-1]]
+
+	return set, nil
+}
+
+func (s *BundleSet) segment(id int32) (*Bundle, error) {
+	b, ok := s.segments[id]
+	if !ok {
+		glogger.Error("bundle segment not found",
+			zap.String("partition", s.partition), zap.Int32("segment", id))
+		return nil, ErrSegmentNotFound
+	}
+
+	return b, nil
+}
+
+// Returns the segment ids in ascending order
+func (s *BundleSet) segmentIDs() []int32 {
+	ids := make([]int32, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// BundleSize returns the total size of the segments
+func (s *BundleSet) BundleSize() int64 {
+	var size int64
+	for _, b := range s.segments {
+		size += b.BundleSize()
+	}
+
+	return size
+}
+
+// Returns a copy of the set in which the segment of the same id is
+// replaced by b, or b is added as the last segment.
+func (s *BundleSet) withSegment(b *Bundle) *BundleSet {
+	ns := *s
+	ns.segments = make(map[int32]*Bundle)
+	for id, seg := range s.segments {
+		ns.segments[id] = seg
+	}
+	ns.segments[b.segment] = b
+	if b.segment >= s.active.segment {
+		ns.active = b
+	}
+
+	return &ns
+}
+
+// pin pins all the segments of the set. Segments of a published set are
+// never closed, so it must be called with cmu held while the set is
+// current.
+func (s *BundleSet) pin() {
+	for _, b := range s.segments {
+		b.pin()
+	}
+}
+
+func (s *BundleSet) unpin() {
+	for _, b := range s.segments {
+		b.unpin()
+	}
+}
+
+func (s *BundleSet) Cleanup() error {
+	var err error
+	for _, b := range s.segments {
+		if e := b.Cleanup(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (s *BundleSet) needsRollover() bool {
+	return gconf != nil && gconf.BundleSegmentSize > 0 &&
+		s.active.BundleSize() >= gconf.BundleSegmentSize
+}
+
+// rollBundle creates the next segment of the set and publishes the new set.
+// It must be called with wmu held.
+func (d *PackDevice) rollBundle(set *BundleSet) (*BundleSet, error) {
+	id := set.active.segment + 1
+	b, err := OpenBundleSegment(d.objectsDir, set.partition, id)
+	if err != nil {
+		return nil, err
+	}
+	ns := set.withSegment(b)
+
+	// The set is not published if it has been closed, e.g. the partition
+	// is being deleted.
+	d.lock.Lock()
+	if d.bundles[set.partition] == set {
+		d.bundles[set.partition] = ns
+	}
+	d.lock.Unlock()
+
+	glogger.Info("bundle rolled over",
+		zap.String("device", d.device),
+		zap.String("partition", set.partition),
+		zap.Int32("segment", id))
+
+	return ns, nil
+}
+
+// Returns the paths of the segment and of its compacted copy
+func (d *PackDevice) bundlePaths(partition string, id int32) (string, string) {
+	pd := filepath.Join(d.objectsDir, partition)
+	bp, cp := segmentFileNames(id)
+	return filepath.Join(pd, bp), filepath.Join(pd, cp)
+}
+
+// Returns true if any segment of the partition exists
+func (d *PackDevice) hasBundle(partition string) bool {
+	ids, err := listSegments(filepath.Join(d.objectsDir, partition))
+	return err == nil && len(ids) > 0
+}
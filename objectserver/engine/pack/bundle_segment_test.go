@@ -0,0 +1,185 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+func TestParseSegmentFileName(t *testing.T) {
+	for id := int32(0); id < 3; id++ {
+		bp, cp := segmentFileNames(id)
+		sid, compacted, ok := parseSegmentFileName(bp)
+		require.True(t, ok)
+		require.False(t, compacted)
+		require.Equal(t, id, sid)
+
+		sid, compacted, ok = parseSegmentFileName(cp)
+		require.True(t, ok)
+		require.True(t, compacted)
+		require.Equal(t, id, sid)
+	}
+	require.Equal(t, "bundle.0001.data", func() string {
+		bp, _ := segmentFileNames(1)
+		return bp
+	}())
+
+	for _, name := range []string{"abc", "bundle.0000.data", "bundle.x.data",
+		"bundle.0001.tmp", "hashes.pkl"} {
+		_, _, ok := parseSegmentFileName(name)
+		require.False(t, ok)
+	}
+}
+
+// Verifies that the objects could be read back
+func requireObjects(t *testing.T, d *PackDevice, objs []*PackObject) {
+	for _, obj := range objs {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+
+		r, err := d.NewReader(vo)
+		require.Nil(t, err)
+		hash := md5.New()
+		io.Copy(hash, r)
+		require.Equal(t, obj.meta.SystemMeta[common.HEtag],
+			hex.EncodeToString(hash.Sum(nil)))
+	}
+}
+
+func TestBundleSegments(t *testing.T) {
+	defer func(origin PackConfig) { *gconf = origin }(*gconf)
+	gconf.BundleSegmentSize = SIZE_1K * 8
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+
+	// Bundles of older versions are the first segment
+	partition := "1"
+	require.Nil(t, formatBundleFileV1(d, partition))
+
+	var objs []*PackObject
+	segments := make(map[int32]bool)
+	for i := 0; i < 6; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+		segments[obj.dataIndex.Segment] = true
+	}
+	require.True(t, len(segments) > 1)
+
+	set, err := d.getBundle(partition)
+	require.Nil(t, err)
+	require.Equal(t, len(segments), len(set.segments))
+	require.Equal(t, BundleVersion1, set.segments[0].Version)
+	require.Equal(t, CurrentBundleVersion, set.active.Version)
+	for id := range segments {
+		bp, _ := d.bundlePaths(partition, id)
+		require.False(t, fs.IsFileNotExist(bp))
+	}
+	requireObjects(t, d, objs)
+
+	// Segments are found again after reopening
+	d.Close()
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	set, err = d.getBundle(partition)
+	require.Nil(t, err)
+	require.Equal(t, len(segments), len(set.segments))
+	requireObjects(t, d, objs)
+
+	// Indexes are rebuilt with their segments
+	indexes := make(map[string]*NeedleIndex)
+	for _, obj := range objs {
+		key := fmt.Sprintf("%s/data", obj.key)
+		dbIndex, err := d.getDBIndex(obj.key, DATA)
+		require.Nil(t, err)
+		indexes[key] = dbIndex.Index
+		require.Nil(t, d.db.Delete(d.wopt, []byte(key)))
+	}
+	_, err = d.RebuildIndex([]string{partition}, false)
+	require.Nil(t, err)
+	for _, obj := range objs {
+		dbIndex, err := d.getDBIndex(obj.key, DATA)
+		require.Nil(t, err)
+		require.True(t,
+			proto.Equal(indexes[fmt.Sprintf("%s/data", obj.key)], dbIndex.Index))
+	}
+
+	// Each segment is compacted on its own
+	for _, obj := range objs[:3] {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		vo.meta.Timestamp = common.GetTimestamp()
+		require.Nil(t, d.CommitDeletion(vo))
+	}
+	stat, err := d.CompactPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), stat.Needles)
+	requireObjects(t, d, objs[3:])
+
+	set, err = d.getBundle(partition)
+	require.Nil(t, err)
+	require.Equal(t, CurrentBundleVersion, set.segments[0].Version)
+	for id := range set.segments {
+		_, cp := d.bundlePaths(partition, id)
+		require.True(t, fs.IsFileNotExist(cp))
+	}
+}
+
+func TestRecoverSegmentCompaction(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	bp0, cp0 := d.bundlePaths(partition, 0)
+	bp2, cp2 := d.bundlePaths(partition, 2)
+	require.Nil(t, os.MkdirAll(filepath.Dir(bp0), 0755))
+	require.Nil(t, formatBundleFile(cp0))
+	require.Nil(t, formatBundleFile(cp2))
+	require.Nil(t, d.db.Put(
+		d.wopt, compactionMarker(partition), []byte(filepath.Base(cp2))))
+
+	// Only the segment named by the marker is replaced
+	require.Nil(t, d.recoverCompaction(partition))
+	require.True(t, fs.IsFileNotExist(cp0))
+	require.True(t, fs.IsFileNotExist(bp0))
+	require.True(t, fs.IsFileNotExist(cp2))
+	require.False(t, fs.IsFileNotExist(bp2))
+
+	v, err := d.db.GetBytes(d.ropt, compactionMarker(partition))
+	require.Nil(t, err)
+	require.Empty(t, v)
+}
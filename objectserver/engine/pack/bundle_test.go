@@ -35,7 +35,8 @@ func TestRefreshBundleHeader(t *testing.T) {
 	require.Nil(t, err)
 	defer b.Cleanup()
 
-	require.Equal(t, BundleVersion1, b.Version)
+	require.Equal(t, CurrentBundleVersion, b.Version)
+	require.Equal(t, ChecksumCRC32C, b.Checksum)
 	require.True(t, SuperBlockSize < NeedleAlignment)
 	require.Equal(t, int64(NeedleAlignment), b.BundleSize())
 }
@@ -0,0 +1,256 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/uber-go/tally"
+)
+
+const (
+	cacheStripes = 256
+	// Rough memory used by an entry besides the indexes and the needle
+	cacheEntryOverhead = 256
+)
+
+// Entries are never modified once added, so they could be used without
+// holding the lock.
+type cachedObject struct {
+	key  string
+	data *DBIndex
+	meta *DBIndex
+	// Bundle segments which the needle indexes point to
+	bundle *BundleSet
+	// Verified needle from the header to the end of meta, nil if the data
+	// has not been read yet.
+	needle []byte
+	size   int64
+}
+
+// readCache is a LRU cache of the db indexes and needles of SOs. Every
+// index mutation of an object must invalidate its entry after the db is
+// written. An entry loaded before the invalidation of its key is rejected,
+// so a stale entry never gets into the cache.
+type readCache struct {
+	sync.Mutex
+	capacity   int64
+	objectSize int64
+	size       int64
+	lru        *list.List
+	entries    map[string]*list.Element
+	// Bumped on each invalidation of the keys in the stripe
+	epochs [cacheStripes]uint64
+
+	hits      tally.Counter
+	misses    tally.Counter
+	evictions tally.Counter
+}
+
+// Needles larger than objectSize are not cached, but their indexes are.
+func newReadCache(capacity, objectSize int64) *readCache {
+	c := &readCache{
+		capacity:   capacity,
+		objectSize: objectSize,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	c.setMetricsScope(tally.NoopScope)
+
+	return c
+}
+
+func (c *readCache) setMetricsScope(scope tally.Scope) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.hits = scope.Counter("read_cache_hits")
+	c.misses = scope.Counter("read_cache_misses")
+	c.evictions = scope.Counter("read_cache_evictions")
+}
+
+func cacheStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % cacheStripes)
+}
+
+// epoch must be taken before loading an entry from the db.
+func (c *readCache) epoch(key string) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.epochs[cacheStripe(key)]
+}
+
+func (c *readCache) get(key string) *cachedObject {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	c.hits.Inc(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedObject)
+}
+
+func (c *readCache) put(e *cachedObject) {
+	e.size = int64(len(e.key)+len(e.needle)+proto.Size(e.data)) + cacheEntryOverhead
+	if e.meta != nil {
+		e.size += int64(proto.Size(e.meta))
+	}
+
+	if elem, ok := c.entries[e.key]; ok {
+		c.size -= elem.Value.(*cachedObject).size
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[e.key] = c.lru.PushFront(e)
+	}
+	c.size += e.size
+
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		c.remove(elem)
+		c.evictions.Inc(1)
+	}
+}
+
+func (c *readCache) remove(elem *list.Element) {
+	e := elem.Value.(*cachedObject)
+	c.lru.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// miss counts a lookup not served by the cache. Only objects which could
+// be cached are counted, because LOs and tombstones always miss.
+func (c *readCache) miss() {
+	if c == nil {
+		return
+	}
+
+	c.misses.Inc(1)
+}
+
+// add caches the db indexes of a SO loaded since epoch was taken.
+func (c *readCache) add(e *cachedObject, epoch uint64) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.epochs[cacheStripe(e.key)] != epoch {
+		return
+	}
+	c.put(e)
+}
+
+// needle returns the cached needle if it is the one described by idx.
+func (c *readCache) needle(key string, idx *NeedleIndex) []byte {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e := elem.Value.(*cachedObject)
+	if e.data.Index != idx {
+		return nil
+	}
+	return e.needle
+}
+
+// setNeedle attaches the needle to the entry whose data index is idx. The
+// index is compared by pointer, so the needle read by an object loaded
+// without the cache is never attached.
+func (c *readCache) setNeedle(key string, idx *NeedleIndex, needle []byte) {
+	if c == nil || int64(len(needle)) > c.objectSize {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	e := elem.Value.(*cachedObject)
+	if e.data.Index != idx || e.needle != nil {
+		return
+	}
+	c.put(&cachedObject{
+		key:    e.key,
+		data:   e.data,
+		meta:   e.meta,
+		bundle: e.bundle,
+		needle: needle,
+	})
+}
+
+func (c *readCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.epochs[cacheStripe(key)]++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *readCache) invalidatePartition(partition string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.epochs {
+		c.epochs[i]++
+	}
+
+	prefix := "/" + partition + "/"
+	for key, elem := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(elem)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+func newCachedObject(key string, size int) *cachedObject {
+	return &cachedObject{
+		key: key,
+		data: &DBIndex{
+			Index: &NeedleIndex{Offset: SuperBlockDiskSize},
+			Meta:  &ObjectMeta{Name: key},
+		},
+		needle: make([]byte, size),
+	}
+}
+
+func TestReadCacheEviction(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	c := newReadCache(SIZE_1K*4, SIZE_1K)
+	c.setMetricsScope(scope)
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("/1/abc/%d", i)
+		c.add(newCachedObject(key, SIZE_1K), c.epoch(key))
+	}
+	require.True(t, c.size <= c.capacity)
+	require.Nil(t, c.get("/1/abc/0"))
+	require.NotNil(t, c.get("/1/abc/3"))
+
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(1), counters["read_cache_hits+"].Value())
+	require.True(t, counters["read_cache_evictions+"].Value() > 0)
+}
+
+func TestReadCacheInvalidate(t *testing.T) {
+	c := newReadCache(SIZE_1M, SIZE_1K)
+
+	key := "/1/abc/0"
+	c.add(newCachedObject(key, 0), c.epoch(key))
+	require.NotNil(t, c.get(key))
+
+	// Entries loaded before invalidation are rejected
+	epoch := c.epoch(key)
+	c.invalidate(key)
+	require.Nil(t, c.get(key))
+	c.add(newCachedObject(key, 0), epoch)
+	require.Nil(t, c.get(key))
+
+	c.add(newCachedObject(key, 0), c.epoch(key))
+	c.add(newCachedObject("/2/abc/0", 0), c.epoch("/2/abc/0"))
+	c.invalidatePartition("1")
+	require.Nil(t, c.get(key))
+	require.NotNil(t, c.get("/2/abc/0"))
+}
+
+func TestReadCacheNeedle(t *testing.T) {
+	c := newReadCache(SIZE_1M, SIZE_1K)
+
+	key := "/1/abc/0"
+	e := newCachedObject(key, 0)
+	e.needle = nil
+	c.add(e, c.epoch(key))
+
+	// Needle of another index is not attached
+	c.setNeedle(key, &NeedleIndex{Offset: SuperBlockDiskSize}, []byte("x"))
+	require.Nil(t, c.needle(key, e.data.Index))
+
+	// Needle too large is not attached
+	c.setNeedle(key, e.data.Index, make([]byte, SIZE_1K+1))
+	require.Nil(t, c.needle(key, e.data.Index))
+
+	c.setNeedle(key, e.data.Index, []byte("needle"))
+	require.Equal(t, []byte("needle"), c.needle(key, e.data.Index))
+}
+
+func TestDeviceReadCache(t *testing.T) {
+	defer func(origin PackConfig) { *gconf = origin }(*gconf)
+	gconf.ReadCacheSize = SIZE_1M
+	gconf.ReadCacheObjectSize = SIZE_1M
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	require.NotNil(t, d.cache)
+	scope := tally.NewTestScope("", nil)
+	d.cache.setMetricsScope(scope)
+
+	obj := newPackObject(SIZE_1K, "1")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	readEtag := func() string {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+		r, err := d.NewReader(vo)
+		require.Nil(t, err)
+		hash := md5.New()
+		io.Copy(hash, r)
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	require.Equal(t, obj.meta.SystemMeta[common.HEtag], readEtag())
+	e := d.cache.get(obj.key)
+	require.NotNil(t, e)
+	require.NotNil(t, e.needle)
+	require.Equal(t, obj.meta.SystemMeta[common.HEtag], readEtag())
+
+	// Overriding the object invalidates the entry
+	nobj := newPackObject(SIZE_1K, "1")
+	nobj.name, nobj.key, nobj.meta.Name = obj.name, obj.key, obj.name
+	require.Nil(t, feedObject(nobj, d))
+	require.Nil(t, d.CommitWrite(nobj))
+	nobj.Close()
+	require.Nil(t, d.cache.get(obj.key))
+	require.Equal(t, nobj.meta.SystemMeta[common.HEtag], readEtag())
+
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+	require.Nil(t, d.cache.get(obj.key))
+
+	vo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+
+	// Tombstones are never cached, so they are not counted as misses
+	counters := scope.Snapshot().Counters()
+	require.Equal(t, int64(2), counters["read_cache_misses+"].Value())
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// Needle compression of each pack policy, configured by the option
+// `compression` in the policy section of swift.conf
+var policyCompressions = make(map[int]uint32)
+
+func parseCompression(name string) (uint32, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return 0, nil
+	case "snappy":
+		return NeedleFlagSnappy, nil
+	default:
+		return 0, ErrUnknownCompression
+	}
+}
+
+func isCompressed(idx *NeedleIndex) bool {
+	return idx.Flags&NeedleFlagSnappy != 0
+}
+
+// Compresses the data of a SO if it makes the needle smaller on disk,
+// otherwise nil is returned. Needles are 4K aligned, so the compression
+// is pointless unless it saves at least one block. Flags are carried by
+// the needle header since bundle version 2.
+func (d *PackDevice) compressData(bundle *Bundle, data []byte, metaSize int32) []byte {
+	if d.compression != NeedleFlagSnappy ||
+		bundle.Version < BundleVersion2 || len(data) == 0 {
+		return nil
+	}
+
+	hs := bundle.needleHeaderSize()
+	c := snappy.Encode(nil, data)
+	if CalculateDiskSize(hs, int64(len(c)), metaSize) >=
+		CalculateDiskSize(hs, int64(len(data)), metaSize) {
+		return nil
+	}
+
+	return c
+}
+
+func decompressData(idx *NeedleIndex, data []byte) ([]byte, error) {
+	if !isCompressed(idx) {
+		return data, nil
+	}
+
+	data, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, ErrNeedleDecompression
+	}
+
+	return data, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+// Feeds the object with text data which is highly compressible
+func feedTextObject(obj *PackObject, d *PackDevice) ([]byte, error) {
+	data := bytes.Repeat([]byte("auklet "), int(obj.dataSize)/7+1)[:obj.dataSize]
+	digest := md5.Sum(data)
+	obj.meta.SystemMeta[common.HEtag] = hex.EncodeToString(digest[:])
+	obj.meta.SystemMeta[common.HContentLength] = strconv.Itoa(len(data))
+	obj.meta.SystemMeta[common.XTimestamp] = common.GetTimestamp()
+
+	w, err := d.newSOWriter(obj)
+	if err != nil {
+		return nil, err
+	}
+	obj.writer = w
+
+	_, err = w.Write(data)
+	return data, err
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, flag := range map[string]uint32{
+		"":       0,
+		"none":   0,
+		"snappy": NeedleFlagSnappy,
+		"Snappy": NeedleFlagSnappy,
+	} {
+		c, err := parseCompression(name)
+		require.Nil(t, err)
+		require.Equal(t, flag, c)
+	}
+
+	_, err := parseCompression("zip")
+	require.Equal(t, ErrUnknownCompression, err)
+}
+
+func TestCompressedObject(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.compression = NeedleFlagSnappy
+
+	partition := "1"
+	obj := newPackObject(SIZE_1K*64, partition)
+	data, err := feedTextObject(obj, d)
+	require.Nil(t, err)
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+	require.Equal(t, NeedleFlagSnappy, obj.dataIndex.Flags)
+	require.True(t, obj.dataIndex.DataSize < obj.dataSize)
+
+	// Random data is not compressible
+	robj := newPackObject(SIZE_1K*64, partition)
+	require.Nil(t, feedObject(robj, d))
+	require.Nil(t, d.CommitWrite(robj))
+	robj.Close()
+	require.Equal(t, uint32(0), robj.dataIndex.Flags)
+	require.Equal(t, robj.dataSize, robj.dataIndex.DataSize)
+
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+	require.Equal(t, obj.dataSize, vo.meta.DataSize)
+
+	r, err := d.NewReader(vo)
+	require.Nil(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data, b)
+
+	r, err = d.NewRangeReader(vo, 100, SIZE_1K)
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, data[100:100+SIZE_1K], b)
+
+	stat, err := d.AuditPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), stat.ProcessedFiles)
+	require.Equal(t, int64(0), stat.Quarantines)
+}
+
+func TestAuditUndecompressableObject(t *testing.T) {
+	defer func(origin PackConfig) { *gconf = origin }(*gconf)
+	gconf.SkipNeedleChecksum = true
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.compression = NeedleFlagSnappy
+
+	partition := "1"
+	obj := newPackObject(SIZE_1K*64, partition)
+	_, err = feedTextObject(obj, d)
+	require.Nil(t, err)
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+	require.Equal(t, NeedleFlagSnappy, obj.dataIndex.Flags)
+
+	bundle, err := d.getBundle(partition)
+	require.Nil(t, err)
+	garbage := bytes.Repeat([]byte{0xff}, 16)
+	_, err = bundle.active.WriteAt(garbage, obj.dataIndex.DataOffset)
+	require.Nil(t, err)
+
+	stat, err := d.AuditPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Quarantines)
+
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+}
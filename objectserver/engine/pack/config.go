@@ -20,12 +20,51 @@ type PackConfig struct {
 	AllowedHeaders map[string]bool
 
 	// Auditor configuration
-	AuditorFPS int64 // rate of auditor: files per seconds
-	AuditorBPS int64 // rate of auditor: bytes per seconds
+	AuditorFPS        int64 // rate of auditor: files per seconds
+	AuditorBPS        int64 // rate of auditor: bytes per seconds
+	OrphanGracePeriod int64 // seconds before orphan needles are reclaimed
+
+	// Replicator configuration
+	ReclaimAge int64 // seconds before tombstones are reaped
+
+	// Replication throttling of the RPC server, 0 for unlimited
+	ReplicationDeviceBPS int64 // bytes per second pushed from a device
+	ReplicationNodeBPS   int64 // bytes per second pushed from the node
+	ReplicationOPS       int64 // objects per second pushed from the node
+	ReplicationHostSyncs int64 // concurrent syncs to a remote host
 
 	// QUSE
 	LazyMigration     bool
 	PackChunkedObject bool
+
+	// Don't verify needle checksum on read, so that SO could be sent by
+	// sendfile like LO
+	SkipNeedleChecksum bool
+
+	// Size in bytes a bundle segment is rolled over at, 0 to never roll
+	BundleSegmentSize int64
+
+	// Bundle compaction
+	CompactionInterval int64   // seconds between two compaction passes
+	CompactionRatio    float64 // compact once live/allocated drops below it
+
+	// Seconds between two passes moving objects across the needle
+	// threshold, 0 to disable
+	RepackInterval int64
+
+	// Read cache of small objects
+	ReadCacheSize       int64 // bytes of memory per device, 0 to disable
+	ReadCacheObjectSize int64 // max size of needles cached
+
+	// Group commit of small objects
+	GroupCommitWindow int64 // microseconds to wait for concurrent commits
+	GroupCommitSize   int64 // max needles flushed in one group
+
+	// Meta db statistics
+	DBStatsInterval int64 // seconds between two recon dumps, 0 to disable
+
+	// Space accounting of partitions
+	SpaceStatsInterval int64 // seconds between two recon dumps, 0 to disable
 }
 
 var gconf *PackConfig
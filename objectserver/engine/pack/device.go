@@ -19,6 +19,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
@@ -34,13 +36,47 @@ type PackDevice struct {
 	hashPrefix string
 	hashSuffix string
 	objectsDir string
-	bundles    map[string]*Bundle
+	bundles    map[string]*BundleSet
 	lock       sync.RWMutex
 	db         *gorocksdb.DB
 	wopt       *gorocksdb.WriteOptions
-	ropt       *gorocksdb.ReadOptions
-	wg         *sync.WaitGroup //garantee a clean exit
+	ropt       *gorocksdb.ReadOptions // seeks in total order
+	propt      *gorocksdb.ReadOptions // seeks by the prefix extractor
+	wg         *sync.WaitGroup        //garantee a clean exit
 	km         *common.Kmutex
+	// Index mutations and small object index lookups hold the read lock.
+	// Bundle compaction holds the write lock while it swaps needle offsets.
+	cmu            sync.RWMutex
+	stopCompaction chan bool
+	cache          *readCache
+	// Serializes the summary updates of the suffixes in the same stripe
+	smu [suffixStripes]sync.Mutex
+	// Needle flag of the compression applied to the data of SOs
+	compression uint32
+	// Column families of data, meta and ts indexes, nil if the db has none
+	cfs map[PartType]*gorocksdb.ColumnFamilyHandle
+	// Indexes are written to the column families if true, otherwise they
+	// are migrated back to the default one.
+	cfIndexes bool
+	// Non zero while indexes are migrated between column families
+	migrating int32
+	// Objects not larger than it are saved in the bundle
+	needleThreshold int64
+	// Data needles of SOs are shared by identical objects if enabled
+	dedup bool
+	// Serializes the lookups and updates of the dedup records in the same
+	// stripe
+	dmu [dedupStripes]sync.Mutex
+	// Serializes the updates of the usage records in the same stripe
+	umu [usageStripes]sync.Mutex
+	// Keys sealing the needles and LO data files, nil if not enabled
+	keyring *Keyring
+	// One of the device modes, read by the object server on every update
+	mode atomic.Value
+	// Hole punches are deferred while snapshots copy the bundles
+	pmu      sync.Mutex
+	freezes  int
+	deferred []deferredPunch
 }
 
 func NewPackDevice(device, driveRoot string, policy int) *PackDevice {
@@ -68,16 +104,22 @@ func NewPackDevice(device, driveRoot string, policy int) *PackDevice {
 		objectsDir: op,
 		hashPrefix: prefix,
 		hashSuffix: suffix,
-		bundles:    make(map[string]*Bundle),
+		bundles:    make(map[string]*BundleSet),
 		wg:         &sync.WaitGroup{},
 		km:         common.NewKmutex(),
+
+		stopCompaction: make(chan bool),
+		compression:    policyCompressions[policy],
+		dedup:          policyDedups[policy],
+		keyring:        policyKeyrings[policy],
+	}
+	if d.needleThreshold = policyNeedleThresholds[policy]; d.needleThreshold <= 0 {
+		d.needleThreshold = NEEDLE_THRESHOLD
 	}
 
-	opts := gorocksdb.NewDefaultOptions()
-	opts.SetCreateIfMissing(true)
-	opts.SetWalSizeLimitMb(64)
+	d.loadMode()
 
-	d.db, err = gorocksdb.OpenDb(opts, dp)
+	d.db, d.cfs, err = openMetaDB(dp, policyDBOptions[policy])
 	if err != nil {
 		glogger.Error("failed to open meta database",
 			zap.String("database", dp),
@@ -87,6 +129,23 @@ func NewPackDevice(device, driveRoot string, policy int) *PackDevice {
 	d.wopt = gorocksdb.NewDefaultWriteOptions()
 	d.wopt.SetSync(true)
 	d.ropt = gorocksdb.NewDefaultReadOptions()
+	SetTotalOrderSeek(d.ropt, true)
+	d.propt = gorocksdb.NewDefaultReadOptions()
+	if d.cfs != nil {
+		d.startIndexMigration(policyDBOptions[policy])
+	}
+
+	if gconf != nil && gconf.ReadCacheSize > 0 {
+		d.cache = newReadCache(gconf.ReadCacheSize, gconf.ReadCacheObjectSize)
+	}
+
+	if gconf != nil && gconf.CompactionInterval > 0 {
+		go d.runCompactor(time.Second * time.Duration(gconf.CompactionInterval))
+	}
+
+	if gconf != nil && gconf.RepackInterval > 0 {
+		go d.runRepacker(time.Second * time.Duration(gconf.RepackInterval))
+	}
 
 	return d
 }
@@ -95,7 +154,8 @@ func (d *PackDevice) tempDir() string {
 	return filepath.Join(d.driveRoot, d.device, "tmp")
 }
 
-func (d *PackDevice) getBundle(partition string) (*Bundle, error) {
+// getBundle returns the current segment set of the bundle of the partition
+func (d *PackDevice) getBundle(partition string) (*BundleSet, error) {
 	if partition == "" {
 		return nil, ErrEmptyPartition
 	}
@@ -115,7 +175,11 @@ func (d *PackDevice) getBundle(partition string) (*Bundle, error) {
 		return bundle, nil
 	}
 
-	bundle, err := OpenBundle(d.objectsDir, partition)
+	if err := d.recoverCompaction(partition); err != nil {
+		return nil, err
+	}
+
+	bundle, err := OpenBundleSet(d.objectsDir, partition)
 	if err != nil {
 		return nil, err
 	}
@@ -144,8 +208,12 @@ func (d *PackDevice) Close() {
 	glogger.Debug(
 		"closing device", zap.String("name", d.device), zap.Int("policy", d.policy))
 	// Make sure that the device could be close safely
+	close(d.stopCompaction)
 	d.wg.Wait()
 
+	for _, cf := range d.cfs {
+		cf.Destroy()
+	}
 	d.db.Close()
 
 	for _, bundle := range d.bundles {
@@ -160,6 +228,45 @@ func (d *PackDevice) Close() {
 // Re-implemented API
 // ***************************
 func (d *PackDevice) LoadObjectMeta(obj *PackObject) error {
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+
+	return d.loadObjectMeta(obj)
+}
+
+// Looks up the db indexes of the object in the read cache first. For SO,
+// the bundle which the needle indexes point to is returned as well.
+func (d *PackDevice) lookupDBIndexes(obj *PackObject) (dataDBIdx,
+	metaDBIdx, tsDBIdx *DBIndex, bundle *BundleSet, err error) {
+	if e := d.cache.get(obj.key); e != nil {
+		return e.data, e.meta, nil, e.bundle, nil
+	}
+
+	epoch := d.cache.epoch(obj.key)
+	dataDBIdx, metaDBIdx, tsDBIdx, err = d.loadObjDBIndexes(obj)
+	if err != nil || tsDBIdx != nil || dataDBIdx == nil ||
+		dataDBIdx.Index == nil {
+		return
+	}
+
+	if bundle, err = d.getBundle(obj.partition); err != nil {
+		return
+	}
+	d.cache.miss()
+	d.cache.add(&cachedObject{
+		key:    obj.key,
+		data:   dataDBIdx,
+		meta:   metaDBIdx,
+		bundle: bundle,
+	}, epoch)
+
+	return
+}
+
+// loadObjectMeta is the lock free version of LoadObjectMeta. It must be
+// called with cmu held so that the needle indexes and the bundle they
+// point to are loaded consistently.
+func (d *PackDevice) loadObjectMeta(obj *PackObject) error {
 	var err error
 	// Reset the data structure if error occurs
 	defer func() {
@@ -169,10 +276,11 @@ func (d *PackDevice) LoadObjectMeta(obj *PackObject) error {
 			obj.metaIndex = nil
 			obj.dMeta = nil
 			obj.mMeta = nil
+			obj.pinBundle(nil)
 		}
 	}()
 
-	dataDBIdx, metaDBIdx, tsDBIdx, err := d.loadObjDBIndexes(obj)
+	dataDBIdx, metaDBIdx, tsDBIdx, bundle, err := d.lookupDBIndexes(obj)
 	if err != nil {
 		return err
 	}
@@ -192,6 +300,11 @@ func (d *PackDevice) LoadObjectMeta(obj *PackObject) error {
 	obj.small = obj.dataIndex != nil
 	obj.dMeta = dataDBIdx.Meta
 
+	// Pin the bundle which the needle indexes point to. A compaction
+	// running after this point won't affect readers of this object, since
+	// the segment replaced is kept open until the object is closed.
+	obj.pinBundle(bundle)
+
 	// Both dMeta, mMeta should be considered as const
 	obj.meta = dataDBIdx.Meta.DeepCopy()
 
@@ -223,7 +336,7 @@ func (d *PackDevice) LoadObjectMeta(obj *PackObject) error {
 func (d *PackDevice) NewWriter(obj *PackObject) (*dataWriter, error) {
 	// At this point, we are not able to ensure that we can get the
 	// exact size
-	if (obj.dataSize >= 0 && obj.dataSize <= NEEDLE_THRESHOLD) ||
+	if (obj.dataSize >= 0 && obj.dataSize <= d.needleThreshold) ||
 		(obj.dataSize < 0 && gconf.PackChunkedObject) {
 		obj.small = true
 		return d.newSOWriter(obj)
@@ -260,36 +373,57 @@ func (d *PackDevice) NewReader(obj *PackObject) (*dataReader, error) {
 }
 
 func (d *PackDevice) CommitWrite(obj *PackObject) error {
-	if err := d.clearStaleDBIndexes(obj); err != nil {
-		glogger.Error("unable to clean stale db indexes",
-			zap.String("object", obj.name))
-		return err
-	}
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	// Commits of an object are serialized, so that the indexes checked
+	// before committing are still the ones overridden.
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+	// Invalidated after the db is written
+	defer d.cache.invalidate(obj.key)
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	d.clearStaleDBIndexes(batch, obj)
 	if obj.small {
-		return d.commitSO(obj, DATA)
+		return d.commitSO(batch, obj, DATA)
 	}
 
-	return d.commitLO(obj, DATA)
+	return d.commitLO(batch, obj, DATA)
 }
 
 func (d *PackDevice) CommitUpdate(obj *PackObject) error {
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+	defer d.cache.invalidate(obj.key)
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
 	if obj.small {
-		return d.commitSO(obj, META)
+		return d.commitSO(batch, obj, META)
 	}
 
-	return d.commitLO(obj, META)
+	return d.commitLO(batch, obj, META)
 }
 
 func (d *PackDevice) CommitDeletion(obj *PackObject) error {
-	if err := d.clearDBIndexes(obj); err != nil {
-		glogger.Error("unable to clear db indexes",
-			zap.String("object", obj.name))
-		return err
-	}
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+	defer d.cache.invalidate(obj.key)
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
 
+	d.clearDBIndexes(batch, obj)
 	if obj.small {
-		return d.deleteSO(obj)
+		return d.deleteSO(batch, obj)
 	}
 
-	return d.deleteLO(obj)
+	return d.deleteLO(batch, obj)
 }
@@ -20,22 +20,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
 
 	"github.com/iqiyi/auklet/common"
 )
 
 type AuditStat struct {
-	ProcessedBytes int64
-	ProcessedFiles int64
-	Quarantines    int64
-	Errors         int64
+	ProcessedBytes   int64
+	ProcessedFiles   int64
+	Quarantines      int64
+	Errors           int64
+	Orphans          int64
+	ReclaimedBytes   int64
+	ReapedTombstones int64
 }
 
 const (
@@ -63,13 +68,65 @@ func (d *PackDevice) limitAuditRate(filesQuota int64, rate int64,
 	return filesQuota + timePerRequest
 }
 
+// Quarantines the object whose data is found corrupted. False is returned
+// if the object has been modified since the audit started. An error means
+// that auditing should be stopped.
+func (d *PackDevice) quarantineCorrupted(obj *PackObject) (bool, error) {
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	// The object is locked like commits until it is quarantined, so that
+	// a PUT or DELETE landing after the check is not quarantined instead.
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+
+	// Double check if the corruption is caused by race
+	canary := &PackObject{
+		name:      obj.name,
+		key:       obj.key,
+		partition: obj.partition,
+	}
+	if err := d.loadObjectMeta(canary); err != nil {
+		glogger.Error("unable to load meta of object",
+			zap.String("object", obj.name), zap.Error(err))
+		return false, nil
+	}
+	defer canary.Close()
+
+	// The needle may also be moved by bundle compaction, in which case
+	// the checksum was calculated from a stale offset.
+	if !canary.exists {
+		glogger.Info("object has been deleted", zap.String("object", obj.name))
+		return false, nil
+	}
+	if canary.meta.Timestamp != obj.meta.Timestamp ||
+		!proto.Equal(canary.dataIndex, obj.dataIndex) {
+		glogger.Info("object has been modified",
+			zap.String("object", obj.name),
+			zap.String("origin-timestamp", obj.meta.Timestamp),
+			zap.String("timestamp", canary.meta.Timestamp))
+		return false, nil
+	}
+
+	// canary has more detail than the origin one
+	if err := d.quarantineObject(canary); err != nil {
+		glogger.Error("unable to quarantine object",
+			zap.String("object", obj.name), zap.Error(err))
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (d *PackDevice) AuditPartition(partition string) (*AuditStat, error) {
 	stat := &AuditStat{}
 	filesQuota := int64(0)
 	bytesQuota := int64(0)
 
 	prefix := []byte(fmt.Sprintf("/%s/", partition))
-	iter := d.db.NewIterator(d.ropt)
+	iter := d.newIndexIterator()
 	defer iter.Close()
 	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
 		key := string(iter.Key().Data())
@@ -116,6 +173,22 @@ func (d *PackDevice) AuditPartition(partition string) (*AuditStat, error) {
 
 		reader, err := d.NewReader(obj)
 
+		// Data which could not be decompressed is corrupted as well, unless
+		// it is caused by race.
+		if err == ErrNeedleDecompression {
+			glogger.Info("undecompressable data detected",
+				zap.String("object", obj.name))
+			quarantined, err := d.quarantineCorrupted(obj)
+			if err != nil {
+				break
+			}
+			if quarantined {
+				stat.Quarantines++
+			}
+			stat.ProcessedFiles++
+			continue
+		}
+
 		// Race 1 in POINT #1 for LO would be detectd here. Since the FileNotExists
 		// would be raised,  thus it is safe to ignore the object.
 		// Technically, this is not an error, but it should be ok to consider
@@ -185,30 +258,13 @@ func (d *PackDevice) AuditPartition(partition string) (*AuditStat, error) {
 				zap.String("object", obj.name),
 				zap.String("checksum", checksum))
 
-			// Double check if the mismatch is caused by race
-			canary := &PackObject{
-				key: obj.key,
-			}
-			if err := d.LoadObjectMeta(canary); err != nil {
-				glogger.Error("unable to load meta of object",
-					zap.String("object", obj.name), zap.Error(err))
-				continue
+			quarantined, err := d.quarantineCorrupted(obj)
+			if err != nil {
+				break
 			}
-
-			if canary.meta.Timestamp != obj.meta.Timestamp {
-				glogger.Info("object has been modified",
-					zap.String("object", obj.name),
-					zap.String("origin-timestamp", obj.meta.Timestamp),
-					zap.String("timestamp", canary.meta.Timestamp))
+			if !quarantined {
 				continue
 			}
-
-			// canary has more detail than the origin one
-			if err := d.QuarantineObject(canary); err != nil {
-				glogger.Error("unable to quarantine object, stop auditing",
-					zap.String("object", obj.name), zap.Error(err))
-				break
-			}
 			stat.Quarantines++
 		}
 
@@ -216,6 +272,29 @@ func (d *PackDevice) AuditPartition(partition string) (*AuditStat, error) {
 		stat.ProcessedBytes += obj.meta.DataSize
 	}
 
+	if gconf.OrphanGracePeriod > 0 {
+		ostat, err := d.ReclaimOrphans(partition,
+			time.Duration(gconf.OrphanGracePeriod)*time.Second, false)
+		if err != nil {
+			glogger.Error("unable to reclaim orphan needles",
+				zap.String("partition", partition), zap.Error(err))
+			stat.Errors++
+		}
+		if ostat != nil {
+			stat.Orphans += ostat.Orphans
+			stat.ReclaimedBytes += ostat.ReclaimedBytes
+			stat.Errors += ostat.Errors
+		}
+	}
+
+	reaped, err := d.ReapTombstones(partition, gconf.ReclaimAge)
+	if err != nil {
+		glogger.Error("unable to reap tombstones",
+			zap.String("partition", partition), zap.Error(err))
+		stat.Errors++
+	}
+	stat.ReapedTombstones += reaped
+
 	return stat, nil
 
 }
@@ -245,12 +324,65 @@ func (d *PackDevice) saveQurantinedDBIndex(dir string, partType PartType, dbInde
 	return err
 }
 
+// Copies the needles of a SO out of the bundle as <part-type>.needle, so
+// that the corrupted bytes are kept after the needles are deallocated.
+func (d *PackDevice) saveQurantinedNeedles(obj *PackObject, destDir string) error {
+	set, err := d.pinnedBundle(obj)
+	if err != nil {
+		glogger.Error("unable to find bundle",
+			zap.String("object", obj.name), zap.String("partition", obj.partition))
+		return err
+	}
+
+	if err = os.MkdirAll(destDir, 0755); err != nil {
+		glogger.Error("unable to create quarantine dir",
+			zap.String("path", destDir),
+			zap.Error(err))
+		return err
+	}
+
+	needles := []struct {
+		ot  PartType
+		idx *NeedleIndex
+	}{{DATA, obj.dataIndex}, {META, obj.metaIndex}}
+	for _, n := range needles {
+		if n.idx == nil {
+			continue
+		}
+
+		bundle, err := set.segment(n.idx.Segment)
+		if err != nil {
+			return err
+		}
+
+		needle := make([]byte, n.idx.Size)
+		if _, err = bundle.ReadAt(needle, n.idx.Offset); err != nil {
+			glogger.Error("unable to read needle",
+				zap.String("object", obj.name),
+				zap.String("part-type", string(n.ot)),
+				zap.Int64("offset", n.idx.Offset),
+				zap.Error(err))
+			return err
+		}
+
+		p := filepath.Join(destDir, fmt.Sprintf("%s.needle", n.ot))
+		if err = ioutil.WriteFile(p, needle, 0644); err != nil {
+			glogger.Error("unable to save needle",
+				zap.String("path", p),
+				zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (d *PackDevice) saveQurantinedObject(obj *PackObject) error {
-	// Do nothing if the object is a SO
+	destDir := filepath.Join(QuarantineDir(d.driveRoot, d.device, d.policy), obj.key)
 	if obj.small {
-		return nil
+		return d.saveQurantinedNeedles(obj, destDir)
 	}
-	destDir := filepath.Join(QuarantineDir(d.driveRoot, d.device, d.policy), obj.key)
+
 	// os.Rename don't allow existing dest dir
 	if err := os.MkdirAll(filepath.Dir(destDir), 0755); err != nil {
 		glogger.Error("unable to create quarantine dir",
@@ -319,14 +451,45 @@ func (d *PackDevice) QuarantineObject(obj *PackObject) error {
 	d.wg.Add(1)
 	defer d.wg.Done()
 
-	// Prevent the corrupted object from being read first
-	if err := d.clearDBIndexes(obj); err != nil {
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+
+	return d.quarantineObject(obj)
+}
+
+// quarantineObject is the lock free version of QuarantineObject. It must be
+// called with cmu and the object locked.
+func (d *PackDevice) quarantineObject(obj *PackObject) error {
+	// Prevent the corrupted object from being read first. The reference to
+	// a shared needle is dropped along with the indexes.
+	// The stripe is unlocked right after the write, as poisonNeedle locks
+	// it again.
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	d.clearDBIndexes(batch, obj)
+	var last bool
+	var err error
+	digest := sharedDigest(obj)
+	if digest != "" {
+		unlock := d.lockDedupStripe(obj.partition, digest)
+		last, err = d.releaseShared(batch, obj.partition, obj.dataIndex)
+		if err == nil {
+			err = d.writeDBIndexes(batch)
+		}
+		unlock()
+	} else {
+		err = d.writeDBIndexes(batch)
+	}
+	if err != nil {
 		glogger.Error("unable to clear db index for quarantined object",
 			zap.String("object", obj.name),
 			zap.String("object-key", obj.key),
 			zap.Error(err))
 		return err
 	}
+	d.cache.invalidate(obj.key)
 	go InvalidateHash(filepath.Join(d.objectsDir, obj.key))
 
 	if err := d.saveQurantinedObject(obj); err != nil {
@@ -345,5 +508,29 @@ func (d *PackDevice) QuarantineObject(obj *PackObject) error {
 		return err
 	}
 
+	// Needles of SO are deallocated only after they have been saved. A
+	// shared needle is kept for the other objects referring to it, which
+	// will be quarantined on their own.
+	if obj.small {
+		if last {
+			obj.dataIndex = unsharedIndex(obj.dataIndex)
+		} else if digest != "" {
+			if err := d.poisonNeedle(obj.partition, obj.dataIndex); err != nil {
+				glogger.Error("unable to mark shared needle corrupted",
+					zap.String("object", obj.name),
+					zap.String("object-key", obj.key),
+					zap.Error(err))
+				return err
+			}
+		}
+		if err := d.deallocateSO(obj, DATA); err != nil {
+			glogger.Error("unable to deallocate quarantined needles",
+				zap.String("object", obj.name),
+				zap.String("object-key", obj.key),
+				zap.Error(err))
+			return err
+		}
+	}
+
 	return nil
 }
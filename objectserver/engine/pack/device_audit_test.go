@@ -19,11 +19,13 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/fs"
 )
 
 func TestAuditPartition1(t *testing.T) {
@@ -108,3 +110,76 @@ func TestAuditBadObject2(t *testing.T) {
 	require.False(t, v1.exists)
 	require.False(t, v2.exists)
 }
+
+func TestQuarantineSmallObject(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj := newPackObject(SIZE_1K*10, "1")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	vo := copyVanilla(obj)
+	vo.device = d
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+
+	idx := vo.dataIndex
+	needle := make([]byte, idx.Size)
+	_, err = vo.bundle.active.ReadAt(needle, idx.Offset)
+	require.Nil(t, err)
+
+	require.Nil(t, vo.Quarantine())
+
+	qd := filepath.Join(QuarantineDir(root, PACK_DEVICE, PACK_POLICY_INDEX), obj.key)
+	saved, err := ioutil.ReadFile(filepath.Join(qd, "data.needle"))
+	require.Nil(t, err)
+	require.Equal(t, needle, saved)
+	require.False(t, fs.IsFileNotExist(filepath.Join(qd, "data.json")))
+
+	// The needle is deallocated
+	_, err = vo.bundle.active.ReadAt(needle, idx.Offset)
+	require.Nil(t, err)
+	require.Equal(t, make([]byte, idx.Size), needle)
+
+	vo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+}
+
+func TestQuarantineModifiedObject(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj := newPackObject(SIZE_1K*10, "1")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	vo := copyVanilla(obj)
+	vo.device = d
+	require.Nil(t, d.LoadObjectMeta(vo))
+
+	// Override the object after it is loaded
+	nobj := newPackObject(SIZE_1K*10, "1")
+	nobj.name, nobj.key, nobj.meta.Name = obj.name, obj.key, obj.name
+	require.Nil(t, feedObject(nobj, d))
+	require.Nil(t, d.CommitWrite(nobj))
+	nobj.Close()
+
+	require.Nil(t, vo.Quarantine())
+	qd := filepath.Join(QuarantineDir(root, PACK_DEVICE, PACK_POLICY_INDEX), obj.key)
+	require.True(t, fs.IsFileNotExist(qd))
+
+	vo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+	require.Equal(t, nobj.meta.Timestamp, vo.meta.Timestamp)
+}
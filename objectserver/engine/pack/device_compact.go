@@ -0,0 +1,583 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+type CompactionStat struct {
+	Needles        int64
+	ReclaimedBytes int64
+}
+
+// The marker is saved in the same write batch as the relocated needle
+// indexes. If it is found on startup, the compacted bundle must replace
+// the original one because the db indexes already point to it.
+func compactionMarker(partition string) []byte {
+	return []byte(fmt.Sprintf("/.compaction/%s", partition))
+}
+
+func (d *PackDevice) isCompactionStopped() bool {
+	select {
+	case <-d.stopCompaction:
+		return true
+	default:
+		return false
+	}
+}
+
+type segmentUsage struct {
+	segment   int32
+	live      int64 // bytes referenced by needle indexes
+	allocated int64 // bytes of the segment file, excluding the super block
+}
+
+// Returns the usages of the segments of the bundle in ascending order of
+// segment ids.
+func (d *PackDevice) segmentUsages(partition string) ([]*segmentUsage, error) {
+	ids, err := listSegments(filepath.Join(d.objectsDir, partition))
+	if err != nil {
+		return nil, err
+	}
+
+	var usages []*segmentUsage
+	segments := make(map[int32]*segmentUsage)
+	for _, id := range ids {
+		bp, _ := d.bundlePaths(partition, id)
+		info, err := os.Stat(bp)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		u := &segmentUsage{segment: id, allocated: info.Size() - SuperBlockDiskSize}
+		usages = append(usages, u)
+		segments[id] = u
+	}
+	if len(usages) == 0 {
+		return nil, nil
+	}
+
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		dbIndex := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", string(iter.Key().Data())),
+				zap.Error(err))
+			return nil, ErrDBIndexCorrupted
+		}
+
+		if idx := dbIndex.Index; idx != nil {
+			if u := segments[idx.Segment]; u != nil {
+				u.live += idx.Size
+			}
+		}
+	}
+
+	return usages, nil
+}
+
+// Returns the bytes referenced by needle indexes and the bytes allocated
+// by all the segments of the bundle, excluding the super blocks.
+func (d *PackDevice) partitionUsage(partition string) (int64, int64, error) {
+	usages, err := d.segmentUsages(partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var live, allocated int64
+	for _, u := range usages {
+		live += u.live
+		allocated += u.allocated
+	}
+
+	return live, allocated, nil
+}
+
+// Copies the needle described by idx from src to dst at offset dstOff and
+// returns the needle index relative to dst. The needle is converted to the
+// format of dst, so bundles of old versions are upgraded by compaction.
+// If rekey is not nil, needles not sealed with its active key are sealed
+// with it again.
+func copyNeedle(src *Bundle, dst *os.File, dstSB *SuperBlock, dstOff int64,
+	idx *NeedleIndex, rekey *Keyring) (*NeedleIndex, error) {
+	buf := make([]byte, idx.Size)
+	if _, err := src.ReadAt(buf, idx.Offset); err != nil {
+		return nil, err
+	}
+
+	end := idx.MetaOffset + int64(idx.MetaSize) - idx.Offset
+	if end > idx.Size {
+		return nil, ErrNeedleCorrupted
+	}
+	if err := src.verifyNeedle(buf[0:end]); err != nil {
+		return nil, err
+	}
+
+	payload := buf[idx.DataOffset-idx.Offset : end]
+	dataSize, metaSize, flags := idx.DataSize, idx.MetaSize, idx.Flags
+	if rekey != nil && dstSB.Version >= BundleVersion2 &&
+		rekey.needsReseal(flags, payload[dataSize:]) {
+		data, meta, err := rekey.resealNeedle(
+			flags, payload[:dataSize], payload[dataSize:])
+		if err != nil {
+			return nil, err
+		}
+		payload = append(append(make([]byte, 0, len(data)+len(meta)), data...), meta...)
+		dataSize, metaSize = int64(len(data)), int32(len(meta))
+		flags |= NeedleFlagEncrypted
+	}
+
+	hs := dstSB.needleHeaderSize()
+	nh := &NeedleHeader{
+		MagicNumber: NeedleMagicNumber,
+		DataOffset:  dstOff + int64(hs),
+		DataSize:    dataSize,
+		MetaSize:    metaSize,
+		Flags:       flags,
+	}
+	nh.MetaOffset = nh.DataOffset + nh.DataSize
+	nh.NeedleSize = CalculateDiskSize(hs, nh.DataSize, nh.MetaSize)
+
+	needle := make([]byte, nh.NeedleSize)
+	copy(needle[hs:], payload)
+	dstSB.sealNeedle(nh, needle[0:int(hs)+len(payload)])
+
+	if _, err := dst.WriteAt(needle, dstOff); err != nil {
+		return nil, err
+	}
+
+	return &NeedleIndex{
+		Offset:     dstOff,
+		Size:       nh.NeedleSize,
+		DataOffset: nh.DataOffset,
+		DataSize:   nh.DataSize,
+		MetaOffset: nh.MetaOffset,
+		MetaSize:   nh.MetaSize,
+		Flags:      nh.Flags,
+		Segment:    idx.Segment,
+		Digest:     idx.Digest,
+	}, nil
+}
+
+// CompactPartition compacts all the segments of the bundle of a partition.
+func (d *PackDevice) CompactPartition(partition string) (*CompactionStat, error) {
+	set, err := d.getBundle(partition)
+	if err != nil {
+		glogger.Error("unable to find bundle",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+
+	stat := &CompactionStat{}
+	for _, id := range set.segmentIDs() {
+		s, err := d.compactSegment(partition, id, nil)
+		if err != nil {
+			return nil, err
+		}
+		stat.Needles += s.Needles
+		stat.ReclaimedBytes += s.ReclaimedBytes
+	}
+
+	return stat, nil
+}
+
+// compactSegment copies the live needles of a bundle segment to a new
+// file and replaces the segment with it. Needles are sealed with the active
+// key of rekey on the way if it is not nil.
+// Most of the copying is done without blocking object requests. Only the
+// needles written during the copying are copied again while index
+// mutations are blocked, so that the swap is atomic to GET/PUT/DELETE.
+func (d *PackDevice) compactSegment(partition string, id int32,
+	rekey *Keyring) (*CompactionStat, error) {
+	if d.isCompactionStopped() {
+		return nil, ErrCompactionAborted
+	}
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	set, err := d.getBundle(partition)
+	if err != nil {
+		glogger.Error("unable to find bundle",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+	bundle, err := set.segment(id)
+	if err != nil {
+		return nil, err
+	}
+
+	bp, cp := d.bundlePaths(partition, id)
+	os.Remove(cp)
+	if err = formatBundleFile(cp); err != nil {
+		return nil, err
+	}
+	cf, err := os.OpenFile(cp, os.O_RDWR, BundleFileMode)
+	if err != nil {
+		glogger.Error("unable to open compacted bundle",
+			zap.String("bundle-file", cp), zap.Error(err))
+		return nil, err
+	}
+	defer cf.Close()
+
+	header := make([]byte, SuperBlockSize)
+	if _, err = cf.ReadAt(header, 0); err != nil {
+		glogger.Error("cannot read bundle super block",
+			zap.String("bundle-file", cp), zap.Error(err))
+		return nil, err
+	}
+	sb := NewSuperBlock(header)
+
+	swapped := false
+	defer func() {
+		if !swapped {
+			os.Remove(cp)
+		}
+	}()
+
+	stat := &CompactionStat{}
+	// Needles copied to the compacted bundle, keyed by their original offset
+	moved := make(map[int64]*NeedleIndex)
+	offset := int64(SuperBlockDiskSize)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+
+	// Phase 1: copy needles without blocking anyone. The needles may be
+	// deallocated at the same time, so errors are ignored here and the
+	// needles still referenced will be copied again in phase 2.
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		if d.isCompactionStopped() {
+			iter.Close()
+			return nil, ErrCompactionAborted
+		}
+
+		dbIndex := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			continue
+		}
+		idx := dbIndex.Index
+		if idx == nil || idx.Segment != id || moved[idx.Offset] != nil {
+			continue
+		}
+
+		nIdx, err := copyNeedle(bundle, cf, sb, offset, idx, rekey)
+		if err != nil {
+			continue
+		}
+		moved[idx.Offset] = nIdx
+		offset += nIdx.Size
+	}
+	iter.Close()
+
+	// The needles copied so far are synced without blocking anyone, so
+	// that only the needles copied in phase 2 are left to sync.
+	if err = cf.Sync(); err != nil {
+		glogger.Error("unable to sync compacted bundle",
+			zap.String("bundle-file", cp), zap.Error(err))
+		return nil, err
+	}
+
+	// Phase 2: block index mutations and bundle appending. Dedup records
+	// are kept from being released until the bundle is swapped.
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	unlock := d.lockDedupStripes(nil)
+	defer unlock()
+	bundle.Lock()
+	defer bundle.Unlock()
+
+	d.lock.RLock()
+	current := d.bundles[partition]
+	d.lock.RUnlock()
+	if current == nil || current.segments[id] != bundle {
+		glogger.Info("bundle has been closed during compaction",
+			zap.String("partition", partition), zap.Int32("segment", id))
+		return nil, ErrCompactionAborted
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	referenced := make(map[int64]bool)
+
+	iter = d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		dbIndex := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			return nil, ErrDBIndexCorrupted
+		}
+		idx := dbIndex.Index
+		if idx == nil || idx.Segment != id {
+			continue
+		}
+
+		// Offsets of needles are never reused in a bundle, so the needle
+		// found in moved must be the same one.
+		nIdx := moved[idx.Offset]
+		if nIdx == nil {
+			if nIdx, err = copyNeedle(bundle, cf, sb, offset, idx, rekey); err != nil {
+				glogger.Error("unable to copy needle",
+					zap.String("object-key", key),
+					zap.Int64("offset", idx.Offset),
+					zap.Error(err))
+				return nil, err
+			}
+			moved[idx.Offset] = nIdx
+			offset += nIdx.Size
+		}
+		referenced[idx.Offset] = true
+
+		dbIndex.Index = nIdx
+		b, err := proto.Marshal(dbIndex)
+		if err != nil {
+			glogger.Error("unable to marshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			return nil, err
+		}
+		batch.Put([]byte(key), b)
+		stat.Needles++
+	}
+
+	if err = d.relocateDedupRecords(batch, partition, id, moved, referenced); err != nil {
+		glogger.Error("unable to relocate dedup records",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+
+	// Needles deallocated after being copied in phase 1
+	for old, nIdx := range moved {
+		if referenced[old] {
+			continue
+		}
+		if err = syscall.Fallocate(int(cf.Fd()),
+			FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE,
+			nIdx.Offset, nIdx.Size); err != nil {
+			glogger.Error("unable to punch hole.",
+				zap.Int64("offset", nIdx.Offset),
+				zap.String("partition", partition))
+			return nil, err
+		}
+	}
+
+	if err = cf.Sync(); err != nil {
+		glogger.Error("unable to sync compacted bundle",
+			zap.String("bundle-file", cp), zap.Error(err))
+		return nil, err
+	}
+
+	// Relocation keeps the timestamps of the indexes, so the suffix
+	// summaries need no update. Sizes of the needles may be changed by the
+	// conversion, so the partition usage is counted again on next load.
+	marker := compactionMarker(partition)
+	batch.Put(marker, []byte(filepath.Base(cp)))
+	batch.Delete(usageKey(partition))
+	unlockUsage := d.lockUsageStripe(partition)
+	err = d.writeBatch(batch)
+	unlockUsage()
+	if err != nil {
+		glogger.Error("unable to save relocated db indexes",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+	swapped = true
+
+	// From now on, the db indexes point to the compacted bundle. If the
+	// bundle cannot be replaced right now, remove it from the cache so that
+	// getBundle will try to recover the compaction.
+	nb, err := d.swapBundle(partition, id, bp, cp)
+	d.lock.Lock()
+	if err != nil {
+		delete(d.bundles, partition)
+	} else {
+		d.bundles[partition] = current.withSegment(nb)
+	}
+	d.lock.Unlock()
+	d.cache.invalidatePartition(partition)
+
+	// Readers may still pin the original segment, which is closed once
+	// they are all gone.
+	stat.ReclaimedBytes = bundle.BundleSize() - offset
+	bundle.retire()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.db.Delete(d.wopt, marker); err != nil {
+		glogger.Error("unable to delete compaction marker",
+			zap.String("partition", partition), zap.Error(err))
+	}
+
+	return stat, nil
+}
+
+func (d *PackDevice) swapBundle(partition string, id int32, bp, cp string) (*Bundle, error) {
+	if err := os.Rename(cp, bp); err != nil {
+		glogger.Error("unable to replace bundle",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+
+	if dir, err := os.OpenFile(filepath.Dir(bp), os.O_RDONLY, 0666); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return OpenBundleSegment(d.objectsDir, partition, id)
+}
+
+// recoverCompaction finishes or rolls back a compaction interrupted by
+// crash. It must be called before the bundle of the partition is opened.
+// The marker names the compacted segment which must replace the original
+// one, and any other compacted segment is unfinished.
+func (d *PackDevice) recoverCompaction(partition string) error {
+	marker := compactionMarker(partition)
+	v, err := d.db.GetBytes(d.ropt, marker)
+	if err != nil {
+		glogger.Error("unable to retrieve compaction marker",
+			zap.String("partition", partition), zap.Error(err))
+		return err
+	}
+
+	target := int32(-1)
+	if id, compacted, ok := parseSegmentFileName(string(v)); ok && compacted {
+		target = id
+	}
+
+	names, err := fs.ReadDirNames(filepath.Join(d.objectsDir, partition))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range names {
+		id, compacted, ok := parseSegmentFileName(name)
+		if !ok || !compacted {
+			continue
+		}
+
+		bp, cp := d.bundlePaths(partition, id)
+		if id != target {
+			glogger.Info("removing unfinished compacted bundle",
+				zap.String("partition", partition), zap.Int32("segment", id))
+			if err = os.Remove(cp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		glogger.Info("recovering bundle compaction",
+			zap.String("partition", partition), zap.Int32("segment", id))
+		if err = os.Rename(cp, bp); err != nil {
+			glogger.Error("unable to replace bundle",
+				zap.String("partition", partition), zap.Error(err))
+			return err
+		}
+		if dir, err := os.OpenFile(filepath.Dir(bp), os.O_RDONLY, 0666); err == nil {
+			dir.Sync()
+			dir.Close()
+		}
+	}
+
+	if len(v) == 0 {
+		return nil
+	}
+
+	return d.db.Delete(d.wopt, marker)
+}
+
+func (d *PackDevice) compactPartitions() {
+	dirs, err := ioutil.ReadDir(d.objectsDir)
+	if err != nil {
+		glogger.Error("unable to list partitions",
+			zap.String("dir", d.objectsDir), zap.Error(err))
+		return
+	}
+
+	for _, dir := range dirs {
+		if d.isCompactionStopped() {
+			return
+		}
+
+		partition := dir.Name()
+		if _, err = strconv.ParseUint(partition, 10, 64); err != nil {
+			continue
+		}
+
+		usages, err := d.segmentUsages(partition)
+		if err != nil {
+			continue
+		}
+
+		for _, u := range usages {
+			if d.isCompactionStopped() {
+				return
+			}
+			if u.allocated <= 0 ||
+				float64(u.live)/float64(u.allocated) >= gconf.CompactionRatio {
+				continue
+			}
+
+			stat, err := d.compactSegment(partition, u.segment, nil)
+			if err != nil {
+				glogger.Error("unable to compact bundle segment",
+					zap.String("device", d.device),
+					zap.String("partition", partition),
+					zap.Int32("segment", u.segment),
+					zap.Error(err))
+				continue
+			}
+
+			glogger.Info("bundle segment compacted",
+				zap.String("device", d.device),
+				zap.String("partition", partition),
+				zap.Int32("segment", u.segment),
+				zap.Int64("needles", stat.Needles),
+				zap.Int64("reclaimed-bytes", stat.ReclaimedBytes))
+		}
+	}
+}
+
+func (d *PackDevice) runCompactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stopCompaction:
+			return
+		case <-ticker.C:
+			d.compactPartitions()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+func TestCompactPartition(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 10; i++ {
+		obj := newPackObject(SIZE_1K*10, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+
+	for _, obj := range objs[:5] {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		vo.meta.Timestamp = common.GetTimestamp()
+		require.Nil(t, d.CommitDeletion(vo))
+	}
+
+	bp, cp := d.bundlePaths(partition, 0)
+	before := fileSize(bp)
+	live, allocated, err := d.partitionUsage(partition)
+	require.Nil(t, err)
+	require.Equal(t, allocated/2, live)
+
+	stat, err := d.CompactPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), stat.Needles)
+	require.Equal(t, before-fileSize(bp), stat.ReclaimedBytes)
+	require.Equal(t, live+SuperBlockDiskSize, fileSize(bp))
+	require.True(t, fs.IsFileNotExist(cp))
+
+	for _, obj := range objs[5:] {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+
+		r, err := d.NewReader(vo)
+		require.Nil(t, err)
+		hash := md5.New()
+		n, _ := io.Copy(hash, r)
+		require.Equal(t, obj.meta.DataSize, n)
+		require.Equal(t, obj.meta.SystemMeta[common.HEtag],
+			hex.EncodeToString(hash.Sum(nil)))
+	}
+}
+
+func TestCompactPartitionUpgrade(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj := newPackObject(SIZE_1K, "1")
+	require.Nil(t, formatBundleFileV1(d, obj.partition))
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	_, err = d.CompactPartition(obj.partition)
+	require.Nil(t, err)
+
+	bundle, err := d.getBundle(obj.partition)
+	require.Nil(t, err)
+	require.Equal(t, CurrentBundleVersion, bundle.active.Version)
+	require.Equal(t, ChecksumCRC32C, bundle.active.Checksum)
+
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.Equal(t,
+		int64(SuperBlockDiskSize+NeedleHeaderSizeV2), vo.dataIndex.DataOffset)
+	r, err := d.NewReader(vo)
+	require.Nil(t, err)
+	hash := md5.New()
+	io.Copy(hash, r)
+	require.Equal(t, obj.meta.SystemMeta[common.HEtag],
+		hex.EncodeToString(hash.Sum(nil)))
+}
+
+func TestCompactPinnedSegment(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 2; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+	vo.Close()
+
+	set, err := d.getBundle(partition)
+	require.Nil(t, err)
+	old := set.segments[0]
+
+	// The object loaded before compaction is still readable
+	vo = copyVanilla(objs[1])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	_, err = d.CompactPartition(partition)
+	require.Nil(t, err)
+	require.False(t, old.closed)
+
+	r, err := d.NewReader(vo)
+	require.Nil(t, err)
+	hash := md5.New()
+	io.Copy(hash, r)
+	r.Close()
+	require.Equal(t, objs[1].meta.SystemMeta[common.HEtag],
+		hex.EncodeToString(hash.Sum(nil)))
+
+	// Deleting it deallocates the needle in the compacted segment
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+	vo.Close()
+	require.True(t, old.closed)
+
+	stat, err := d.ReclaimOrphans(partition, 0, true)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Needles)
+}
+
+func TestRecoverCompaction1(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	bp, cp := d.bundlePaths(partition, 0)
+	require.Nil(t, os.MkdirAll(filepath.Dir(bp), 0755))
+	require.Nil(t, formatBundleFile(cp))
+	require.Nil(t, d.db.Put(
+		d.wopt, compactionMarker(partition), []byte(CompactedFileName)))
+
+	require.Nil(t, d.recoverCompaction(partition))
+	require.True(t, fs.IsFileNotExist(cp))
+	require.False(t, fs.IsFileNotExist(bp))
+
+	v, err := d.db.GetBytes(d.ropt, compactionMarker(partition))
+	require.Nil(t, err)
+	require.Empty(t, v)
+}
+
+func TestRecoverCompaction2(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	bp, cp := d.bundlePaths(partition, 0)
+	require.Nil(t, os.MkdirAll(filepath.Dir(bp), 0755))
+	require.Nil(t, formatBundleFile(cp))
+
+	require.Nil(t, d.recoverCompaction(partition))
+	require.True(t, fs.IsFileNotExist(cp))
+	require.True(t, fs.IsFileNotExist(bp))
+}
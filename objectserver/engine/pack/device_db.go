@@ -0,0 +1,680 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+const (
+	// Records moved in one batch when indexes are migrated between column
+	// families. Commits are blocked while a batch is moved.
+	cfMigrationBatch = 1000
+)
+
+// Saved in the default column family once all the indexes are migrated.
+// The value tells where they are.
+var cfMigrationMarker = []byte("/.column-families")
+
+var (
+	cfLayoutColumnFamilies = []byte("column-families")
+	cfLayoutDefault        = []byte("default")
+)
+
+// Indexes of each part type are saved in the column family of the same
+// name if column families are enabled.
+var indexColumnFamilies = []PartType{DATA, META, TOMBSTONE}
+
+// Tuning of the meta db of each device
+type DBOptions struct {
+	BlockCacheSize  int64 // bytes of LRU block cache, 0 for RocksDB default
+	BloomBits       int   // bits per key of bloom filters, 0 to disable
+	CompactionStyle gorocksdb.CompactionStyle
+	ColumnFamilies  bool  // save data, meta and ts indexes separately
+	PrefixExtractor bool  // prefix bloom filters on /partition/suffix/
+	RateLimit       int64 // bytes per second of flush and compaction, 0 for no limit
+}
+
+// Meta db options of each pack policy, configured in [object-pack] and
+// overridden by [object-pack:<policy index>]
+var policyDBOptions = make(map[int]*DBOptions)
+
+func policyOption(config conf.Config, policy int, key string) (string, bool) {
+	if v, ok := config.File.Get(fmt.Sprintf("object-pack:%d", policy), key); ok {
+		return v, true
+	}
+
+	return config.Get("object-pack", key)
+}
+
+func parseDBOptions(config conf.Config, policy int) (*DBOptions, error) {
+	opts := &DBOptions{CompactionStyle: gorocksdb.LevelCompactionStyle}
+
+	if v, ok := policyOption(config, policy, "rocksdb_block_cache_size"); ok {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		opts.BlockCacheSize = size
+	}
+
+	if v, ok := policyOption(config, policy, "rocksdb_bloom_bits"); ok {
+		bits, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.BloomBits = bits
+	}
+
+	if v, ok := policyOption(config, policy, "rocksdb_compaction_style"); ok {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "", "level":
+		case "universal":
+			opts.CompactionStyle = gorocksdb.UniversalCompactionStyle
+		default:
+			// FIFO compaction drops old indexes, so it is never allowed.
+			return nil, ErrUnknownCompactionStyle
+		}
+	}
+
+	if v, ok := policyOption(config, policy, "rocksdb_column_families"); ok {
+		opts.ColumnFamilies = common.LooksTrue(v)
+	}
+
+	if v, ok := policyOption(config, policy, "rocksdb_prefix_extractor"); ok {
+		opts.PrefixExtractor = common.LooksTrue(v)
+	}
+
+	if v, ok := policyOption(config, policy, "rocksdb_rate_limit"); ok {
+		rate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if rate > 0 && !rateLimiterSupported() {
+			return nil, ErrRateLimiterUnsupported
+		}
+		opts.RateLimit = rate
+	}
+
+	return opts, nil
+}
+
+func newRocksDBOptions(o *DBOptions) *gorocksdb.Options {
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	opts.SetWalSizeLimitMb(64)
+	if o == nil {
+		return opts
+	}
+
+	// Column families share the table options, so the block cache is per
+	// device.
+	bbto := gorocksdb.NewDefaultBlockBasedTableOptions()
+	if o.BlockCacheSize > 0 {
+		bbto.SetBlockCache(gorocksdb.NewLRUCache(int(o.BlockCacheSize)))
+	}
+	if o.BloomBits > 0 {
+		bbto.SetFilterPolicy(gorocksdb.NewBloomFilter(o.BloomBits))
+	}
+	opts.SetBlockBasedTableFactory(bbto)
+	opts.SetCompactionStyle(o.CompactionStyle)
+	if o.PrefixExtractor {
+		opts.SetPrefixExtractor(suffixPrefixTransform{})
+	}
+	if o.RateLimit > 0 {
+		setRateLimiter(opts, o.RateLimit)
+	}
+
+	return opts
+}
+
+// suffixPrefixTransform extracts /partition/suffix/ from the keys of
+// indexes, so that the bloom filters are checked when the indexes of a
+// suffix are listed by newSuffixIterator. Partitions are of variable
+// length, so a fixed prefix transform doesn't fit. Other iterators cross
+// the prefixes, so they seek in total order.
+type suffixPrefixTransform struct{}
+
+// Returns the length of /partition/suffix/ in the key, or 0 if the key is
+// out of the domain.
+func suffixPrefixLen(key []byte) int {
+	if len(key) < 2 || key[0] != '/' || key[1] == '.' {
+		return 0
+	}
+
+	n := 0
+	for i, c := range key {
+		if c != '/' {
+			continue
+		}
+		if n++; n == 3 {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+func (suffixPrefixTransform) Transform(src []byte) []byte {
+	return src[:suffixPrefixLen(src)]
+}
+
+func (suffixPrefixTransform) InDomain(src []byte) bool {
+	return suffixPrefixLen(src) > 0
+}
+
+func (suffixPrefixTransform) InRange(src []byte) bool {
+	return suffixPrefixLen(src) == len(src)
+}
+
+func (suffixPrefixTransform) Name() string {
+	return "auklet.SuffixPrefix"
+}
+
+// openMetaDB opens the meta db at path. Column families are used if they
+// are enabled or the db has them already, because a db with column
+// families can't be opened without them. Indexes are not migrated here.
+// Column families are dropped only once the indexes have been migrated
+// back to the default one.
+func openMetaDB(path string, o *DBOptions) (
+	*gorocksdb.DB, map[PartType]*gorocksdb.ColumnFamilyHandle, error) {
+	opts := newRocksDBOptions(o)
+	enabled := o != nil && o.ColumnFamilies
+
+	// Listing fails if the db doesn't exist yet
+	existing, _ := gorocksdb.ListColumnFamilies(opts, path)
+	if !enabled && len(existing) <= 1 {
+		db, err := gorocksdb.OpenDb(opts, path)
+		return db, nil, err
+	}
+
+	opts.SetCreateIfMissingColumnFamilies(true)
+	names := []string{"default"}
+	cfOpts := []*gorocksdb.Options{opts}
+	for _, ot := range indexColumnFamilies {
+		names = append(names, string(ot))
+		cfOpts = append(cfOpts, opts)
+	}
+
+	db, handles, err := gorocksdb.OpenDbColumnFamilies(opts, path, names, cfOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Records of the default column family are written without handle
+	handles[0].Destroy()
+	handles = handles[1:]
+	cfs := make(map[PartType]*gorocksdb.ColumnFamilyHandle)
+	for i, ot := range indexColumnFamilies {
+		cfs[ot] = handles[i]
+	}
+	if enabled {
+		return db, cfs, nil
+	}
+
+	ropt := gorocksdb.NewDefaultReadOptions()
+	defer ropt.Destroy()
+	layout, err := db.GetBytes(ropt, cfMigrationMarker)
+	if err != nil || !bytes.Equal(layout, cfLayoutDefault) {
+		return db, cfs, err
+	}
+
+	for _, h := range handles {
+		if err = db.DropColumnFamily(h); err != nil {
+			glogger.Error("unable to drop column family",
+				zap.String("database", path), zap.Error(err))
+			break
+		}
+	}
+	for _, h := range handles {
+		h.Destroy()
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	glogger.Info("column families dropped", zap.String("database", path))
+	return db, nil, nil
+}
+
+// Returns the column family of the index key, or nil for the default one.
+func indexColumnFamily(
+	cfs map[PartType]*gorocksdb.ColumnFamilyHandle, key []byte) *gorocksdb.ColumnFamilyHandle {
+	if cfs == nil {
+		return nil
+	}
+
+	// Internal keys such as suffix summaries start with a dot
+	fields := splitObjectKey(string(key))
+	if len(fields) != 4 || strings.HasPrefix(fields[0], ".") {
+		return nil
+	}
+
+	return cfs[PartType(fields[3])]
+}
+
+// startIndexMigration migrates the indexes in the background if they are
+// not where the options want them to be. Indexes saved in the default
+// column family by older versions are moved to their own column families,
+// and moved back if column families are turned off again, after which the
+// column families are dropped on next open. Reads and writes of indexes
+// go on during the migration, and it is resumed on next open if the device
+// is closed meanwhile.
+func (d *PackDevice) startIndexMigration(o *DBOptions) {
+	d.cfIndexes = o != nil && o.ColumnFamilies
+
+	layout, err := d.db.GetBytes(d.ropt, cfMigrationMarker)
+	if err != nil {
+		glogger.Error("unable to read column family layout",
+			zap.String("device", d.device), zap.Error(err))
+		return
+	}
+	if d.cfIndexes && bytes.Equal(layout, cfLayoutColumnFamilies) {
+		return
+	}
+	if !d.cfIndexes && bytes.Equal(layout, cfLayoutDefault) {
+		return
+	}
+
+	atomic.StoreInt32(&d.migrating, 1)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := d.migrateIndexes(); err != nil {
+			glogger.Error("unable to migrate indexes between column families",
+				zap.String("device", d.device),
+				zap.Bool("column-families", d.cfIndexes),
+				zap.Error(err))
+		}
+	}()
+}
+
+func (d *PackDevice) isMigrating() bool {
+	return atomic.LoadInt32(&d.migrating) != 0
+}
+
+// indexPlacement returns the column family the key is written to, and the
+// one it may still be found in if it is an index being migrated. nil
+// stands for the default column family.
+func (d *PackDevice) indexPlacement(key []byte) (
+	dst, src *gorocksdb.ColumnFamilyHandle, moving bool) {
+	cf := indexColumnFamily(d.cfs, key)
+	if cf == nil {
+		return nil, nil, false
+	}
+
+	if d.cfIndexes {
+		return cf, nil, d.isMigrating()
+	}
+	return nil, cf, d.isMigrating()
+}
+
+func (d *PackDevice) migrateIndexes() error {
+	sources := []*gorocksdb.ColumnFamilyHandle{nil}
+	layout := cfLayoutColumnFamilies
+	if !d.cfIndexes {
+		sources = sources[:0]
+		for _, ot := range indexColumnFamilies {
+			sources = append(sources, d.cfs[ot])
+		}
+		layout = cfLayoutDefault
+	}
+
+	var moved int64
+	for _, src := range sources {
+		var from []byte
+		for {
+			if d.isCompactionStopped() {
+				glogger.Info("index migration interrupted",
+					zap.String("device", d.device), zap.Int64("indexes", moved))
+				return nil
+			}
+
+			last, n, err := d.migrateIndexBatch(src, from)
+			if err != nil {
+				return err
+			}
+			if last == nil {
+				break
+			}
+			from, moved = last, moved+n
+		}
+	}
+
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	if err := d.db.Put(d.wopt, cfMigrationMarker, layout); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&d.migrating, 0)
+
+	glogger.Info("indexes migrated",
+		zap.String("device", d.device),
+		zap.Bool("column-families", d.cfIndexes),
+		zap.Int64("indexes", moved))
+	return nil
+}
+
+// migrateIndexBatch moves a batch of indexes from the column family src to
+// the one they are written to, starting from the key from. The keys are
+// listed first, then each of them is moved with its latest value while
+// commits are blocked, so that the indexes written meanwhile are never
+// overridden. The last key listed is returned, or nil if none is left.
+func (d *PackDevice) migrateIndexBatch(
+	src *gorocksdb.ColumnFamilyHandle, from []byte) ([]byte, int64, error) {
+	var keys [][]byte
+	iter := d.newCFIterator(d.ropt, src)
+	if from == nil {
+		iter.SeekToFirst()
+	} else {
+		iter.Seek(from)
+	}
+	for ; iter.Valid() && len(keys) < cfMigrationBatch; iter.Next() {
+		key := iter.Key().Data()
+		if indexColumnFamily(d.cfs, key) != nil {
+			keys = append(keys, append([]byte{}, key...))
+		}
+	}
+	err := iter.Err()
+	iter.Close()
+	if err != nil || len(keys) == 0 {
+		return nil, 0, err
+	}
+
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, key := range keys {
+		v, err := d.getCFBytes(src, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if v == nil {
+			continue
+		}
+		dst, _, _ := d.indexPlacement(key)
+		putCF(batch, dst, key, v)
+		deleteCF(batch, src, key)
+	}
+	if err = d.db.Write(d.wopt, batch); err != nil {
+		return nil, 0, err
+	}
+
+	return keys[len(keys)-1], int64(batch.Count() / 2), nil
+}
+
+func (d *PackDevice) newCFIterator(
+	ropt *gorocksdb.ReadOptions, cf *gorocksdb.ColumnFamilyHandle) *gorocksdb.Iterator {
+	if cf == nil {
+		return d.db.NewIterator(ropt)
+	}
+	return d.db.NewIteratorCF(ropt, cf)
+}
+
+func putCF(batch *gorocksdb.WriteBatch,
+	cf *gorocksdb.ColumnFamilyHandle, key, value []byte) {
+	if cf == nil {
+		batch.Put(key, value)
+	} else {
+		batch.PutCF(cf, key, value)
+	}
+}
+
+func deleteCF(batch *gorocksdb.WriteBatch,
+	cf *gorocksdb.ColumnFamilyHandle, key []byte) {
+	if cf == nil {
+		batch.Delete(key)
+	} else {
+		batch.DeleteCF(cf, key)
+	}
+}
+
+// writeBatch writes the batch to the db. Records are collected in the
+// default column family and routed to their own column families here, so
+// that batches could be merged and summarized regardless of the layout.
+func (d *PackDevice) writeBatch(batch *gorocksdb.WriteBatch) error {
+	if d.cfs == nil {
+		return d.db.Write(d.wopt, batch)
+	}
+
+	routed := gorocksdb.NewWriteBatch()
+	defer routed.Destroy()
+	iter := batch.NewIterator()
+	for iter.Next() {
+		r := iter.Record()
+		dst, src, moving := d.indexPlacement(r.Key)
+		switch r.Type {
+		case gorocksdb.WriteBatchRecordTypeValue:
+			putCF(routed, dst, r.Key, r.Value)
+		case gorocksdb.WriteBatchRecordTypeDeletion:
+			deleteCF(routed, dst, r.Key)
+		default:
+			return ErrUnknownBatchRecord
+		}
+		// The copy not migrated yet must not be read or migrated later
+		if moving {
+			deleteCF(routed, src, r.Key)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return d.db.Write(d.wopt, routed)
+}
+
+// getIndexBytes reads the value of the key from its column family. nil is
+// returned if the key is not found. While indexes are migrated, the column
+// family they are moved from is read first, because a key is moved
+// atomically, so it is found in one of them whenever it is read.
+func (d *PackDevice) getIndexBytes(key []byte) ([]byte, error) {
+	dst, src, moving := d.indexPlacement(key)
+	if moving {
+		v, err := d.getCFBytes(src, key)
+		if err != nil || v != nil {
+			return v, err
+		}
+	}
+
+	return d.getCFBytes(dst, key)
+}
+
+// Reads the value of the key from the column family, the default one if
+// cf is nil.
+func (d *PackDevice) getCFBytes(
+	cf *gorocksdb.ColumnFamilyHandle, key []byte) ([]byte, error) {
+	if cf == nil {
+		return d.db.GetBytes(d.ropt, key)
+	}
+
+	v, err := d.db.GetCF(d.ropt, cf, key)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Free()
+
+	if v.Data() == nil {
+		return nil, nil
+	}
+	return append([]byte{}, v.Data()...), nil
+}
+
+// indexIterator iterates the keys of all the column families in order, as
+// if they were saved in one keyspace.
+type indexIterator struct {
+	iters []*gorocksdb.Iterator
+	cur   *gorocksdb.Iterator
+	// While indexes are migrated, the column families are iterated at the
+	// same snapshot, so that each index is seen exactly once.
+	snap *gorocksdb.Snapshot
+	ropt *gorocksdb.ReadOptions
+}
+
+// newIndexIterator iterates the keys in total order, so that it could go
+// across partitions, suffixes and internal keys.
+func (d *PackDevice) newIndexIterator() *indexIterator {
+	return d.newIterator(false)
+}
+
+// newSuffixIterator iterates the indexes of a single suffix. Seeks take the
+// prefix bloom filters if the prefix extractor is enabled, so the iterator
+// is not valid beyond the /partition/suffix/ of the key sought.
+func (d *PackDevice) newSuffixIterator() *indexIterator {
+	return d.newIterator(true)
+}
+
+func (d *PackDevice) newIterator(prefixSeek bool) *indexIterator {
+	it := &indexIterator{}
+	ropt := d.ropt
+	if prefixSeek {
+		ropt = d.propt
+	}
+	if d.isMigrating() {
+		it.snap = d.db.NewSnapshot()
+		it.ropt = gorocksdb.NewDefaultReadOptions()
+		it.ropt.SetSnapshot(it.snap)
+		SetTotalOrderSeek(it.ropt, !prefixSeek)
+		ropt = it.ropt
+	}
+
+	it.iters = append(it.iters, d.db.NewIterator(ropt))
+	for _, ot := range indexColumnFamilies {
+		if cf, ok := d.cfs[ot]; ok {
+			it.iters = append(it.iters, d.db.NewIteratorCF(ropt, cf))
+		}
+	}
+
+	return it
+}
+
+// Picks the iterator holding the smallest key
+func (it *indexIterator) pick() {
+	it.cur = nil
+	for _, i := range it.iters {
+		if !i.Valid() {
+			continue
+		}
+		if it.cur == nil || bytes.Compare(i.Key().Data(), it.cur.Key().Data()) < 0 {
+			it.cur = i
+		}
+	}
+}
+
+func (it *indexIterator) Seek(key []byte) {
+	for _, i := range it.iters {
+		i.Seek(key)
+	}
+	it.pick()
+}
+
+func (it *indexIterator) Valid() bool {
+	return it.cur != nil
+}
+
+func (it *indexIterator) ValidForPrefix(prefix []byte) bool {
+	return it.cur != nil && it.cur.ValidForPrefix(prefix)
+}
+
+func (it *indexIterator) Next() {
+	it.cur.Next()
+	it.pick()
+}
+
+func (it *indexIterator) Key() *gorocksdb.Slice {
+	return it.cur.Key()
+}
+
+func (it *indexIterator) Value() *gorocksdb.Slice {
+	return it.cur.Value()
+}
+
+func (it *indexIterator) Err() error {
+	for _, i := range it.iters {
+		if err := i.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *indexIterator) Close() {
+	for _, i := range it.iters {
+		i.Close()
+	}
+	if it.snap != nil {
+		it.ropt.Destroy()
+		it.snap.Release()
+	}
+}
+
+// Integer properties of the meta db reported to recon. Values are summed
+// up across column families.
+var dbStatsProperties = []string{
+	"rocksdb.estimate-num-keys",
+	"rocksdb.estimate-live-data-size",
+	"rocksdb.total-sst-files-size",
+	"rocksdb.cur-size-all-mem-tables",
+	"rocksdb.estimate-table-readers-mem",
+	"rocksdb.estimate-pending-compaction-bytes",
+	"rocksdb.num-running-compactions",
+	"rocksdb.num-running-flushes",
+	"rocksdb.background-errors",
+	"rocksdb.block-cache-usage",
+}
+
+// DBStats returns the statistics of the meta db. Properties not supported
+// by the RocksDB in use are omitted.
+func (d *PackDevice) DBStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+	for _, p := range dbStatsProperties {
+		values := []string{d.db.GetProperty(p)}
+		for _, ot := range indexColumnFamilies {
+			if cf, ok := d.cfs[ot]; ok {
+				values = append(values, d.db.GetPropertyCF(p, cf))
+			}
+		}
+
+		var sum int64
+		found := false
+		for _, v := range values {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			sum += n
+			found = true
+		}
+		if found {
+			stats[strings.TrimPrefix(p, "rocksdb.")] = sum
+		}
+	}
+	stats["column-families"] = d.cfIndexes
+	stats["column-families-migrating"] = d.isMigrating()
+
+	return stats
+}
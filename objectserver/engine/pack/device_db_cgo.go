@@ -0,0 +1,85 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// RocksDB options not exposed by the gorocksdb in use. The rate limiter is
+// missing in the C API of some RocksDB releases, so it is referenced weakly
+// and checked before being used.
+
+/*
+#include <stdlib.h>
+#include "rocksdb/c.h"
+
+typedef struct rocksdb_ratelimiter_t rocksdb_ratelimiter_t;
+
+extern rocksdb_ratelimiter_t* rocksdb_ratelimiter_create(
+	int64_t rate_bytes_per_sec, int64_t refill_period_us, int32_t fairness);
+extern void rocksdb_ratelimiter_destroy(rocksdb_ratelimiter_t*);
+extern void rocksdb_options_set_ratelimiter(
+	rocksdb_options_t* opt, rocksdb_ratelimiter_t* limiter);
+
+#pragma weak rocksdb_ratelimiter_create
+#pragma weak rocksdb_ratelimiter_destroy
+#pragma weak rocksdb_options_set_ratelimiter
+
+static int auklet_ratelimiter_supported() {
+	return rocksdb_ratelimiter_create != NULL &&
+		rocksdb_ratelimiter_destroy != NULL &&
+		rocksdb_options_set_ratelimiter != NULL;
+}
+
+// The options hold the limiter by a shared pointer, so the handle is
+// destroyed right away. Refill period and fairness are the defaults of
+// RocksDB.
+static void auklet_set_ratelimiter(rocksdb_options_t* opt, int64_t rate) {
+	rocksdb_ratelimiter_t* limiter =
+		rocksdb_ratelimiter_create(rate, 100 * 1000, 10);
+	rocksdb_options_set_ratelimiter(opt, limiter);
+	rocksdb_ratelimiter_destroy(limiter);
+}
+*/
+import "C"
+
+func rateLimiterSupported() bool {
+	return C.auklet_ratelimiter_supported() != 0
+}
+
+// setRateLimiter limits the bytes written per second by flush and
+// compaction of the db. The C options are not exposed by gorocksdb, so
+// they are taken from the unexported field.
+func setRateLimiter(opts *gorocksdb.Options, bytesPerSec int64) {
+	c := unsafe.Pointer(reflect.ValueOf(opts).Elem().FieldByName("c").Pointer())
+	C.auklet_set_ratelimiter((*C.rocksdb_options_t)(c), C.int64_t(bytesPerSec))
+}
+
+// SetTotalOrderSeek makes the iterators of ropt seek and iterate in the
+// order of all the keys, ignoring the prefix extractor. Iterators crossing
+// the /partition/suffix/ prefixes must be created with it, otherwise they
+// may skip keys.
+func SetTotalOrderSeek(ropt *gorocksdb.ReadOptions, value bool) {
+	v := C.uchar(0)
+	if value {
+		v = 1
+	}
+	C.rocksdb_readoptions_set_total_order_seek(
+		(*C.rocksdb_readoptions_t)(ropt.UnsafeGetReadOptions()), v)
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tecbot/gorocksdb"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+func TestParseDBOptions(t *testing.T) {
+	config, err := conf.StringConfig(`
+[object-pack]
+rocksdb_block_cache_size = 1048576
+rocksdb_bloom_bits = 10
+
+[object-pack:1]
+rocksdb_compaction_style = universal
+rocksdb_column_families = true
+rocksdb_prefix_extractor = true
+`)
+	require.Nil(t, err)
+
+	opts, err := parseDBOptions(config, 0)
+	require.Nil(t, err)
+	require.Equal(t, &DBOptions{
+		BlockCacheSize:  1048576,
+		BloomBits:       10,
+		CompactionStyle: gorocksdb.LevelCompactionStyle,
+	}, opts)
+
+	opts, err = parseDBOptions(config, 1)
+	require.Nil(t, err)
+	require.Equal(t, &DBOptions{
+		BlockCacheSize:  1048576,
+		BloomBits:       10,
+		CompactionStyle: gorocksdb.UniversalCompactionStyle,
+		ColumnFamilies:  true,
+		PrefixExtractor: true,
+	}, opts)
+
+	config, err = conf.StringConfig(`
+[object-pack]
+rocksdb_compaction_style = fifo
+`)
+	require.Nil(t, err)
+	_, err = parseDBOptions(config, 0)
+	require.Equal(t, ErrUnknownCompactionStyle, err)
+
+	config, err = conf.StringConfig(`
+[object-pack]
+rocksdb_rate_limit = 10485760
+`)
+	require.Nil(t, err)
+	opts, err = parseDBOptions(config, 0)
+	if !rateLimiterSupported() {
+		require.Equal(t, ErrRateLimiterUnsupported, err)
+		return
+	}
+	require.Nil(t, err)
+	require.Equal(t, int64(10485760), opts.RateLimit)
+
+	// The limiter is taken by the db
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	db, _, err := openMetaDB(root, opts)
+	require.Nil(t, err)
+	db.Close()
+}
+
+func TestColumnFamiliesMigration(t *testing.T) {
+	defer delete(policyDBOptions, PACK_POLICY_INDEX)
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	require.Nil(t, d.cfs)
+
+	partition := "1"
+	objs := populateSuffixes(t, d, partition)
+	hashes := make(map[string]string)
+	for _, suffix := range d.ListSuffixes(partition) {
+		hash, err := d.CalculateSuffixHash(partition, suffix, ONE_WEEK)
+		require.Nil(t, err)
+		hashes[suffix] = hash
+	}
+	d.Close()
+
+	policyDBOptions[PACK_POLICY_INDEX] = &DBOptions{
+		BlockCacheSize:  SIZE_1M,
+		BloomBits:       10,
+		CompactionStyle: gorocksdb.LevelCompactionStyle,
+		ColumnFamilies:  true,
+	}
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	require.NotNil(t, d.cfs)
+	waitIndexMigration(d)
+
+	// No index is left in the default column family
+	prefix := []byte("/" + partition + "/")
+	iter := d.db.NewIterator(d.ropt)
+	iter.Seek(prefix)
+	require.False(t, iter.ValidForPrefix(prefix))
+	iter.Close()
+
+	for suffix, expected := range hashes {
+		hash, err := d.CalculateSuffixHash(partition, suffix, ONE_WEEK)
+		require.Nil(t, err)
+		require.Equal(t, expected, hash)
+	}
+
+	vo := copyVanilla(objs[2])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+
+	// New indexes are written to column families as well
+	obj := newPackObject(SIZE_1K, partition)
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+	v, err := d.db.GetCF(d.ropt, d.cfs[DATA], []byte(filepath.Join(obj.key, string(DATA))))
+	require.Nil(t, err)
+	require.NotNil(t, v.Data())
+	v.Free()
+
+	stats := d.DBStats()
+	require.Equal(t, true, stats["column-families"])
+	require.NotNil(t, stats["estimate-num-keys"])
+	d.Close()
+
+	// Indexes are migrated back if the option is turned off, then the
+	// column families are dropped on next open.
+	delete(policyDBOptions, PACK_POLICY_INDEX)
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	require.NotNil(t, d.cfs)
+	waitIndexMigration(d)
+	require.Equal(t, false, d.DBStats()["column-families"])
+	d.Close()
+
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	require.Nil(t, d.cfs)
+	for _, o := range append(objs, obj) {
+		vo = copyVanilla(o)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+	}
+}
+
+func TestIndexesDuringMigration(t *testing.T) {
+	defer delete(policyDBOptions, PACK_POLICY_INDEX)
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	policyDBOptions[PACK_POLICY_INDEX] = &DBOptions{ColumnFamilies: true}
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	waitIndexMigration(d)
+
+	// Move the indexes of 2 objects back as if they were not migrated yet
+	partition := "1"
+	objs := populateSuffixes(t, d, partition)
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, obj := range objs[:2] {
+		key := []byte(filepath.Join(obj.key, string(DATA)))
+		v, err := d.getCFBytes(d.cfs[DATA], key)
+		require.Nil(t, err)
+		batch.Put(key, v)
+		batch.DeleteCF(d.cfs[DATA], key)
+	}
+	require.Nil(t, d.db.Write(d.wopt, batch))
+	atomic.StoreInt32(&d.migrating, 1)
+
+	// Indexes not migrated yet are found, and those overridden meanwhile
+	// are not migrated later.
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+	vo.Close()
+
+	vo = copyVanilla(objs[1])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+	vo.Close()
+
+	require.Nil(t, d.migrateIndexes())
+	require.False(t, d.isMigrating())
+	for i, obj := range objs[:2] {
+		key := []byte(filepath.Join(obj.key, string(DATA)))
+		v, err := d.db.GetBytes(d.ropt, key)
+		require.Nil(t, err)
+		require.Nil(t, v)
+
+		vo = copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.Equal(t, i == 0, vo.exists)
+		vo.Close()
+	}
+}
+
+func TestSuffixPrefixTransform(t *testing.T) {
+	var tr suffixPrefixTransform
+	require.Equal(t, []byte("/12/abc/"), tr.Transform([]byte("/12/abc/0123/data")))
+	require.True(t, tr.InDomain([]byte("/12/abc/0123/data")))
+	require.True(t, tr.InRange([]byte("/12/abc/")))
+	require.False(t, tr.InDomain([]byte("/12/")))
+	require.False(t, tr.InDomain([]byte("/.suffixes/12/abc")))
+	require.False(t, tr.InRange([]byte("/12/abc/0123/data")))
+}
+
+func TestPrefixExtractorScans(t *testing.T) {
+	defer delete(policyDBOptions, PACK_POLICY_INDEX)
+	policyDBOptions[PACK_POLICY_INDEX] = &DBOptions{
+		BloomBits:       10,
+		CompactionStyle: gorocksdb.LevelCompactionStyle,
+		PrefixExtractor: true,
+	}
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	populateSuffixes(t, d, partition)
+	fopt := gorocksdb.NewDefaultFlushOptions()
+	defer fopt.Destroy()
+	require.Nil(t, d.db.Flush(fopt))
+
+	// Scans of the partition go across the suffixes
+	var keys int
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		keys++
+	}
+	iter.Close()
+	require.Equal(t, 9, keys)
+
+	suffixes := d.ListSuffixes(partition)
+	require.NotEmpty(t, suffixes)
+	var suffixKeys int
+	for _, suffix := range suffixes {
+		prefix := []byte(fmt.Sprintf("/%s/%s/", partition, suffix))
+		iter := d.newSuffixIterator()
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			suffixKeys++
+		}
+		iter.Close()
+	}
+	require.Equal(t, keys, suffixKeys)
+}
+
+func waitIndexMigration(d *PackDevice) {
+	for d.isMigrating() {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+)
+
+// Dedup mode of each pack policy, configured by the option `dedup` in the
+// policy section of swift.conf
+var policyDedups = make(map[int]bool)
+
+const dedupStripes = 256
+
+// In dedup mode, the data needle of a SO is shared by all the objects of
+// the partition with identical data. The record of a shared needle is
+// keyed by the SHA-256 of the data and counts the db indexes referring to
+// it. Those indexes carry the digest, so that the needle is punched only
+// when the last of them is gone.
+func dedupRecordKey(partition, digest string) []byte {
+	return []byte(fmt.Sprintf("/.dedup/%s/%s", partition, digest))
+}
+
+func dedupPrefix(partition string) []byte {
+	return []byte(fmt.Sprintf("/.dedup/%s/", partition))
+}
+
+func dedupStripe(partition, digest string) int {
+	h := fnv.New32a()
+	io.WriteString(h, partition)
+	io.WriteString(h, digest)
+	return int(h.Sum32() % dedupStripes)
+}
+
+func contentDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isSameNeedle(a, b *NeedleIndex) bool {
+	return a != nil && b != nil && a.Segment == b.Segment && a.Offset == b.Offset
+}
+
+// Stripes are always locked in ascending order. All the stripes are locked
+// if stripes is nil. A stripe is kept locked from the lookup of a record
+// to the write of the indexes referring to it.
+func (d *PackDevice) lockDedupStripes(stripes map[int]bool) func() {
+	var locked []int
+	for i := 0; i < dedupStripes; i++ {
+		if stripes == nil || stripes[i] {
+			d.dmu[i].Lock()
+			locked = append(locked, i)
+		}
+	}
+
+	return func() {
+		for _, i := range locked {
+			d.dmu[i].Unlock()
+		}
+	}
+}
+
+func (d *PackDevice) lockDedupStripe(partition, digest string) func() {
+	return d.lockDedupStripes(map[int]bool{dedupStripe(partition, digest): true})
+}
+
+// nil is returned if the record is not found
+func (d *PackDevice) getDedupRecord(partition, digest string) (*DedupRecord, error) {
+	b, err := d.db.GetBytes(d.ropt, dedupRecordKey(partition, digest))
+	if err != nil {
+		glogger.Error("unable to retrieve dedup record",
+			zap.String("partition", partition),
+			zap.String("digest", digest),
+			zap.Error(err))
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	r := new(DedupRecord)
+	if err = proto.Unmarshal(b, r); err != nil || r.Index == nil {
+		glogger.Error("unable to unmarshal dedup record",
+			zap.String("partition", partition),
+			zap.String("digest", digest),
+			zap.Error(err))
+		return nil, ErrDBIndexCorrupted
+	}
+
+	return r, nil
+}
+
+func putDedupRecord(batch *gorocksdb.WriteBatch,
+	partition, digest string, r *DedupRecord) error {
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	batch.Put(dedupRecordKey(partition, digest), b)
+	return nil
+}
+
+// commitShared saves the data index of obj as one more reference to the
+// needle of the record, instead of appending a needle of its own. The
+// stripe of the digest must be locked.
+func (d *PackDevice) commitShared(batch *gorocksdb.WriteBatch,
+	obj *PackObject, digest string, r *DedupRecord) error {
+	obj.dataIndex = proto.Clone(r.Index).(*NeedleIndex)
+	r.Refs++
+
+	err := d.saveDBIndex(batch, obj, DATA)
+	if err == nil {
+		err = putDedupRecord(batch, obj.partition, digest, r)
+	}
+	if err == nil {
+		err = d.writeDBIndexes(batch)
+	}
+	if err != nil {
+		glogger.Error("unable to save shared needle index",
+			zap.String("object", obj.name),
+			zap.String("digest", digest),
+			zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// releaseShared appends the drop of a reference to the shared needle of idx
+// to the batch, so that it is written together with the index change of
+// the referring object. The record is deleted along with the last
+// reference, in which case true is returned and the needle is to be punched
+// once the batch is written. The stripe of the digest must be locked until
+// then.
+func (d *PackDevice) releaseShared(batch *gorocksdb.WriteBatch,
+	partition string, idx *NeedleIndex) (bool, error) {
+	r, err := d.getDedupRecord(partition, idx.Digest)
+	if err != nil {
+		return false, err
+	}
+	// Records without any referring index are dropped by compaction
+	if r == nil {
+		glogger.Info("dedup record not found",
+			zap.String("partition", partition),
+			zap.String("digest", idx.Digest))
+		return false, nil
+	}
+
+	if r.Refs > 1 {
+		r.Refs--
+		return false, putDedupRecord(batch, partition, idx.Digest, r)
+	}
+
+	batch.Delete(dedupRecordKey(partition, idx.Digest))
+	return true, nil
+}
+
+// releaseStale releases the shared data needle of the stale copy of an
+// overridden or deleted object in the batch. If it was the last reference,
+// the digest is cleared from the stale data index so that the needle is
+// punched by deallocateSO.
+func (d *PackDevice) releaseStale(
+	batch *gorocksdb.WriteBatch, stale *PackObject) error {
+	if sharedDigest(stale) == "" {
+		return nil
+	}
+
+	last, err := d.releaseShared(batch, stale.partition, stale.dataIndex)
+	if err != nil {
+		glogger.Error("unable to release shared needle",
+			zap.String("object", stale.name),
+			zap.String("partition", stale.partition),
+			zap.Error(err))
+		return err
+	}
+	if last {
+		stale.dataIndex = unsharedIndex(stale.dataIndex)
+	}
+
+	return nil
+}
+
+// Returns the digest of the shared data needle of the small object, or an
+// empty string if the data needle is not shared.
+func sharedDigest(obj *PackObject) string {
+	if obj == nil || !obj.small {
+		return ""
+	}
+
+	return obj.dataIndex.GetDigest()
+}
+
+// Returns a copy of the index without the digest. The index may be shared
+// with the object it was copied from, so it is never changed in place.
+func unsharedIndex(idx *NeedleIndex) *NeedleIndex {
+	c := proto.Clone(idx).(*NeedleIndex)
+	c.Digest = ""
+	return c
+}
+
+// poisonNeedle marks the shared needle as corrupted, so that new objects
+// no longer refer to it. The needle itself is kept until the objects
+// referring to it are all quarantined or overridden.
+func (d *PackDevice) poisonNeedle(partition string, idx *NeedleIndex) error {
+	unlock := d.lockDedupStripe(partition, idx.Digest)
+	defer unlock()
+
+	r, err := d.getDedupRecord(partition, idx.Digest)
+	if err != nil || r == nil || r.Corrupted || !isSameNeedle(r.Index, idx) {
+		return err
+	}
+
+	r.Corrupted = true
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return d.db.Put(d.wopt, dedupRecordKey(partition, idx.Digest), b)
+}
+
+// relocateDedupRecords appends the records of the needles moved by the
+// compaction of the segment to the batch. Records of needles no longer
+// referred to by any index are deleted.
+func (d *PackDevice) relocateDedupRecords(batch *gorocksdb.WriteBatch,
+	partition string, id int32, moved map[int64]*NeedleIndex,
+	referenced map[int64]bool) error {
+	prefix := dedupPrefix(partition)
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := iter.Key().Data()
+		r := new(DedupRecord)
+		if err := proto.Unmarshal(iter.Value().Data(), r); err != nil {
+			glogger.Error("unable to unmarshal dedup record",
+				zap.String("key", string(key)), zap.Error(err))
+			return ErrDBIndexCorrupted
+		}
+		if r.Index == nil || r.Index.Segment != id {
+			continue
+		}
+
+		if !referenced[r.Index.Offset] {
+			batch.Delete(key)
+			continue
+		}
+
+		r.Index = moved[r.Index.Offset]
+		b, err := proto.Marshal(r)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, b)
+	}
+
+	return iter.Err()
+}
+
+// Appends the deletions of all the dedup records of the partition to the
+// batch.
+func (d *PackDevice) clearDedupRecords(batch *gorocksdb.WriteBatch, partition string) {
+	prefix := dedupPrefix(partition)
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		batch.Delete(iter.Key().Data())
+	}
+}
+
+// Returns the locations of the needles of the partition which are still
+// recorded as shared.
+func (d *PackDevice) sharedNeedles(partition string) (map[needleLocation]bool, error) {
+	shared := make(map[needleLocation]bool)
+	prefix := dedupPrefix(partition)
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		r := new(DedupRecord)
+		if err := proto.Unmarshal(iter.Value().Data(), r); err != nil {
+			glogger.Error("unable to unmarshal dedup record",
+				zap.String("key", string(iter.Key().Data())), zap.Error(err))
+			return nil, ErrDBIndexCorrupted
+		}
+		if r.Index != nil {
+			shared[needleLocation{r.Index.Segment, r.Index.Offset}] = true
+		}
+	}
+
+	return shared, iter.Err()
+}
+
+// rebuildDedupRecords appends the records counted from the rebuilt data
+// indexes of the partition to the batch. Only records which differ from
+// the existing ones are written.
+func (d *PackDevice) rebuildDedupRecords(batch *gorocksdb.WriteBatch,
+	partition string, indexes []*DBIndex) error {
+	records := make(map[string]*DedupRecord)
+	for _, dbIndex := range indexes {
+		idx := dbIndex.Index
+		if idx.GetDigest() == "" {
+			continue
+		}
+		r, ok := records[idx.Digest]
+		if !ok {
+			r = &DedupRecord{Index: idx}
+			records[idx.Digest] = r
+		}
+		r.Refs++
+	}
+
+	prefix := dedupPrefix(partition)
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		digest := key[len(prefix):]
+		old := new(DedupRecord)
+		if err := proto.Unmarshal(iter.Value().Data(), old); err != nil {
+			old = nil
+		}
+
+		r, ok := records[digest]
+		if !ok {
+			batch.Delete([]byte(key))
+			continue
+		}
+		if old != nil && isSameNeedle(old.Index, r.Index) {
+			r.Corrupted = old.Corrupted
+			if r.Refs == old.Refs {
+				delete(records, digest)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for digest, r := range records {
+		if err := putDedupRecord(batch, partition, digest, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
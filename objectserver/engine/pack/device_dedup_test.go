@@ -0,0 +1,327 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"github.com/tecbot/gorocksdb"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+// Commits small objects of the partition with the given data
+func commitDedupObjects(t *testing.T, d *PackDevice,
+	partition string, data []byte, n int) []*PackObject {
+	var objs []*PackObject
+	for i := 0; i < n; i++ {
+		obj := newPackObject(int64(len(data)), partition)
+		obj.meta.SystemMeta[common.HEtag] = bytesMd5(data)
+		obj.meta.SystemMeta[common.HContentLength] = strconv.Itoa(len(data))
+		w, err := d.newSOWriter(obj)
+		require.Nil(t, err)
+		obj.writer = w
+		_, err = w.Write(data)
+		require.Nil(t, err)
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+
+	return objs
+}
+
+// Overrides the object with the given data
+func overrideDedupObject(t *testing.T, d *PackDevice,
+	obj *PackObject, data []byte) (*PackObject, error) {
+	no := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(no))
+	defer no.Close()
+	fresh := newPackObject(int64(len(data)), obj.partition)
+	no.small, no.dataSize, no.meta = fresh.small, fresh.dataSize, fresh.meta
+	no.meta.Name = obj.name
+	no.meta.Timestamp = incSeconds(obj.meta.Timestamp, 2)
+	no.meta.SystemMeta[common.HEtag] = bytesMd5(data)
+	no.meta.SystemMeta[common.HContentLength] = strconv.Itoa(len(data))
+	w, err := d.newSOWriter(no)
+	require.Nil(t, err)
+	no.writer = w
+	_, err = w.Write(data)
+	require.Nil(t, err)
+
+	return no, d.CommitWrite(no)
+}
+
+func loadDataIndex(t *testing.T, d *PackDevice, obj *PackObject) *NeedleIndex {
+	dbIndex, err := d.getDBIndex(obj.key, DATA)
+	require.Nil(t, err)
+	require.NotNil(t, dbIndex)
+	return dbIndex.Index
+}
+
+// Returns true if the needle has been punched
+func isNeedlePunched(t *testing.T, d *PackDevice,
+	partition string, idx *NeedleIndex) bool {
+	set, err := d.getBundle(partition)
+	require.Nil(t, err)
+	bundle, err := set.segment(idx.Segment)
+	require.Nil(t, err)
+
+	needle := make([]byte, idx.Size)
+	_, err = bundle.ReadAt(needle, idx.Offset)
+	require.Nil(t, err)
+	return bytes.Equal(make([]byte, idx.Size), needle)
+}
+
+func TestDedupObjects(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.dedup = true
+
+	partition := "1"
+	data := generateData(SIZE_1K * 8)
+	digest := contentDigest(data)
+	objs := commitDedupObjects(t, d, partition, data, 3)
+
+	idx := loadDataIndex(t, d, objs[0])
+	require.Equal(t, digest, idx.Digest)
+	for _, obj := range objs[1:] {
+		require.True(t, proto.Equal(idx, loadDataIndex(t, d, obj)))
+	}
+	r, err := d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), r.Refs)
+	require.True(t, proto.Equal(idx, r.Index))
+	requireObjects(t, d, objs)
+
+	// Objects with other data have needles of their own
+	other := commitDedupObjects(t, d, partition, generateData(SIZE_1K*8), 1)
+	oIdx := loadDataIndex(t, d, other[0])
+	require.NotEqual(t, idx.Offset, oIdx.Offset)
+	require.NotEqual(t, digest, oIdx.Digest)
+
+	// The needle is kept until the last reference is dropped
+	deleteObject(t, d, objs[0], time.Now())
+	nobj, err := overrideDedupObject(t, d, objs[1], generateData(SIZE_1K*4))
+	require.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	r, err = d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), r.Refs)
+	require.False(t, isNeedlePunched(t, d, partition, idx))
+	requireObjects(t, d, []*PackObject{objs[2], nobj})
+
+	deleteObject(t, d, objs[2], time.Now())
+	r, err = d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Nil(t, r)
+	require.True(t, isNeedlePunched(t, d, partition, idx))
+
+	// The data is saved in a new needle afterwards
+	objs = commitDedupObjects(t, d, partition, data, 1)
+	nIdx := loadDataIndex(t, d, objs[0])
+	require.Equal(t, digest, nIdx.Digest)
+	require.NotEqual(t, idx.Offset, nIdx.Offset)
+	requireObjects(t, d, objs)
+}
+
+func TestDedupCompaction(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.dedup = true
+
+	partition := "1"
+	garbage := commitDedupObjects(t, d, partition, generateData(SIZE_1K*8), 1)
+	data := generateData(SIZE_1K * 8)
+	digest := contentDigest(data)
+	objs := commitDedupObjects(t, d, partition, data, 2)
+	deleteObject(t, d, garbage[0], time.Now())
+
+	// A record no longer referred to by any index
+	stale := commitDedupObjects(t, d, partition, generateData(SIZE_1K*8), 1)
+	sDigest := loadDataIndex(t, d, stale[0]).Digest
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	d.clearDataDBIndex(batch, stale[0])
+	require.Nil(t, d.writeDBIndexes(batch))
+
+	old := loadDataIndex(t, d, objs[0])
+	stat, err := d.CompactPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), stat.Needles)
+
+	idx := loadDataIndex(t, d, objs[0])
+	require.NotEqual(t, old.Offset, idx.Offset)
+	require.True(t, proto.Equal(idx, loadDataIndex(t, d, objs[1])))
+	r, err := d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), r.Refs)
+	require.True(t, proto.Equal(idx, r.Index))
+	requireObjects(t, d, objs)
+
+	r, err = d.getDedupRecord(partition, sDigest)
+	require.Nil(t, err)
+	require.Nil(t, r)
+
+	// The relocated needle is punched once all references are dropped
+	deleteObject(t, d, objs[0], time.Now())
+	require.False(t, isNeedlePunched(t, d, partition, idx))
+	deleteObject(t, d, objs[1], time.Now())
+	require.True(t, isNeedlePunched(t, d, partition, idx))
+}
+
+func TestDedupQuarantine(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.dedup = true
+
+	partition := "1"
+	data := generateData(SIZE_1K * 8)
+	digest := contentDigest(data)
+	objs := commitDedupObjects(t, d, partition, data, 2)
+	idx := loadDataIndex(t, d, objs[0])
+
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.Nil(t, d.QuarantineObject(vo))
+
+	// The other object still refers to the needle
+	r, err := d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.True(t, r.Corrupted)
+	require.Equal(t, int64(1), r.Refs)
+	require.False(t, isNeedlePunched(t, d, partition, idx))
+
+	// New objects don't refer to the corrupted needle
+	nobjs := commitDedupObjects(t, d, partition, data, 1)
+	nIdx := loadDataIndex(t, d, nobjs[0])
+	require.Empty(t, nIdx.Digest)
+	require.NotEqual(t, idx.Offset, nIdx.Offset)
+
+	vo = copyVanilla(objs[1])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.Nil(t, d.QuarantineObject(vo))
+	r, err = d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Nil(t, r)
+	require.True(t, isNeedlePunched(t, d, partition, idx))
+	requireObjects(t, d, nobjs)
+}
+
+func TestDedupReleaseCrash(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.dedup = true
+
+	partition := "1"
+	data := generateData(SIZE_1K * 8)
+	digest := contentDigest(data)
+	objs := commitDedupObjects(t, d, partition, data, 2)
+	idx := loadDataIndex(t, d, objs[0])
+
+	// No reference is dropped unless the indexes are written
+	restore := injectIndexWriteCrash()
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = incSeconds(objs[0].meta.Timestamp, 2)
+	require.Equal(t, errInjectedCrash, d.CommitDeletion(vo))
+	vo.Close()
+	_, err = overrideDedupObject(t, d, objs[1], generateData(SIZE_1K*4))
+	require.Equal(t, errInjectedCrash, err)
+	restore()
+
+	r, err := d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), r.Refs)
+	requireObjects(t, d, objs)
+
+	// Overriding with the same data keeps referring to the needle
+	nobj, err := overrideDedupObject(t, d, objs[1], data)
+	require.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+	r, err = d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), r.Refs)
+	require.True(t, proto.Equal(idx, loadDataIndex(t, d, nobj)))
+	require.False(t, isNeedlePunched(t, d, partition, idx))
+
+	deleteObject(t, d, objs[0], time.Now())
+	r, err = d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), r.Refs)
+	require.False(t, isNeedlePunched(t, d, partition, idx))
+	requireObjects(t, d, []*PackObject{nobj})
+}
+
+func TestDedupRebuildIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.dedup = true
+
+	partition := "1"
+	data := generateData(SIZE_1K * 8)
+	digest := contentDigest(data)
+	objs := commitDedupObjects(t, d, partition, data, 3)
+
+	stat, err := d.RebuildIndex([]string{partition}, false)
+	require.Nil(t, err)
+	require.Empty(t, stat.Diffs)
+	requireObjects(t, d, objs)
+
+	// The object which appended the needle is not brought back after its
+	// tombstone is gone
+	deleteObject(t, d, objs[0], time.Now())
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	d.clearTombstoneDBIndex(batch, objs[0])
+	require.Nil(t, d.writeDBIndexes(batch))
+	require.Nil(t, d.db.Delete(d.wopt, dedupRecordKey(partition, digest)))
+
+	stat, err = d.RebuildIndex([]string{partition}, false)
+	require.Nil(t, err)
+	require.Empty(t, stat.Diffs)
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+	requireObjects(t, d, objs[1:])
+
+	// The lost record is counted again
+	r, err := d.getDedupRecord(partition, digest)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), r.Refs)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+)
+
+// Sent to a queued needle to make its committer the leader of next group
+var errGroupLeader = errors.New("promoted to group leader")
+
+// Small objects of a bundle committed concurrently are queued and flushed
+// in groups. The committer arriving at an idle queue becomes the leader. It
+// waits for the window or until the group is full, then appends all the
+// queued needles with one fdatasync and one db write on behalf of the
+// others.
+type groupCommitter struct {
+	sync.Mutex
+	queue   []*pendingNeedle
+	leading bool
+	full    chan bool
+}
+
+func newGroupCommitter() *groupCommitter {
+	return &groupCommitter{full: make(chan bool, 1)}
+}
+
+func mergeWriteBatch(dst, src *gorocksdb.WriteBatch) error {
+	iter := src.NewIterator()
+	for iter.Next() {
+		r := iter.Record()
+		switch r.Type {
+		case gorocksdb.WriteBatchRecordTypeValue:
+			dst.Put(r.Key, r.Value)
+		case gorocksdb.WriteBatchRecordTypeDeletion:
+			dst.Delete(r.Key)
+		default:
+			return ErrUnknownBatchRecord
+		}
+	}
+
+	return iter.Error()
+}
+
+// groupCommit returns only after the needle is flushed and indexed, either
+// by the caller itself as the leader, or by the leader of its group.
+func (d *PackDevice) groupCommit(bundle *BundleSet, n *pendingNeedle) error {
+	g := bundle.group
+	size := int(gconf.GroupCommitSize)
+	if size <= 0 {
+		size = 1
+	}
+	n.done = make(chan error, 1)
+
+	g.Lock()
+	g.queue = append(g.queue, n)
+	if g.leading {
+		if len(g.queue) >= size {
+			select {
+			case g.full <- true:
+			default:
+			}
+		}
+		g.Unlock()
+
+		// Needles queued during the flush of previous group are flushed
+		// immediately by the promoted leader.
+		if err := <-n.done; err != errGroupLeader {
+			return err
+		}
+	} else {
+		g.leading = true
+		g.Unlock()
+
+		timer := time.NewTimer(time.Duration(gconf.GroupCommitWindow) * time.Microsecond)
+		select {
+		case <-timer.C:
+		case <-g.full:
+		}
+		timer.Stop()
+	}
+
+	g.Lock()
+	if size > len(g.queue) {
+		size = len(g.queue)
+	}
+	group := g.queue[:size]
+	g.queue = append([]*pendingNeedle(nil), g.queue[size:]...)
+	select {
+	case <-g.full:
+	default:
+	}
+	g.Unlock()
+
+	err := d.appendNeedles(bundle, group...)
+	for _, p := range group {
+		if p != n {
+			p.done <- err
+		}
+	}
+
+	g.Lock()
+	if len(g.queue) > 0 {
+		g.queue[0].done <- errGroupLeader
+	} else {
+		g.leading = false
+	}
+	g.Unlock()
+
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tecbot/gorocksdb"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+func enableGroupCommit(window, size int64) func() {
+	origin := *gconf
+	gconf.GroupCommitWindow = window
+	gconf.GroupCommitSize = size
+	return func() { *gconf = origin }
+}
+
+func commitConcurrently(t *testing.T, d *PackDevice, objs []*PackObject) []error {
+	for _, obj := range objs {
+		require.Nil(t, feedObject(obj, d))
+	}
+
+	errs := make([]error, len(objs))
+	wg := &sync.WaitGroup{}
+	for i := range objs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = d.CommitWrite(objs[i])
+			objs[i].Close()
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestGroupCommit(t *testing.T) {
+	defer enableGroupCommit(10000, 8)()
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 20; i++ {
+		objs = append(objs, newPackObject(SIZE_1K, partition))
+	}
+	for _, err := range commitConcurrently(t, d, objs) {
+		require.Nil(t, err)
+	}
+
+	bundle, err := d.getBundle(partition)
+	require.Nil(t, err)
+	require.NotNil(t, bundle.group)
+	require.Empty(t, bundle.group.queue)
+	require.False(t, bundle.group.leading)
+
+	var size int64
+	for _, obj := range objs {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+		size += vo.dataIndex.Size
+
+		r, err := d.NewReader(vo)
+		require.Nil(t, err)
+		hash := md5.New()
+		io.Copy(hash, r)
+		require.Equal(t, obj.meta.SystemMeta[common.HEtag],
+			hex.EncodeToString(hash.Sum(nil)))
+	}
+	require.Equal(t, size+SuperBlockDiskSize, bundle.BundleSize())
+}
+
+func TestGroupCommitFailure(t *testing.T) {
+	defer enableGroupCommit(10000, 4)()
+	defer injectIndexWriteCrash()()
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 10; i++ {
+		objs = append(objs, newPackObject(SIZE_1K, partition))
+	}
+	for _, err := range commitConcurrently(t, d, objs) {
+		require.Equal(t, errInjectedCrash, err)
+	}
+
+	bundle, err := d.getBundle(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(SuperBlockDiskSize), bundle.BundleSize())
+
+	for _, obj := range objs {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.False(t, vo.exists)
+	}
+}
+
+func TestMergeWriteBatch(t *testing.T) {
+	src := gorocksdb.NewWriteBatch()
+	defer src.Destroy()
+	src.Put([]byte("a"), []byte("1"))
+	src.Delete([]byte("b"))
+
+	dst := gorocksdb.NewWriteBatch()
+	defer dst.Destroy()
+	dst.Put([]byte("c"), []byte("2"))
+	require.Nil(t, mergeWriteBatch(dst, src))
+	require.Equal(t, 3, dst.Count())
+
+	iter := dst.NewIterator()
+	var records []gorocksdb.WriteBatchRecord
+	for iter.Next() {
+		records = append(records, *iter.Record())
+	}
+	require.Len(t, records, 3)
+	require.Equal(t, "a", string(records[1].Key))
+	require.Equal(t, "1", string(records[1].Value))
+	require.Equal(t, gorocksdb.WriteBatchRecordTypeDeletion, records[2].Type)
+	require.Equal(t, "b", string(records[2].Key))
+}
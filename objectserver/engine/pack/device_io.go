@@ -22,8 +22,10 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"syscall"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
 
 	"github.com/iqiyi/auklet/common"
@@ -38,7 +40,8 @@ const (
 	TOMBSTONE PartType = "ts"
 )
 
-// File above 4M will be save as standalone file
+// File above the needle threshold, 4M by default, will be save as
+// standalone file
 const (
 	NEEDLE_THRESHOLD = 4 * 1024 * 1024
 	RECLAIM_AGE      = 60 * 60 * 24 * 7
@@ -51,6 +54,12 @@ type dataReader struct {
 	*io.SectionReader
 
 	fd *os.File // underlying file
+
+	// Bundle of the SO, which is not set if the data is read into memory
+	bundle *Bundle
+	base   int64 // offset of the data in the file
+	// The underlying file is encrypted, so it can't be sent as it is
+	sealed bool
 }
 
 func (r *dataReader) Close() error {
@@ -61,15 +70,142 @@ func (r *dataReader) Close() error {
 	return nil
 }
 
+// WriteTo is used by io.Copy. If the writer is able to read from a file
+// directly, e.g. TCP connection, the rest of data is passed to it as a
+// file so that it could be sent by sendfile/splice without being copied to
+// user space.
+func (r *dataReader) WriteTo(w io.Writer) (int64, error) {
+	_, ok := w.(io.ReaderFrom)
+	if !ok || r.sealed || (r.fd == nil && r.bundle == nil) {
+		return io.Copy(w, r.SectionReader)
+	}
+
+	f := r.fd
+	if r.bundle != nil {
+		// The offset of the bundle file is used for appending needles, so
+		// the data has to be sent from another open file description.
+		var err error
+		if f, err = r.bundle.Reopen(); err != nil {
+			glogger.Error("unable to reopen bundle",
+				zap.String("partition", r.bundle.partition), zap.Error(err))
+			return 0, err
+		}
+		defer f.Close()
+	}
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Seek(r.base+pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, &io.LimitedReader{R: f, N: r.Size() - pos})
+	r.Seek(pos+n, io.SeekStart)
+	return n, err
+}
+
 func (d *PackDevice) newSORangeReader(
 	obj *PackObject, offset, size int64) (*dataReader, error) {
-	bundle, err := d.getBundle(obj.partition)
+	set, err := d.pinnedBundle(obj)
 	if err != nil {
 		return nil, err
 	}
 
-	off := obj.dataIndex.DataOffset + offset
-	return &dataReader{io.NewSectionReader(bundle, off, size), nil}, nil
+	idx := obj.dataIndex
+	if needle := d.cache.needle(obj.key, idx); needle != nil {
+		return d.newNeedleDataReader(obj, needle, offset, size)
+	}
+
+	bundle, err := set.segment(idx.Segment)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksum covers the whole needle, so it can't be verified while the
+	// data is sent by sendfile. Unless skip_needle_checksum is set, small
+	// objects in bundles with checksums are served from memory.
+	verify := bundle.hasChecksum() && !gconf.SkipNeedleChecksum
+	if !verify && !isCompressed(idx) && !isEncrypted(idx) && d.cache == nil {
+		off := idx.DataOffset + offset
+		return &dataReader{
+			SectionReader: io.NewSectionReader(bundle, off, size),
+			bundle:        bundle,
+			base:          off,
+		}, nil
+	}
+
+	// The whole needle has to be read for checksum verification, caching,
+	// decryption or decompression. This is acceptable because the size of a
+	// SO is limited by the needle threshold.
+	end := idx.MetaOffset + int64(idx.MetaSize) - idx.Offset
+	if end < int64(bundle.needleHeaderSize()) || end > idx.Size {
+		glogger.Error("needle index is corrupted",
+			zap.String("object", obj.name),
+			zap.String("partition", obj.partition))
+		return nil, ErrNeedleCorrupted
+	}
+
+	needle := make([]byte, end)
+	if _, err = bundle.ReadAt(needle, idx.Offset); err != nil {
+		glogger.Error("unable to read needle",
+			zap.String("object", obj.name),
+			zap.String("partition", obj.partition),
+			zap.Error(err))
+		return nil, err
+	}
+
+	if verify {
+		if err = bundle.verifyNeedle(needle); err != nil {
+			glogger.Error("unable to verify needle",
+				zap.String("object", obj.name),
+				zap.String("partition", obj.partition),
+				zap.Int64("offset", idx.Offset),
+				zap.Error(err))
+			return nil, err
+		}
+	}
+	d.cache.setNeedle(obj.key, idx, needle)
+
+	return d.newNeedleDataReader(obj, needle, offset, size)
+}
+
+// Serves the range of object data from the needle read into memory.
+func (d *PackDevice) newNeedleDataReader(
+	obj *PackObject, needle []byte, offset, size int64) (*dataReader, error) {
+	idx := obj.dataIndex
+	start, end := idx.DataOffset-idx.Offset, idx.MetaOffset-idx.Offset
+	if start < 0 || start > end || end > int64(len(needle)) {
+		glogger.Error("needle index is corrupted",
+			zap.String("object", obj.name),
+			zap.String("partition", obj.partition))
+		return nil, ErrNeedleCorrupted
+	}
+
+	data, err := d.keyring.openPart(idx.Flags, needle[start:end], needleDataAD)
+	if err != nil {
+		glogger.Error("unable to decrypt needle",
+			zap.String("object", obj.name),
+			zap.String("partition", obj.partition),
+			zap.Int64("offset", idx.Offset),
+			zap.Error(err))
+		return nil, err
+	}
+
+	data, err = decompressData(idx, data)
+	if err != nil {
+		glogger.Error("unable to decompress needle",
+			zap.String("object", obj.name),
+			zap.String("partition", obj.partition),
+			zap.Int64("offset", idx.Offset),
+			zap.Error(err))
+		return nil, err
+	}
+
+	return &dataReader{
+		SectionReader: io.NewSectionReader(bytes.NewReader(data), offset, size),
+	}, nil
 }
 
 func (d *PackDevice) newLORangeReader(
@@ -84,11 +220,49 @@ func (d *PackDevice) newLORangeReader(
 		return nil, err
 	}
 
-	return &dataReader{io.NewSectionReader(f, offset, size), f}, nil
+	id, sealed, err := loKeyID(f.Fd())
+	if err != nil {
+		glogger.Error("unable to read encryption key id",
+			zap.String("object", obj.name),
+			zap.String("path", dp),
+			zap.Error(err))
+		f.Close()
+		return nil, err
+	}
+	if !sealed {
+		return &dataReader{
+			SectionReader: io.NewSectionReader(f, offset, size),
+			fd:            f,
+			base:          offset,
+		}, nil
+	}
+
+	// Only the chunks covering the range are decrypted
+	fi, err := f.Stat()
+	var opener *chunkOpener
+	if err == nil {
+		opener, err = newChunkOpener(f, fi.Size(), d.keyring, id)
+	}
+	if err != nil {
+		glogger.Error("unable to open encrypted large object",
+			zap.String("object", obj.name),
+			zap.String("path", dp),
+			zap.Uint32("key-id", id),
+			zap.Error(err))
+		f.Close()
+		return nil, err
+	}
+
+	return &dataReader{
+		SectionReader: io.NewSectionReader(opener, offset, size),
+		fd:            f,
+		base:          offset,
+		sealed:        true,
+	}, nil
 }
 
 func (d *PackDevice) getDBIndex(key string, ot PartType) (*DBIndex, error) {
-	b, err := d.db.GetBytes(d.ropt, []byte(filepath.Join(key, string(ot))))
+	b, err := d.getIndexBytes([]byte(filepath.Join(key, string(ot))))
 	if err != nil {
 		glogger.Error("unable to retrieve db index",
 			zap.String("object-key", key),
@@ -135,6 +309,17 @@ func (d *PackDevice) loadObjDBIndexes(obj *PackObject) (dataDBIndex,
 // ********************
 type dataWriter struct {
 	io.Writer
+
+	// Encrypts the data of LO before it is written to the file
+	sealer *chunkSealer
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if w.sealer != nil {
+		return w.sealer.Write(p)
+	}
+
+	return w.Writer.Write(p)
 }
 
 func (w *dataWriter) Close() error {
@@ -146,9 +331,11 @@ func (w *dataWriter) Close() error {
 }
 
 func (d *PackDevice) newSOWriter(obj *PackObject) (*dataWriter, error) {
-	bufSize := CalculateBufferSize(NeedleHeaderSize, obj.dataSize)
-	buf := make([]byte, NeedleHeaderSize, bufSize)
-	return &dataWriter{bytes.NewBuffer(buf)}, nil
+	// Reserve space for the largest needle header because the version of
+	// the bundle is unknown until the object is committed.
+	bufSize := CalculateBufferSize(NeedleHeaderSizeV2, obj.dataSize)
+	buf := make([]byte, NeedleHeaderSizeV2, bufSize)
+	return &dataWriter{Writer: bytes.NewBuffer(buf)}, nil
 }
 
 func (d *PackDevice) newLOWriter(obj *PackObject) (*dataWriter, error) {
@@ -158,65 +345,56 @@ func (d *PackDevice) newLOWriter(obj *PackObject) (*dataWriter, error) {
 	if err != nil {
 		glogger.Error("unable to create AtomicFileWriter",
 			zap.String("name", obj.name))
+		return &dataWriter{Writer: w}, err
+	}
+
+	dw := &dataWriter{Writer: w}
+	if d.keyring != nil {
+		dw.sealer = newChunkSealer(w, d.keyring)
 	}
 
-	return &dataWriter{w}, err
+	return dw, nil
 }
 
-func (d *PackDevice) clearDataDBIndex(obj *PackObject) error {
+func (d *PackDevice) clearDataDBIndex(
+	batch *gorocksdb.WriteBatch, obj *PackObject) {
 	dKey := filepath.Join(obj.key, string(DATA))
-	return d.db.Delete(d.wopt, []byte(dKey))
+	batch.Delete([]byte(dKey))
 }
 
-func (d *PackDevice) clearMetaDBIndex(obj *PackObject) error {
+func (d *PackDevice) clearMetaDBIndex(
+	batch *gorocksdb.WriteBatch, obj *PackObject) {
 	mKey := filepath.Join(obj.key, string(META))
-	return d.db.Delete(d.wopt, []byte(mKey))
+	batch.Delete([]byte(mKey))
 }
 
-func (d *PackDevice) clearTombstoneDBIndex(obj *PackObject) error {
+func (d *PackDevice) clearTombstoneDBIndex(
+	batch *gorocksdb.WriteBatch, obj *PackObject) {
 	tsKey := filepath.Join(obj.key, string(TOMBSTONE))
-	return d.db.Delete(d.wopt, []byte(tsKey))
+	batch.Delete([]byte(tsKey))
 }
 
-func (d *PackDevice) clearStaleDBIndexes(obj *PackObject) error {
+func (d *PackDevice) clearStaleDBIndexes(
+	batch *gorocksdb.WriteBatch, obj *PackObject) {
 	// Tombstone found. Clear it before saving the new object.
 	if !obj.exists && obj.meta != nil {
-		if err := d.clearTombstoneDBIndex(obj); err != nil {
-			glogger.Error("unable to delete tombstone",
-				zap.String("object", obj.name), zap.Error(err))
-			return err
-		}
+		d.clearTombstoneDBIndex(batch, obj)
 	}
 
 	if obj.exists && obj.mMeta != nil {
-		if err := d.clearMetaDBIndex(obj); err != nil {
-			glogger.Error("unable to clear stale meta",
-				zap.String("object", obj.name), zap.Error(err))
-			return err
-		}
+		d.clearMetaDBIndex(batch, obj)
 	}
-
-	return nil
 }
 
 // TODO: can we merge this with clearStaleDBIndexes ?
-func (d *PackDevice) clearDBIndexes(obj *PackObject) error {
-	if err := d.clearDataDBIndex(obj); err != nil {
-		glogger.Error("unable to delete data db index",
-			zap.String("object-key", obj.key))
-		return err
-	}
-
-	if err := d.clearMetaDBIndex(obj); err != nil {
-		glogger.Error("unable to delete meta db index",
-			zap.String("object-key", obj.key))
-		return err
-	}
-
-	return nil
+func (d *PackDevice) clearDBIndexes(
+	batch *gorocksdb.WriteBatch, obj *PackObject) {
+	d.clearDataDBIndex(batch, obj)
+	d.clearMetaDBIndex(batch, obj)
 }
 
-func (d *PackDevice) saveDBIndex(obj *PackObject, ot PartType) error {
+func (d *PackDevice) saveDBIndex(
+	batch *gorocksdb.WriteBatch, obj *PackObject, ot PartType) error {
 	idx := &DBIndex{
 		Meta: obj.meta,
 	}
@@ -237,10 +415,41 @@ func (d *PackDevice) saveDBIndex(obj *PackObject, ot PartType) error {
 	}
 
 	key := fmt.Sprintf("%s/%s", obj.key, ot)
-	return d.db.Put(d.wopt, []byte(key), b)
+	batch.Put([]byte(key), b)
+	return nil
 }
 
-func (d *PackDevice) commitLO(obj *PackObject, ot PartType) error {
+// Overridden by tests to simulate a crash before index mutations persist
+var beforeDBIndexesWrite = func() error { return nil }
+
+// All the index mutations of an object are collected in one batch, so that
+// they are applied either completely or not at all. Summaries of the
+// mutated suffixes and usages of the mutated partitions are updated in the
+// same batch.
+func (d *PackDevice) writeDBIndexes(batch *gorocksdb.WriteBatch) error {
+	if err := beforeDBIndexesWrite(); err != nil {
+		return err
+	}
+
+	unlock, err := d.summarizeBatch(batch)
+	if err != nil {
+		glogger.Error("unable to update suffix summaries", zap.Error(err))
+		return err
+	}
+	defer unlock()
+
+	unlockUsage, err := d.accountBatch(batch)
+	if err != nil {
+		glogger.Error("unable to update partition usages", zap.Error(err))
+		return err
+	}
+	defer unlockUsage()
+
+	return d.writeBatch(batch)
+}
+
+func (d *PackDevice) commitLO(
+	batch *gorocksdb.WriteBatch, obj *PackObject, ot PartType) error {
 	var err error
 	var stale *PackObject
 	// We don't need to deallocate an existing LO
@@ -283,11 +492,24 @@ func (d *PackDevice) commitLO(obj *PackObject, ot PartType) error {
 		return err
 	}
 
-	d.km.Lock(obj.key)
-	defer d.km.Unlock(obj.key)
-	if ot == DATA {
+	// Files of other part types have no data to encrypt
+	if s := obj.writer.sealer; ot == DATA && s != nil {
+		if err = s.Flush(); err == nil {
+			err = setLOKeyID(afw.Fd(), d.keyring.active)
+		}
+		if err != nil {
+			glogger.Error("unable to encrypt large object",
+				zap.String("object", obj.name), zap.Error(err))
+			return err
+		}
+	}
+
+	// The object is locked by the caller, so no commit could happen
+	// between the check and the saving.
+	if ot == DATA && !obj.repack {
 		old := d.staleObjCopy(obj)
-		err = d.LoadObjectMeta(old)
+		err = d.loadObjectMeta(old)
+		old.pinBundle(nil)
 		if err == nil && old.exists{
 			oldTs, err1 := strconv.ParseFloat(old.meta.Timestamp, 10)
 			newTs, err2 := strconv.ParseFloat(obj.meta.Timestamp, 10)
@@ -308,13 +530,30 @@ func (d *PackDevice) commitLO(obj *PackObject, ot PartType) error {
 		return err
 	}
 
-	if err = d.saveDBIndex(obj, ot); err != nil {
-		glogger.Error("unable to save index", zap.String("object", obj.name))
+	// A small object overridden by the LO drops its reference to a shared
+	// needle in the same write
+	if digest := sharedDigest(stale); digest != "" {
+		unlock := d.lockDedupStripe(obj.partition, digest)
+		defer unlock()
+	}
+	if err = d.releaseStale(batch, stale); err == nil {
+		err = d.saveDBIndex(batch, obj, ot)
+	}
+	if err == nil {
+		err = d.writeDBIndexes(batch)
+	}
+	if err != nil {
+		glogger.Error("unable to save index",
+			zap.String("object", obj.name), zap.Error(err))
 		return err
 	}
 
+	if stale != nil && stale.bundle != nil {
+		stale.bundle.pin()
+	}
+	// Added before spawning, so that Close always waits for it
+	d.wg.Add(1)
 	go func() {
-		d.wg.Add(1)
 		defer d.wg.Done()
 
 		HashCleanupListDir(hashDir, RECLAIM_AGE)
@@ -328,14 +567,22 @@ func (d *PackDevice) commitLO(obj *PackObject, ot PartType) error {
 				zap.String("object", stale.name),
 				zap.Bool("small", stale.small))
 			d.deallocateSO(stale, DATA)
+			if stale.bundle != nil {
+				stale.bundle.unpin()
+			}
 		}
 	}()
 
 	return nil
 }
 
+// deepStaleObjCopy copies the needle indexes of obj which are deallocated
+// once overridden. It must be called with cmu held. If the segments which
+// obj was loaded with have been compacted since, the indexes are loaded
+// again, because punching holes at the original offsets would leave the
+// moved needles orphaned.
 func (d *PackDevice) deepStaleObjCopy(obj *PackObject) *PackObject {
-	return &PackObject{
+	stale := &PackObject{
 		name:      obj.name,
 		key:       obj.key,
 		partition: obj.partition,
@@ -346,7 +593,43 @@ func (d *PackDevice) deepStaleObjCopy(obj *PackObject) *PackObject {
 		small:     obj.dataIndex != nil,
 		dataIndex: obj.dataIndex,
 		metaIndex: obj.metaIndex,
+		bundle:    obj.bundle,
+	}
+
+	current, err := d.getBundle(obj.partition)
+	if err != nil {
+		return stale
+	}
+	if stale.bundle != nil &&
+		!isSegmentReplaced(stale.bundle, current, stale.dataIndex, stale.metaIndex) {
+		return stale
 	}
+
+	if stale.bundle != nil {
+		dataDBIdx, metaDBIdx, _, err := d.loadObjDBIndexes(stale)
+		if err != nil {
+			glogger.Error("unable to reload stale indexes",
+				zap.String("object", obj.name), zap.Error(err))
+			return stale
+		}
+		stale.dataIndex = dataDBIdx.GetIndex()
+		stale.metaIndex = metaDBIdx.GetIndex()
+		stale.small = stale.dataIndex != nil
+	}
+	stale.bundle = current
+
+	return stale
+}
+
+// Returns true if the segment of any index in set is not the one in current
+func isSegmentReplaced(set, current *BundleSet, indexes ...*NeedleIndex) bool {
+	for _, idx := range indexes {
+		if idx != nil && set.segments[idx.Segment] != current.segments[idx.Segment] {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (d *PackDevice) staleObjCopy(obj *PackObject) *PackObject {
@@ -357,8 +640,9 @@ func (d *PackDevice) staleObjCopy(obj *PackObject) *PackObject {
 	}
 }
 
-func (d *PackDevice) commitSO(obj *PackObject, ot PartType) error {
-	bundle, err := d.getBundle(obj.partition)
+func (d *PackDevice) commitSO(
+	batch *gorocksdb.WriteBatch, obj *PackObject, ot PartType) error {
+	set, err := d.getBundle(obj.partition)
 	if err != nil {
 		glogger.Error("unable to find bundle",
 			zap.String("partition", obj.partition), zap.Error(err))
@@ -385,34 +669,64 @@ func (d *PackDevice) commitSO(obj *PackObject, ot PartType) error {
 		}
 	}
 
-	bundle.Lock()
-	defer bundle.Unlock()
+	// Only for saving space
+	delete(obj.meta.UserMeta, common.XTimestamp)
+	delete(obj.meta.UserMeta, "name")
 
-	// Ensure new data is always to append to the end and is aligned to 4K
-	var offset int64
-	if offset, err = bundle.Seek(0, io.SeekEnd); err != nil {
-		glogger.Error("unable to seek to end of bundle file",
-			zap.String("partition", obj.partition), zap.Error(err))
-		return err
+	// In dedup mode, the data is saved as a reference to the needle of an
+	// identical object if there is one. The digest is not recorded if the
+	// needle of the same digest is corrupted, in which case a needle of its
+	// own is appended.
+	var digest string
+	if ot == DATA && d.dedup {
+		buf, ok := obj.writer.Writer.(*bytes.Buffer)
+		if !ok {
+			glogger.Error("data writer is not for small object")
+			return ErrWrongDataWriter
+		}
+		digest = contentDigest(buf.Bytes()[NeedleHeaderSizeV2:])
 	}
-	if offset%NeedleAlignment != 0 {
-		return ErrNeedleNotAligned
+
+	// The shared needle of the stale data is released in the same write as
+	// the new index, so both stripes are kept locked until then.
+	stripes := make(map[int]bool)
+	if digest != "" {
+		stripes[dedupStripe(obj.partition, digest)] = true
+	}
+	if sd := sharedDigest(stale); sd != "" {
+		stripes[dedupStripe(obj.partition, sd)] = true
+	}
+	if len(stripes) > 0 {
+		unlock := d.lockDedupStripes(stripes)
+		defer unlock()
 	}
 
-	// Roll back in case of any failure.
-	// IMPORTANT!!!
-	// Deferred function calls in Go are executed in Last In First Out order
-	// after the surrounding function returns. This makes sure that this rollback
-	// operation will be called before pack is released.
-	defer func() {
-		if err != nil {
-			bundle.Truncate(offset)
+	var r *DedupRecord
+	if digest != "" {
+		if r, err = d.getDedupRecord(obj.partition, digest); err != nil {
+			return err
 		}
-	}()
+		if r != nil && r.Corrupted {
+			r, digest = nil, ""
+		}
+	}
 
-	// Only for saving space
-	delete(obj.meta.UserMeta, common.XTimestamp)
-	delete(obj.meta.UserMeta, "name")
+	if r != nil && stale != nil && isSameNeedle(r.Index, stale.dataIndex) {
+		// The object keeps referring to the same needle, which is counted
+		// again by commitShared
+		r.Refs--
+		stale.dataIndex = nil
+	} else if err = d.releaseStale(batch, stale); err != nil {
+		return err
+	}
+
+	if r != nil {
+		if err = d.commitShared(batch, obj, digest, r); err != nil {
+			return err
+		}
+		d.deallocateStale(stale, ot)
+		return nil
+	}
 
 	// *Append* meta to the buffer, namely after the data
 	b, err := proto.Marshal(obj.meta)
@@ -422,90 +736,295 @@ func (d *PackDevice) commitSO(obj *PackObject, ot PartType) error {
 		return err
 	}
 
-	if _, err = obj.writer.Write(b); err != nil {
-		glogger.Error("unable to write meta to buffer",
-			zap.String("object", obj.name), zap.Error(err))
-		return err
-	}
-
-	nh := &NeedleHeader{
-		MagicNumber: NeedleMagicNumber,
-		DataOffset:  offset + int64(NeedleHeaderSize),
-		DataSize:    obj.dataSize,
-	}
-	nh.MetaOffset = nh.DataOffset + nh.DataSize
-	nh.MetaSize = int32(len(b))
-	nh.NeedleSize = CalculateDiskSize(NeedleHeaderSize, nh.DataSize, int32(len(b)))
-
 	buf, ok := obj.writer.Writer.(*bytes.Buffer)
 	if !ok {
 		glogger.Error("data writer is not for small object")
 		return ErrWrongDataWriter
 	}
-	nh.WriteToBuffer(buf.Bytes()[0:NeedleHeaderSize])
+
+	// The needle is laid out for the segment being appended to. It is laid
+	// out again if the segment is rolled over before it is appended.
+	hs := set.active.needleHeaderSize()
+	dataSize := obj.dataSize
+	var flags uint32
+	if ot == DATA {
+		data := buf.Bytes()[NeedleHeaderSizeV2:]
+		if c := d.compressData(set.active, data, int32(len(b))); c != nil {
+			buf.Truncate(NeedleHeaderSizeV2)
+			buf.Write(c)
+			dataSize = int64(len(c))
+			flags = d.compression
+		}
+	}
+
+	if d.keyring != nil && set.active.Version >= BundleVersion2 {
+		data, meta, err := d.keyring.sealNeedle(buf.Bytes()[NeedleHeaderSizeV2:], b)
+		if err != nil {
+			glogger.Error("unable to encrypt needle",
+				zap.String("object", obj.name), zap.Error(err))
+			return err
+		}
+		buf.Truncate(NeedleHeaderSizeV2)
+		buf.Write(data)
+		dataSize = int64(len(data))
+		b = meta
+		flags |= NeedleFlagEncrypted
+	}
+
+	if _, err = obj.writer.Write(b); err != nil {
+		glogger.Error("unable to write meta to buffer",
+			zap.String("object", obj.name), zap.Error(err))
+		return err
+	}
 
 	// Pad the buffer with 0 to achieve the 4k alignment
-	paddingSize := int(nh.NeedleSize - int64(NeedleHeaderSize) - int64(nh.MetaSize) - nh.DataSize)
+	needleSize := CalculateDiskSize(hs, dataSize, int32(len(b)))
+	paddingSize := int(needleSize - int64(hs) - int64(len(b)) - dataSize)
 	if _, err = obj.writer.Write(padding[:paddingSize]); err != nil {
 		glogger.Error("unable to pad object to buffer",
 			zap.String("object", obj.name), zap.Error(err))
 		return err
 	}
 
-	// Flush the buffer to the bundle
-	if _, err = bundle.Write(buf.Bytes()); err != nil {
-		glogger.Error("unable to write object data",
-			zap.String("object", obj.name), zap.Error(err))
+	n := &pendingNeedle{
+		obj:   obj,
+		ot:    ot,
+		batch: batch,
+		// Skip the unused part of the reserved header space
+		needle:   buf.Bytes()[NeedleHeaderSizeV2-hs:],
+		hs:       hs,
+		dataSize: dataSize,
+		metaSize: int32(len(b)),
+		flags:    flags,
+		digest:   digest,
+	}
+	if set.group != nil {
+		err = d.groupCommit(set, n)
+	} else {
+		err = d.appendNeedles(set, n)
+	}
+	if err != nil {
 		return err
 	}
 
-	nIndex := &NeedleIndex{
-		Offset:     offset,
-		Size:       nh.NeedleSize,
-		DataOffset: nh.DataOffset,
-		DataSize:   nh.DataSize,
-		MetaOffset: nh.MetaOffset,
-		MetaSize:   nh.MetaSize,
+	d.deallocateStale(stale, ot)
+
+	return err
+}
+
+// Deallocate existing needles when overriding objects
+// We could have done this at the begining, however,
+// it is better to remove old objects only when new objects
+// are created successfully, IMHO.
+func (d *PackDevice) deallocateStale(stale *PackObject, ot PartType) {
+	if stale == nil {
+		return
 	}
 
-	if ot == DATA {
-		obj.dataIndex = nIndex
-	} else {
-		obj.metaIndex = nIndex
-	}
-	err = d.saveDBIndex(obj, ot)
-
-	// Deallocate existing needles when overriding objects
-	// We could have done this at the begining, however,
-	// it is better to remove old objects only when new objects
-	// are created successfully, IMHO.
-	if stale != nil {
-		glogger.Info("deallocating stale object",
-			zap.String("object", stale.name),
-			zap.Bool("small", stale.small),
-			zap.String("part-type", string(ot)))
+	glogger.Info("deallocating stale object",
+		zap.String("object", stale.name),
+		zap.Bool("small", stale.small),
+		zap.String("part-type", string(ot)))
+	// Called with cmu held, so the bundle is either pinned by the object
+	// overridden or current. It is kept open until deallocated.
+	if stale.bundle != nil {
+		stale.bundle.pin()
+	}
+	// Close waits for the deallocation, or it could be lost at shutdown
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if stale.bundle != nil {
+			defer stale.bundle.unpin()
+		}
 		if stale.small {
-			go d.deallocateSO(stale, ot)
+			d.deallocateSO(stale, ot)
 		} else {
-			go d.deallocateLO(stale, ot)
+			d.deallocateLO(stale, ot)
+		}
+	}()
+}
+
+// A needle whose header is filled once its offset is determined.
+type pendingNeedle struct {
+	obj      *PackObject
+	ot       PartType
+	batch    *gorocksdb.WriteBatch
+	needle   []byte
+	hs       int32 // size of the needle header the needle is laid out for
+	dataSize int64 // size of the data in the needle, maybe compressed
+	metaSize int32
+	flags    uint32
+	digest   string // content digest of the data if it is to be shared
+	done     chan error
+}
+
+// Lays out the needle again for the header size of another bundle version
+func (n *pendingNeedle) relayout(hs int32) {
+	payload := n.needle[n.hs : int64(n.hs)+n.dataSize+int64(n.metaSize)]
+	needle := make([]byte, CalculateDiskSize(hs, n.dataSize, n.metaSize))
+	copy(needle[hs:], payload)
+	n.needle = needle
+	n.hs = hs
+}
+
+// Appends the needles to the end of the active segment of the bundle, then
+// saves their db indexes together with the other index mutations of their
+// objects in one write. The segment is rolled over first if it is full.
+// The segment is kept locked until the db indexes are written.
+func (d *PackDevice) appendNeedles(
+	set *BundleSet, needles ...*pendingNeedle) (err error) {
+	set.wmu.Lock()
+	defer set.wmu.Unlock()
+
+	// The set may have been rolled over by others before the lock is taken
+	if set, err = d.getBundle(set.partition); err != nil {
+		return err
+	}
+	if set.needsRollover() {
+		ns, err := d.rollBundle(set)
+		if err != nil {
+			glogger.Error("unable to roll over bundle",
+				zap.String("partition", set.partition), zap.Error(err))
+			return err
 		}
+		set = ns
 	}
 
-	return err
+	bundle := set.active
+	bundle.Lock()
+	defer bundle.Unlock()
+
+	// Ensure new data is always to append to the end and is aligned to 4K
+	var offset int64
+	if offset, err = bundle.Seek(0, io.SeekEnd); err != nil {
+		glogger.Error("unable to seek to end of bundle file",
+			zap.String("partition", bundle.partition), zap.Error(err))
+		return err
+	}
+	if offset%NeedleAlignment != 0 {
+		return ErrNeedleNotAligned
+	}
+
+	// Roll back in case of any failure.
+	// IMPORTANT!!!
+	// Deferred function calls in Go are executed in Last In First Out order
+	// after the surrounding function returns. This makes sure that this rollback
+	// operation will be called before pack is released.
+	defer func() {
+		if err != nil {
+			bundle.Truncate(offset)
+		}
+	}()
+
+	batch := needles[0].batch
+	if len(needles) > 1 {
+		batch = gorocksdb.NewWriteBatch()
+		defer batch.Destroy()
+	}
+
+	hs := bundle.needleHeaderSize()
+	pos := offset
+	for _, n := range needles {
+		obj := n.obj
+		if n.hs != hs {
+			n.relayout(hs)
+		}
+		nh := &NeedleHeader{
+			MagicNumber: NeedleMagicNumber,
+			DataOffset:  pos + int64(hs),
+			DataSize:    n.dataSize,
+			MetaSize:    n.metaSize,
+			Flags:       n.flags,
+		}
+		nh.MetaOffset = nh.DataOffset + nh.DataSize
+		nh.NeedleSize = CalculateDiskSize(hs, nh.DataSize, nh.MetaSize)
+		bundle.sealNeedle(nh, n.needle[:nh.MetaOffset-pos+int64(nh.MetaSize)])
+
+		bundle.touch()
+		if _, err = bundle.Write(n.needle); err != nil {
+			glogger.Error("unable to write object data",
+				zap.String("object", obj.name), zap.Error(err))
+			return err
+		}
+
+		nIndex := &NeedleIndex{
+			Offset:     pos,
+			Size:       nh.NeedleSize,
+			DataOffset: nh.DataOffset,
+			DataSize:   nh.DataSize,
+			MetaOffset: nh.MetaOffset,
+			MetaSize:   nh.MetaSize,
+			Flags:      nh.Flags,
+			Segment:    bundle.segment,
+			Digest:     n.digest,
+		}
+		if n.ot == DATA {
+			obj.dataIndex = nIndex
+		} else {
+			obj.metaIndex = nIndex
+		}
+		if err = d.saveDBIndex(n.batch, obj, n.ot); err != nil {
+			glogger.Error("unable to save index",
+				zap.String("object", obj.name), zap.Error(err))
+			return err
+		}
+		if n.digest != "" {
+			r := &DedupRecord{Index: nIndex, Refs: 1}
+			if err = putDedupRecord(n.batch, obj.partition, n.digest, r); err != nil {
+				glogger.Error("unable to save dedup record",
+					zap.String("object", obj.name), zap.Error(err))
+				return err
+			}
+		}
+		if batch != n.batch {
+			if err = mergeWriteBatch(batch, n.batch); err != nil {
+				glogger.Error("unable to merge db indexes",
+					zap.String("object", obj.name), zap.Error(err))
+				return err
+			}
+		}
+
+		pos += nh.NeedleSize
+	}
+
+	// Bundles are opened without O_SYNC in group commit mode
+	if set.group != nil {
+		if err = syscall.Fdatasync(int(bundle.Fd())); err != nil {
+			glogger.Error("unable to sync bundle",
+				zap.String("partition", bundle.partition), zap.Error(err))
+			return err
+		}
+	}
+
+	if err = d.writeDBIndexes(batch); err != nil {
+		glogger.Error("unable to write db indexes",
+			zap.String("partition", bundle.partition),
+			zap.Int("needles", len(needles)),
+			zap.Error(err))
+		return err
+	}
+
+	return nil
 }
 
 // ********************
 // Object deletion
 // ********************
 func (d *PackDevice) deallocateNeedles(
-	bundle *Bundle, indexes ...*NeedleIndex) error {
+	set *BundleSet, indexes ...*NeedleIndex) error {
 	for _, oi := range indexes {
 		if oi == nil {
 			continue
 		}
-		if err := bundle.PunchHole(oi.Offset, oi.Size); err != nil {
+		bundle, err := set.segment(oi.Segment)
+		if err != nil {
+			return err
+		}
+		if err = d.punchHole(bundle, oi.Offset, oi.Size); err != nil {
 			glogger.Error("unable to punch hole.",
 				zap.Int64("offset", oi.Offset),
+				zap.Int32("segment", oi.Segment),
 				zap.String("partition", bundle.partition))
 			return err
 		}
@@ -514,8 +1033,21 @@ func (d *PackDevice) deallocateNeedles(
 	return nil
 }
 
+// pinnedBundle returns the bundle pinned by LoadObjectMeta, or the current
+// bundle of the partition if the object was not loaded that way.
+func (d *PackDevice) pinnedBundle(obj *PackObject) (*BundleSet, error) {
+	if obj.bundle != nil {
+		return obj.bundle, nil
+	}
+
+	return d.getBundle(obj.partition)
+}
+
 func (d *PackDevice) deallocateSO(obj *PackObject, ot PartType) error {
-	bundle, err := d.getBundle(obj.partition)
+	// The needle indexes of obj are only valid in the bundle they were
+	// loaded with. Punching a hole in a compacted bundle would destroy
+	// other needles.
+	bundle, err := d.pinnedBundle(obj)
 	if err != nil {
 		glogger.Error("unable to find bundle",
 			zap.String("object", obj.name), zap.String("partition", obj.partition))
@@ -526,6 +1058,13 @@ func (d *PackDevice) deallocateSO(obj *PackObject, ot PartType) error {
 		return d.deallocateNeedles(bundle, obj.metaIndex)
 	}
 
+	// Shared needles are released together with the index change by
+	// releaseStale, which clears the digest once the last reference is
+	// dropped. Until then the needle is kept for the other references.
+	if obj.dataIndex.GetDigest() != "" {
+		return d.deallocateNeedles(bundle, obj.metaIndex)
+	}
+
 	return d.deallocateNeedles(bundle, obj.metaIndex, obj.dataIndex)
 }
 
@@ -551,16 +1090,30 @@ func (d *PackDevice) deallocateLO(obj *PackObject, ot PartType) error {
 	return err
 }
 
-func (d *PackDevice) deleteSO(obj *PackObject) error {
-	var err error
-	if err = d.saveDBIndex(obj, TOMBSTONE); err != nil {
+func (d *PackDevice) deleteSO(
+	batch *gorocksdb.WriteBatch, obj *PackObject) error {
+	stale := d.deepStaleObjCopy(obj)
+
+	if digest := sharedDigest(stale); digest != "" {
+		unlock := d.lockDedupStripe(obj.partition, digest)
+		defer unlock()
+	}
+
+	err := d.releaseStale(batch, stale)
+	if err == nil {
+		err = d.saveDBIndex(batch, obj, TOMBSTONE)
+	}
+	if err == nil {
+		err = d.writeDBIndexes(batch)
+	}
+	if err != nil {
 		glogger.Error("unable to save tombstone index",
-			zap.String("object", obj.name))
+			zap.String("object", obj.name), zap.Error(err))
 		return err
 	}
 
 	// deallocatedSO will try to clear the meta needle implicitly
-	if err = d.deallocateSO(obj, DATA); err != nil {
+	if err = d.deallocateSO(stale, DATA); err != nil {
 		glogger.Error("unable to deallocate needle space",
 			zap.String("object", obj.name))
 	}
@@ -568,6 +1121,7 @@ func (d *PackDevice) deleteSO(obj *PackObject) error {
 	return err
 }
 
-func (d *PackDevice) deleteLO(obj *PackObject) error {
-	return d.commitLO(obj, TOMBSTONE)
+func (d *PackDevice) deleteLO(
+	batch *gorocksdb.WriteBatch, obj *PackObject) error {
+	return d.commitLO(batch, obj, TOMBSTONE)
 }
@@ -21,14 +21,22 @@ import (
 	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tecbot/gorocksdb"
+	"github.com/uber-go/tally"
 
 	"github.com/iqiyi/auklet/common"
 	"github.com/iqiyi/auklet/common/fs"
+	"github.com/iqiyi/auklet/common/middleware"
+	"github.com/iqiyi/auklet/common/srv"
 )
 
 func TestSOWriter(t *testing.T) {
@@ -66,13 +74,63 @@ func TestSORangeReader(t *testing.T) {
 
 	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
 	obj := newPackSO("")
-	obj.dataIndex = &NeedleIndex{Offset: 4096}
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
+	require.Nil(t, obj.Close())
+
 	r, err := d.newSORangeReader(obj, 0, obj.meta.DataSize)
 	require.Nil(t, err)
 
 	require.Nil(t, r.fd)
 }
 
+func TestSORangeReaderChecksumMismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	obj := newPackObject(SIZE_1K, "")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
+	require.Nil(t, obj.Close())
+
+	// Flip a bit of the object data
+	bundle, err := d.getBundle(obj.partition)
+	require.Nil(t, err)
+	b := make([]byte, 1)
+	_, err = bundle.active.ReadAt(b, obj.dataIndex.DataOffset)
+	require.Nil(t, err)
+	b[0] ^= 0x01
+	_, err = bundle.active.WriteAt(b, obj.dataIndex.DataOffset)
+	require.Nil(t, err)
+
+	_, err = d.newSORangeReader(obj, 0, obj.meta.DataSize)
+	require.Equal(t, ErrNeedleChecksumMismatch, err)
+}
+
+func TestSORangeReaderV1(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	obj := newPackObject(SIZE_1K, "")
+	require.Nil(t, formatBundleFileV1(d, obj.partition))
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
+	require.Nil(t, obj.Close())
+	require.Equal(t,
+		int64(SuperBlockDiskSize+NeedleHeaderSize), obj.dataIndex.DataOffset)
+
+	r, err := d.newSORangeReader(obj, 0, obj.meta.DataSize)
+	require.Nil(t, err)
+	hash := md5.New()
+	io.Copy(hash, r)
+	etag := hex.EncodeToString(hash.Sum(nil))
+	require.Equal(t, obj.meta.SystemMeta[common.HEtag], etag)
+}
+
 func TestLORangeReader(t *testing.T) {
 	root, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -99,7 +157,7 @@ func TestCommitSO(t *testing.T) {
 
 	obj := newPackSO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitSO(obj, DATA))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	obj.device = d
@@ -115,7 +173,7 @@ func TestCommitLO(t *testing.T) {
 
 	obj := newPackLO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitLO(obj, DATA))
+	require.Nil(t, d.commitLO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	obj.device = d
@@ -131,7 +189,7 @@ func TestWrongDataWriter1(t *testing.T) {
 
 	obj := newPackSO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Equal(t, d.commitLO(obj, DATA), ErrWrongDataWriter)
+	require.Equal(t, d.commitLO(gorocksdb.NewWriteBatch(), obj, DATA), ErrWrongDataWriter)
 }
 
 func TestWrongDataWriter2(t *testing.T) {
@@ -142,7 +200,7 @@ func TestWrongDataWriter2(t *testing.T) {
 
 	obj := newPackLO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Equal(t, d.commitSO(obj, DATA), ErrWrongDataWriter)
+	require.Equal(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA), ErrWrongDataWriter)
 }
 
 func TestLoadSODBIndex(t *testing.T) {
@@ -153,7 +211,7 @@ func TestLoadSODBIndex(t *testing.T) {
 
 	obj := newPackSO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitSO(obj, DATA))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	o := &PackObject{
@@ -168,7 +226,7 @@ func TestLoadSODBIndex(t *testing.T) {
 
 	require.NotNil(t, dIdx.Index)
 	require.Equal(t,
-		int64(SuperBlockDiskSize+NeedleHeaderSize), dIdx.Index.DataOffset)
+		int64(SuperBlockDiskSize+NeedleHeaderSizeV2), dIdx.Index.DataOffset)
 	require.Equal(t, obj.meta.SystemMeta, dIdx.Meta.SystemMeta)
 }
 
@@ -180,7 +238,7 @@ func TestLoadLODBIndex(t *testing.T) {
 
 	obj := newPackLO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitLO(obj, DATA))
+	require.Nil(t, d.commitLO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	o := &PackObject{
@@ -205,7 +263,7 @@ func TestDeleteLO(t *testing.T) {
 
 	obj := newPackLO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitLO(obj, DATA))
+	require.Nil(t, d.commitLO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	obj.device = d
@@ -213,7 +271,7 @@ func TestDeleteLO(t *testing.T) {
 	require.False(t, fs.IsFileNotExist(dp))
 
 	obj.meta.Timestamp = common.GetTimestamp()
-	require.Nil(t, d.deleteLO(obj))
+	require.Nil(t, d.deleteLO(gorocksdb.NewWriteBatch(), obj))
 	// This is a little tricky. In the case of LO, the commitLO will
 	// start a goroutine to clean the data files which is never guaranteed
 	// to be started when the function return. So we need to yield the
@@ -237,11 +295,11 @@ func TestDeleteSO(t *testing.T) {
 
 	obj := newPackSO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitSO(obj, DATA))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 
 	obj.meta.Timestamp = common.GetTimestamp()
-	require.Nil(t, d.deleteSO(obj))
+	require.Nil(t, d.deleteSO(gorocksdb.NewWriteBatch(), obj))
 	_, _, tsIdx, err := d.loadObjDBIndexes(obj)
 	require.Nil(t, err)
 	require.NotNil(t, tsIdx)
@@ -255,7 +313,7 @@ func TestPersistSO(t *testing.T) {
 
 	obj := newPackSO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitSO(obj, DATA))
+	require.Nil(t, d.commitSO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 	d.Close()
 
@@ -282,7 +340,7 @@ func TestPersistLO(t *testing.T) {
 
 	obj := newPackLO("")
 	require.Nil(t, feedObject(obj, d))
-	require.Nil(t, d.commitLO(obj, DATA))
+	require.Nil(t, d.commitLO(gorocksdb.NewWriteBatch(), obj, DATA))
 	require.Nil(t, obj.Close())
 	d.Close()
 
@@ -301,3 +359,198 @@ func TestPersistLO(t *testing.T) {
 	etag := hex.EncodeToString(hash.Sum(nil))
 	require.Equal(t, obj.meta.SystemMeta[common.HEtag], etag)
 }
+
+// Collects the bytes sent to a TCP connection until it is closed
+func newTCPSink(t testing.TB) (*net.TCPConn, func() []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	received := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+
+	return conn.(*net.TCPConn), func() []byte {
+		conn.Close()
+		return <-received
+	}
+}
+
+func TestDataReaderWriteTo(t *testing.T) {
+	defer func(skip bool) { gconf.SkipNeedleChecksum = skip }(gconf.SkipNeedleChecksum)
+	gconf.SkipNeedleChecksum = true
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	so := newPackObject(SIZE_1K*10, "1")
+	lo := newPackLO("1")
+	for _, obj := range []*PackObject{so, lo} {
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+
+		r, err := d.NewRangeReader(vo, 10, 100)
+		require.Nil(t, err)
+		require.True(t, r.bundle != nil || r.fd != nil)
+		expected, err := ioutil.ReadAll(r.SectionReader)
+		require.Nil(t, err)
+
+		// The data already read must not be sent again
+		_, err = r.Seek(0, io.SeekStart)
+		require.Nil(t, err)
+		head := make([]byte, 10)
+		_, err = io.ReadFull(r, head)
+		require.Nil(t, err)
+
+		conn, wait := newTCPSink(t)
+		n, err := io.Copy(conn, r)
+		require.Nil(t, err)
+		require.Equal(t, int64(90), n)
+		require.Equal(t, expected, append(head, wait()...))
+		require.Nil(t, r.Close())
+	}
+}
+
+// Records whether the data is read from a file, i.e. could be sent by
+// sendfile.
+type fileSink struct {
+	bytes.Buffer
+	fromFile bool
+}
+
+func (s *fileSink) ReadFrom(r io.Reader) (int64, error) {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		_, s.fromFile = lr.R.(*os.File)
+	}
+	return s.Buffer.ReadFrom(r)
+}
+
+func TestObjectCopySendfile(t *testing.T) {
+	defer func(skip bool) { gconf.SkipNeedleChecksum = skip }(gconf.SkipNeedleChecksum)
+	gconf.SkipNeedleChecksum = true
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj := newPackObject(SIZE_1K*10, "1")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	sink := &fileSink{}
+	n, err := vo.Copy(sink)
+	require.Nil(t, err)
+	require.Equal(t, obj.dataSize, n)
+	require.True(t, sink.fromFile)
+	require.Nil(t, vo.Close())
+
+	// The data has to be copied to more than one writer
+	vo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	sink = &fileSink{}
+	hash := md5.New()
+	_, err = vo.Copy(sink, hash)
+	require.Nil(t, err)
+	require.False(t, sink.fromFile)
+	require.Equal(t, int(obj.dataSize), sink.Len())
+	require.Nil(t, vo.Close())
+}
+
+// Reports the CPU time spent on serving 1GB of object data by GET requests,
+// with or without sendfile. The response writer is wrapped like the one of
+// object server.
+func benchmarkObjectCopy(b *testing.B, obj *PackObject, sendfile bool) {
+	defer func(skip bool) { gconf.SkipNeedleChecksum = skip }(gconf.SkipNeedleChecksum)
+	gconf.SkipNeedleChecksum = true
+
+	root, err := ioutil.TempDir("", "")
+	require.Nil(b, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	require.Nil(b, feedObject(obj, d))
+	require.Nil(b, d.CommitWrite(obj))
+	obj.Close()
+
+	handler := func(writer http.ResponseWriter, req *http.Request) {
+		w := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+		vo := copyVanilla(obj)
+		if err := d.LoadObjectMeta(vo); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer vo.Close()
+
+		w.WriteHeader(http.StatusOK)
+		if sendfile {
+			vo.Copy(w)
+		} else {
+			// Copied through user space like the ETag check
+			vo.Copy(w, ioutil.Discard)
+		}
+	}
+	server := httptest.NewServer(middleware.RequestMetrics(tally.NoopScope)(
+		http.HandlerFunc(handler)))
+	defer server.Close()
+
+	var before, after syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+	b.SetBytes(obj.dataSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := http.Get(server.URL)
+		require.Nil(b, err)
+		require.Equal(b, http.StatusOK, resp.StatusCode)
+		n, err := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		require.Nil(b, err)
+		require.Equal(b, obj.dataSize, n)
+	}
+	b.StopTimer()
+	syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+
+	cpu := time.Duration(after.Utime.Nano() + after.Stime.Nano() -
+		before.Utime.Nano() - before.Stime.Nano())
+	gb := float64(obj.dataSize) * float64(b.N) / (1 << 30)
+	b.Logf("cpu per GB: %v", time.Duration(float64(cpu)/gb))
+}
+
+func BenchmarkSOCopy(b *testing.B) {
+	benchmarkObjectCopy(b, newPackObject(SIZE_1M, "1"), false)
+}
+
+func BenchmarkSOSendfile(b *testing.B) {
+	benchmarkObjectCopy(b, newPackObject(SIZE_1M, "1"), true)
+}
+
+func BenchmarkLOCopy(b *testing.B) {
+	benchmarkObjectCopy(b, newPackObject(SIZE_1M*8, "1"), false)
+}
+
+func BenchmarkLOSendfile(b *testing.B) {
+	benchmarkObjectCopy(b, newPackObject(SIZE_1M*8, "1"), true)
+}
@@ -18,14 +18,17 @@ package pack
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/iqiyi/auklet/common/conf"
 	"github.com/iqiyi/auklet/common/fs"
+	"github.com/iqiyi/auklet/common/middleware"
 	"github.com/iqiyi/auklet/common/ring"
 
+	"github.com/uber-go/tally"
 	"go.uber.org/zap"
 )
 
@@ -38,7 +41,10 @@ type PackDeviceMgr struct {
 	rwlock      sync.RWMutex
 	devices     map[string]*PackDevice
 	stopMonitor chan bool
+	stopStats   chan bool
 	testMode    bool
+	// Scope of device metrics, nil if metrics are not reported
+	metricsScope tally.Scope
 }
 
 func NewPackDeviceMgr(port int, driveRoot string, policy int) *PackDeviceMgr {
@@ -54,6 +60,7 @@ func NewPackDeviceMgr(port int, driveRoot string, policy int) *PackDeviceMgr {
 		Port:        port,
 		devices:     make(map[string]*PackDevice),
 		stopMonitor: make(chan bool),
+		stopStats:   make(chan bool),
 		hashPrefix:  prefix,
 		hashSuffix:  suffix,
 	}
@@ -73,6 +80,7 @@ func (dm *PackDeviceMgr) GetPackDevice(device string) *PackDevice {
 		if d == nil {
 			d = NewPackDevice(device, dm.DriveRoot, dm.Policy)
 			dm.devices[device] = d
+			dm.reportMetrics(device, d)
 		}
 
 		return d
@@ -83,6 +91,26 @@ func (dm *PackDeviceMgr) GetPackDevice(device string) *PackDevice {
 	return dm.devices[device]
 }
 
+// Must be called with the write lock held
+func (dm *PackDeviceMgr) reportMetrics(device string, d *PackDevice) {
+	if dm.metricsScope == nil || d == nil {
+		return
+	}
+
+	d.cache.setMetricsScope(
+		dm.metricsScope.Tagged(map[string]string{"device": device}))
+}
+
+func (dm *PackDeviceMgr) setMetricsScope(scope tally.Scope) {
+	dm.rwlock.Lock()
+	defer dm.rwlock.Unlock()
+
+	dm.metricsScope = scope
+	for name, d := range dm.devices {
+		dm.reportMetrics(name, d)
+	}
+}
+
 func (dm *PackDeviceMgr) Close() {
 	dm.rwlock.Lock()
 	defer dm.rwlock.Unlock()
@@ -90,6 +118,7 @@ func (dm *PackDeviceMgr) Close() {
 	if !dm.testMode {
 		dm.stopMonitor <- true
 	}
+	close(dm.stopStats)
 
 	for name, dev := range dm.devices {
 		dev.Close()
@@ -172,11 +201,118 @@ func (dm *PackDeviceMgr) monitorDisks() {
 	}
 }
 
+// dumpDBStats saves the meta db statistics of the devices to the object
+// recon cache periodically, grouped by policy.
+func (dm *PackDeviceMgr) dumpDBStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dm.stopStats:
+			return
+		case <-ticker.C:
+		}
+
+		stats := make(map[string]interface{})
+		dm.rwlock.RLock()
+		for name, d := range dm.devices {
+			stats[name] = d.DBStats()
+		}
+		dm.rwlock.RUnlock()
+
+		err := middleware.DumpReconCache(middleware.ReconCachePath, "object",
+			map[string]interface{}{
+				"pack_rocksdb_stats": map[string]interface{}{
+					strconv.Itoa(dm.Policy): stats,
+				},
+			})
+		if err != nil {
+			glogger.Error("unable to dump RocksDB statistics",
+				zap.Int("policy", dm.Policy), zap.Error(err))
+		}
+	}
+}
+
+// dumpSpaceStats saves the space accounting of the devices to the object
+// recon cache periodically, grouped by policy. Accounting every partition
+// is slow, so the devices are accounted without holding the lock of the
+// manager, and only the totals are saved to the object recon cache, which
+// is rewritten by others all the time. Stats of the partitions are saved to
+// a recon cache of their own. Totals of the devices are reported as gauges
+// as well.
+func (dm *PackDeviceMgr) dumpSpaceStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dm.stopStats:
+			return
+		case <-ticker.C:
+		}
+
+		dm.rwlock.RLock()
+		devices := make(map[string]*PackDevice, len(dm.devices))
+		for name, d := range dm.devices {
+			devices[name] = d
+		}
+		scope := dm.metricsScope
+		dm.rwlock.RUnlock()
+
+		totals := make(map[string]interface{})
+		partitions := make(map[string]interface{})
+		for name, d := range devices {
+			ps, total, err := d.SpaceStats()
+			if err != nil {
+				continue
+			}
+
+			pm := make(map[string]interface{})
+			for p, stat := range ps {
+				pm[p] = stat.toMap()
+			}
+			totals[name] = total.toMap()
+			partitions[name] = pm
+
+			if scope != nil {
+				s := scope.Tagged(map[string]string{"device": name})
+				s.Gauge("live_bytes").Update(float64(total.LiveBytes))
+				s.Gauge("live_needles").Update(float64(total.Needles))
+				s.Gauge("tombstones").Update(float64(total.Tombstones))
+				s.Gauge("bundle_bytes").Update(float64(total.BundleBytes))
+				s.Gauge("allocated_blocks").Update(float64(total.AllocatedBlocks))
+				s.Gauge("fragmentation").Update(total.Fragmentation())
+			}
+		}
+
+		policy := strconv.Itoa(dm.Policy)
+		err := middleware.DumpReconCache(middleware.ReconCachePath, "object",
+			map[string]interface{}{
+				"pack_space_stats": map[string]interface{}{policy: totals},
+			})
+		if err != nil {
+			glogger.Error("unable to dump space statistics",
+				zap.Int("policy", dm.Policy), zap.Error(err))
+		}
+
+		err = middleware.DumpReconCache(middleware.ReconCachePath, "pack-space",
+			map[string]interface{}{
+				"pack_partition_space_stats": map[string]interface{}{policy: partitions},
+			})
+		if err != nil {
+			glogger.Error("unable to dump partition space statistics",
+				zap.Int("policy", dm.Policy), zap.Error(err))
+		}
+	}
+}
+
 func (dm *PackDeviceMgr) modifyDevice(device string, d *PackDevice) {
 	dm.rwlock.Lock()
 	defer dm.rwlock.Unlock()
 	if d != nil {
 		dm.devices[device] = d
+		dm.reportMetrics(device, d)
 	} else {
 		delete(dm.devices, device)
 	}
@@ -0,0 +1,177 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+// A device in read-only mode serves reads only. Updates from clients and
+// replicators are rejected with 507, so that they turn to handoffs.
+// A device in drain mode is read-only as well, and the replicator treats all
+// its partitions as handoffs, so that they are pushed away and removed
+// before the device is taken out of the ring.
+const (
+	DeviceModeNormal   = "normal"
+	DeviceModeReadOnly = "read-only"
+	DeviceModeDrain    = "drain"
+)
+
+func isValidDeviceMode(mode string) bool {
+	return mode == DeviceModeNormal ||
+		mode == DeviceModeReadOnly ||
+		mode == DeviceModeDrain
+}
+
+// The mode is saved in the device, so that it survives restarts of object
+// server and is visible to the replicator. Absence of the file means normal
+// mode.
+func PackDeviceModePath(device, driveRoot string, policy int) string {
+	suffix := ""
+	if policy != 0 {
+		suffix = fmt.Sprintf("-%d", policy)
+	}
+
+	return filepath.Join(driveRoot, device, fmt.Sprintf("pack-mode%s", suffix))
+}
+
+func ReadDeviceMode(driveRoot, device string, policy int) (string, error) {
+	b, err := ioutil.ReadFile(PackDeviceModePath(device, driveRoot, policy))
+	if os.IsNotExist(err) {
+		return DeviceModeNormal, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	mode := strings.TrimSpace(string(b))
+	if !isValidDeviceMode(mode) {
+		return "", ErrInvalidDeviceMode
+	}
+
+	return mode, nil
+}
+
+// loadMode is called on opening. A device whose mode could not be read is
+// regarded as read-only, so that neither new objects are accepted nor
+// partitions are moved away until the mode is set again.
+func (d *PackDevice) loadMode() {
+	mode, err := ReadDeviceMode(d.driveRoot, d.device, d.policy)
+	if err != nil {
+		glogger.Error("unable to read device mode, fall back to read-only",
+			zap.String("device", d.device),
+			zap.Int("policy", d.policy),
+			zap.Error(err))
+		mode = DeviceModeReadOnly
+	}
+
+	d.mode.Store(mode)
+}
+
+func (d *PackDevice) Mode() string {
+	return d.mode.Load().(string)
+}
+
+func (d *PackDevice) IsReadOnly() bool {
+	return d.Mode() != DeviceModeNormal
+}
+
+// SetMode saves the mode to the device before it takes effect
+func (d *PackDevice) SetMode(mode string) error {
+	if !isValidDeviceMode(mode) {
+		return ErrInvalidDeviceMode
+	}
+
+	w, err := fs.NewAtomicFileWriter(
+		d.tempDir(), filepath.Join(d.driveRoot, d.device))
+	if err != nil {
+		glogger.Error("unable to create temp file",
+			zap.String("device", d.device), zap.Error(err))
+		return err
+	}
+	defer w.Abandon()
+
+	if _, err = w.Write([]byte(mode + "\n")); err == nil {
+		err = w.Save(PackDeviceModePath(d.device, d.driveRoot, d.policy))
+	}
+	if err != nil {
+		glogger.Error("unable to save device mode",
+			zap.String("device", d.device),
+			zap.Int("policy", d.policy),
+			zap.Error(err))
+		return err
+	}
+
+	d.mode.Store(mode)
+	glogger.Info("device mode changed",
+		zap.String("device", d.device),
+		zap.Int("policy", d.policy),
+		zap.String("mode", mode))
+
+	return nil
+}
+
+func (f *PackEngine) IsReadOnly(device string) bool {
+	d := f.deviceMgr.GetPackDevice(device)
+	return d != nil && d.IsReadOnly()
+}
+
+// SetDeviceMode changes the mode of the device through the rpc server of
+// the running object server, or just queries it if no mode is given.
+func SetDeviceMode(cnf conf.Config, flags *flag.FlagSet) (string, error) {
+	var err error
+	glogger, err = common.GetLogger(
+		flags.Lookup("l").Value.(flag.Getter).Get().(string), "pack-device-mode")
+	if err != nil {
+		return "", err
+	}
+
+	device := flags.Lookup("d").Value.(flag.Getter).Get().(string)
+	policy := flags.Lookup("policy").Value.(flag.Getter).Get().(int)
+	mode := flags.Lookup("mode").Value.(flag.Getter).Get().(string)
+	if mode != "" && !isValidDeviceMode(mode) {
+		return "", ErrInvalidDeviceMode
+	}
+
+	rpcPort := int(cnf.GetInt("app:object-server", "rpc_port", 60000))
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", rpcPort), grpc.WithInsecure())
+	if err != nil {
+		glogger.Error("unable to dial to rpc server",
+			zap.Int("port", rpcPort), zap.Error(err))
+		return "", err
+	}
+	defer conn.Close()
+
+	msg := &DeviceModeMsg{Device: device, Policy: uint32(policy), Mode: mode}
+	reply, err := NewPackRpcServiceClient(conn).DeviceMode(context.Background(), msg)
+	if err != nil {
+		return "", err
+	}
+
+	return reply.Mode, nil
+}
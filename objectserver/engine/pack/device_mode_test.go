@@ -0,0 +1,62 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceMode(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	require.Equal(t, DeviceModeNormal, d.Mode())
+	require.False(t, d.IsReadOnly())
+
+	require.Equal(t, ErrInvalidDeviceMode, d.SetMode("readonly"))
+	require.Equal(t, DeviceModeNormal, d.Mode())
+
+	require.Nil(t, d.SetMode(DeviceModeDrain))
+	require.Equal(t, DeviceModeDrain, d.Mode())
+	require.True(t, d.IsReadOnly())
+
+	// The mode survives restarts and is visible to the replicator
+	d.Close()
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	require.Equal(t, DeviceModeDrain, d.Mode())
+	mode, err := ReadDeviceMode(root, PACK_DEVICE, PACK_POLICY_INDEX)
+	require.Nil(t, err)
+	require.Equal(t, DeviceModeDrain, mode)
+
+	require.Nil(t, d.SetMode(DeviceModeNormal))
+	require.False(t, d.IsReadOnly())
+	d.Close()
+
+	// Device with unknown mode falls back to read-only
+	require.Nil(t, ioutil.WriteFile(
+		PackDeviceModePath(PACK_DEVICE, root, PACK_POLICY_INDEX),
+		[]byte("unknown\n"), 0644))
+	_, err = ReadDeviceMode(root, PACK_DEVICE, PACK_POLICY_INDEX)
+	require.Equal(t, ErrInvalidDeviceMode, err)
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	require.Equal(t, DeviceModeReadOnly, d.Mode())
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+type OrphanStat struct {
+	Partition      string
+	Needles        int64
+	Orphans        int64
+	ReclaimedBytes int64
+	Errors         int64
+}
+
+type orphanNeedle struct {
+	bundle *Bundle
+	offset int64
+	size   int64
+}
+
+// Location of a needle in the bundle
+type needleLocation struct {
+	segment int32
+	offset  int64
+}
+
+// A tombstone expires if the timestamp of the object is before the deadline.
+// Malformed timestamps never expire.
+func isMetaExpired(meta *ObjectMeta, deadline time.Time) bool {
+	ts, err := strconv.ParseFloat(meta.Timestamp, 64)
+	if err != nil {
+		return false
+	}
+
+	return ts < float64(deadline.UnixNano())/NANO
+}
+
+// ReclaimOrphans punches holes for the needles of the partition which are
+// not referenced by any db index, e.g. needles left by a crash between
+// bundle writing and index saving, or by a deallocation lost at shutdown.
+// Only needles written before grace are reclaimed, i.e. those of segments
+// not appended to within grace. The timestamp of the object doesn't tell
+// it, since old objects are written by replication as well. If dryRun is
+// true, orphans are reported only.
+func (d *PackDevice) ReclaimOrphans(
+	partition string, grace time.Duration, dryRun bool) (*OrphanStat, error) {
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	stat := &OrphanStat{Partition: partition}
+	if !d.hasBundle(partition) {
+		return stat, nil
+	}
+
+	set, err := d.getBundle(partition)
+	if err != nil {
+		glogger.Error("unable to find bundle",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+
+	deadline := time.Now().Add(-grace)
+	var candidates []*orphanNeedle
+	for _, id := range set.segmentIDs() {
+		bundle := set.segments[id]
+		// appendNeedles keeps the segment locked until the db index is
+		// written, so every needle before end is either indexed already or
+		// an orphan.
+		bundle.Lock()
+		end := bundle.BundleSize()
+		settled := !bundle.appendedSince(deadline)
+		bundle.Unlock()
+
+		corrupted, err := walkNeedles(bundle, d.keyring, end,
+			func(offset int64, nh *NeedleHeader, meta *ObjectMeta) error {
+				stat.Needles++
+				if settled {
+					candidates = append(candidates, &orphanNeedle{
+						bundle: bundle, offset: offset, size: nh.NeedleSize})
+				}
+				return nil
+			})
+		stat.Errors += corrupted
+		if err != nil {
+			return stat, err
+		}
+	}
+	if len(candidates) == 0 {
+		return stat, nil
+	}
+
+	// Block compaction so that the db indexes are relative to the segments
+	// scanned.
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+
+	d.lock.RLock()
+	current := d.bundles[partition]
+	d.lock.RUnlock()
+	if current == nil {
+		glogger.Info("bundle has been closed during orphan scanning",
+			zap.String("partition", partition))
+		return stat, nil
+	}
+
+	// Offsets of needles are never reused, so a needle unreferenced now
+	// will never be referenced again.
+	referenced := make(map[needleLocation]bool)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		dbIndex := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", string(iter.Key().Data())),
+				zap.Error(err))
+			return stat, ErrDBIndexCorrupted
+		}
+		if idx := dbIndex.Index; idx != nil {
+			referenced[needleLocation{idx.Segment, idx.Offset}] = true
+		}
+	}
+
+	// Shared needles are also referenced by their dedup records
+	shared, err := d.sharedNeedles(partition)
+	if err != nil {
+		return stat, err
+	}
+	for loc := range shared {
+		referenced[loc] = true
+	}
+
+	for _, n := range candidates {
+		// Segments replaced by compaction are skipped
+		if current.segments[n.bundle.segment] != n.bundle ||
+			referenced[needleLocation{n.bundle.segment, n.offset}] {
+			continue
+		}
+
+		if !dryRun {
+			if err = d.punchHole(n.bundle, n.offset, n.size); err != nil {
+				glogger.Error("unable to punch hole.",
+					zap.Int64("offset", n.offset),
+					zap.Int32("segment", n.bundle.segment),
+					zap.String("partition", partition),
+					zap.Error(err))
+				return stat, err
+			}
+		}
+		stat.Orphans++
+		stat.ReclaimedBytes += n.size
+	}
+
+	return stat, nil
+}
+
+// ReclaimDeviceOrphans is the entry of reclaim-orphans command. The object
+// server must be stopped because the meta db can be opened by only one
+// process.
+func ReclaimDeviceOrphans(cnf conf.Config, flags *flag.FlagSet) ([]*OrphanStat, error) {
+	var err error
+	glogger, err = common.GetLogger(
+		flags.Lookup("l").Value.(flag.Getter).Get().(string), "pack-reclaim-orphans")
+	if err != nil {
+		return nil, err
+	}
+
+	driveRoot := cnf.GetDefault("app:object-server", "devices", "/srv/node")
+	device := flags.Lookup("d").Value.(flag.Getter).Get().(string)
+	policy := flags.Lookup("policy").Value.(flag.Getter).Get().(int)
+	grace := flags.Lookup("grace").Value.(flag.Getter).Get().(int)
+	dryRun := flags.Lookup("dry-run").Value.(flag.Getter).Get() == true
+	partitions := splitPartitions(
+		flags.Lookup("partitions").Value.(flag.Getter).Get().(string))
+
+	// Meta of encrypted needles is decrypted while scanning bundles
+	if policyKeyrings[policy], err = parseKeyring(cnf, policy); err != nil {
+		return nil, err
+	}
+
+	d := NewPackDevice(device, driveRoot, policy)
+	if d == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+	defer d.Close()
+
+	if len(partitions) == 0 {
+		if partitions, err = d.listPartitions(); err != nil {
+			return nil, err
+		}
+	}
+
+	var stats []*OrphanStat
+	for _, p := range partitions {
+		stat, err := d.ReclaimOrphans(p, time.Duration(grace)*time.Second, dryRun)
+		if err != nil {
+			glogger.Error("unable to reclaim orphan needles",
+				zap.String("device", device),
+				zap.String("partition", p),
+				zap.Error(err))
+			return stats, err
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+func TestReclaimOrphans(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 4; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+
+	// Lose the indexes of the first 2 objects as if the process crashed
+	// before saving them
+	var orphaned int64
+	for _, obj := range objs[:2] {
+		require.Nil(t, d.db.Delete(d.wopt, []byte(fmt.Sprintf("%s/data", obj.key))))
+		orphaned += obj.dataIndex.Size
+	}
+
+	stat, err := d.ReclaimOrphans(partition, time.Hour, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(4), stat.Needles)
+	require.Equal(t, int64(0), stat.Orphans)
+
+	stat, err = d.ReclaimOrphans(partition, 0, true)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), stat.Orphans)
+	require.Equal(t, orphaned, stat.ReclaimedBytes)
+
+	stat, err = d.ReclaimOrphans(partition, 0, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), stat.Orphans)
+	require.Equal(t, orphaned, stat.ReclaimedBytes)
+
+	// Holes are not recognized as needles any more
+	stat, err = d.ReclaimOrphans(partition, 0, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), stat.Needles)
+	require.Equal(t, int64(0), stat.Orphans)
+
+	for _, obj := range objs[2:] {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		require.True(t, vo.exists)
+
+		r, err := d.NewReader(vo)
+		require.Nil(t, err)
+		hash := md5.New()
+		io.Copy(hash, r)
+		require.Equal(t, obj.meta.SystemMeta[common.HEtag],
+			hex.EncodeToString(hash.Sum(nil)))
+	}
+}
+
+func TestReclaimOrphansOfOldObjects(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	// An object of 2 days ago pushed by replication right now, whose index
+	// is not saved yet
+	partition := "1"
+	obj := newPackObject(SIZE_1K, partition)
+	obj.meta.Timestamp = common.CanonicalTimestampFromTime(
+		time.Now().Add(-time.Hour * 48))
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+	require.Nil(t, d.db.Delete(d.wopt, []byte(fmt.Sprintf("%s/data", obj.key))))
+
+	stat, err := d.ReclaimOrphans(partition, time.Hour, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Needles)
+	require.Equal(t, int64(0), stat.Orphans)
+
+	// Reclaimed once the segment has not been written for the grace period
+	set, err := d.getBundle(partition)
+	require.Nil(t, err)
+	atomic.StoreInt64(&set.segments[0].appended,
+		time.Now().Add(-time.Hour*2).UnixNano())
+	stat, err = d.ReclaimOrphans(partition, time.Hour, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Orphans)
+	require.Equal(t, obj.dataIndex.Size, stat.ReclaimedBytes)
+}
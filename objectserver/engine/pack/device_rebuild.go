@@ -0,0 +1,552 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+// IndexDiff is a db index which is different from the rebuilt one.
+// Existing is nil if the index is missing in the db, and Rebuilt is nil if
+// the index should not exist.
+type IndexDiff struct {
+	Key      string
+	Existing *DBIndex
+	Rebuilt  *DBIndex
+}
+
+type RebuildStat struct {
+	Partitions int64
+	Needles    int64
+	Files      int64
+	Indexes    int64
+	Errors     int64
+	Diffs      []*IndexDiff
+}
+
+// All the parts of an object found on the disk. Only the newest one of each
+// part is kept.
+type rebuiltObject struct {
+	data *DBIndex
+	meta *DBIndex
+	ts   *DBIndex
+}
+
+func isNewerIndex(a, b *DBIndex) bool {
+	if b == nil {
+		return true
+	}
+
+	ta, err1 := strconv.ParseFloat(a.Meta.Timestamp, 64)
+	tb, err2 := strconv.ParseFloat(b.Meta.Timestamp, 64)
+	if err1 != nil || err2 != nil {
+		return a.Meta.Timestamp > b.Meta.Timestamp
+	}
+
+	return ta > tb
+}
+
+func (o *rebuiltObject) add(ot PartType, idx *DBIndex) {
+	switch ot {
+	case DATA:
+		if isNewerIndex(idx, o.data) {
+			o.data = idx
+		}
+	case META:
+		if isNewerIndex(idx, o.meta) {
+			o.meta = idx
+		}
+	case TOMBSTONE:
+		if isNewerIndex(idx, o.ts) {
+			o.ts = idx
+		}
+	}
+}
+
+// Resolves the db indexes of the object in the same way as they are
+// committed.
+func (o *rebuiltObject) indexes() map[PartType]*DBIndex {
+	indexes := make(map[PartType]*DBIndex)
+	if o.ts != nil && (o.data == nil || !isNewerIndex(o.data, o.ts)) {
+		indexes[TOMBSTONE] = o.ts
+		return indexes
+	}
+
+	if o.data == nil {
+		return indexes
+	}
+	indexes[DATA] = o.data
+
+	// Meta of SO is saved as needle while meta of LO is saved as file
+	if o.meta != nil && isNewerIndex(o.meta, o.data) &&
+		(o.meta.Index == nil) == (o.data.Index == nil) {
+		indexes[META] = o.meta
+	}
+
+	return indexes
+}
+
+func isSameDBIndex(a, b *DBIndex) bool {
+	return proto.Equal(a.Index, b.Index) &&
+		a.Meta.GetTimestamp() == b.Meta.GetTimestamp()
+}
+
+// Meta needles never carry data. Besides, immutable system metadata such as
+// ETag are removed from them because they are identical to the data needle.
+func isDataNeedle(nh *NeedleHeader, meta *ObjectMeta) bool {
+	if nh.DataSize > 0 {
+		return true
+	}
+
+	_, ok := meta.SystemMeta[common.HEtag]
+	return ok
+}
+
+func (d *PackDevice) listPartitions() ([]string, error) {
+	names, err := fs.ReadDirNames(d.objectsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []string
+	for _, name := range names {
+		if common.IsDecimal(name) {
+			partitions = append(partitions, name)
+		}
+	}
+
+	return partitions, nil
+}
+
+// Walks through the bundle needle by needle until end. Needles are 4K
+// aligned, so when a needle is unrecognizable, e.g. deallocated, the
+// walking continues from the next 4K block. Needles failing the checksum
+// are skipped and counted in the returned number. Meta of encrypted needles
+// is decrypted by the keyring.
+func walkNeedles(bundle *Bundle, kr *Keyring, end int64,
+	fn func(offset int64, nh *NeedleHeader, meta *ObjectMeta) error) (int64, error) {
+	var corrupted int64
+	hs := int64(bundle.needleHeaderSize())
+	header := make([]byte, hs)
+	for offset := int64(SuperBlockDiskSize); offset < end; {
+		if _, err := bundle.ReadAt(header, offset); err != nil {
+			glogger.Error("unable to read needle header",
+				zap.String("partition", bundle.partition),
+				zap.Int32("segment", bundle.segment),
+				zap.Int64("offset", offset),
+				zap.Error(err))
+			return corrupted, err
+		}
+
+		nh := &NeedleHeader{}
+		nh.DeserializeFrom(header)
+		size := nh.MetaOffset + int64(nh.MetaSize) - offset
+		if nh.MagicNumber != NeedleMagicNumber ||
+			nh.NeedleSize <= 0 || nh.NeedleSize%NeedleAlignment != 0 ||
+			nh.DataOffset != offset+hs || nh.DataSize < 0 ||
+			nh.MetaOffset != nh.DataOffset+nh.DataSize ||
+			size > nh.NeedleSize || offset+nh.NeedleSize > end {
+			offset += NeedleAlignment
+			continue
+		}
+
+		needle := make([]byte, size)
+		if _, err := bundle.ReadAt(needle, offset); err != nil {
+			glogger.Error("unable to read needle",
+				zap.String("partition", bundle.partition),
+				zap.Int32("segment", bundle.segment),
+				zap.Int64("offset", offset),
+				zap.Error(err))
+			return corrupted, err
+		}
+
+		meta := new(ObjectMeta)
+		err := bundle.verifyNeedle(needle)
+		var b []byte
+		if err == nil {
+			b, err = kr.openPart(nh.Flags, needle[nh.MetaOffset-offset:], needleMetaAD)
+		}
+		if err == nil {
+			err = proto.Unmarshal(b, meta)
+		}
+		if err != nil || meta.Name == "" {
+			glogger.Error("skip corrupted needle",
+				zap.String("partition", bundle.partition),
+				zap.Int32("segment", bundle.segment),
+				zap.Int64("offset", offset),
+				zap.Error(err))
+			corrupted++
+			offset += NeedleAlignment
+			continue
+		}
+
+		if err = fn(offset, nh, meta); err != nil {
+			return corrupted, err
+		}
+
+		offset += nh.NeedleSize
+	}
+
+	return corrupted, nil
+}
+
+// Locations of the data needles found are saved in needles.
+func (d *PackDevice) scanBundle(partition string, objects map[string]*rebuiltObject,
+	needles map[needleLocation]bool, stat *RebuildStat) error {
+	if !d.hasBundle(partition) {
+		return nil
+	}
+
+	set, err := d.getBundle(partition)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range set.segmentIDs() {
+		bundle := set.segments[id]
+		corrupted, err := walkNeedles(bundle, d.keyring, bundle.BundleSize(),
+			func(offset int64, nh *NeedleHeader, meta *ObjectMeta) error {
+				ot := META
+				if isDataNeedle(nh, meta) {
+					ot = DATA
+					needles[needleLocation{id, offset}] = true
+				}
+
+				key := generateObjectKey(d.hashPrefix, d.hashSuffix, meta.Name, partition)
+				obj, ok := objects[key]
+				if !ok {
+					obj = &rebuiltObject{}
+					objects[key] = obj
+				}
+				obj.add(ot, &DBIndex{
+					Index: &NeedleIndex{
+						Offset:     offset,
+						Size:       nh.NeedleSize,
+						DataOffset: nh.DataOffset,
+						DataSize:   nh.DataSize,
+						MetaOffset: nh.MetaOffset,
+						MetaSize:   nh.MetaSize,
+						Flags:      nh.Flags,
+						Segment:    id,
+					},
+					Meta: meta,
+				})
+				stat.Needles++
+				return nil
+			})
+		stat.Errors += corrupted
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Large objects are rebuilt from the attributes of .data/.meta/.ts files
+// in the same way as lazy migration.
+func (d *PackDevice) scanLargeObjects(partition string,
+	objects map[string]*rebuiltObject, stat *RebuildStat) error {
+	pd := filepath.Join(d.objectsDir, partition)
+	suffixes, err := fs.ReadDirNames(pd)
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range suffixes {
+		if len(suffix) != 3 || !common.IsHex(suffix) {
+			continue
+		}
+
+		hashes, err := fs.ReadDirNames(filepath.Join(pd, suffix))
+		if err != nil {
+			glogger.Error("unable to list suffix directory",
+				zap.String("partition", partition),
+				zap.String("suffix", suffix),
+				zap.Error(err))
+			stat.Errors++
+			continue
+		}
+
+		for _, hash := range hashes {
+			if len(hash) != 32 {
+				continue
+			}
+
+			hashDir := filepath.Join(pd, suffix, hash)
+			files, err := fs.ReadDirNames(hashDir)
+			if err != nil {
+				stat.Errors++
+				continue
+			}
+
+			key := generateKeyFromHash(partition, hash)
+			for _, f := range files {
+				ot := PartType(strings.TrimPrefix(filepath.Ext(f), "."))
+				if ot != DATA && ot != META && ot != TOMBSTONE {
+					continue
+				}
+
+				metadata, err := ReadMetadata(filepath.Join(hashDir, f))
+				if err != nil || metadata["name"] == "" {
+					glogger.Error("unable to read attributes of object file",
+						zap.String("path", filepath.Join(hashDir, f)),
+						zap.Error(err))
+					stat.Errors++
+					continue
+				}
+
+				o := &PackObject{
+					name:      metadata["name"],
+					key:       key,
+					partition: partition,
+				}
+				o.populateObjectMeta(metadata)
+
+				obj, ok := objects[key]
+				if !ok {
+					obj = &rebuiltObject{}
+					objects[key] = obj
+				}
+				obj.add(ot, &DBIndex{Meta: o.meta})
+				stat.Files++
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *PackDevice) rebuildPartitionIndex(
+	partition string, dryRun bool, stat *RebuildStat) error {
+	objects := make(map[string]*rebuiltObject)
+	needles := make(map[needleLocation]bool)
+	if err := d.scanBundle(partition, objects, needles, stat); err != nil {
+		return err
+	}
+	if err := d.scanLargeObjects(partition, objects, stat); err != nil {
+		return err
+	}
+
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	unlock := d.lockDedupStripes(nil)
+	defer unlock()
+
+	existing := make(map[string]*DBIndex)
+	shared := make(map[needleLocation]bool)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		dbIndex := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			existing[key] = nil
+			continue
+		}
+		existing[key] = dbIndex
+
+		// Tombstone of SO is saved in db only. Keep it unless there is
+		// newer data.
+		if strings.HasSuffix(key, "/"+string(TOMBSTONE)) && dbIndex.Meta != nil {
+			objKey := strings.TrimSuffix(key, "/"+string(TOMBSTONE))
+			obj, ok := objects[objKey]
+			if !ok {
+				obj = &rebuiltObject{}
+				objects[objKey] = obj
+			}
+			obj.add(TOMBSTONE, dbIndex)
+		}
+
+		// A shared needle only has the meta of the object which appended
+		// it. The indexes referring to it are kept as long as it is found,
+		// unless there is newer data.
+		if idx := dbIndex.Index; idx.GetDigest() != "" &&
+			needles[needleLocation{idx.Segment, idx.Offset}] {
+			shared[needleLocation{idx.Segment, idx.Offset}] = true
+			objKey := strings.TrimSuffix(key, "/"+string(DATA))
+			obj, ok := objects[objKey]
+			if !ok {
+				obj = &rebuiltObject{}
+				objects[objKey] = obj
+			}
+			if obj.data != nil && isSameNeedle(obj.data.Index, idx) {
+				obj.data = dbIndex
+			} else {
+				obj.add(DATA, dbIndex)
+			}
+		}
+	}
+	iter.Close()
+
+	// The object which appended a shared needle may have been deleted or
+	// overridden, while the needle is still referred to by the others.
+	for _, obj := range objects {
+		idx := obj.data.GetIndex()
+		if idx != nil && idx.Digest == "" &&
+			shared[needleLocation{idx.Segment, idx.Offset}] {
+			obj.data = nil
+		}
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	rebuilt := make(map[string]bool)
+	var dataIndexes []*DBIndex
+	for objKey, obj := range objects {
+		for ot, dbIndex := range obj.indexes() {
+			key := fmt.Sprintf("%s/%s", objKey, ot)
+			rebuilt[key] = true
+			stat.Indexes++
+			if ot == DATA {
+				dataIndexes = append(dataIndexes, dbIndex)
+			}
+
+			old := existing[key]
+			if old != nil && isSameDBIndex(old, dbIndex) {
+				continue
+			}
+			stat.Diffs = append(stat.Diffs,
+				&IndexDiff{Key: key, Existing: old, Rebuilt: dbIndex})
+
+			b, err := proto.Marshal(dbIndex)
+			if err != nil {
+				return err
+			}
+			batch.Put([]byte(key), b)
+		}
+	}
+
+	for key, old := range existing {
+		if rebuilt[key] {
+			continue
+		}
+		stat.Diffs = append(stat.Diffs, &IndexDiff{Key: key, Existing: old})
+		batch.Delete([]byte(key))
+	}
+
+	if err := d.rebuildDedupRecords(batch, partition, dataIndexes); err != nil {
+		glogger.Error("unable to rebuild dedup records",
+			zap.String("partition", partition), zap.Error(err))
+		return err
+	}
+
+	if dryRun || batch.Count() == 0 {
+		return nil
+	}
+
+	// The usage of the partition is counted from the rebuilt indexes on
+	// next load
+	batch.Delete(usageKey(partition))
+	err := d.writeBatch(batch)
+	d.cache.invalidatePartition(partition)
+	if err != nil {
+		return err
+	}
+
+	// Summaries may have missed the indexes which were corrupted
+	return d.buildSuffixSummaries(partition)
+}
+
+// RebuildIndex rebuilds the db indexes of the given partitions from bundle
+// files and large object files. All the partitions of the device are rebuilt
+// if partitions is empty. If dryRun is true, the db will not be changed and
+// only differences are reported.
+func (d *PackDevice) RebuildIndex(
+	partitions []string, dryRun bool) (*RebuildStat, error) {
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	var err error
+	if len(partitions) == 0 {
+		if partitions, err = d.listPartitions(); err != nil {
+			glogger.Error("unable to list partitions",
+				zap.String("device", d.device), zap.Error(err))
+			return nil, err
+		}
+	}
+
+	stat := &RebuildStat{}
+	for _, p := range partitions {
+		if err = d.rebuildPartitionIndex(p, dryRun, stat); err != nil {
+			glogger.Error("unable to rebuild partition index",
+				zap.String("device", d.device),
+				zap.String("partition", p),
+				zap.Error(err))
+			return stat, err
+		}
+		stat.Partitions++
+	}
+
+	return stat, nil
+}
+
+// Parses the comma separated partition filter of commands.
+func splitPartitions(filter string) []string {
+	var partitions []string
+	for _, p := range strings.Split(filter, ",") {
+		if p != "" {
+			partitions = append(partitions, p)
+		}
+	}
+
+	return partitions
+}
+
+// RebuildDeviceIndex is the entry of rebuild-index command. The object
+// server must be stopped because the meta db can be opened by only one
+// process.
+func RebuildDeviceIndex(cnf conf.Config, flags *flag.FlagSet) (*RebuildStat, error) {
+	var err error
+	glogger, err = common.GetLogger(
+		flags.Lookup("l").Value.(flag.Getter).Get().(string), "pack-rebuild-index")
+	if err != nil {
+		return nil, err
+	}
+
+	driveRoot := cnf.GetDefault("app:object-server", "devices", "/srv/node")
+	device := flags.Lookup("d").Value.(flag.Getter).Get().(string)
+	policy := flags.Lookup("policy").Value.(flag.Getter).Get().(int)
+	dryRun := flags.Lookup("dry-run").Value.(flag.Getter).Get() == true
+
+	partitions := splitPartitions(
+		flags.Lookup("partitions").Value.(flag.Getter).Get().(string))
+
+	// Meta of encrypted needles is decrypted while scanning bundles
+	if policyKeyrings[policy], err = parseKeyring(cnf, policy); err != nil {
+		return nil, err
+	}
+
+	d := NewPackDevice(device, driveRoot, policy)
+	if d == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+	defer d.Close()
+
+	return d.RebuildIndex(partitions, dryRun)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+// Populates a partition with a SO, a SO with extra meta, a deleted SO and
+// a LO. Returns the db indexes saved.
+func populateRebuildPartition(t *testing.T, d *PackDevice,
+	partition string) map[string][]byte {
+	for i := 0; i < 3; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+
+		vo := copyVanilla(obj)
+		vo.device = d
+		vo.asyncWG = &sync.WaitGroup{}
+		require.Nil(t, d.LoadObjectMeta(vo))
+		switch i {
+		case 1:
+			require.Nil(t, vo.CommitMeta(map[string]string{
+				common.XTimestamp:     incSeconds(obj.meta.Timestamp, 1),
+				"X-Object-Meta-Color": "blue",
+			}))
+		case 2:
+			vo.meta.Timestamp = incSeconds(obj.meta.Timestamp, 1)
+			require.Nil(t, d.CommitDeletion(vo))
+		}
+	}
+
+	obj := newPackLO(partition)
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	indexes := make(map[string][]byte)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.db.NewIterator(d.ropt)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		indexes[string(iter.Key().Data())] = append([]byte{}, iter.Value().Data()...)
+	}
+
+	return indexes
+}
+
+func TestRebuildIndexDryRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	indexes := populateRebuildPartition(t, d, partition)
+	require.Len(t, indexes, 5)
+
+	stat, err := d.RebuildIndex(nil, true)
+	require.Nil(t, err)
+	require.Empty(t, stat.Diffs)
+	require.Equal(t, int64(5), stat.Indexes)
+
+	// Remove a db index, which should be reported but not be restored
+	for k := range indexes {
+		require.Nil(t, d.db.Delete(d.wopt, []byte(k)))
+		stat, err = d.RebuildIndex([]string{partition}, true)
+		require.Nil(t, err)
+
+		if len(stat.Diffs) == 0 {
+			// Tombstone of SO cannot be rebuilt
+			continue
+		}
+		require.Len(t, stat.Diffs, 1)
+		require.Equal(t, k, stat.Diffs[0].Key)
+		require.Nil(t, stat.Diffs[0].Existing)
+
+		v, err := d.db.GetBytes(d.ropt, []byte(k))
+		require.Nil(t, err)
+		require.Empty(t, v)
+		break
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	indexes := populateRebuildPartition(t, d, partition)
+	for k := range indexes {
+		require.Nil(t, d.db.Delete(d.wopt, []byte(k)))
+	}
+	// Garbage index should be removed
+	garbage := fmt.Sprintf("/%s/abc/garbage/data", partition)
+	require.Nil(t, d.db.Put(d.wopt, []byte(garbage), []byte("garbage")))
+
+	stat, err := d.RebuildIndex(nil, false)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Partitions)
+	// One tombstone is lost
+	require.Equal(t, int64(4), stat.Indexes)
+
+	v, err := d.db.GetBytes(d.ropt, []byte(garbage))
+	require.Nil(t, err)
+	require.Empty(t, v)
+
+	for k, b := range indexes {
+		expected := new(DBIndex)
+		require.Nil(t, proto.Unmarshal(b, expected))
+
+		v, err := d.db.GetBytes(d.ropt, []byte(k))
+		require.Nil(t, err)
+		if strings.HasSuffix(k, "/ts") {
+			// Tombstone of SO
+			require.Empty(t, v)
+			continue
+		}
+
+		rebuilt := new(DBIndex)
+		require.Nil(t, proto.Unmarshal(v, rebuilt))
+		require.True(t, proto.Equal(expected.Index, rebuilt.Index))
+		require.Equal(t, expected.Meta.Timestamp, rebuilt.Meta.Timestamp)
+	}
+}
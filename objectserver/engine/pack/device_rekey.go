@@ -0,0 +1,306 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+type RekeyStat struct {
+	Partition string
+	Segments  int64 // bundle segments rewritten
+	Needles   int64 // needle indexes relocated to the rewritten segments
+	Files     int64 // LO data files encrypted again
+}
+
+// RekeyPartition encrypts the needles and LO data files of the partition
+// which are not sealed with the active key, including those in plain text.
+// Needles are sealed again by compacting the segments holding any of them,
+// so that the needles shared by dedup are rewritten only once. Segments
+// sealed with the active key already are left as they are, so reencrypting
+// a partition again resumes where it was interrupted.
+func (d *PackDevice) RekeyPartition(partition string) (*RekeyStat, error) {
+	if d.keyring == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	stat := &RekeyStat{Partition: partition}
+	if d.hasBundle(partition) {
+		segments, err := d.segmentsToRekey(partition)
+		if err != nil {
+			return stat, err
+		}
+		for _, id := range segments {
+			s, err := d.compactSegment(partition, id, d.keyring)
+			if err != nil {
+				glogger.Error("unable to rekey bundle segment",
+					zap.String("device", d.device),
+					zap.String("partition", partition),
+					zap.Int32("segment", id),
+					zap.Error(err))
+				return stat, err
+			}
+			stat.Segments++
+			stat.Needles += s.Needles
+		}
+	}
+
+	// Data files of LO, whose data indexes have no needle index
+	var candidates []*PackObject
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		if !strings.HasSuffix(key, "/"+string(DATA)) {
+			continue
+		}
+
+		dbIndex := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			continue
+		}
+		if dbIndex.Index == nil && dbIndex.Meta != nil {
+			candidates = append(candidates, &PackObject{
+				name:      dbIndex.Meta.Name,
+				key:       strings.TrimSuffix(key, "/"+string(DATA)),
+				partition: partition,
+				dMeta:     dbIndex.Meta,
+			})
+		}
+	}
+	iter.Close()
+
+	for _, obj := range candidates {
+		rekeyed, err := d.rekeyLO(obj)
+		if err != nil {
+			glogger.Error("unable to rekey large object",
+				zap.String("device", d.device),
+				zap.String("object", obj.name),
+				zap.Error(err))
+			return stat, err
+		}
+		if rekeyed {
+			stat.Files++
+		}
+	}
+
+	return stat, nil
+}
+
+// segmentsToRekey returns the ids of the segments of the partition which
+// hold any needle not sealed with the active key. The key of an encrypted
+// needle is told from the key id at the beginning of its meta part.
+func (d *PackDevice) segmentsToRekey(partition string) ([]int32, error) {
+	set, err := d.getBundle(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int32]bool)
+	keyID := make([]byte, keyIDSize)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		dbIndex := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", string(iter.Key().Data())),
+				zap.Error(err))
+			continue
+		}
+		idx := dbIndex.Index
+		if idx == nil || found[idx.Segment] {
+			continue
+		}
+
+		if isEncrypted(idx) {
+			bundle, err := set.segment(idx.Segment)
+			if err != nil {
+				return nil, err
+			}
+			// Needles unreadable here are reported by the compaction
+			if _, err = bundle.ReadAt(keyID, idx.MetaOffset); err == nil &&
+				!d.keyring.needsReseal(idx.Flags, keyID) {
+				continue
+			}
+		}
+		found[idx.Segment] = true
+	}
+
+	var segments []int32
+	for _, id := range set.segmentIDs() {
+		if found[id] {
+			segments = append(segments, id)
+		}
+	}
+
+	return segments, nil
+}
+
+// rekeyLO replaces the data file of the LO by a copy sealed with the active
+// key. The copy keeps the metadata of the file and is saved only if the
+// object has not been modified since it was listed. False is returned if
+// the file is sealed with the active key already.
+func (d *PackDevice) rekeyLO(obj *PackObject) (bool, error) {
+	hashDir := filepath.Join(d.objectsDir, obj.key)
+	dp := filepath.Join(hashDir, fmt.Sprintf("%s.%s", obj.dMeta.Timestamp, DATA))
+	f, err := os.Open(dp)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	id, sealed, err := loKeyID(f.Fd())
+	if err != nil || (sealed && id == d.keyring.active) {
+		return false, err
+	}
+
+	metadata, err := RawReadMetadata(f.Fd())
+	if err != nil {
+		return false, err
+	}
+
+	var src io.Reader = f
+	if sealed {
+		fi, err := f.Stat()
+		if err != nil {
+			return false, err
+		}
+		opener, err := newChunkOpener(f, fi.Size(), d.keyring, id)
+		if err != nil {
+			return false, err
+		}
+		src = io.NewSectionReader(opener, 0, opener.Size())
+	}
+
+	w, err := fs.NewAtomicFileWriter(d.tempDir(), hashDir)
+	if err != nil {
+		return false, err
+	}
+	defer w.Abandon()
+
+	if err = RawWriteMetadata(w.Fd(), metadata); err != nil {
+		return false, err
+	}
+	s := newChunkSealer(w, d.keyring)
+	if _, err = io.Copy(s, src); err != nil {
+		return false, err
+	}
+	if err = s.Flush(); err != nil {
+		return false, err
+	}
+	if err = setLOKeyID(w.Fd(), d.keyring.active); err != nil {
+		return false, err
+	}
+
+	// Commits are excluded, so that the file can't be replaced or removed
+	// between the check and the save.
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+
+	dbIndex, err := d.getDBIndex(obj.key, DATA)
+	if err != nil || dbIndex == nil || dbIndex.Index != nil ||
+		dbIndex.Meta.Timestamp != obj.dMeta.Timestamp {
+		return false, err
+	}
+
+	if err = w.Save(dp); err != nil {
+		glogger.Error("unable to save rekeyed large object",
+			zap.String("object", obj.name),
+			zap.String("dst", dp),
+			zap.Error(err))
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ReencryptDevice is the entry of reencrypt command. It seals all the data
+// of the device with the active key of the policy, so that the keys used
+// before could be retired. Object server must be stopped.
+func ReencryptDevice(cnf conf.Config, flags *flag.FlagSet) ([]*RekeyStat, error) {
+	var err error
+	glogger, err = common.GetLogger(
+		flags.Lookup("l").Value.(flag.Getter).Get().(string), "pack-reencrypt")
+	if err != nil {
+		return nil, err
+	}
+
+	driveRoot := cnf.GetDefault("app:object-server", "devices", "/srv/node")
+	device := flags.Lookup("d").Value.(flag.Getter).Get().(string)
+	policy := flags.Lookup("policy").Value.(flag.Getter).Get().(int)
+	partitions := splitPartitions(
+		flags.Lookup("partitions").Value.(flag.Getter).Get().(string))
+
+	keyring, err := parseKeyring(cnf, policy)
+	if err != nil {
+		return nil, err
+	}
+	if keyring == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	policyKeyrings[policy] = keyring
+
+	d := NewPackDevice(device, driveRoot, policy)
+	if d == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+	defer d.Close()
+
+	if len(partitions) == 0 {
+		if partitions, err = d.listPartitions(); err != nil {
+			return nil, err
+		}
+	}
+
+	var stats []*RekeyStat
+	for _, p := range partitions {
+		stat, err := d.RekeyPartition(p)
+		if stat != nil {
+			stats = append(stats, stat)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	glogger.Info("device reencrypted",
+		zap.String("device", device),
+		zap.Int("policy", policy),
+		zap.Uint32("key-id", keyring.active),
+		zap.Int("partitions", len(stats)))
+
+	return stats, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the id of the key sealing the meta of the needle
+func needleKeyID(t *testing.T, d *PackDevice, obj *PackObject) uint32 {
+	idx := loadDataIndex(t, d, obj)
+	require.True(t, isEncrypted(idx))
+	set, err := d.getBundle(obj.partition)
+	require.Nil(t, err)
+	bundle, err := set.segment(idx.Segment)
+	require.Nil(t, err)
+
+	meta := make([]byte, idx.MetaSize)
+	_, err = bundle.ReadAt(meta, idx.MetaOffset)
+	require.Nil(t, err)
+	return binary.LittleEndian.Uint32(meta)
+}
+
+func fileKeyID(t *testing.T, d *PackDevice, obj *PackObject) uint32 {
+	f, err := os.Open(generateLOFilePath(obj, obj.meta.Timestamp, DATA))
+	require.Nil(t, err)
+	defer f.Close()
+	id, sealed, err := loKeyID(f.Fd())
+	require.Nil(t, err)
+	require.True(t, sealed)
+	return id
+}
+
+func TestEncryptedObjects(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	d.keyring = newTestKeyring(t, 0)
+
+	partition := "1"
+	so := newPackObject(SIZE_1K*8, partition)
+	lo := newPackLO(partition)
+	lo.device = d
+	for _, obj := range []*PackObject{so, lo} {
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+	}
+	requireObjects(t, d, []*PackObject{so, lo})
+	require.Equal(t, uint32(2), needleKeyID(t, d, so))
+	require.Equal(t, uint32(2), fileKeyID(t, d, lo))
+
+	// Ranges are decrypted as well
+	for _, obj := range []*PackObject{so, lo} {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		r, err := d.NewRangeReader(vo, 100, 1000)
+		require.Nil(t, err)
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		require.Nil(t, err)
+		vr, err := d.NewReader(vo)
+		require.Nil(t, err)
+		all, err := ioutil.ReadAll(vr)
+		vr.Close()
+		require.Nil(t, err)
+		require.Equal(t, all[100:1100], got)
+	}
+
+	// Meta needles are decrypted by index rebuilding
+	vo := copyVanilla(so)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = incSeconds(vo.meta.Timestamp, 1)
+	vo.meta.UserMeta["X-Object-Meta-Tag"] = "dev"
+	require.Nil(t, d.CommitUpdate(vo))
+	stat, err := d.RebuildIndex([]string{partition}, false)
+	require.Nil(t, err)
+	require.Empty(t, stat.Diffs)
+	require.Zero(t, stat.Errors)
+
+	// Data can't be read without the key
+	d.keyring = nil
+	for _, obj := range []*PackObject{so, lo} {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		_, err := d.NewReader(vo)
+		require.Equal(t, ErrEncryptionKeyNotFound, err)
+	}
+}
+
+func TestRekeyPartition(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	_, err = d.RekeyPartition("1")
+	require.Equal(t, ErrEncryptionDisabled, err)
+
+	// Objects in plain text and sealed with the old key
+	partition := "1"
+	var objs []*PackObject
+	for _, kr := range []*Keyring{nil, newTestKeyring(t, 1)} {
+		d.keyring = kr
+		so := newPackSO(partition)
+		lo := newPackLO(partition)
+		lo.device = d
+		for _, obj := range []*PackObject{so, lo} {
+			require.Nil(t, feedObject(obj, d))
+			require.Nil(t, d.CommitWrite(obj))
+			obj.Close()
+		}
+		objs = append(objs, so, lo)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	d.keyring = newTestKeyring(t, 2)
+	requireObjects(t, d, objs)
+
+	stat, err := d.RekeyPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Segments)
+	require.Equal(t, int64(2), stat.Files)
+	for _, obj := range objs {
+		if obj.small {
+			require.Equal(t, uint32(2), needleKeyID(t, d, obj))
+		} else {
+			require.Equal(t, uint32(2), fileKeyID(t, d, obj))
+		}
+	}
+
+	// The old key is no longer needed
+	d.keyring, err = newKeyring([]byte(
+		"2 000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"), 0)
+	require.Nil(t, err)
+	requireObjects(t, d, objs)
+
+	stat, err = d.RekeyPartition(partition)
+	require.Nil(t, err)
+	require.Zero(t, stat.Segments)
+	require.Zero(t, stat.Files)
+}
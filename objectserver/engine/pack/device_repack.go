@@ -0,0 +1,308 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+// Needle threshold of each pack policy, configured in [object-pack] and
+// overridden by [object-pack:<policy index>]
+var policyNeedleThresholds = make(map[int]int64)
+
+func parseNeedleThreshold(config conf.Config, policy int) (int64, error) {
+	v, ok := policyOption(config, policy, "needle_threshold")
+	if !ok {
+		return NEEDLE_THRESHOLD, nil
+	}
+
+	threshold, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if threshold <= 0 {
+		return 0, ErrInvalidNeedleThreshold
+	}
+
+	return threshold, nil
+}
+
+type RepackStat struct {
+	ToLarge int64 // SO moved out to standalone files
+	ToSmall int64 // LO moved into the bundle
+}
+
+type repackCandidate struct {
+	key   string
+	name  string
+	small bool
+}
+
+// Returns true if the object is on the wrong side of the needle threshold
+func (d *PackDevice) needsRepack(dbIndex *DBIndex) bool {
+	small := dbIndex.Index != nil
+	if small {
+		return dbIndex.Meta.DataSize > d.needleThreshold
+	}
+
+	return dbIndex.Meta.DataSize >= 0 && dbIndex.Meta.DataSize <= d.needleThreshold
+}
+
+// RepackPartition moves the SOs of the partition exceeding the needle
+// threshold out to standalone files, and the LOs within it into the
+// bundle. Timestamps and metadata are kept, so replicas are not affected.
+func (d *PackDevice) RepackPartition(partition string) (*RepackStat, error) {
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	var candidates []*repackCandidate
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		if !strings.HasSuffix(key, "/"+string(DATA)) {
+			continue
+		}
+
+		dbIndex := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			continue
+		}
+		if d.needsRepack(dbIndex) {
+			candidates = append(candidates, &repackCandidate{
+				key:   strings.TrimSuffix(key, "/"+string(DATA)),
+				name:  dbIndex.Meta.Name,
+				small: dbIndex.Index != nil,
+			})
+		}
+	}
+	iter.Close()
+
+	stat := &RepackStat{}
+	for _, c := range candidates {
+		if d.isCompactionStopped() {
+			return stat, ErrRepackAborted
+		}
+
+		moved, err := d.repackObject(&PackObject{
+			name:      c.name,
+			key:       c.key,
+			partition: partition,
+			device:    d,
+		})
+		if err != nil {
+			glogger.Error("unable to repack object",
+				zap.String("device", d.device),
+				zap.String("object", c.name),
+				zap.Bool("small", c.small),
+				zap.Error(err))
+			return stat, err
+		}
+		if !moved {
+			continue
+		}
+
+		if c.small {
+			stat.ToLarge++
+		} else {
+			stat.ToSmall++
+		}
+	}
+
+	return stat, nil
+}
+
+// Returns true if the data and meta indexes of the object are still the
+// ones loaded into obj.
+func (d *PackDevice) isObjectUnchanged(obj *PackObject) (bool, error) {
+	dataDBIdx, err := d.getDBIndex(obj.key, DATA)
+	if err != nil || dataDBIdx == nil {
+		return false, err
+	}
+	if dataDBIdx.Meta.Timestamp != obj.dMeta.Timestamp ||
+		!proto.Equal(dataDBIdx.Index, obj.dataIndex) {
+		return false, nil
+	}
+
+	metaDBIdx, err := d.getDBIndex(obj.key, META)
+	if err != nil {
+		return false, err
+	}
+	if metaDBIdx == nil || obj.mMeta == nil {
+		return metaDBIdx == nil && obj.mMeta == nil, nil
+	}
+
+	return metaDBIdx.Meta.Timestamp == obj.mMeta.Timestamp, nil
+}
+
+// repackObject moves the object across the needle threshold. The data is
+// copied before the indexes are locked, and the copy is committed only if
+// the object has not been modified since it was loaded. False is returned
+// if the object needs no repacking any more.
+func (d *PackDevice) repackObject(obj *PackObject) (bool, error) {
+	if err := d.LoadObjectMeta(obj); err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	if !obj.exists || !d.needsRepack(&DBIndex{Meta: obj.dMeta, Index: obj.dataIndex}) {
+		return false, nil
+	}
+
+	// The new copy keeps the data part as it is. The meta part, if any, is
+	// committed after the data part.
+	dst := &PackObject{
+		name:      obj.name,
+		key:       obj.key,
+		partition: obj.partition,
+		device:    d,
+		exists:    true,
+		small:     !obj.small,
+		dataSize:  obj.dMeta.DataSize,
+		meta:      obj.dMeta.DeepCopy(),
+		dataIndex: obj.dataIndex,
+		metaIndex: obj.metaIndex,
+		bundle:    obj.bundle,
+		repack:    true,
+	}
+
+	var err error
+	if dst.small {
+		dst.writer, err = d.newSOWriter(dst)
+	} else {
+		dst.writer, err = d.newLOWriter(dst)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer dst.writer.Close()
+
+	r, err := d.NewReader(obj)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(dst.writer, r)
+	r.Close()
+	if err != nil {
+		glogger.Error("unable to copy object data",
+			zap.String("object", obj.name), zap.Error(err))
+		return false, err
+	}
+
+	// The object is locked like CommitWrite does, so that it can't be
+	// modified between the check and the commit.
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+	d.km.Lock(obj.key)
+	defer d.km.Unlock(obj.key)
+	defer d.cache.invalidate(obj.key)
+
+	unchanged, err := d.isObjectUnchanged(obj)
+	if err != nil || !unchanged {
+		return false, err
+	}
+
+	// The stale copy is deallocated by the commit
+	if err = d.commitRepacked(dst, DATA); err != nil {
+		return false, err
+	}
+
+	if obj.mMeta != nil {
+		dst.meta = obj.mMeta.DeepCopy()
+		dst.dataSize = 0
+		dst.metaIndex = nil
+		if err = d.commitRepacked(dst, META); err != nil {
+			return false, err
+		}
+	}
+
+	glogger.Info("object repacked",
+		zap.String("device", d.device),
+		zap.String("object", obj.name),
+		zap.Bool("small", dst.small),
+		zap.Int64("size", obj.dMeta.DataSize))
+
+	return true, nil
+}
+
+func (d *PackDevice) commitRepacked(obj *PackObject, ot PartType) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	if obj.small {
+		return d.commitSO(batch, obj, ot)
+	}
+
+	return d.commitLO(batch, obj, ot)
+}
+
+func (d *PackDevice) repackPartitions() {
+	partitions, err := d.listPartitions()
+	if err != nil {
+		glogger.Error("unable to list partitions",
+			zap.String("device", d.device), zap.Error(err))
+		return
+	}
+
+	for _, partition := range partitions {
+		if d.isCompactionStopped() {
+			return
+		}
+
+		stat, err := d.RepackPartition(partition)
+		if err != nil {
+			glogger.Error("unable to repack partition",
+				zap.String("device", d.device),
+				zap.String("partition", partition),
+				zap.Error(err))
+			continue
+		}
+
+		if stat.ToLarge > 0 || stat.ToSmall > 0 {
+			glogger.Info("partition repacked",
+				zap.String("device", d.device),
+				zap.String("partition", partition),
+				zap.Int64("to-large", stat.ToLarge),
+				zap.Int64("to-small", stat.ToSmall))
+		}
+	}
+}
+
+// The repacker is stopped together with the compactor when the device is
+// closed.
+func (d *PackDevice) runRepacker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stopCompaction:
+			return
+		case <-ticker.C:
+			d.repackPartitions()
+		}
+	}
+}
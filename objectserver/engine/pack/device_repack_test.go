@@ -0,0 +1,125 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+func TestParseNeedleThreshold(t *testing.T) {
+	config, err := conf.StringConfig(`
+[object-pack]
+needle_threshold = 1048576
+
+[object-pack:1]
+needle_threshold = 0
+`)
+	require.Nil(t, err)
+
+	threshold, err := parseNeedleThreshold(config, 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(SIZE_1M), threshold)
+
+	_, err = parseNeedleThreshold(config, 1)
+	require.Equal(t, ErrInvalidNeedleThreshold, err)
+
+	config, err = conf.StringConfig("[object-pack]\n")
+	require.Nil(t, err)
+	threshold, err = parseNeedleThreshold(config, 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(NEEDLE_THRESHOLD), threshold)
+}
+
+// Verifies that the object is repacked with its timestamps and metadata kept
+func requireRepacked(t *testing.T, d *PackDevice,
+	obj *PackObject, small bool, dataTs, metaTs string) {
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.True(t, vo.exists)
+	require.Equal(t, small, vo.small)
+	require.Equal(t, dataTs, vo.dMeta.Timestamp)
+	require.Equal(t, metaTs, vo.meta.Timestamp)
+	require.Equal(t, "dev", vo.meta.UserMeta["X-Object-Meta-Tag"])
+	requireObjects(t, d, []*PackObject{obj})
+}
+
+func TestRepackPartition(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	require.Equal(t, int64(NEEDLE_THRESHOLD), d.needleThreshold)
+
+	partition := "1"
+	so := newPackObject(SIZE_1K*8, partition)
+	lo := newPackObject(SIZE_1K*32, partition)
+	lo.small = false
+	dataTs := make(map[*PackObject]string)
+	metaTs := make(map[*PackObject]string)
+	for _, obj := range []*PackObject{so, lo} {
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		dataTs[obj] = obj.meta.Timestamp
+
+		time.Sleep(time.Millisecond * 10)
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		vo.meta.Timestamp = common.GetTimestamp()
+		vo.meta.UserMeta["X-Object-Meta-Tag"] = "dev"
+		require.Nil(t, d.CommitUpdate(vo))
+		metaTs[obj] = vo.meta.Timestamp
+	}
+
+	// Nothing to do with the objects on the right side
+	stat, err := d.RepackPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, &RepackStat{}, stat)
+
+	// The SO is moved out once the threshold is lowered
+	d.needleThreshold = SIZE_1K * 4
+	stat, err = d.RepackPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, &RepackStat{ToLarge: 1}, stat)
+	requireRepacked(t, d, so, false, dataTs[so], metaTs[so])
+	requireRepacked(t, d, lo, false, dataTs[lo], metaTs[lo])
+	require.False(t, fs.IsFileNotExist(
+		filepath.Join(d.objectsDir, so.key, dataTs[so]+".data")))
+
+	// Both are moved into the bundle once the threshold is raised
+	d.needleThreshold = SIZE_1K * 64
+	stat, err = d.RepackPartition(partition)
+	require.Nil(t, err)
+	require.Equal(t, &RepackStat{ToSmall: 2}, stat)
+	requireRepacked(t, d, so, true, dataTs[so], metaTs[so])
+	requireRepacked(t, d, lo, true, dataTs[lo], metaTs[lo])
+
+	// Standalone files are deallocated in background
+	time.Sleep(time.Millisecond * 100)
+	for _, obj := range []*PackObject{so, lo} {
+		require.True(t, fs.IsFileNotExist(filepath.Join(d.objectsDir, obj.key)))
+	}
+}
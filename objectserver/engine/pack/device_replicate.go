@@ -30,6 +30,7 @@ import (
 	"github.com/iqiyi/auklet/common/fs"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
 )
 
@@ -42,7 +43,7 @@ const (
 func (d *PackDevice) isSuffixExists(partition, suffix string) bool {
 	prefix := []byte(fmt.Sprintf("/%s/%s/", partition, suffix))
 
-	iter := d.db.NewIterator(d.ropt)
+	iter := d.newSuffixIterator()
 	defer iter.Close()
 	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
 		return true
@@ -51,12 +52,21 @@ func (d *PackDevice) isSuffixExists(partition, suffix string) bool {
 	return false
 }
 
-// The algorithm should work in product environment.
-// Rough benchmark shows that it takes about 100ms to get the suffix
-// list in a partition.
-// To be honest, it is not efficient but it is simple.
-// If it is inadequent, extra complex data structures should be maintained.
+// ListSuffixes reads the suffix summaries of the partition. Suffixes are
+// probed one by one if the summaries are unavailable, which takes about
+// 100ms for a partition.
 func (d *PackDevice) ListSuffixes(partition string) []string {
+	summaries, err := d.loadSuffixSummaries(partition)
+	if err == nil {
+		suffixes := make([]string, 0, len(summaries))
+		for suffix := range summaries {
+			suffixes = append(suffixes, suffix)
+		}
+		return suffixes
+	}
+
+	glogger.Error("unable to load suffix summaries",
+		zap.String("partition", partition), zap.Error(err))
 	suffixes := make([]string, 0, MaxPartitionSuffixes)
 	for i := 0; i < MaxPartitionSuffixes; i++ {
 		suffix := fmt.Sprintf("%03x", i)
@@ -69,6 +79,9 @@ func (d *PackDevice) ListSuffixes(partition string) []string {
 	return suffixes
 }
 
+// CalculateSuffixHash returns the legacy hash of the suffix, which is the
+// MD5 of the timestamps of its indexes in the order of keys. It is what
+// all versions exchange by REPLICATE, so it is kept for compatibility.
 // FIXME: identify the empty string because empty string has
 // valid MD5 checksum.
 func (d *PackDevice) CalculateSuffixHash(partition, suffix string,
@@ -77,23 +90,80 @@ func (d *PackDevice) CalculateSuffixHash(partition, suffix string,
 
 	prefix := []byte(fmt.Sprintf("/%s/%s/", partition, suffix))
 
-	iter := d.db.NewIterator(d.ropt)
+	iter := d.newSuffixIterator()
 	defer iter.Close()
 	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
 		b := iter.Value().Data()
 		nMeta := new(DBIndex)
 		if err := proto.Unmarshal(b, nMeta); err != nil {
 			glogger.Error("unable to unmarshal needle meta",
-				zap.String("object-key", string(iter.Key().Data())))
+				zap.String("object-key", key))
 			return "", ErrDBIndexCorrupted
 		}
 
+		if isTombstoneExpired(key, nMeta, reclaimAge) {
+			continue
+		}
+
 		io.WriteString(h, nMeta.Meta.Timestamp)
 	}
 
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// CalculateSummaryHash returns the hash kept in the suffix summary. The
+// indexes of the suffix are rescanned only if the summary contains expired
+// tombstones. The hash of an empty suffix is all zeros.
+func (d *PackDevice) CalculateSummaryHash(partition, suffix string,
+	reclaimAge int64) (string, error) {
+	if err := d.ensureSuffixSummaries(partition); err != nil {
+		return "", err
+	}
+
+	s, err := d.getSuffixSummary(partition, suffix)
+	if err != nil {
+		return "", err
+	}
+
+	if s.hasExpiredTombstone(reclaimAge) {
+		return d.rescanSuffix(partition, suffix, reclaimAge)
+	}
+
+	return suffixHashString(s.Hash), nil
+}
+
+// GetSummaryHashes returns the summary hashes of all the non-empty
+// suffixes of the partition. They are always up to date, so neither
+// hashes.pkl nor the invalidations are involved. The number of suffixes
+// rescanned for expired tombstones is returned as hashed.
+func (d *PackDevice) GetSummaryHashes(partition string,
+	reclaimAge int64) (hashed int64, hashes map[string]string, err error) {
+	if fs.IsFileNotExist(filepath.Join(d.objectsDir, partition)) {
+		return
+	}
+
+	summaries, err := d.loadSuffixSummaries(partition)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hashes = make(map[string]string)
+	for suffix, s := range summaries {
+		if !s.hasExpiredTombstone(reclaimAge) {
+			hashes[suffix] = suffixHashString(s.Hash)
+			continue
+		}
+
+		if hashes[suffix], err = d.rescanSuffix(partition, suffix, reclaimAge); err != nil {
+			return 0, nil, err
+		}
+		hashed++
+	}
+
+	return
+}
+
 // Return the absolute paths of partition directory, hashes.pkl and
 // hashes.invalid.
 func (d *PackDevice) hashesPaths(partition string) (string, string, string) {
@@ -158,7 +228,7 @@ func (d *PackDevice) GetHashes(partition string,
 	for suffix, hash := range hashes {
 		if hash == "" {
 			modified = true
-			h, err := d.CalculateSuffixHash(partition, suffix, common.ONE_WEEK)
+			h, err := d.CalculateSuffixHash(partition, suffix, reclaimAge)
 			if err == nil {
 				hashes[suffix] = h
 				hashed++
@@ -271,7 +341,7 @@ func (d *PackDevice) ListSuffixTimestamps(partition, suffix string) (
 	tses := make(map[string]*ObjectTimestamps)
 
 	prefix := []byte(fmt.Sprintf("/%s/%s/", partition, suffix))
-	iter := d.db.NewIterator(d.ropt)
+	iter := d.newSuffixIterator()
 	defer iter.Close()
 	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
 		key := string(iter.Key().Data())
@@ -284,6 +354,10 @@ func (d *PackDevice) ListSuffixTimestamps(partition, suffix string) (
 			return nil, ErrDBIndexCorrupted
 		}
 
+		if isTombstoneExpired(key, nMeta, gconf.ReclaimAge) {
+			continue
+		}
+
 		hash := splitObjectKey(key)[2]
 		ts, ok := tses[hash]
 		if !ok {
@@ -322,6 +396,9 @@ func (d *PackDevice) DeleteHandoff(partition string) error {
 	d.wg.Add(1)
 	defer d.wg.Done()
 
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+
 	partitionDir, _, invalidPath := d.hashesPaths(partition)
 	mtime, err := fs.GetFileMTime(invalidPath)
 	if err != nil {
@@ -330,18 +407,25 @@ func (d *PackDevice) DeleteHandoff(partition string) error {
 		return err
 	}
 
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
 	prefix := []byte(fmt.Sprintf("/%s/", partition))
-	iter := d.db.NewIterator(d.ropt)
+	iter := d.newIndexIterator()
 	defer iter.Close()
 	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-		key := iter.Key().Data()
-		err := d.db.Delete(d.wopt, key)
-		if err != nil {
-			glogger.Error("unable to delete record from rocksdb",
-				zap.String("key", string(key)))
-			return err
-		}
+		batch.Delete(iter.Key().Data())
+	}
+	batch.Delete(suffixMarker(partition))
+	batch.Delete(usageKey(partition))
+	d.clearDedupRecords(batch, partition)
+
+	if err = d.writeDBIndexes(batch); err != nil {
+		glogger.Error("unable to delete records from rocksdb",
+			zap.String("partition", partition), zap.Error(err))
+		return err
 	}
+	d.cache.invalidatePartition(partition)
 
 	mtime2, err := fs.GetFileMTime(invalidPath)
 	if err != nil {
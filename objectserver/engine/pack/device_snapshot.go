@@ -0,0 +1,506 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+type SnapshotStat struct {
+	Path      string
+	Segments  int64 // bundle segments cloned
+	Reflinked int64 // bundle segments sharing blocks with the origin
+	Files     int64 // files hard linked, e.g. LO
+}
+
+// SnapshotsDir returns the directory where the snapshots of the device are
+// saved. Each snapshot is laid out like a device in it, so that it could
+// be inspected as a device, e.g. by dump-db.
+func SnapshotsDir(driveRoot, device string) string {
+	return filepath.Join(driveRoot, device, "snapshots")
+}
+
+func isValidSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsRune(name, os.PathSeparator)
+}
+
+// Returns true if the file at the path relative to the objects directory
+// is a bundle segment, which is modified in place.
+func isSegmentPath(rel string) bool {
+	dir, name := filepath.Split(rel)
+	if _, _, ok := parseSegmentFileName(name); !ok {
+		return false
+	}
+
+	return !strings.ContainsRune(strings.TrimSuffix(dir, "/"), os.PathSeparator)
+}
+
+// linkTree recreates the directory tree of src at dst. Files for which
+// mutable returns true are passed to clone, the others are hard linked
+// because they are never modified in place. Files removed while walking
+// are skipped.
+func linkTree(src, dst string, mutable func(rel string) bool,
+	clone func(path, target string) error, stat *SnapshotStat) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if mutable(rel) {
+			err = clone(path, target)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		err = os.Link(path, target)
+		if err == nil {
+			stat.Files++
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// cloneTree is linkTree with the mutable files cloned by reflink if
+// possible.
+func cloneTree(src, dst string,
+	mutable func(rel string) bool, stat *SnapshotStat) error {
+	return linkTree(src, dst, mutable, func(path, target string) error {
+		reflinked, err := fs.CloneFile(path, target)
+		if err != nil {
+			glogger.Error("unable to clone file",
+				zap.String("src", path), zap.String("dst", target), zap.Error(err))
+			return err
+		}
+		stat.Segments++
+		if reflinked {
+			stat.Reflinked++
+		}
+		return nil
+	}, stat)
+}
+
+type deferredPunch struct {
+	bundle *Bundle
+	offset int64
+	length int64
+}
+
+// punchHole deallocates the needle at offset of the bundle segment. The
+// hole is punched later if a snapshot is copying the segments, because the
+// needle may still be referenced by the frozen meta db.
+func (d *PackDevice) punchHole(b *Bundle, offset, length int64) error {
+	d.pmu.Lock()
+	if d.freezes > 0 {
+		// The segment may be replaced by compaction in the meantime, and
+		// is kept open until the hole is punched.
+		if b.pin() {
+			d.deferred = append(d.deferred, deferredPunch{b, offset, length})
+		}
+		d.pmu.Unlock()
+		return nil
+	}
+	d.pmu.Unlock()
+
+	return b.PunchHole(offset, length)
+}
+
+func (d *PackDevice) holdPunches() {
+	d.pmu.Lock()
+	d.freezes++
+	d.pmu.Unlock()
+}
+
+// releasePunches punches the holes deferred once no snapshot is copying
+// the segments. Needles of holes failed to punch are left as orphans.
+func (d *PackDevice) releasePunches() {
+	d.pmu.Lock()
+	d.freezes--
+	var punches []deferredPunch
+	if d.freezes == 0 {
+		punches, d.deferred = d.deferred, nil
+	}
+	d.pmu.Unlock()
+
+	for _, p := range punches {
+		if err := p.bundle.PunchHole(p.offset, p.length); err != nil {
+			glogger.Error("unable to punch deferred hole",
+				zap.Int64("offset", p.offset),
+				zap.Int32("segment", p.bundle.segment),
+				zap.String("partition", p.bundle.partition),
+				zap.Error(err))
+		}
+		p.bundle.unpin()
+	}
+}
+
+// frozenSegment is a bundle segment opened by freezeSnapshot with the size
+// it had then. Needles appended later are not part of the snapshot.
+type frozenSegment struct {
+	file   *os.File
+	size   int64
+	target string
+}
+
+func closeSegments(segments []*frozenSegment) {
+	for _, s := range segments {
+		s.file.Close()
+	}
+}
+
+// freezeSnapshot blocks all the commits of the device only while a
+// snapshot of the meta db is taken and the bundle segments are opened with
+// their sizes recorded. LO files are hard linked meanwhile as well, since
+// they are unlinked once replaced. Nothing is copied with commits blocked.
+// Hole punches are deferred until releasePunches, so that the needles
+// referenced by the db snapshot are kept until the segments are copied.
+func (d *PackDevice) freezeSnapshot(objectsDir string, stat *SnapshotStat) (
+	*gorocksdb.Snapshot, []*frozenSegment, error) {
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+
+	var segments []*frozenSegment
+	open := func(path, target string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		segments = append(segments,
+			&frozenSegment{file: f, size: info.Size(), target: target})
+		return nil
+	}
+	if err := linkTree(d.objectsDir, objectsDir, isSegmentPath, open, stat); err != nil {
+		closeSegments(segments)
+		return nil, nil, err
+	}
+
+	d.holdPunches()
+	return d.db.NewSnapshot(), segments, nil
+}
+
+// copySegments clones the frozen segments up to their recorded sizes
+func copySegments(segments []*frozenSegment, stat *SnapshotStat) error {
+	defer closeSegments(segments)
+
+	for _, s := range segments {
+		reflinked, err := fs.CloneFileSize(s.file, s.target, s.size)
+		if err != nil {
+			glogger.Error("unable to clone segment",
+				zap.String("src", s.file.Name()),
+				zap.String("dst", s.target),
+				zap.Error(err))
+			return err
+		}
+		stat.Segments++
+		if reflinked {
+			stat.Reflinked++
+		}
+	}
+
+	return nil
+}
+
+// Records copied into the snapshot db in a write batch
+const snapshotBatchRecords = 1024
+
+func copyColumnFamily(src, dst *gorocksdb.DB,
+	ropt *gorocksdb.ReadOptions, wopt *gorocksdb.WriteOptions,
+	from, to *gorocksdb.ColumnFamilyHandle) error {
+	var iter *gorocksdb.Iterator
+	if from == nil {
+		iter = src.NewIterator(ropt)
+	} else {
+		iter = src.NewIteratorCF(ropt, from)
+	}
+	defer iter.Close()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if to == nil {
+			batch.Put(iter.Key().Data(), iter.Value().Data())
+		} else {
+			batch.PutCF(to, iter.Key().Data(), iter.Value().Data())
+		}
+		if batch.Count() < snapshotBatchRecords {
+			continue
+		}
+		if err := dst.Write(wopt, batch); err != nil {
+			return err
+		}
+		batch.Clear()
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return dst.Write(wopt, batch)
+}
+
+// copyDB writes the records of the db snapshot into a new db at path with
+// the same column families. Only the live records are written once, so
+// the snapshot db takes no more space than the device db.
+func (d *PackDevice) copyDB(snap *gorocksdb.Snapshot, path string) error {
+	o := &DBOptions{}
+	if po := policyDBOptions[d.policy]; po != nil {
+		*o = *po
+	}
+	o.ColumnFamilies = d.cfs != nil
+	db, cfs, err := openMetaDB(path, o)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, cf := range cfs {
+			cf.Destroy()
+		}
+		db.Close()
+	}()
+
+	ropt := gorocksdb.NewDefaultReadOptions()
+	defer ropt.Destroy()
+	ropt.SetSnapshot(snap)
+	ropt.SetFillCache(false)
+	SetTotalOrderSeek(ropt, true)
+	wopt := gorocksdb.NewDefaultWriteOptions()
+	defer wopt.Destroy()
+
+	// Records of the default column family are copied without handle
+	if err = copyColumnFamily(d.db, db, ropt, wopt, nil, nil); err != nil {
+		return err
+	}
+	for ot, cf := range d.cfs {
+		if err = copyColumnFamily(d.db, db, ropt, wopt, cf, cfs[ot]); err != nil {
+			return err
+		}
+	}
+
+	fopt := gorocksdb.NewDefaultFlushOptions()
+	defer fopt.Destroy()
+	fopt.SetWait(true)
+
+	return db.Flush(fopt)
+}
+
+// Snapshot creates a consistent copy of the meta db and bundles of the
+// device while it is serving. Commits are blocked only while the snapshot
+// is frozen, then the meta db and bundles are copied in the background of
+// the commits. Bundles are cloned by reflink if the file system supports
+// it, otherwise they are copied.
+func (d *PackDevice) Snapshot(name string) (*SnapshotStat, error) {
+	if !isValidSnapshotName(name) {
+		return nil, ErrInvalidSnapshotName
+	}
+
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	op, dp := PackDevicePaths(name, SnapshotsDir(d.driveRoot, d.device), d.policy)
+	if fs.Exists(op) || fs.Exists(dp) {
+		return nil, ErrSnapshotExists
+	}
+	if err := os.MkdirAll(filepath.Dir(op), 0755); err != nil {
+		return nil, err
+	}
+
+	stat := &SnapshotStat{Path: filepath.Dir(op)}
+	snap, segments, err := d.freezeSnapshot(op, stat)
+	if err == nil {
+		err = d.copyDB(snap, dp)
+		if err == nil {
+			err = copySegments(segments, stat)
+		} else {
+			closeSegments(segments)
+		}
+		snap.Release()
+		d.releasePunches()
+	}
+	if err != nil {
+		glogger.Error("unable to create snapshot",
+			zap.String("device", d.device),
+			zap.String("snapshot", name),
+			zap.Error(err))
+		os.RemoveAll(op)
+		os.RemoveAll(dp)
+		return nil, err
+	}
+
+	glogger.Info("snapshot created",
+		zap.String("device", d.device),
+		zap.String("snapshot", name),
+		zap.Int64("segments", stat.Segments),
+		zap.Int64("reflinked", stat.Reflinked),
+		zap.Int64("files", stat.Files))
+
+	return stat, nil
+}
+
+// ListSnapshots returns the names of the snapshots of the device of the
+// policy.
+func ListSnapshots(driveRoot, device string, policy int) ([]string, error) {
+	root := SnapshotsDir(driveRoot, device)
+	names, err := fs.ReadDirNames(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []string
+	for _, name := range names {
+		_, dp := PackDevicePaths(name, root, policy)
+		if fs.Exists(dp) {
+			snapshots = append(snapshots, name)
+		}
+	}
+
+	return snapshots, nil
+}
+
+// RestoreSnapshot replaces the objects and meta db of the device by the
+// snapshot, which is kept for later restores. The replaced ones are moved
+// aside with suffix ".pre-restore-<unix time>". The object server must be
+// stopped.
+func RestoreSnapshot(driveRoot, device string, policy int, name string) error {
+	if !isValidSnapshotName(name) {
+		return ErrInvalidSnapshotName
+	}
+
+	sop, sdp := PackDevicePaths(name, SnapshotsDir(driveRoot, device), policy)
+	if !fs.Exists(sop) || !fs.Exists(sdp) {
+		return ErrSnapshotNotFound
+	}
+
+	op, dp := PackDevicePaths(device, driveRoot, policy)
+	suffix := fmt.Sprintf(".pre-restore-%d", time.Now().Unix())
+	for _, p := range []string{op, dp} {
+		if !fs.Exists(p) {
+			continue
+		}
+		if err := os.Rename(p, p+suffix); err != nil {
+			glogger.Error("unable to move aside",
+				zap.String("path", p), zap.Error(err))
+			return err
+		}
+	}
+
+	// The meta db is modified in place, so all of its files are cloned
+	stat := &SnapshotStat{}
+	if err := cloneTree(sop, op, isSegmentPath, stat); err != nil {
+		return err
+	}
+	all := func(string) bool { return true }
+	if err := cloneTree(sdp, dp, all, stat); err != nil {
+		return err
+	}
+
+	glogger.Info("snapshot restored",
+		zap.String("device", device),
+		zap.Int("policy", policy),
+		zap.String("snapshot", name),
+		zap.Int64("segments", stat.Segments),
+		zap.Int64("files", stat.Files))
+
+	return nil
+}
+
+// SnapshotDevice is the entry of snapshot command. Snapshots are created by
+// the running object server, while they are listed and restored offline.
+func SnapshotDevice(cnf conf.Config, flags *flag.FlagSet) (*SnapshotStat, error) {
+	var err error
+	glogger, err = common.GetLogger(
+		flags.Lookup("l").Value.(flag.Getter).Get().(string), "pack-snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	driveRoot := cnf.GetDefault("app:object-server", "devices", "/srv/node")
+	device := flags.Lookup("d").Value.(flag.Getter).Get().(string)
+	policy := flags.Lookup("policy").Value.(flag.Getter).Get().(int)
+	name := flags.Lookup("name").Value.(flag.Getter).Get().(string)
+	if name == "" {
+		name = time.Now().Format("20060102150405")
+	}
+
+	if flags.Lookup("restore").Value.(flag.Getter).Get() == true {
+		if err = RestoreSnapshot(driveRoot, device, policy, name); err != nil {
+			return nil, err
+		}
+		return &SnapshotStat{Path: filepath.Join(driveRoot, device)}, nil
+	}
+
+	rpcPort := int(cnf.GetInt("app:object-server", "rpc_port", 60000))
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", rpcPort), grpc.WithInsecure())
+	if err != nil {
+		glogger.Error("unable to dial to rpc server",
+			zap.Int("port", rpcPort), zap.Error(err))
+		return nil, err
+	}
+	defer conn.Close()
+
+	msg := &SnapshotMsg{Device: device, Policy: uint32(policy), Name: name}
+	reply, err := NewPackRpcServiceClient(conn).Snapshot(context.Background(), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotStat{
+		Path:      reply.Path,
+		Segments:  reply.Segments,
+		Reflinked: reply.Reflinked,
+		Files:     reply.Files,
+	}, nil
+}
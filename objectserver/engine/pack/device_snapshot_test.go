@@ -0,0 +1,128 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+func TestIsSegmentPath(t *testing.T) {
+	require.True(t, isSegmentPath("1/bundle.data"))
+	require.True(t, isSegmentPath("1/bundle.0002.data"))
+	require.True(t, isSegmentPath("1/bundle.compact"))
+	require.False(t, isSegmentPath("1/hashes.pkl"))
+	require.False(t, isSegmentPath("1/abc/0123456789abcdef/1.data"))
+}
+
+func TestSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+
+	partition := "1"
+	so := newPackSO(partition)
+	lo := newPackLO(partition)
+	for _, obj := range []*PackObject{so, lo} {
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+	}
+
+	stat, err := d.Snapshot("s1")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stat.Segments)
+	require.True(t, stat.Files > 0)
+	require.Equal(t, filepath.Join(SnapshotsDir(root, PACK_DEVICE), "s1"), stat.Path)
+
+	_, err = d.Snapshot("s1")
+	require.Equal(t, ErrSnapshotExists, err)
+	_, err = d.Snapshot("../s2")
+	require.Equal(t, ErrInvalidSnapshotName, err)
+
+	snapshots, err := ListSnapshots(root, PACK_DEVICE, PACK_POLICY_INDEX)
+	require.Nil(t, err)
+	require.Equal(t, []string{"s1"}, snapshots)
+
+	// Changes after the snapshot are not seen in it
+	for _, obj := range []*PackObject{so, lo} {
+		vo := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(vo))
+		vo.meta.Timestamp = common.GetTimestamp()
+		require.Nil(t, d.CommitDeletion(vo))
+	}
+	obj := newPackSO(partition)
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	sd := NewPackDevice("s1", SnapshotsDir(root, PACK_DEVICE), PACK_POLICY_INDEX)
+	require.NotNil(t, sd)
+	requireObjects(t, sd, []*PackObject{so, lo})
+	vo := copyVanilla(obj)
+	require.Nil(t, sd.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+	sd.Close()
+
+	// Deleted objects are back once the snapshot is restored
+	d.Close()
+	require.Nil(t, RestoreSnapshot(root, PACK_DEVICE, PACK_POLICY_INDEX, "s1"))
+	d = NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+	requireObjects(t, d, []*PackObject{so, lo})
+	vo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	require.False(t, vo.exists)
+
+	op, _ := PackDevicePaths(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	matches, err := filepath.Glob(op + ".pre-restore-*")
+	require.Nil(t, err)
+	require.Len(t, matches, 1)
+
+	require.Equal(t, ErrSnapshotNotFound,
+		RestoreSnapshot(root, PACK_DEVICE, PACK_POLICY_INDEX, "s2"))
+}
+
+func TestSnapshotDefersPunches(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	so := newPackSO("1")
+	require.Nil(t, feedObject(so, d))
+	require.Nil(t, d.CommitWrite(so))
+	so.Close()
+
+	// Needles deleted while a snapshot is copying are kept until it is done
+	d.holdPunches()
+	vo := copyVanilla(so)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+	require.NotEmpty(t, d.deferred)
+
+	d.releasePunches()
+	require.Empty(t, d.deferred)
+	require.Equal(t, 0, d.freezes)
+}
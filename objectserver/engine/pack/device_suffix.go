@@ -0,0 +1,418 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+)
+
+const suffixStripes = 256
+
+// Every suffix of a partition has a summary saved apart from the object
+// keys, which is updated in the same write batch as the indexes of the
+// suffix. The summary hash is the XOR of the digests of its indexes, so it
+// could be maintained incrementally in any order of mutations. It differs
+// from the legacy suffix hash, so it is exchanged only with remotes which
+// request it.
+func suffixSummaryKey(partition, suffix string) []byte {
+	return []byte(fmt.Sprintf("/.suffixes/%s/%s", partition, suffix))
+}
+
+// The marker is saved once the summaries of the partition are built from
+// all of its indexes. Summaries of a partition without the marker, e.g. one
+// written by an older version, are not trusted.
+func suffixMarker(partition string) []byte {
+	return []byte(fmt.Sprintf("/.suffixes/%s", partition))
+}
+
+func suffixStripe(partition, suffix string) int {
+	h := fnv.New32a()
+	io.WriteString(h, partition)
+	io.WriteString(h, suffix)
+	return int(h.Sum32() % suffixStripes)
+}
+
+func indexDigest(key string, idx *DBIndex) []byte {
+	h := md5.New()
+	io.WriteString(h, key)
+	io.WriteString(h, " ")
+	io.WriteString(h, idx.GetMeta().GetTimestamp())
+	return h.Sum(nil)
+}
+
+func xorDigest(hash, digest []byte) []byte {
+	x := make([]byte, md5.Size)
+	copy(x, hash)
+	for i := range digest {
+		x[i] ^= digest[i]
+	}
+	return x
+}
+
+func suffixHashString(hash []byte) string {
+	return hex.EncodeToString(xorDigest(hash, nil))
+}
+
+func isTombstoneKey(key string) bool {
+	return strings.HasSuffix(key, "/"+string(TOMBSTONE))
+}
+
+func (s *SuffixSummary) add(key string, idx *DBIndex) {
+	s.Indexes++
+	s.Hash = xorDigest(s.Hash, indexDigest(key, idx))
+	if strings.HasSuffix(key, "/"+string(META)) {
+		return
+	}
+
+	s.Objects++
+	ts := idx.GetMeta().GetTimestamp()
+	if isTombstoneKey(key) && (s.OldestTombstone == "" || ts < s.OldestTombstone) {
+		s.OldestTombstone = ts
+	}
+}
+
+// OldestTombstone is kept as a lower bound after removal. It is refreshed
+// when the suffix is rescanned.
+func (s *SuffixSummary) remove(key string, idx *DBIndex) {
+	s.Indexes--
+	s.Hash = xorDigest(s.Hash, indexDigest(key, idx))
+	if !strings.HasSuffix(key, "/"+string(META)) {
+		s.Objects--
+	}
+	if s.Indexes <= 0 {
+		s.Reset()
+	}
+}
+
+// The summary may contain tombstones older than reclaimAge, whose digests
+// must be excluded from the suffix hash.
+func (s *SuffixSummary) hasExpiredTombstone(reclaimAge int64) bool {
+	if reclaimAge <= 0 || s.OldestTombstone == "" {
+		return false
+	}
+
+	deadline := time.Now().Add(-time.Duration(reclaimAge) * time.Second)
+	return isMetaExpired(&ObjectMeta{Timestamp: s.OldestTombstone}, deadline)
+}
+
+// Stripes are always locked in ascending order. All the stripes are locked
+// if stripes is nil.
+func (d *PackDevice) lockSuffixStripes(stripes map[int]bool) func() {
+	var locked []int
+	for i := 0; i < suffixStripes; i++ {
+		if stripes == nil || stripes[i] {
+			d.smu[i].Lock()
+			locked = append(locked, i)
+		}
+	}
+
+	return func() {
+		for _, i := range locked {
+			d.smu[i].Unlock()
+		}
+	}
+}
+
+func (d *PackDevice) getSuffixSummary(partition, suffix string) (*SuffixSummary, error) {
+	b, err := d.db.GetBytes(d.ropt, suffixSummaryKey(partition, suffix))
+	if err != nil {
+		glogger.Error("unable to retrieve suffix summary",
+			zap.String("partition", partition),
+			zap.String("suffix", suffix),
+			zap.Error(err))
+		return nil, err
+	}
+
+	s := new(SuffixSummary)
+	if err = proto.Unmarshal(b, s); err != nil {
+		glogger.Error("unable to unmarshal suffix summary",
+			zap.String("partition", partition),
+			zap.String("suffix", suffix),
+			zap.Error(err))
+		return nil, ErrDBIndexCorrupted
+	}
+
+	return s, nil
+}
+
+// A corrupted index is regarded as absent. Summaries affected by it are
+// fixed when the partition index is rebuilt.
+func (d *PackDevice) getIndexByKey(key string) (*DBIndex, error) {
+	b, err := d.getIndexBytes([]byte(key))
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+
+	idx := new(DBIndex)
+	if err = proto.Unmarshal(b, idx); err != nil {
+		glogger.Error("unable to unmarshal db index",
+			zap.String("object-key", key), zap.Error(err))
+		return nil, nil
+	}
+
+	return idx, nil
+}
+
+type indexMutation struct {
+	key    string
+	fields []string
+	// nil for deletion
+	value []byte
+}
+
+// summarizeBatch appends the summary updates of the suffixes mutated by the
+// batch to itself. The stripes of the suffixes stay locked until the
+// returned function is called, which must be after the batch is written.
+func (d *PackDevice) summarizeBatch(batch *gorocksdb.WriteBatch) (func(), error) {
+	var mutations []*indexMutation
+	stripes := make(map[int]bool)
+	iter := batch.NewIterator()
+	for iter.Next() {
+		r := iter.Record()
+		fields := splitObjectKey(string(r.Key))
+		// Not an object index, e.g. a marker
+		if len(fields) != 4 {
+			continue
+		}
+
+		m := &indexMutation{key: string(r.Key), fields: fields}
+		switch r.Type {
+		case gorocksdb.WriteBatchRecordTypeValue:
+			m.value = append([]byte{}, r.Value...)
+		case gorocksdb.WriteBatchRecordTypeDeletion:
+		default:
+			return nil, ErrUnknownBatchRecord
+		}
+		mutations = append(mutations, m)
+		stripes[suffixStripe(fields[0], fields[1])] = true
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	unlock := d.lockSuffixStripes(stripes)
+	summaries := make(map[string]*SuffixSummary)
+	// Latest index of the keys mutated more than once in the batch
+	latest := make(map[string]*DBIndex)
+	for _, m := range mutations {
+		sk := string(suffixSummaryKey(m.fields[0], m.fields[1]))
+		s, ok := summaries[sk]
+		if !ok {
+			var err error
+			if s, err = d.getSuffixSummary(m.fields[0], m.fields[1]); err != nil {
+				unlock()
+				return nil, err
+			}
+			summaries[sk] = s
+		}
+
+		old, ok := latest[m.key]
+		if !ok {
+			var err error
+			if old, err = d.getIndexByKey(m.key); err != nil {
+				unlock()
+				return nil, err
+			}
+		}
+		if old != nil {
+			s.remove(m.key, old)
+		}
+
+		var idx *DBIndex
+		if m.value != nil {
+			idx = new(DBIndex)
+			if err := proto.Unmarshal(m.value, idx); err != nil {
+				unlock()
+				return nil, err
+			}
+			s.add(m.key, idx)
+		}
+		latest[m.key] = idx
+	}
+
+	for sk, s := range summaries {
+		if s.Indexes <= 0 {
+			batch.Delete([]byte(sk))
+			continue
+		}
+
+		b, err := proto.Marshal(s)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		batch.Put([]byte(sk), b)
+	}
+
+	return unlock, nil
+}
+
+// buildSuffixSummaries rebuilds the summaries of the partition from its
+// indexes. Index writes of the whole device are blocked meanwhile, so it
+// should only happen once for a partition.
+func (d *PackDevice) buildSuffixSummaries(partition string) error {
+	unlock := d.lockSuffixStripes(nil)
+	defer unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	prefix := []byte(fmt.Sprintf("/.suffixes/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		batch.Delete(iter.Key().Data())
+	}
+	iter.Close()
+
+	summaries := make(map[string]*SuffixSummary)
+	prefix = []byte(fmt.Sprintf("/%s/", partition))
+	iter = d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		idx := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), idx); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			continue
+		}
+
+		suffix := splitObjectKey(key)[1]
+		s, ok := summaries[suffix]
+		if !ok {
+			s = new(SuffixSummary)
+			summaries[suffix] = s
+		}
+		s.add(key, idx)
+	}
+	iter.Close()
+
+	for suffix, s := range summaries {
+		b, err := proto.Marshal(s)
+		if err != nil {
+			return err
+		}
+		batch.Put(suffixSummaryKey(partition, suffix), b)
+	}
+	batch.Put(suffixMarker(partition), []byte{})
+
+	if err := d.writeBatch(batch); err != nil {
+		glogger.Error("unable to save suffix summaries",
+			zap.String("partition", partition), zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (d *PackDevice) ensureSuffixSummaries(partition string) error {
+	v, err := d.db.GetBytes(d.ropt, suffixMarker(partition))
+	if err != nil {
+		glogger.Error("unable to retrieve suffix marker",
+			zap.String("partition", partition), zap.Error(err))
+		return err
+	}
+
+	if v != nil {
+		return nil
+	}
+	return d.buildSuffixSummaries(partition)
+}
+
+// loadSuffixSummaries returns the summaries of non-empty suffixes of the
+// partition, keyed by suffix.
+func (d *PackDevice) loadSuffixSummaries(partition string) (
+	map[string]*SuffixSummary, error) {
+	if err := d.ensureSuffixSummaries(partition); err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]*SuffixSummary)
+	prefix := []byte(fmt.Sprintf("/.suffixes/%s/", partition))
+	iter := d.newIndexIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		s := new(SuffixSummary)
+		if err := proto.Unmarshal(iter.Value().Data(), s); err != nil {
+			glogger.Error("unable to unmarshal suffix summary",
+				zap.String("key", key), zap.Error(err))
+			return nil, ErrDBIndexCorrupted
+		}
+
+		if s.Indexes > 0 {
+			summaries[strings.TrimPrefix(key, string(prefix))] = s
+		}
+	}
+
+	return summaries, nil
+}
+
+// rescanSuffix calculates the hash of the suffix from its indexes without
+// expired tombstones and refreshes the summary of the suffix.
+func (d *PackDevice) rescanSuffix(partition, suffix string,
+	reclaimAge int64) (string, error) {
+	unlock := d.lockSuffixStripes(
+		map[int]bool{suffixStripe(partition, suffix): true})
+	defer unlock()
+
+	var hash []byte
+	s := new(SuffixSummary)
+	prefix := []byte(fmt.Sprintf("/%s/%s/", partition, suffix))
+	iter := d.newSuffixIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		idx := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), idx); err != nil {
+			glogger.Error("unable to unmarshal needle meta",
+				zap.String("object-key", key))
+			return "", ErrDBIndexCorrupted
+		}
+
+		s.add(key, idx)
+		if !isTombstoneExpired(key, idx, reclaimAge) {
+			hash = xorDigest(hash, indexDigest(key, idx))
+		}
+	}
+
+	sk := suffixSummaryKey(partition, suffix)
+	var err error
+	if s.Indexes == 0 {
+		err = d.db.Delete(d.wopt, sk)
+	} else {
+		var b []byte
+		if b, err = proto.Marshal(s); err == nil {
+			err = d.db.Put(d.wopt, sk, b)
+		}
+	}
+	if err != nil {
+		glogger.Error("unable to refresh suffix summary",
+			zap.String("partition", partition),
+			zap.String("suffix", suffix),
+			zap.Error(err))
+	}
+
+	return suffixHashString(hash), nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tecbot/gorocksdb"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+// Calculates the suffix hash of the indexes given as key to timestamp
+func expectedSuffixHash(indexes map[string]string) string {
+	hash := make([]byte, md5.Size)
+	for key, ts := range indexes {
+		h := md5.New()
+		io.WriteString(h, fmt.Sprintf("%s %s", key, ts))
+		for i, b := range h.Sum(nil) {
+			hash[i] ^= b
+		}
+	}
+
+	return hex.EncodeToString(hash)
+}
+
+func populateSuffixes(t *testing.T, d *PackDevice, partition string) []*PackObject {
+	var objs []*PackObject
+	for i := 0; i < 8; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+
+	vo := copyVanilla(objs[0])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.UserMeta["X-Object-Meta-Tag"] = "dev"
+	require.Nil(t, d.CommitUpdate(vo))
+
+	vo = copyVanilla(objs[1])
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.GetTimestamp()
+	require.Nil(t, d.CommitDeletion(vo))
+
+	return objs
+}
+
+func TestSuffixSummary(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	objs := populateSuffixes(t, d, partition)
+
+	summaries, err := d.loadSuffixSummaries(partition)
+	require.Nil(t, err)
+	var objects int64
+	for _, s := range summaries {
+		objects += s.Objects
+	}
+	require.Equal(t, int64(len(objs)), objects)
+
+	for _, obj := range objs {
+		suffix := splitObjectKey(obj.key)[1]
+		tses, err := d.ListSuffixTimestamps(partition, suffix)
+		require.Nil(t, err)
+		indexes := make(map[string]string)
+		for hash, ts := range tses {
+			key := generateKeyFromHash(partition, hash)
+			if idx, _ := d.getDBIndex(key, TOMBSTONE); idx != nil {
+				indexes[key+"/ts"] = ts.DataTimestamp
+			} else {
+				indexes[key+"/data"] = ts.DataTimestamp
+			}
+			if ts.MetaTimestamp != "" {
+				indexes[key+"/meta"] = ts.MetaTimestamp
+			}
+		}
+
+		hash, err := d.CalculateSummaryHash(partition, suffix, ONE_WEEK)
+		require.Nil(t, err)
+		require.Equal(t, expectedSuffixHash(indexes), hash)
+	}
+
+	// Summaries maintained incrementally are the same as rebuilt ones
+	require.Nil(t, d.buildSuffixSummaries(partition))
+	rebuilt, err := d.loadSuffixSummaries(partition)
+	require.Nil(t, err)
+	require.Equal(t, summaries, rebuilt)
+}
+
+func TestSuffixSummaryUpgrade(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	objs := populateSuffixes(t, d, partition)
+	expected := d.ListSuffixes(partition)
+	sort.Strings(expected)
+	require.NotEmpty(t, expected)
+
+	// Partitions written by older versions have no summaries
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, suffix := range expected {
+		batch.Delete(suffixSummaryKey(partition, suffix))
+	}
+	batch.Delete(suffixMarker(partition))
+	require.Nil(t, d.db.Write(d.wopt, batch))
+
+	actual := d.ListSuffixes(partition)
+	sort.Strings(actual)
+	require.Equal(t, expected, actual)
+	marker, err := d.db.GetBytes(d.ropt, suffixMarker(partition))
+	require.Nil(t, err)
+	require.NotNil(t, marker)
+
+	// Summaries and the marker are removed along with the partition
+	require.Nil(t, d.DeleteHandoff(objs[0].partition))
+	prefix := suffixMarker(partition)
+	iter := d.db.NewIterator(d.ropt)
+	defer iter.Close()
+	iter.Seek(prefix)
+	require.False(t, iter.ValidForPrefix(prefix))
+}
+
+func TestSuffixSummaryExpiredTombstone(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	obj := newPackObject(SIZE_1K, partition)
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+
+	ts := time.Now().Add(-time.Second * (ONE_WEEK + 60))
+	deleteObject(t, d, obj, ts)
+	suffix := splitObjectKey(obj.key)[1]
+	tombstone := map[string]string{
+		obj.key + "/ts": common.CanonicalTimestampFromTime(ts),
+	}
+
+	s, err := d.getSuffixSummary(partition, suffix)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), s.Objects)
+	require.True(t, s.hasExpiredTombstone(ONE_WEEK))
+	require.False(t, s.hasExpiredTombstone(0))
+
+	hash, err := d.CalculateSummaryHash(partition, suffix, 0)
+	require.Nil(t, err)
+	require.Equal(t, expectedSuffixHash(tombstone), hash)
+	hash, err = d.CalculateSummaryHash(partition, suffix, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, expectedSuffixHash(nil), hash)
+
+	reaped, err := d.ReapTombstones(partition, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), reaped)
+	require.Empty(t, d.ListSuffixes(partition))
+}
+
+func TestGetSummaryHashes(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	populateSuffixes(t, d, partition)
+
+	hashed, hashes, err := d.GetSummaryHashes(partition, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), hashed)
+	require.Len(t, hashes, len(d.ListSuffixes(partition)))
+
+	// Legacy hashes are still answered by GetHashes for older replicators
+	_, legacy, err := d.GetHashes(partition, nil, false, ONE_WEEK)
+	require.Nil(t, err)
+	require.Len(t, legacy, len(hashes))
+	for suffix, hash := range hashes {
+		summary, err := d.CalculateSummaryHash(partition, suffix, ONE_WEEK)
+		require.Nil(t, err)
+		require.Equal(t, summary, hash)
+
+		expected, err := d.CalculateSuffixHash(partition, suffix, ONE_WEEK)
+		require.Nil(t, err)
+		require.Equal(t, expected, legacy[suffix])
+		require.NotEqual(t, legacy[suffix], hash)
+	}
+
+	_, hashes, err = d.GetSummaryHashes("2", ONE_WEEK)
+	require.Nil(t, err)
+	require.Empty(t, hashes)
+}
@@ -19,6 +19,8 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -270,3 +272,116 @@ func TestCommitUpdateLO(t *testing.T) {
 	require.NotNil(t, dIdx)
 	require.NotNil(t, mIdx)
 }
+
+var errInjectedCrash = errors.New("injected crash")
+
+// Simulates a crash right before the index mutations of an object persist
+func injectIndexWriteCrash() func() {
+	beforeDBIndexesWrite = func() error { return errInjectedCrash }
+	return func() {
+		beforeDBIndexesWrite = func() error { return nil }
+	}
+}
+
+// Writes a SO with extra meta and returns the persisted db indexes
+func prepareCrashObject(t *testing.T, d *PackDevice) (*PackObject, []byte) {
+	obj := newPackObject(SIZE_1K, "")
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	require.Nil(t, obj.Close())
+
+	oo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(oo))
+	oo.meta.Timestamp = incSeconds(obj.meta.Timestamp, 1)
+	oo.meta.UserMeta = map[string]string{"X-Object-Meta-Owner": "IQIYI"}
+	require.Nil(t, d.CommitUpdate(oo))
+
+	return obj, dumpDBIndexes(t, d, obj)
+}
+
+func dumpDBIndexes(t *testing.T, d *PackDevice, obj *PackObject) []byte {
+	dIdx, mIdx, tsIdx, err := d.loadObjDBIndexes(obj)
+	require.Nil(t, err)
+	b, err := json.Marshal([]*DBIndex{dIdx, mIdx, tsIdx})
+	require.Nil(t, err)
+	return b
+}
+
+func TestCommitWriteCrash(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj, indexes := prepareCrashObject(t, d)
+	bundle, err := d.getBundle(obj.partition)
+	require.Nil(t, err)
+	size := bundle.BundleSize()
+
+	// Both the stale meta and the data would be changed by overriding
+	for _, fresh := range []*PackObject{
+		newPackObject(SIZE_1K, obj.partition), newPackLO(obj.partition)} {
+		no := copyVanilla(obj)
+		require.Nil(t, d.LoadObjectMeta(no))
+		no.small, no.dataSize, no.meta = fresh.small, fresh.dataSize, fresh.meta
+		no.meta.Name = obj.name
+		no.meta.Timestamp = incSeconds(obj.meta.Timestamp, 2)
+		require.Nil(t, feedObject(no, d))
+
+		restore := injectIndexWriteCrash()
+		require.Equal(t, errInjectedCrash, d.CommitWrite(no))
+		restore()
+		no.Close()
+
+		require.Equal(t, indexes, dumpDBIndexes(t, d, obj))
+		require.Equal(t, size, bundle.BundleSize())
+	}
+}
+
+func TestCommitDeletionCrash(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj, indexes := prepareCrashObject(t, d)
+
+	oo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(oo))
+	oo.meta.Timestamp = incSeconds(obj.meta.Timestamp, 2)
+
+	restore := injectIndexWriteCrash()
+	require.Equal(t, errInjectedCrash, d.CommitDeletion(oo))
+	restore()
+	require.Equal(t, indexes, dumpDBIndexes(t, d, obj))
+
+	// Needles must not be deallocated
+	oo = copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(oo))
+	r, err := d.NewReader(oo)
+	require.Nil(t, err)
+	hash := md5.New()
+	io.Copy(hash, r)
+	require.Equal(t,
+		obj.meta.SystemMeta[common.HEtag], hex.EncodeToString(hash.Sum(nil)))
+}
+
+func TestQuarantineObjectCrash(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	obj, indexes := prepareCrashObject(t, d)
+
+	oo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(oo))
+
+	restore := injectIndexWriteCrash()
+	require.Equal(t, errInjectedCrash, d.QuarantineObject(oo))
+	restore()
+	require.Equal(t, indexes, dumpDBIndexes(t, d, obj))
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+)
+
+// Tombstones older than the reclaim age are ignored by suffix hashing and
+// listing no matter they have been reaped or not, so that replicas reaping
+// at different time still agree with each other. Tombstones never expire
+// if reclaimAge is not positive.
+func isTombstoneExpired(key string, idx *DBIndex, reclaimAge int64) bool {
+	if reclaimAge <= 0 || !strings.HasSuffix(key, "/"+string(TOMBSTONE)) {
+		return false
+	}
+
+	deadline := time.Now().Add(-time.Duration(reclaimAge) * time.Second)
+	return isMetaExpired(idx.Meta, deadline)
+}
+
+type expiredTombstone struct {
+	key       string
+	timestamp string
+}
+
+// ReapTombstones deletes the tombstone indexes of the partition older than
+// reclaimAge and invalidates the hashes of affected suffixes. Tombstone
+// files of LO are reaped by HashCleanupListDir.
+func (d *PackDevice) ReapTombstones(partition string, reclaimAge int64) (int64, error) {
+	if reclaimAge <= 0 {
+		return 0, nil
+	}
+
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	var expired []*expiredTombstone
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		if !strings.HasSuffix(key, "/"+string(TOMBSTONE)) {
+			continue
+		}
+
+		dbIndex := new(DBIndex)
+		if err := proto.Unmarshal(iter.Value().Data(), dbIndex); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			continue
+		}
+		if isTombstoneExpired(key, dbIndex, reclaimAge) {
+			expired = append(expired, &expiredTombstone{
+				key:       strings.TrimSuffix(key, "/"+string(TOMBSTONE)),
+				timestamp: dbIndex.Meta.Timestamp,
+			})
+		}
+	}
+	iter.Close()
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	d.cmu.RLock()
+	defer d.cmu.RUnlock()
+
+	suffixes := make(map[string]string)
+	var reaped int64
+	var err error
+	for _, t := range expired {
+		var ok bool
+		if ok, err = d.reapTombstone(t); err != nil {
+			glogger.Error("unable to delete expired tombstone",
+				zap.String("object-key", t.key), zap.Error(err))
+			break
+		}
+		if ok {
+			suffixes[splitObjectKey(t.key)[1]] = t.key
+			reaped++
+		}
+	}
+
+	for _, key := range suffixes {
+		if err := InvalidateHash(filepath.Join(d.objectsDir, key)); err != nil {
+			glogger.Error("unable to invalidate suffix hash",
+				zap.String("object-key", key), zap.Error(err))
+		}
+	}
+
+	return reaped, err
+}
+
+// Deletes the tombstone unless it has been replaced since scanning. The
+// object is locked like commits, so that a DELETE can't write a newer
+// tombstone between the check and the deletion.
+func (d *PackDevice) reapTombstone(t *expiredTombstone) (bool, error) {
+	d.km.Lock(t.key)
+	defer d.km.Unlock(t.key)
+	defer d.cache.invalidate(t.key)
+
+	dbIndex, err := d.getDBIndex(t.key, TOMBSTONE)
+	if err != nil {
+		return false, err
+	}
+	if dbIndex == nil || dbIndex.Meta.Timestamp != t.timestamp {
+		return false, nil
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	d.clearTombstoneDBIndex(batch, &PackObject{key: t.key})
+	if err = d.writeDBIndexes(batch); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+func deleteObject(t *testing.T, d *PackDevice, obj *PackObject, ts time.Time) {
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = common.CanonicalTimestampFromTime(ts)
+	require.Nil(t, d.CommitDeletion(vo))
+}
+
+func TestReapTombstones(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	var objs []*PackObject
+	for i := 0; i < 2; i++ {
+		obj := newPackObject(SIZE_1K, partition)
+		require.Nil(t, feedObject(obj, d))
+		require.Nil(t, d.CommitWrite(obj))
+		obj.Close()
+		objs = append(objs, obj)
+	}
+	deleteObject(t, d, objs[0], time.Now().Add(-time.Second*(ONE_WEEK+60)))
+	deleteObject(t, d, objs[1], time.Now())
+
+	// Expired tombstones are ignored before being reaped
+	suffix := splitObjectKey(objs[0].key)[1]
+	empty := hex.EncodeToString(md5.New().Sum(nil))
+	hash, err := d.CalculateSuffixHash(partition, suffix, ONE_WEEK)
+	require.Nil(t, err)
+	if suffix != splitObjectKey(objs[1].key)[1] {
+		require.Equal(t, empty, hash)
+	}
+
+	reaped, err := d.ReapTombstones(partition, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), reaped)
+
+	idx, err := d.getDBIndex(objs[0].key, TOMBSTONE)
+	require.Nil(t, err)
+	require.Nil(t, idx)
+	idx, err = d.getDBIndex(objs[1].key, TOMBSTONE)
+	require.Nil(t, err)
+	require.NotNil(t, idx)
+
+	_, _, ip := d.hashesPaths(partition)
+	suffixes, err := LoadInvalidSuffixes(ip)
+	require.Nil(t, err)
+	require.Contains(t, suffixes, suffix)
+
+	// Suffix hash is not changed by reaping
+	rhash, err := d.CalculateSuffixHash(partition, suffix, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, hash, rhash)
+
+	reaped, err = d.ReapTombstones(partition, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), reaped)
+}
+
+func TestReapTombstonesRacingDeletion(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	obj := newPackObject(SIZE_1K, partition)
+	require.Nil(t, feedObject(obj, d))
+	require.Nil(t, d.CommitWrite(obj))
+	obj.Close()
+	deleteObject(t, d, obj, time.Now().Add(-time.Second*(ONE_WEEK+60)))
+
+	// A DELETE arrives right after the reaper has checked the tombstone
+	ts := time.Now()
+	deleted := make(chan error, 1)
+	var once sync.Once
+	beforeDBIndexesWrite = func() error {
+		once.Do(func() {
+			go func() {
+				vo := copyVanilla(obj)
+				if err := d.LoadObjectMeta(vo); err != nil {
+					deleted <- err
+					return
+				}
+				vo.meta.Timestamp = common.CanonicalTimestampFromTime(ts)
+				deleted <- d.CommitDeletion(vo)
+			}()
+			time.Sleep(time.Millisecond * 100)
+		})
+		return nil
+	}
+	defer func() {
+		beforeDBIndexesWrite = func() error { return nil }
+	}()
+
+	reaped, err := d.ReapTombstones(partition, ONE_WEEK)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), reaped)
+	require.Nil(t, <-deleted)
+
+	// The newer tombstone survives
+	idx, err := d.getDBIndex(obj.key, TOMBSTONE)
+	require.Nil(t, err)
+	require.NotNil(t, idx)
+	require.Equal(t, common.CanonicalTimestampFromTime(ts), idx.Meta.Timestamp)
+}
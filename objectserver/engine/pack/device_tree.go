@@ -0,0 +1,101 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// The hash tree of a partition has the suffixes under the root, and the
+// objects of a suffix are grouped into buckets by the leading characters of
+// their hashes. Replicators compare the suffix hashes first, then the bucket
+// hashes of the suffixes diverged, so that only the objects in the buckets
+// diverged are diffed.
+const treeBucketChars = 2
+
+func treeBucket(hash string) string {
+	return hash[:treeBucketChars]
+}
+
+// The hash of a bucket is the MD5 of the hashes and timestamps of its
+// objects in the order of hashes.
+func bucketHashes(tses map[string]*ObjectTimestamps) map[string]string {
+	buckets := make(map[string][]string)
+	for h := range tses {
+		b := treeBucket(h)
+		buckets[b] = append(buckets[b], h)
+	}
+
+	hashes := make(map[string]string)
+	for b, objs := range buckets {
+		sort.Strings(objs)
+		m := md5.New()
+		for _, h := range objs {
+			fmt.Fprintf(m, "%s %s %s\n",
+				h, tses[h].DataTimestamp, tses[h].MetaTimestamp)
+		}
+		hashes[b] = hex.EncodeToString(m.Sum(nil))
+	}
+
+	return hashes
+}
+
+func (d *PackDevice) PartitionTree(
+	partition string, suffixes []string) (*PartitionTree, error) {
+	tree := &PartitionTree{Suffixes: make(map[string]*SuffixTree)}
+	for _, s := range suffixes {
+		tses, err := d.ListSuffixTimestamps(partition, s)
+		if err != nil {
+			return nil, err
+		}
+		tree.Suffixes[s] = &SuffixTree{Buckets: bucketHashes(tses)}
+	}
+
+	return tree, nil
+}
+
+func (f *PackEngine) PartitionTree(
+	device, partition string, suffixes []string) (*PartitionTree, error) {
+	dev := f.deviceMgr.GetPackDevice(device)
+	if dev == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+
+	return dev.PartitionTree(partition, suffixes)
+}
+
+// divergedTimestamps returns the timestamps of the objects of a suffix in
+// the buckets whose hashes are different from the remote ones. All of them
+// are returned if the remote suffix tree is unknown.
+func divergedTimestamps(tses map[string]*ObjectTimestamps,
+	remote *SuffixTree) map[string]*ObjectTimestamps {
+	if remote == nil {
+		return tses
+	}
+
+	local := bucketHashes(tses)
+	diverged := make(map[string]*ObjectTimestamps)
+	for h, ts := range tses {
+		b := treeBucket(h)
+		if local[b] != remote.Buckets[b] {
+			diverged[h] = ts
+		}
+	}
+
+	return diverged
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	objs := populateSuffixes(t, d, partition)
+	var suffixes []string
+	for _, obj := range objs {
+		suffixes = append(suffixes, splitObjectKey(obj.key)[1])
+	}
+
+	tree, err := d.PartitionTree(partition, suffixes)
+	require.Nil(t, err)
+	require.Len(t, tree.Suffixes, len(suffixes))
+
+	// Nothing diverges from the tree of the same objects
+	for _, s := range suffixes {
+		tses, err := d.ListSuffixTimestamps(partition, s)
+		require.Nil(t, err)
+		require.Empty(t, divergedTimestamps(tses, tree.Suffixes[s]))
+		require.Equal(t, tses, divergedTimestamps(tses, nil))
+	}
+
+	// Only the bucket of the object updated diverges
+	obj := objs[2]
+	vo := copyVanilla(obj)
+	require.Nil(t, d.LoadObjectMeta(vo))
+	vo.meta.Timestamp = incSeconds(obj.meta.Timestamp, 1)
+	require.Nil(t, d.CommitUpdate(vo))
+
+	parts := splitObjectKey(obj.key)
+	tses, err := d.ListSuffixTimestamps(partition, parts[1])
+	require.Nil(t, err)
+	diverged := divergedTimestamps(tses, tree.Suffixes[parts[1]])
+	require.Contains(t, diverged, parts[2])
+	for h := range diverged {
+		require.Equal(t, treeBucket(parts[2]), treeBucket(h))
+	}
+}
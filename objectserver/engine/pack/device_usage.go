@@ -0,0 +1,403 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+)
+
+const usageStripes = 64
+
+// Every partition has a usage record saved apart from the object keys,
+// which is updated in the same write batch as the indexes of the
+// partition. Needles shared by dedup are counted once by their dedup
+// records rather than by the indexes referring to them.
+// The record is absent if the partition is written by an older version, or
+// if the sizes of its needles are changed by compaction. Such a partition
+// is counted from its indexes when its usage is loaded.
+func usageKey(partition string) []byte {
+	return []byte(fmt.Sprintf("/.usage/%s", partition))
+}
+
+func usageStripe(partition string) int {
+	h := fnv.New32a()
+	io.WriteString(h, partition)
+	return int(h.Sum32() % usageStripes)
+}
+
+// Stripes are always locked in ascending order. They are locked after the
+// stripes of suffix summaries.
+func (d *PackDevice) lockUsageStripes(stripes map[int]bool) func() {
+	var locked []int
+	for i := 0; i < usageStripes; i++ {
+		if stripes[i] {
+			d.umu[i].Lock()
+			locked = append(locked, i)
+		}
+	}
+
+	return func() {
+		for _, i := range locked {
+			d.umu[i].Unlock()
+		}
+	}
+}
+
+func (d *PackDevice) lockUsageStripe(partition string) func() {
+	return d.lockUsageStripes(map[int]bool{usageStripe(partition): true})
+}
+
+// Needles shared by dedup are accounted by their records
+func (u *PartitionUsage) addIndex(key string, idx *DBIndex, sign int64) {
+	if isTombstoneKey(key) {
+		u.Tombstones += sign
+	}
+	if n := idx.Index; n != nil && n.Digest == "" {
+		u.Needles += sign
+		u.LiveBytes += sign * n.Size
+	}
+}
+
+func (u *PartitionUsage) addRecord(r *DedupRecord, sign int64) {
+	if r.Index != nil {
+		u.Needles += sign
+		u.LiveBytes += sign * r.Index.Size
+	}
+}
+
+// Applies the value of an index or a dedup record to the usage. Corrupted
+// values are regarded as absent.
+func (u *PartitionUsage) add(m *indexMutation, value []byte, sign int64) {
+	if len(value) == 0 {
+		return
+	}
+
+	if len(m.fields) == 4 {
+		idx := new(DBIndex)
+		if proto.Unmarshal(value, idx) == nil {
+			u.addIndex(m.key, idx, sign)
+		}
+		return
+	}
+
+	r := new(DedupRecord)
+	if proto.Unmarshal(value, r) == nil {
+		u.addRecord(r, sign)
+	}
+}
+
+// nil is returned if the record is not found
+func (d *PackDevice) getPartitionUsage(partition string) (*PartitionUsage, error) {
+	b, err := d.db.GetBytes(d.ropt, usageKey(partition))
+	if err != nil {
+		glogger.Error("unable to retrieve partition usage",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	u := new(PartitionUsage)
+	if err = proto.Unmarshal(b, u); err != nil {
+		glogger.Error("unable to unmarshal partition usage",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, ErrDBIndexCorrupted
+	}
+
+	return u, nil
+}
+
+// Returns the partition of an object index or a dedup record, or an empty
+// string for other keys.
+func usagePartition(fields []string) string {
+	if len(fields) == 4 && !strings.HasPrefix(fields[0], ".") {
+		return fields[0]
+	}
+	if len(fields) == 3 && fields[0] == ".dedup" {
+		return fields[1]
+	}
+
+	return ""
+}
+
+// accountBatch appends the usage updates of the partitions mutated by the
+// batch to itself. Partitions without a usage record, or whose record is
+// deleted by the batch, are skipped. The stripes of the partitions stay
+// locked until the returned function is called, which must be after the
+// batch is written.
+func (d *PackDevice) accountBatch(batch *gorocksdb.WriteBatch) (func(), error) {
+	var mutations []*indexMutation
+	stripes := make(map[int]bool)
+	cleared := make(map[string]bool)
+	iter := batch.NewIterator()
+	for iter.Next() {
+		r := iter.Record()
+		fields := splitObjectKey(string(r.Key))
+		if len(fields) == 2 && fields[0] == ".usage" {
+			cleared[fields[1]] = true
+			continue
+		}
+		partition := usagePartition(fields)
+		if partition == "" {
+			continue
+		}
+
+		m := &indexMutation{key: string(r.Key), fields: fields}
+		switch r.Type {
+		case gorocksdb.WriteBatchRecordTypeValue:
+			m.value = append([]byte{}, r.Value...)
+		case gorocksdb.WriteBatchRecordTypeDeletion:
+		default:
+			return nil, ErrUnknownBatchRecord
+		}
+		mutations = append(mutations, m)
+		stripes[usageStripe(partition)] = true
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	unlock := d.lockUsageStripes(stripes)
+	usages := make(map[string]*PartitionUsage)
+	// Latest value of the keys mutated more than once in the batch
+	latest := make(map[string][]byte)
+	for _, m := range mutations {
+		partition := usagePartition(m.fields)
+		if cleared[partition] {
+			continue
+		}
+		u, ok := usages[partition]
+		if !ok {
+			var err error
+			if u, err = d.getPartitionUsage(partition); err != nil {
+				unlock()
+				return nil, err
+			}
+			usages[partition] = u
+		}
+		if u == nil {
+			continue
+		}
+
+		old, ok := latest[m.key]
+		if !ok {
+			var err error
+			if old, err = d.getIndexBytes([]byte(m.key)); err != nil {
+				unlock()
+				return nil, err
+			}
+		}
+		u.add(m, old, -1)
+		u.add(m, m.value, 1)
+		latest[m.key] = m.value
+	}
+
+	for partition, u := range usages {
+		if u == nil || cleared[partition] {
+			continue
+		}
+
+		b, err := proto.Marshal(u)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		batch.Put(usageKey(partition), b)
+	}
+
+	return unlock, nil
+}
+
+// buildPartitionUsage counts the usage of the partition from its indexes
+// and dedup records, and saves it.
+func (d *PackDevice) buildPartitionUsage(partition string) (*PartitionUsage, error) {
+	unlock := d.lockUsageStripe(partition)
+	defer unlock()
+
+	// Built by another caller while waiting for the lock
+	u, err := d.getPartitionUsage(partition)
+	if err != nil || u != nil {
+		return u, err
+	}
+
+	u = new(PartitionUsage)
+	prefix := []byte(fmt.Sprintf("/%s/", partition))
+	iter := d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		key := string(iter.Key().Data())
+		idx := new(DBIndex)
+		if err = proto.Unmarshal(iter.Value().Data(), idx); err != nil {
+			glogger.Error("unable to unmarshal db index",
+				zap.String("object-key", key), zap.Error(err))
+			continue
+		}
+		u.addIndex(key, idx, 1)
+	}
+	iter.Close()
+
+	prefix = dedupPrefix(partition)
+	iter = d.newIndexIterator()
+	for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+		r := new(DedupRecord)
+		if err = proto.Unmarshal(iter.Value().Data(), r); err != nil {
+			glogger.Error("unable to unmarshal dedup record",
+				zap.String("key", string(iter.Key().Data())), zap.Error(err))
+			continue
+		}
+		u.addRecord(r, 1)
+	}
+	iter.Close()
+
+	b, err := proto.Marshal(u)
+	if err == nil {
+		err = d.db.Put(d.wopt, usageKey(partition), b)
+	}
+	if err != nil {
+		glogger.Error("unable to save partition usage",
+			zap.String("partition", partition), zap.Error(err))
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (d *PackDevice) loadPartitionUsage(partition string) (*PartitionUsage, error) {
+	u, err := d.getPartitionUsage(partition)
+	if err != nil || u != nil {
+		return u, err
+	}
+
+	return d.buildPartitionUsage(partition)
+}
+
+// SpaceStat is the space accounting of a partition or a whole device
+type SpaceStat struct {
+	LiveBytes       int64 // bytes of the needles referred to by the indexes
+	Needles         int64 // needles referred to by the indexes
+	Tombstones      int64
+	BundleBytes     int64 // apparent size of the bundle segments
+	AllocatedBlocks int64 // 4K blocks allocated to the bundle segments
+}
+
+func (s *SpaceStat) add(o *SpaceStat) {
+	s.LiveBytes += o.LiveBytes
+	s.Needles += o.Needles
+	s.Tombstones += o.Tombstones
+	s.BundleBytes += o.BundleBytes
+	s.AllocatedBlocks += o.AllocatedBlocks
+}
+
+// Fragmentation is the ratio of the allocated space not used by any live
+// needle, e.g. needles overridden but not punched yet.
+func (s *SpaceStat) Fragmentation() float64 {
+	allocated := s.AllocatedBlocks * 4096
+	if allocated <= 0 || s.LiveBytes >= allocated {
+		return 0
+	}
+
+	return 1 - float64(s.LiveBytes)/float64(allocated)
+}
+
+func (s *SpaceStat) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"live-bytes":       s.LiveBytes,
+		"needles":          s.Needles,
+		"tombstones":       s.Tombstones,
+		"bundle-bytes":     s.BundleBytes,
+		"allocated-blocks": s.AllocatedBlocks,
+		"fragmentation":    s.Fragmentation(),
+	}
+}
+
+// PartitionSpaceStat returns the space accounting of the partition. Blocks
+// allocated to the bundle are read from the file system, so that holes
+// punched by deallocation are excluded.
+func (d *PackDevice) PartitionSpaceStat(partition string) (*SpaceStat, error) {
+	u, err := d.loadPartitionUsage(partition)
+	if err != nil {
+		return nil, err
+	}
+	stat := &SpaceStat{
+		LiveBytes:  u.LiveBytes,
+		Needles:    u.Needles,
+		Tombstones: u.Tombstones,
+	}
+
+	ids, err := listSegments(filepath.Join(d.objectsDir, partition))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		bp, _ := d.bundlePaths(partition, id)
+		info, err := os.Stat(bp)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stat.BundleBytes += info.Size()
+		stat.AllocatedBlocks += info.Sys().(*syscall.Stat_t).Blocks / 8
+	}
+
+	return stat, nil
+}
+
+// SpaceStats returns the space accounting of every partition and the total
+// of the device. Partitions failing to be accounted are skipped.
+func (d *PackDevice) SpaceStats() (map[string]*SpaceStat, *SpaceStat, error) {
+	// The device may be closed by the manager meanwhile
+	if d.isCompactionStopped() {
+		return nil, nil, ErrPackDeviceClosed
+	}
+	d.wg.Add(1)
+	defer d.wg.Done()
+
+	partitions, err := d.listPartitions()
+	if err != nil {
+		glogger.Error("unable to list partitions",
+			zap.String("device", d.device), zap.Error(err))
+		return nil, nil, err
+	}
+
+	stats := make(map[string]*SpaceStat)
+	total := &SpaceStat{}
+	for _, p := range partitions {
+		stat, err := d.PartitionSpaceStat(p)
+		if err != nil {
+			glogger.Error("unable to account partition space",
+				zap.String("device", d.device),
+				zap.String("partition", p),
+				zap.Error(err))
+			continue
+		}
+		stats[p] = stat
+		total.add(stat)
+	}
+
+	return stats, total, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// Requires the usage maintained incrementally to be the same as the one
+// counted from the indexes.
+func requireUsageConsistent(t *testing.T, d *PackDevice, partition string) *PartitionUsage {
+	u, err := d.getPartitionUsage(partition)
+	require.Nil(t, err)
+	require.NotNil(t, u)
+
+	require.Nil(t, d.db.Delete(d.wopt, usageKey(partition)))
+	rebuilt, err := d.loadPartitionUsage(partition)
+	require.Nil(t, err)
+	require.True(t, proto.Equal(rebuilt, u), "expected %v, got %v", rebuilt, u)
+
+	return u
+}
+
+func TestPartitionUsage(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+	d := NewPackDevice(PACK_DEVICE, root, PACK_POLICY_INDEX)
+	defer d.Close()
+
+	partition := "1"
+	u, err := d.loadPartitionUsage(partition)
+	require.Nil(t, err)
+	require.Equal(t, &PartitionUsage{}, u)
+
+	// 8 data needles and a meta needle, one of the data needles is
+	// replaced by a tombstone
+	objs := populateSuffixes(t, d, partition)
+	u = requireUsageConsistent(t, d, partition)
+	require.Equal(t, int64(8), u.Needles)
+	require.Equal(t, int64(1), u.Tombstones)
+
+	stat, err := d.PartitionSpaceStat(partition)
+	require.Nil(t, err)
+	require.Equal(t, u.LiveBytes, stat.LiveBytes)
+	require.True(t, stat.BundleBytes >= stat.LiveBytes)
+	require.True(t, stat.AllocatedBlocks > 0)
+
+	// Shared needles are counted once
+	d.dedup = true
+	data := generateData(SIZE_1K * 8)
+	shared := commitDedupObjects(t, d, partition, data, 3)
+	u = requireUsageConsistent(t, d, partition)
+	require.Equal(t, int64(9), u.Needles)
+
+	for _, obj := range shared {
+		deleteObject(t, d, obj, time.Now())
+	}
+	deleteObject(t, d, objs[2], time.Now())
+	u = requireUsageConsistent(t, d, partition)
+	require.Equal(t, int64(7), u.Needles)
+	require.Equal(t, int64(5), u.Tombstones)
+
+	// Compaction invalidates the usage
+	_, err = d.CompactPartition(partition)
+	require.Nil(t, err)
+	u, err = d.getPartitionUsage(partition)
+	require.Nil(t, err)
+	require.Nil(t, u)
+	u, err = d.loadPartitionUsage(partition)
+	require.Nil(t, err)
+	require.Equal(t, int64(7), u.Needles)
+
+	stats, total, err := d.SpaceStats()
+	require.Nil(t, err)
+	require.Len(t, stats, 1)
+	require.Equal(t, total, stats[partition])
+}
@@ -0,0 +1,434 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/iqiyi/auklet/common/conf"
+	"github.com/iqiyi/auklet/common/fs"
+)
+
+// Keyring of each pack policy, configured by the options
+// `encryption_keyfile` and `encryption_key_id` in [object-pack] and
+// overridden by [object-pack:<policy index>]. Encryption is disabled if
+// the keyfile is not configured.
+var policyKeyrings = make(map[int]*Keyring)
+
+const (
+	keyIDSize    = 4
+	nonceSize    = 12
+	sealOverhead = nonceSize + 16 // nonce and GCM tag
+
+	// Data of LO is sealed chunk by chunk, so that ranges are decrypted
+	// without reading the whole file.
+	loChunkSize       = 64 * 1024
+	loSealedChunkSize = loChunkSize + sealOverhead
+	// The id of the key sealing a LO data file. Files without it, e.g.
+	// written before encryption is enabled, are in plain text.
+	loKeyIDXattr = "user.auklet.key-id"
+)
+
+// Additional data authenticated with the parts of a needle
+var (
+	needleDataAD = []byte("data")
+	needleMetaAD = []byte("meta")
+)
+
+// Keyring holds the AES keys of a policy by their ids. New data is always
+// sealed with the active key, while data sealed with any of the keys could
+// be opened, so that keys are rotated without rewriting all the data at
+// once.
+type Keyring struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+// Parses the keys, one per line as "<id> <key in hex>". Keys of 16, 24 or
+// 32 bytes select AES-128, AES-192 or AES-256. Blank lines and lines
+// starting with # are ignored. The key of the highest id is active if
+// active is 0.
+func newKeyring(content []byte, active uint32) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, ErrInvalidKeyfile
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, ErrInvalidKeyfile
+		}
+		if _, ok := k.aeads[uint32(id)]; ok {
+			return nil, ErrInvalidKeyfile
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, ErrInvalidKeyfile
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidKeyfile
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.aeads[uint32(id)] = aead
+		if active == 0 && uint32(id) > k.active {
+			k.active = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if active != 0 {
+		k.active = active
+	}
+	if _, ok := k.aeads[k.active]; !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+
+	return k, nil
+}
+
+// LoadKeyring loads the keys from the keyfile. The key of the highest id
+// is active if active is 0.
+func LoadKeyring(path string, active uint32) (*Keyring, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKeyring(content, active)
+}
+
+// nil is returned if encryption is not enabled for the policy
+func parseKeyring(config conf.Config, policy int) (*Keyring, error) {
+	path, ok := policyOption(config, policy, "encryption_keyfile")
+	if !ok || strings.TrimSpace(path) == "" {
+		return nil, nil
+	}
+
+	var active uint64
+	if v, ok := policyOption(config, policy, "encryption_key_id"); ok {
+		var err error
+		if active, err = strconv.ParseUint(strings.TrimSpace(v), 10, 32); err != nil {
+			return nil, err
+		}
+	}
+
+	return LoadKeyring(strings.TrimSpace(path), uint32(active))
+}
+
+// ActiveKeyID returns the id of the key which new data is sealed with
+func (k *Keyring) ActiveKeyID() uint32 {
+	return k.active
+}
+
+func (k *Keyring) aead(id uint32) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+
+	return aead, nil
+}
+
+// Seals the plain text with the active key into an envelope laid out as
+// key id (4 bytes, little endian) | nonce | cipher text | tag.
+func (k *Keyring) seal(plain, ad []byte) ([]byte, error) {
+	aead := k.aeads[k.active]
+	sealed := make([]byte, keyIDSize+nonceSize, keyIDSize+len(plain)+sealOverhead)
+	binary.LittleEndian.PutUint32(sealed, k.active)
+	if _, err := io.ReadFull(rand.Reader, sealed[keyIDSize:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, sealed[keyIDSize:], plain, ad), nil
+}
+
+// Opens the envelope sealed by seal with the key it was sealed with
+func (k *Keyring) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < keyIDSize+sealOverhead {
+		return nil, ErrDecryption
+	}
+	aead, err := k.aead(binary.LittleEndian.Uint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[keyIDSize : keyIDSize+nonceSize]
+	plain, err := aead.Open(nil, nonce, sealed[keyIDSize+nonceSize:], ad)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	return plain, nil
+}
+
+func isEncrypted(idx *NeedleIndex) bool {
+	return idx.Flags&NeedleFlagEncrypted != 0
+}
+
+// Seals the data and meta of a needle. Empty data, e.g. of meta needles, is
+// left as it is. Like compression, the flag is carried by the needle header
+// since bundle version 2, so needles of older bundles stay in plain text.
+func (k *Keyring) sealNeedle(data, meta []byte) ([]byte, []byte, error) {
+	var err error
+	if len(data) > 0 {
+		if data, err = k.seal(data, needleDataAD); err != nil {
+			return nil, nil, err
+		}
+	}
+	if meta, err = k.seal(meta, needleMetaAD); err != nil {
+		return nil, nil, err
+	}
+
+	return data, meta, nil
+}
+
+// Opens a part of the needle sealed by sealNeedle. Parts of needles in plain
+// text are returned as they are.
+func (k *Keyring) openPart(flags uint32, part, ad []byte) ([]byte, error) {
+	if flags&NeedleFlagEncrypted == 0 || len(part) == 0 {
+		return part, nil
+	}
+
+	return k.open(part, ad)
+}
+
+// Returns true if the needle is not sealed with the active key. The meta
+// part is always sealed, so the key is told from it.
+func (k *Keyring) needsReseal(flags uint32, meta []byte) bool {
+	if flags&NeedleFlagEncrypted == 0 {
+		return true
+	}
+
+	return len(meta) < keyIDSize || binary.LittleEndian.Uint32(meta) != k.active
+}
+
+// Reseals the data and meta of the needle with the active key
+func (k *Keyring) resealNeedle(flags uint32, data, meta []byte) ([]byte, []byte, error) {
+	data, err := k.openPart(flags, data, needleDataAD)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta, err = k.openPart(flags, meta, needleMetaAD); err != nil {
+		return nil, nil, err
+	}
+
+	return k.sealNeedle(data, meta)
+}
+
+// The additional data of a LO chunk binds its position, so that chunks
+// can't be reordered, and whether it is the last one, so that the file
+// can't be truncated at a chunk boundary.
+func loChunkAD(index int64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.LittleEndian.PutUint64(ad, uint64(index))
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// chunkSealer seals the data of a LO into chunks of loChunkSize with the
+// active key, each laid out as nonce | cipher text | tag. A full chunk is
+// held back until more data comes, because the last chunk is sealed
+// differently. Every file has at least one chunk, which may be empty.
+type chunkSealer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index int64
+}
+
+func newChunkSealer(w io.Writer, k *Keyring) *chunkSealer {
+	return &chunkSealer{
+		w:    w,
+		aead: k.aeads[k.active],
+		buf:  make([]byte, 0, loChunkSize),
+	}
+}
+
+func (s *chunkSealer) sealChunk(last bool) error {
+	sealed := make([]byte, nonceSize, nonceSize+len(s.buf)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return err
+	}
+	sealed = s.aead.Seal(sealed, sealed, s.buf, loChunkAD(s.index, last))
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.index++
+	return nil
+}
+
+func (s *chunkSealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == loChunkSize {
+			if err := s.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):loChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Seals the last chunk. The sealer must not be written any more.
+func (s *chunkSealer) Flush() error {
+	return s.sealChunk(true)
+}
+
+// Returns the size of the plain text of a LO data file sealed chunk by
+// chunk.
+func loPlainSize(sealedSize int64) (int64, error) {
+	chunks := (sealedSize + loSealedChunkSize - 1) / loSealedChunkSize
+	if chunks == 0 || sealedSize-(chunks-1)*loSealedChunkSize < sealOverhead {
+		return 0, ErrDecryption
+	}
+
+	return sealedSize - chunks*sealOverhead, nil
+}
+
+// chunkOpener is an io.ReaderAt of the plain text of a LO data file sealed
+// by chunkSealer. The last chunk opened is kept for sequential reads.
+type chunkOpener struct {
+	r     io.ReaderAt
+	aead  cipher.AEAD
+	size  int64 // size of the plain text
+	index int64
+	chunk []byte
+}
+
+func newChunkOpener(r io.ReaderAt, sealedSize int64,
+	k *Keyring, id uint32) (*chunkOpener, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	size, err := loPlainSize(sealedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkOpener{r: r, aead: aead, size: size, index: -1}, nil
+}
+
+func (o *chunkOpener) Size() int64 {
+	return o.size
+}
+
+func (o *chunkOpener) openChunk(index int64) error {
+	if index == o.index {
+		return nil
+	}
+
+	size := o.size - index*loChunkSize
+	if size > loChunkSize {
+		size = loChunkSize
+	}
+	sealed := make([]byte, size+sealOverhead)
+	if _, err := o.r.ReadAt(sealed, index*loSealedChunkSize); err != nil {
+		return err
+	}
+
+	last := (index+1)*loChunkSize >= o.size
+	chunk, err := o.aead.Open(sealed[nonceSize:nonceSize],
+		sealed[:nonceSize], sealed[nonceSize:], loChunkAD(index, last))
+	if err != nil {
+		return ErrDecryption
+	}
+
+	o.index, o.chunk = index, chunk
+	return nil
+}
+
+func (o *chunkOpener) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < o.size {
+		if err := o.openChunk(off / loChunkSize); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], o.chunk[off%loChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Returns the id of the key which the LO data file is sealed with. False
+// is returned if the file is in plain text.
+func loKeyID(fd uintptr) (uint32, bool, error) {
+	value := make([]byte, 16)
+	n, err := fs.Getxattr(fd, loKeyIDXattr, value)
+	if err == syscall.ENODATA {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	id, err := strconv.ParseUint(string(value[:n]), 10, 32)
+	if err != nil {
+		return 0, false, ErrDecryption
+	}
+
+	return uint32(id), true, nil
+}
+
+func setLOKeyID(fd uintptr, id uint32) error {
+	_, err := fs.Setxattr(fd, loKeyIDXattr, []byte(strconv.FormatUint(uint64(id), 10)))
+	return err
+}
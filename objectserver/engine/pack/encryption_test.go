@@ -0,0 +1,144 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+const testKeyfile = `
+# retired
+1 000102030405060708090a0b0c0d0e0f
+
+2 000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f
+`
+
+func newTestKeyring(t *testing.T, active uint32) *Keyring {
+	k, err := newKeyring([]byte(testKeyfile), active)
+	require.Nil(t, err)
+	return k
+}
+
+func TestParseKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "keys")
+	require.Nil(t, ioutil.WriteFile(keyfile, []byte(testKeyfile), 0600))
+
+	config, err := conf.StringConfig(`
+[object-pack]
+encryption_keyfile = ` + keyfile + `
+
+[object-pack:1]
+encryption_key_id = 1
+
+[object-pack:2]
+encryption_key_id = 3
+`)
+	require.Nil(t, err)
+
+	k, err := parseKeyring(config, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), k.ActiveKeyID())
+	k, err = parseKeyring(config, 1)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), k.ActiveKeyID())
+	_, err = parseKeyring(config, 2)
+	require.Equal(t, ErrEncryptionKeyNotFound, err)
+
+	config, err = conf.StringConfig("[object-pack]\n")
+	require.Nil(t, err)
+	k, err = parseKeyring(config, 0)
+	require.Nil(t, err)
+	require.Nil(t, k)
+
+	for _, content := range []string{"0 00010203", "1 0001020", "1 000102", "1"} {
+		_, err = newKeyring([]byte(content), 0)
+		require.Equal(t, ErrInvalidKeyfile, err)
+	}
+}
+
+func TestSealNeedle(t *testing.T) {
+	k1, k2 := newTestKeyring(t, 1), newTestKeyring(t, 2)
+	data, meta, err := k1.sealNeedle([]byte("data"), []byte("meta"))
+	require.Nil(t, err)
+	require.False(t, k1.needsReseal(NeedleFlagEncrypted, meta))
+	require.True(t, k2.needsReseal(NeedleFlagEncrypted, meta))
+	require.True(t, k2.needsReseal(0, []byte("meta")))
+
+	// Parts can't be swapped
+	_, err = k2.openPart(NeedleFlagEncrypted, data, needleMetaAD)
+	require.Equal(t, ErrDecryption, err)
+
+	data, meta, err = k2.resealNeedle(NeedleFlagEncrypted, data, meta)
+	require.Nil(t, err)
+	require.False(t, k2.needsReseal(NeedleFlagEncrypted, meta))
+	p, err := k1.openPart(NeedleFlagEncrypted, data, needleDataAD)
+	require.Nil(t, err)
+	require.Equal(t, []byte("data"), p)
+
+	// Empty data of meta needles is kept empty
+	data, _, err = k2.sealNeedle(nil, []byte("meta"))
+	require.Nil(t, err)
+	require.Empty(t, data)
+
+	_, err = (*Keyring)(nil).openPart(NeedleFlagEncrypted, meta, needleMetaAD)
+	require.Equal(t, ErrEncryptionKeyNotFound, err)
+}
+
+func TestChunkSealer(t *testing.T) {
+	k := newTestKeyring(t, 0)
+	for _, size := range []int64{0, 1, loChunkSize, loChunkSize*3 + 77} {
+		plain := generateData(size)
+		buf := &bytes.Buffer{}
+		s := newChunkSealer(buf, k)
+		_, err := io.Copy(s, bytes.NewReader(plain))
+		require.Nil(t, err)
+		require.Nil(t, s.Flush())
+
+		sealed := bytes.NewReader(buf.Bytes())
+		o, err := newChunkOpener(sealed, sealed.Size(), k, 2)
+		require.Nil(t, err)
+		require.Equal(t, size, o.Size())
+		got, err := ioutil.ReadAll(io.NewSectionReader(o, 0, o.Size()))
+		require.Nil(t, err)
+		require.Equal(t, plain, got)
+
+		if size > 100 {
+			got, err = ioutil.ReadAll(io.NewSectionReader(o, 50, size-60))
+			require.Nil(t, err)
+			require.Equal(t, plain[50:size-10], got)
+		}
+
+		// Truncation at a chunk boundary is detected
+		if size > loChunkSize {
+			tr := bytes.NewReader(buf.Bytes()[:loSealedChunkSize])
+			o, err = newChunkOpener(tr, tr.Size(), k, 2)
+			require.Nil(t, err)
+			_, err = ioutil.ReadAll(io.NewSectionReader(o, 0, o.Size()))
+			require.Equal(t, ErrDecryption, err)
+		}
+	}
+}
@@ -18,13 +18,16 @@ import (
 	"flag"
 	"net/textproto"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/iqiyi/auklet/common"
 	"github.com/iqiyi/auklet/common/conf"
 	"github.com/iqiyi/auklet/objectserver/engine"
 
+	"github.com/uber-go/tally"
 	"go.uber.org/zap"
 )
 
@@ -95,6 +98,15 @@ func (f *PackEngine) New(vars map[string]string,
 	return obj, nil
 }
 
+func (f *PackEngine) SetMetricsScope(scope tally.Scope) {
+	f.deviceMgr.setMetricsScope(
+		scope.Tagged(map[string]string{"policy": strconv.Itoa(f.policy)}))
+	// Replication is throttled for all the policies of the node
+	if f.rpcServer != nil {
+		f.rpcServer.throttle.setMetricsScope(scope)
+	}
+}
+
 func (f *PackEngine) Close() error {
 	glogger.Info("closing Pack Engine", zap.Int("policy", f.policy))
 
@@ -111,7 +123,18 @@ func (f *PackEngine) GetHashes(
 		return nil, ErrPackDeviceNotFound
 	}
 
-	_, hashes, err := dev.GetHashes(partition, recalculate, false, common.ONE_WEEK)
+	_, hashes, err := dev.GetHashes(partition, recalculate, false, gconf.ReclaimAge)
+	return hashes, err
+}
+
+func (f *PackEngine) GetSummaryHashes(
+	device, partition string) (map[string]string, error) {
+	dev := f.deviceMgr.GetPackDevice(device)
+	if dev == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+
+	_, hashes, err := dev.GetSummaryHashes(partition, gconf.ReclaimAge)
 	return hashes, err
 }
 
@@ -151,10 +174,28 @@ func PackEngineConstructor(config conf.Config, policy *conf.Policy,
 		return nil, ErrHashConfNotFound
 	}
 	gconf = &PackConfig{
-		AuditorFPS:        config.GetInt("object-auditor", "files_per_second", 20),
-		AuditorBPS:        config.GetInt("object-auditor", "bytes_per_second", 10*1024*1024),
-		LazyMigration:     config.GetBool("object-pack", "lazy_migration", false),
-		PackChunkedObject: config.GetBool("object-pack", "pack_chunked_object", false),
+		AuditorFPS:          config.GetInt("object-auditor", "files_per_second", 20),
+		AuditorBPS:          config.GetInt("object-auditor", "bytes_per_second", 10*1024*1024),
+		OrphanGracePeriod:   config.GetInt("object-auditor", "orphan_grace_period", 0),
+		ReclaimAge:          config.GetInt("object-replicator", "reclaim_age", ONE_WEEK),
+		LazyMigration:       config.GetBool("object-pack", "lazy_migration", false),
+		PackChunkedObject:   config.GetBool("object-pack", "pack_chunked_object", false),
+		SkipNeedleChecksum:  config.GetBool("object-pack", "skip_needle_checksum", false),
+		BundleSegmentSize:   config.GetInt("object-pack", "bundle_segment_size", 0),
+		CompactionInterval:  config.GetInt("object-pack", "compaction_interval", 0),
+		CompactionRatio:     config.GetFloat("object-pack", "compaction_ratio", 0.5),
+		RepackInterval:      config.GetInt("object-pack", "repack_interval", 0),
+		ReadCacheSize:       config.GetInt("object-pack", "read_cache_size", 0),
+		ReadCacheObjectSize: config.GetInt("object-pack", "read_cache_object_size", 1024*1024),
+		GroupCommitWindow:   config.GetInt("object-pack", "group_commit_window", 0),
+		GroupCommitSize:     config.GetInt("object-pack", "group_commit_size", 64),
+		DBStatsInterval:     config.GetInt("object-pack", "rocksdb_stats_interval", 300),
+		SpaceStatsInterval:  config.GetInt("object-pack", "space_stats_interval", 300),
+
+		ReplicationDeviceBPS: config.GetInt("object-replicator", "device_bytes_per_second", 0),
+		ReplicationNodeBPS:   config.GetInt("object-replicator", "node_bytes_per_second", 0),
+		ReplicationOPS:       config.GetInt("object-replicator", "objects_per_second", 0),
+		ReplicationHostSyncs: config.GetInt("object-replicator", "max_syncs_per_host", 0),
 	}
 
 	gconf.AllowedHeaders = map[string]bool{
@@ -171,6 +212,40 @@ func PackEngineConstructor(config conf.Config, policy *conf.Policy,
 		}
 	}
 
+	compression, err := parseCompression(policy.Config["compression"])
+	if err != nil {
+		glogger.Error("unable to parse compression of policy",
+			zap.Int("policy", policy.Index),
+			zap.String("compression", policy.Config["compression"]))
+		return nil, err
+	}
+	policyCompressions[policy.Index] = compression
+	policyDedups[policy.Index] = common.LooksTrue(policy.Config["dedup"])
+
+	dbOpts, err := parseDBOptions(config, policy.Index)
+	if err != nil {
+		glogger.Error("unable to parse RocksDB options of policy",
+			zap.Int("policy", policy.Index), zap.Error(err))
+		return nil, err
+	}
+	policyDBOptions[policy.Index] = dbOpts
+
+	threshold, err := parseNeedleThreshold(config, policy.Index)
+	if err != nil {
+		glogger.Error("unable to parse needle threshold of policy",
+			zap.Int("policy", policy.Index), zap.Error(err))
+		return nil, err
+	}
+	policyNeedleThresholds[policy.Index] = threshold
+
+	keyring, err := parseKeyring(config, policy.Index)
+	if err != nil {
+		glogger.Error("unable to load encryption keys of policy",
+			zap.Int("policy", policy.Index), zap.Error(err))
+		return nil, err
+	}
+	policyKeyrings[policy.Index] = keyring
+
 	port := int(config.GetInt("app:object-server", "bind_port", 6000))
 
 	dm := NewPackDeviceMgr(port, driveRoot, policy.Index)
@@ -180,6 +255,12 @@ func PackEngineConstructor(config conf.Config, policy *conf.Policy,
 	dm.testMode = config.GetBool("app:object-server", "test_mode", false)
 	if !dm.testMode {
 		go dm.monitorDisks()
+		if gconf.DBStatsInterval > 0 {
+			go dm.dumpDBStats(time.Second * time.Duration(gconf.DBStatsInterval))
+		}
+		if gconf.SpaceStatsInterval > 0 {
+			go dm.dumpSpaceStats(time.Second * time.Duration(gconf.SpaceStatsInterval))
+		}
 	}
 
 	rpcPort := int(config.GetInt("app:object-server", "rpc_port", 60000))
@@ -198,6 +279,7 @@ func PackEngineConstructor(config conf.Config, policy *conf.Policy,
 		hashPrefix: prefix,
 		hashSuffix: suffix,
 		deviceMgr:  dm,
+		rpcServer:  rpc,
 		asyncWG:    wg,
 	}, nil
 }
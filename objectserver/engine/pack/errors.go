@@ -45,4 +45,28 @@ var (
 	ErrRemoteDiskUnmounted       = errors.New("remote disk is unmounted")
 	ErrRemoteHash                = errors.New("unable to get remote hash")
 	ErrHashConfNotFound          = errors.New("unable to read hash prefix and suffxi")
+	ErrCompactionAborted         = errors.New("bundle compaction aborted")
+	ErrNeedleCorrupted           = errors.New("needle header is corrupted")
+	ErrNeedleChecksumMismatch    = errors.New("needle checksum mismatch")
+	ErrUnknownBatchRecord        = errors.New("unknown type of write batch record")
+	ErrUnknownCompression        = errors.New("unknown needle compression")
+	ErrNeedleDecompression       = errors.New("unable to decompress needle data")
+	ErrUnknownCompactionStyle    = errors.New("unknown RocksDB compaction style")
+	ErrRateLimiterUnsupported    = errors.New("RocksDB rate limiter is not supported")
+	ErrSegmentNotFound           = errors.New("bundle segment not found")
+	ErrInvalidNeedleThreshold    = errors.New("needle threshold must be positive")
+	ErrRepackAborted             = errors.New("object repacking aborted")
+	ErrInvalidSnapshotName       = errors.New("invalid snapshot name")
+	ErrSnapshotExists            = errors.New("snapshot already exists")
+	ErrSnapshotNotFound          = errors.New("snapshot not found")
+	ErrInvalidKeyfile            = errors.New("encryption keyfile is malformed")
+	ErrEncryptionKeyNotFound     = errors.New("encryption key not found")
+	ErrEncryptionDisabled        = errors.New("encryption is not enabled")
+	ErrDecryption                = errors.New("unable to decrypt data")
+	ErrInvalidDeviceMode         = errors.New("invalid device mode")
+	ErrMalformedSyncFrame        = errors.New("sync frame is malformed")
+	ErrSyncStreamUnsupported     = errors.New("remote is unable to receive sync stream")
+	ErrObjectsNotSynced          = errors.New("unable to sync some objects")
+	ErrPartitionTree             = errors.New("unable to get partition tree of remote")
+	ErrPackDeviceClosed          = errors.New("pack device is closed")
 )
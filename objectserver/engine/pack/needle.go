@@ -17,18 +17,30 @@ package pack
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 )
 
 const (
 	NeedleMagicNumber     = 0xdeadbeef
 	NeedleAlignment       = 4096
 	NeedleHeaderSize      = 40
+	NeedleHeaderSizeV2    = 48
 	DefaultDataBufferSize = 1024 * 256
 	DefaultMetaBufferSize = 512
 )
 
+// Needle flags, available since bundle version 2
+const (
+	// Data of the needle is compressed by snappy
+	NeedleFlagSnappy = uint32(1) << iota
+	// Data and meta of the needle are encrypted by AES-GCM
+	NeedleFlagEncrypted
+)
+
 var padding = make([]byte, NeedleAlignment)
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type NeedleHeader struct {
 	MagicNumber uint32
 	NeedleSize  int64
@@ -36,6 +48,9 @@ type NeedleHeader struct {
 	MetaSize    int32
 	DataOffset  int64
 	DataSize    int64
+	// Available since bundle version 2
+	Checksum uint32
+	Flags    uint32
 }
 
 func (n *NeedleHeader) WriteToBuffer(b []byte) {
@@ -45,6 +60,10 @@ func (n *NeedleHeader) WriteToBuffer(b []byte) {
 	binary.LittleEndian.PutUint32(b[20:24], uint32(n.MetaSize))
 	binary.LittleEndian.PutUint64(b[24:32], uint64(n.DataOffset))
 	binary.LittleEndian.PutUint64(b[32:40], uint64(n.DataSize))
+	if len(b) >= NeedleHeaderSizeV2 {
+		binary.LittleEndian.PutUint32(b[40:44], n.Checksum)
+		binary.LittleEndian.PutUint32(b[44:48], n.Flags)
+	}
 }
 
 func (n *NeedleHeader) DeserializeFrom(b []byte) {
@@ -54,6 +73,17 @@ func (n *NeedleHeader) DeserializeFrom(b []byte) {
 	n.MetaSize = int32(binary.LittleEndian.Uint32(b[20:24]))
 	n.DataOffset = int64(binary.LittleEndian.Uint64(b[24:32]))
 	n.DataSize = int64(binary.LittleEndian.Uint64(b[32:40]))
+	if len(b) >= NeedleHeaderSizeV2 {
+		n.Checksum = binary.LittleEndian.Uint32(b[40:44])
+		n.Flags = binary.LittleEndian.Uint32(b[44:48])
+	}
+}
+
+// CRC32C of the needle header, data and meta. The checksum field in the
+// header is excluded.
+func NeedleChecksum(needle []byte) uint32 {
+	crc := crc32.Update(0, crc32cTable, needle[0:NeedleHeaderSize])
+	return crc32.Update(crc, crc32cTable, needle[NeedleHeaderSize+4:])
 }
 
 // Calculate memory buffer size for SO
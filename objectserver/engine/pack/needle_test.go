@@ -46,6 +46,47 @@ func TestNeedleHeaderSerialization(t *testing.T) {
 	require.Equal(t, n.DataSize, n2.DataSize)
 }
 
+func TestNeedleHeaderSerializationV2(t *testing.T) {
+	n := &NeedleHeader{
+		MagicNumber: NeedleMagicNumber,
+		NeedleSize:  4096,
+		MetaOffset:  4096 + 48 + 83,
+		MetaSize:    255,
+		DataOffset:  4096 + 48,
+		DataSize:    83,
+		Checksum:    0xcafe,
+		Flags:       NeedleFlagSnappy,
+	}
+
+	b := make([]byte, NeedleHeaderSizeV2)
+	n.WriteToBuffer(b)
+
+	n2 := &NeedleHeader{}
+	n2.DeserializeFrom(b)
+	require.Equal(t, n, n2)
+
+	// Checksum is not available in version 1 header
+	n3 := &NeedleHeader{}
+	n3.DeserializeFrom(b[0:NeedleHeaderSize])
+	require.Equal(t, uint32(0), n3.Checksum)
+	require.Equal(t, uint32(0), n3.Flags)
+}
+
+func TestNeedleChecksum(t *testing.T) {
+	needle := make([]byte, NeedleHeaderSizeV2+100)
+	for i := range needle {
+		needle[i] = byte(i)
+	}
+	crc := NeedleChecksum(needle)
+
+	// Checksum field is excluded
+	needle[NeedleHeaderSize] ^= 0xff
+	require.Equal(t, crc, NeedleChecksum(needle))
+
+	needle[NeedleHeaderSizeV2] ^= 0xff
+	require.NotEqual(t, crc, NeedleChecksum(needle))
+}
+
 // Every needle will occupy 4K aligned disk space
 func TestNeedleDiskSize(t *testing.T) {
 	require.Equal(t, int64(0), CalculateDiskSize(40, 83, 440)%NeedleAlignment)
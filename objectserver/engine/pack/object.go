@@ -15,7 +15,6 @@
 package pack
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
@@ -26,6 +25,7 @@ import (
 	"github.com/iqiyi/auklet/common"
 	"github.com/iqiyi/auklet/common/fs"
 
+	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
 )
 
@@ -50,6 +50,13 @@ type PackObject struct {
 	dMeta *ObjectMeta
 	mMeta *ObjectMeta
 
+	// Bundle segments pinned while loading the needle indexes of a SO
+	bundle *BundleSet
+
+	// Set when the object is moved across the needle threshold with its
+	// timestamps kept
+	repack bool
+
 	asyncWG *sync.WaitGroup
 }
 
@@ -61,8 +68,11 @@ func (o *PackObject) ContentLength() int64 {
 	return o.meta.DataSize
 }
 
+// Quarantine moves the object to the quarantine directory of the device,
+// unless it has been modified since it was loaded.
 func (o *PackObject) Quarantine() error {
-	return errors.New("Not Implemented")
+	_, err := o.device.quarantineCorrupted(o)
+	return err
 }
 
 func (o *PackObject) Exists() bool {
@@ -77,6 +87,11 @@ func (o *PackObject) Copy(dsts ...io.Writer) (int64, error) {
 			zap.String("object", o.name), zap.Error(err))
 		return 0, err
 	}
+	if len(dsts) == 1 {
+		// io.MultiWriter hides the ReadFrom of the writer, e.g. the HTTP
+		// response, so that the data would never be sent by sendfile.
+		return io.Copy(dsts[0], o.reader)
+	}
 	return io.Copy(io.MultiWriter(dsts...), o.reader)
 }
 
@@ -245,6 +260,9 @@ func (o *PackObject) objectFiles(dir string) (data, meta, tombstone string) {
 func (o *PackObject) Migrate() bool {
 	df, mf, tf := o.objectFiles(filepath.Join(o.device.objectsDir, o.key))
 
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
 	if tf != "" {
 		tm, err := ReadMetadata(tf)
 		if err != nil {
@@ -253,7 +271,7 @@ func (o *PackObject) Migrate() bool {
 			return false
 		}
 		o.populateObjectMeta(tm)
-		if err = o.device.saveDBIndex(o, TOMBSTONE); err != nil {
+		if err = o.device.saveDBIndex(batch, o, TOMBSTONE); err != nil {
 			glogger.Error("unable to save db index",
 				zap.String("object", o.name),
 				zap.String("part-type", string(TOMBSTONE)),
@@ -261,7 +279,7 @@ func (o *PackObject) Migrate() bool {
 			return false
 		}
 
-		return true
+		return o.migrated(batch)
 	}
 
 	if df == "" {
@@ -275,14 +293,14 @@ func (o *PackObject) Migrate() bool {
 		return false
 	}
 	o.populateObjectMeta(dm)
-	if err = o.device.saveDBIndex(o, DATA); err != nil {
+	if err = o.device.saveDBIndex(batch, o, DATA); err != nil {
 		glogger.Error("unable to save db index",
 			zap.String("object", o.name), zap.Error(err))
 		return false
 	}
 
 	if mf == "" {
-		return true
+		return o.migrated(batch)
 	}
 
 	mm, err := ReadMetadata(mf)
@@ -293,19 +311,46 @@ func (o *PackObject) Migrate() bool {
 	}
 
 	o.populateObjectMeta(mm)
-	if err = o.device.saveDBIndex(o, META); err != nil {
+	if err = o.device.saveDBIndex(batch, o, META); err != nil {
 		glogger.Error("unable to save db index",
 			zap.String("object", o.name), zap.Error(err))
 		return false
 	}
 
+	return o.migrated(batch)
+}
+
+func (o *PackObject) migrated(batch *gorocksdb.WriteBatch) bool {
+	err := o.device.writeDBIndexes(batch)
+	o.device.cache.invalidate(o.key)
+	if err != nil {
+		glogger.Error("unable to write db indexes",
+			zap.String("object", o.name), zap.Error(err))
+		return false
+	}
+
 	return true
 }
 
+// pinBundle pins set for the needle indexes of the object in place of the
+// set pinned before. A nil set unpins the object.
+func (o *PackObject) pinBundle(set *BundleSet) {
+	if set != nil {
+		set.pin()
+	}
+	if o.bundle != nil {
+		o.bundle.unpin()
+	}
+	o.bundle = set
+}
+
 // Close releases any resources used by the instance of PackObject
 // This method is very important. If we don't close the reader/writer
 // explicitly, file descriptors may be leaked.
 func (o *PackObject) Close() error {
+	// Needles of the object are not read any more
+	defer o.pinBundle(nil)
+
 	if o.reader != nil {
 		// I can't imagine an object with both reader/writer set right now.
 		// That is why it returns fast here.
@@ -31,6 +31,13 @@ It has these top-level messages:
 	CheckedObjects
 	WantedParts
 	WantedObjects
+	SuffixSummary
+	DedupRecord
+	PartitionUsage
+	SyncFrame
+	SyncResults
+	SuffixTree
+	PartitionTree
 	Partition
 	PartitionSuffixesReply
 	SuffixHashesMsg
@@ -106,12 +113,15 @@ func (m *ObjectMeta) GetUserMeta() map[string]string {
 }
 
 type NeedleIndex struct {
-	Offset     int64 `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
-	Size       int64 `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
-	DataOffset int64 `protobuf:"varint,3,opt,name=dataOffset" json:"dataOffset,omitempty"`
-	DataSize   int64 `protobuf:"varint,4,opt,name=dataSize" json:"dataSize,omitempty"`
-	MetaOffset int64 `protobuf:"varint,5,opt,name=metaOffset" json:"metaOffset,omitempty"`
-	MetaSize   int32 `protobuf:"varint,6,opt,name=metaSize" json:"metaSize,omitempty"`
+	Offset     int64  `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
+	Size       int64  `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
+	DataOffset int64  `protobuf:"varint,3,opt,name=dataOffset" json:"dataOffset,omitempty"`
+	DataSize   int64  `protobuf:"varint,4,opt,name=dataSize" json:"dataSize,omitempty"`
+	MetaOffset int64  `protobuf:"varint,5,opt,name=metaOffset" json:"metaOffset,omitempty"`
+	MetaSize   int32  `protobuf:"varint,6,opt,name=metaSize" json:"metaSize,omitempty"`
+	Flags      uint32 `protobuf:"varint,7,opt,name=flags" json:"flags,omitempty"`
+	Segment    int32  `protobuf:"varint,8,opt,name=segment" json:"segment,omitempty"`
+	Digest     string `protobuf:"bytes,9,opt,name=digest" json:"digest,omitempty"`
 }
 
 func (m *NeedleIndex) Reset()                    { *m = NeedleIndex{} }
@@ -161,6 +171,27 @@ func (m *NeedleIndex) GetMetaSize() int32 {
 	return 0
 }
 
+func (m *NeedleIndex) GetFlags() uint32 {
+	if m != nil {
+		return m.Flags
+	}
+	return 0
+}
+
+func (m *NeedleIndex) GetSegment() int32 {
+	if m != nil {
+		return m.Segment
+	}
+	return 0
+}
+
+func (m *NeedleIndex) GetDigest() string {
+	if m != nil {
+		return m.Digest
+	}
+	return ""
+}
+
 type DBIndex struct {
 	Index *NeedleIndex `protobuf:"bytes,1,opt,name=index" json:"index,omitempty"`
 	Meta  *ObjectMeta  `protobuf:"bytes,2,opt,name=meta" json:"meta,omitempty"`
@@ -265,6 +296,182 @@ func (m *WantedObjects) GetObjects() map[string]*WantedParts {
 	return nil
 }
 
+type SuffixSummary struct {
+	Objects         int64  `protobuf:"varint,1,opt,name=objects" json:"objects,omitempty"`
+	Indexes         int64  `protobuf:"varint,2,opt,name=indexes" json:"indexes,omitempty"`
+	Hash            []byte `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	OldestTombstone string `protobuf:"bytes,4,opt,name=oldestTombstone" json:"oldestTombstone,omitempty"`
+}
+
+func (m *SuffixSummary) Reset()                    { *m = SuffixSummary{} }
+func (m *SuffixSummary) String() string            { return proto.CompactTextString(m) }
+func (*SuffixSummary) ProtoMessage()               {}
+func (*SuffixSummary) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *SuffixSummary) GetObjects() int64 {
+	if m != nil {
+		return m.Objects
+	}
+	return 0
+}
+
+func (m *SuffixSummary) GetIndexes() int64 {
+	if m != nil {
+		return m.Indexes
+	}
+	return 0
+}
+
+func (m *SuffixSummary) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *SuffixSummary) GetOldestTombstone() string {
+	if m != nil {
+		return m.OldestTombstone
+	}
+	return ""
+}
+
+type DedupRecord struct {
+	Index     *NeedleIndex `protobuf:"bytes,1,opt,name=index" json:"index,omitempty"`
+	Refs      int64        `protobuf:"varint,2,opt,name=refs" json:"refs,omitempty"`
+	Corrupted bool         `protobuf:"varint,3,opt,name=corrupted" json:"corrupted,omitempty"`
+}
+
+func (m *DedupRecord) Reset()                    { *m = DedupRecord{} }
+func (m *DedupRecord) String() string            { return proto.CompactTextString(m) }
+func (*DedupRecord) ProtoMessage()               {}
+func (*DedupRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *DedupRecord) GetIndex() *NeedleIndex {
+	if m != nil {
+		return m.Index
+	}
+	return nil
+}
+
+func (m *DedupRecord) GetRefs() int64 {
+	if m != nil {
+		return m.Refs
+	}
+	return 0
+}
+
+func (m *DedupRecord) GetCorrupted() bool {
+	if m != nil {
+		return m.Corrupted
+	}
+	return false
+}
+
+type PartitionUsage struct {
+	LiveBytes  int64 `protobuf:"varint,1,opt,name=liveBytes" json:"liveBytes,omitempty"`
+	Needles    int64 `protobuf:"varint,2,opt,name=needles" json:"needles,omitempty"`
+	Tombstones int64 `protobuf:"varint,3,opt,name=tombstones" json:"tombstones,omitempty"`
+}
+
+func (m *PartitionUsage) Reset()                    { *m = PartitionUsage{} }
+func (m *PartitionUsage) String() string            { return proto.CompactTextString(m) }
+func (*PartitionUsage) ProtoMessage()               {}
+func (*PartitionUsage) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *PartitionUsage) GetLiveBytes() int64 {
+	if m != nil {
+		return m.LiveBytes
+	}
+	return 0
+}
+
+func (m *PartitionUsage) GetNeedles() int64 {
+	if m != nil {
+		return m.Needles
+	}
+	return 0
+}
+
+func (m *PartitionUsage) GetTombstones() int64 {
+	if m != nil {
+		return m.Tombstones
+	}
+	return 0
+}
+
+type SyncFrame struct {
+	Method string      `protobuf:"bytes,1,opt,name=method" json:"method,omitempty"`
+	Meta   *ObjectMeta `protobuf:"bytes,2,opt,name=meta" json:"meta,omitempty"`
+}
+
+func (m *SyncFrame) Reset()                    { *m = SyncFrame{} }
+func (m *SyncFrame) String() string            { return proto.CompactTextString(m) }
+func (*SyncFrame) ProtoMessage()               {}
+func (*SyncFrame) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *SyncFrame) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *SyncFrame) GetMeta() *ObjectMeta {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+type SyncResults struct {
+	Statuses []int32 `protobuf:"varint,1,rep,packed,name=statuses" json:"statuses,omitempty"`
+}
+
+func (m *SyncResults) Reset()                    { *m = SyncResults{} }
+func (m *SyncResults) String() string            { return proto.CompactTextString(m) }
+func (*SyncResults) ProtoMessage()               {}
+func (*SyncResults) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *SyncResults) GetStatuses() []int32 {
+	if m != nil {
+		return m.Statuses
+	}
+	return nil
+}
+
+type SuffixTree struct {
+	Buckets map[string]string `protobuf:"bytes,1,rep,name=buckets" json:"buckets,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *SuffixTree) Reset()                    { *m = SuffixTree{} }
+func (m *SuffixTree) String() string            { return proto.CompactTextString(m) }
+func (*SuffixTree) ProtoMessage()               {}
+func (*SuffixTree) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *SuffixTree) GetBuckets() map[string]string {
+	if m != nil {
+		return m.Buckets
+	}
+	return nil
+}
+
+type PartitionTree struct {
+	Suffixes map[string]*SuffixTree `protobuf:"bytes,1,rep,name=suffixes" json:"suffixes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *PartitionTree) Reset()                    { *m = PartitionTree{} }
+func (m *PartitionTree) String() string            { return proto.CompactTextString(m) }
+func (*PartitionTree) ProtoMessage()               {}
+func (*PartitionTree) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *PartitionTree) GetSuffixes() map[string]*SuffixTree {
+	if m != nil {
+		return m.Suffixes
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*ObjectMeta)(nil), "pack.ObjectMeta")
 	proto.RegisterType((*NeedleIndex)(nil), "pack.NeedleIndex")
@@ -273,41 +480,66 @@ func init() {
 	proto.RegisterType((*CheckedObjects)(nil), "pack.CheckedObjects")
 	proto.RegisterType((*WantedParts)(nil), "pack.WantedParts")
 	proto.RegisterType((*WantedObjects)(nil), "pack.WantedObjects")
+	proto.RegisterType((*SuffixSummary)(nil), "pack.SuffixSummary")
+	proto.RegisterType((*DedupRecord)(nil), "pack.DedupRecord")
+	proto.RegisterType((*PartitionUsage)(nil), "pack.PartitionUsage")
+	proto.RegisterType((*SyncFrame)(nil), "pack.SyncFrame")
+	proto.RegisterType((*SyncResults)(nil), "pack.SyncResults")
+	proto.RegisterType((*SuffixTree)(nil), "pack.SuffixTree")
+	proto.RegisterType((*PartitionTree)(nil), "pack.PartitionTree")
 }
 
 func init() { proto.RegisterFile("object.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 488 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x54, 0xcd, 0x6e, 0xd3, 0x40,
-	0x10, 0xd6, 0xc6, 0x76, 0x9a, 0x8e, 0x1b, 0x48, 0x57, 0xa8, 0xb2, 0x22, 0x14, 0x19, 0xab, 0x52,
-	0x73, 0x40, 0x39, 0x04, 0x21, 0xa1, 0x54, 0x48, 0x88, 0x9f, 0x03, 0x87, 0x52, 0xb4, 0x2d, 0x82,
-	0x13, 0xd2, 0x36, 0x9e, 0x8a, 0x90, 0x3a, 0x89, 0xb2, 0x1b, 0x44, 0x78, 0x14, 0x6e, 0x3c, 0x02,
-	0xef, 0xc2, 0x03, 0xa1, 0x9d, 0xdd, 0xd8, 0x6b, 0x03, 0x42, 0xbd, 0xcd, 0x7c, 0x3b, 0xdf, 0xec,
-	0x7c, 0xdf, 0x8e, 0x0d, 0x07, 0xcb, 0xab, 0xcf, 0x38, 0xd5, 0xa3, 0xd5, 0x7a, 0xa9, 0x97, 0x3c,
-	0x5c, 0xc9, 0xe9, 0x3c, 0xfb, 0xd5, 0x02, 0x38, 0x27, 0xf8, 0x0c, 0xb5, 0xe4, 0x1c, 0xc2, 0x85,
-	0x2c, 0x30, 0x61, 0x29, 0x1b, 0xee, 0x0b, 0x8a, 0xf9, 0x7d, 0xd8, 0xd7, 0xb3, 0x02, 0x95, 0x96,
-	0xc5, 0x2a, 0x69, 0xd1, 0x41, 0x05, 0xf0, 0x3e, 0x74, 0x72, 0xa9, 0xe5, 0xc5, 0xec, 0x1b, 0x26,
-	0x41, 0xca, 0x86, 0x81, 0x28, 0x73, 0xfe, 0x0c, 0x40, 0x6d, 0x95, 0xc6, 0xc2, 0xf4, 0x4e, 0xc2,
-	0x34, 0x18, 0xc6, 0xe3, 0x74, 0x64, 0xee, 0x1d, 0x55, 0x77, 0x8e, 0x2e, 0xca, 0x92, 0x57, 0x0b,
-	0xbd, 0xde, 0x0a, 0x8f, 0xc3, 0x27, 0xd0, 0xd9, 0x28, 0x5c, 0x13, 0x3f, 0x22, 0xfe, 0xe0, 0x0f,
-	0xfe, 0x3b, 0x57, 0x60, 0xd9, 0x65, 0x7d, 0xff, 0x29, 0xdc, 0x6d, 0xb4, 0xe6, 0x3d, 0x08, 0xe6,
-	0xb8, 0x75, 0xea, 0x4c, 0xc8, 0xef, 0x41, 0xf4, 0x45, 0xde, 0x6c, 0xd0, 0x09, 0xb3, 0xc9, 0xa4,
-	0xf5, 0x84, 0xf5, 0x4f, 0xa1, 0x5b, 0xeb, 0x7c, 0x1b, 0x72, 0xf6, 0x93, 0x41, 0xfc, 0x06, 0x31,
-	0xbf, 0xc1, 0xd7, 0x8b, 0x1c, 0xbf, 0xf2, 0x23, 0x68, 0x2f, 0xaf, 0xaf, 0x15, 0x6a, 0xa2, 0x07,
-	0xc2, 0x65, 0xc6, 0x6f, 0x65, 0x9c, 0x6b, 0x11, 0x4a, 0x31, 0x1f, 0x00, 0x18, 0x07, 0xcf, 0x6d,
-	0xbd, 0xf5, 0xd4, 0x43, 0x6a, 0x8e, 0x87, 0x0d, 0xc7, 0x07, 0x00, 0x05, 0x96, 0xdc, 0xc8, 0x72,
-	0x2b, 0xc4, 0x70, 0x4d, 0x46, 0xdc, 0x76, 0xca, 0x86, 0x91, 0x28, 0xf3, 0xec, 0x03, 0xec, 0xbd,
-	0x7c, 0x6e, 0xc7, 0x3d, 0x81, 0x68, 0x66, 0x02, 0x9a, 0x36, 0x1e, 0x1f, 0x5a, 0xcf, 0x3d, 0x41,
-	0xc2, 0x9e, 0xf3, 0x63, 0x08, 0x0d, 0x9f, 0xe6, 0x8f, 0xc7, 0xbd, 0xe6, 0xdb, 0x08, 0x3a, 0xcd,
-	0x3e, 0x42, 0xcf, 0x62, 0x97, 0xbb, 0xb5, 0x51, 0xfc, 0x18, 0xba, 0x66, 0xea, 0x12, 0x71, 0xbe,
-	0xd6, 0x41, 0x53, 0x65, 0x3a, 0x5c, 0x36, 0xf6, 0xaf, 0x0e, 0x66, 0x3f, 0x18, 0xdc, 0x79, 0xf1,
-	0x09, 0xa7, 0x73, 0xcc, 0xed, 0x3d, 0x8a, 0x9f, 0xc2, 0x9e, 0xdd, 0x76, 0x95, 0x30, 0xda, 0x9b,
-	0x07, 0x76, 0xb6, 0x7a, 0x99, 0x1b, 0x55, 0xd9, 0xd5, 0xd9, 0x31, 0xfa, 0x02, 0x0e, 0xfc, 0x83,
-	0xbf, 0xbc, 0xfc, 0x43, 0xff, 0xe5, 0xe3, 0xf1, 0x91, 0x2f, 0xbc, 0x12, 0xe9, 0x6f, 0xc4, 0x63,
-	0x88, 0xdf, 0xcb, 0x85, 0xc6, 0xfc, 0xad, 0x5c, 0x6b, 0x65, 0x1e, 0xde, 0x28, 0xa5, 0x9e, 0x1d,
-	0x41, 0xb1, 0xc1, 0x4a, 0x33, 0x3b, 0xce, 0xba, 0xef, 0x0c, 0xba, 0x96, 0xb7, 0x53, 0x36, 0x69,
-	0x2a, 0x73, 0x5f, 0x54, 0xad, 0xea, 0x1f, 0xc2, 0xce, 0xfe, 0x2b, 0xec, 0xa4, 0x2e, 0xec, 0xd0,
-	0xef, 0x4d, 0x93, 0x7b, 0x9a, 0xae, 0xda, 0xf4, 0x27, 0x79, 0xf4, 0x3b, 0x00, 0x00, 0xff, 0xff,
-	0x34, 0x01, 0xbd, 0x51, 0x59, 0x04, 0x00, 0x00,
+	// 784 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x55, 0x5d, 0x6b, 0x13, 0x4d,
+	0x14, 0x66, 0x9b, 0xef, 0xb3, 0x49, 0x9b, 0x0e, 0x2f, 0x65, 0x09, 0xaf, 0x25, 0x2e, 0xc5, 0x46,
+	0x90, 0x5c, 0x44, 0x44, 0x49, 0x29, 0x48, 0xad, 0x42, 0x2f, 0x6a, 0x65, 0xd2, 0xa2, 0x57, 0xc2,
+	0x26, 0x7b, 0x92, 0xac, 0xc9, 0xee, 0x86, 0x9d, 0xd9, 0xd2, 0xf4, 0xce, 0xbf, 0x21, 0x78, 0xe1,
+	0x7f, 0xf2, 0xcf, 0x78, 0x27, 0xf3, 0xb1, 0x5f, 0xb1, 0x62, 0x7b, 0x37, 0xe7, 0xe3, 0x99, 0x3d,
+	0xcf, 0x39, 0xcf, 0x99, 0x85, 0x66, 0x38, 0xfe, 0x82, 0x13, 0xde, 0x5f, 0x45, 0x21, 0x0f, 0x49,
+	0x79, 0xe5, 0x4c, 0x16, 0xf6, 0xcf, 0x2d, 0x80, 0x0b, 0xe9, 0x3e, 0x47, 0xee, 0x10, 0x02, 0xe5,
+	0xc0, 0xf1, 0xd1, 0x32, 0xba, 0x46, 0xaf, 0x41, 0xe5, 0x99, 0xfc, 0x0f, 0x0d, 0xee, 0xf9, 0xc8,
+	0xb8, 0xe3, 0xaf, 0xac, 0x2d, 0x19, 0xc8, 0x1c, 0xa4, 0x03, 0x75, 0xd7, 0xe1, 0xce, 0xc8, 0xbb,
+	0x45, 0xab, 0xd4, 0x35, 0x7a, 0x25, 0x9a, 0xda, 0xe4, 0x35, 0x00, 0x5b, 0x33, 0x8e, 0xbe, 0xb8,
+	0xdb, 0x2a, 0x77, 0x4b, 0x3d, 0x73, 0xd0, 0xed, 0x8b, 0xef, 0xf6, 0xb3, 0x6f, 0xf6, 0x47, 0x69,
+	0xca, 0xdb, 0x80, 0x47, 0x6b, 0x9a, 0xc3, 0x90, 0x21, 0xd4, 0x63, 0x86, 0x91, 0xc4, 0x57, 0x24,
+	0x7e, 0xff, 0x0f, 0xfc, 0x95, 0x4e, 0x50, 0xe8, 0x34, 0xbf, 0x73, 0x0c, 0x3b, 0x1b, 0x57, 0x93,
+	0x36, 0x94, 0x16, 0xb8, 0xd6, 0xec, 0xc4, 0x91, 0xfc, 0x07, 0x95, 0x6b, 0x67, 0x19, 0xa3, 0x26,
+	0xa6, 0x8c, 0xe1, 0xd6, 0x2b, 0xa3, 0x73, 0x04, 0xad, 0xc2, 0xcd, 0x0f, 0x01, 0xdb, 0xbf, 0x0c,
+	0x30, 0xdf, 0x23, 0xba, 0x4b, 0x3c, 0x0b, 0x5c, 0xbc, 0x21, 0x7b, 0x50, 0x0d, 0xa7, 0x53, 0x86,
+	0x5c, 0xc2, 0x4b, 0x54, 0x5b, 0xa2, 0xdf, 0xcc, 0xbb, 0x55, 0x17, 0x94, 0xa8, 0x3c, 0x93, 0x7d,
+	0x00, 0xd1, 0xc1, 0x0b, 0x95, 0xaf, 0x7a, 0x9a, 0xf3, 0x14, 0x3a, 0x5e, 0xde, 0xe8, 0xf8, 0x3e,
+	0x80, 0x8f, 0x29, 0xb6, 0xa2, 0xb0, 0x3e, 0xe6, 0xb1, 0x3e, 0xaa, 0x5c, 0xab, 0xda, 0x35, 0x7a,
+	0x15, 0x9a, 0xda, 0x82, 0xcd, 0x74, 0xe9, 0xcc, 0x98, 0x55, 0xeb, 0x1a, 0xbd, 0x16, 0x55, 0x06,
+	0xb1, 0xa0, 0xc6, 0x70, 0xe6, 0x63, 0xc0, 0xad, 0xba, 0x04, 0x24, 0xa6, 0xe0, 0xe4, 0x7a, 0x33,
+	0x64, 0xdc, 0x6a, 0x48, 0xfa, 0xda, 0xb2, 0x3f, 0x41, 0xed, 0xf4, 0x44, 0xd1, 0x3e, 0x84, 0x8a,
+	0x27, 0x0e, 0x92, 0xb5, 0x39, 0xd8, 0x55, 0xb3, 0xcb, 0x35, 0x86, 0xaa, 0x38, 0x39, 0x80, 0xb2,
+	0xa8, 0x43, 0xf6, 0xc1, 0x1c, 0xb4, 0x37, 0x67, 0x4c, 0x65, 0xd4, 0xfe, 0x0c, 0x6d, 0xe5, 0xbb,
+	0x4c, 0xe4, 0xc7, 0xc8, 0x01, 0xb4, 0x04, 0xfb, 0xd4, 0xa3, 0xe7, 0x53, 0x74, 0x8a, 0x2c, 0x1f,
+	0x73, 0x0e, 0x3d, 0xb1, 0xa2, 0xd3, 0xfe, 0x61, 0xc0, 0xf6, 0x9b, 0x39, 0x4e, 0x16, 0xe8, 0xaa,
+	0xef, 0x30, 0x72, 0x04, 0x35, 0xb5, 0x35, 0xcc, 0x32, 0xa4, 0xfe, 0x1e, 0xab, 0xda, 0x8a, 0x69,
+	0xba, 0x54, 0xa6, 0x24, 0x98, 0x20, 0x3a, 0x14, 0x9a, 0xf9, 0xc0, 0x1d, 0x0a, 0x7a, 0x96, 0x57,
+	0x90, 0x39, 0xd8, 0xcb, 0x13, 0xcf, 0x48, 0xe6, 0x95, 0xf5, 0x02, 0xcc, 0x8f, 0x4e, 0xc0, 0xd1,
+	0xfd, 0xe0, 0x44, 0x9c, 0x09, 0x01, 0x09, 0xa6, 0xf2, 0xce, 0x3a, 0x95, 0x67, 0xe1, 0x4b, 0x9b,
+	0x59, 0xd7, 0xad, 0xfb, 0x66, 0x40, 0x4b, 0xe1, 0x12, 0x66, 0xc3, 0x4d, 0x66, 0x7a, 0x33, 0x0b,
+	0x59, 0x7f, 0x21, 0x76, 0xfe, 0x4f, 0x62, 0x87, 0x45, 0x62, 0xbb, 0xf9, 0xbb, 0x65, 0xe5, 0x79,
+	0x4e, 0x5f, 0x0d, 0x68, 0x8d, 0xe2, 0xe9, 0xd4, 0xbb, 0x19, 0xc5, 0xbe, 0xef, 0x44, 0x6b, 0xa1,
+	0xba, 0xac, 0x38, 0x21, 0xe2, 0xc4, 0x14, 0x11, 0x29, 0x19, 0x64, 0x7a, 0x69, 0x12, 0x53, 0xd0,
+	0x9e, 0x3b, 0x6c, 0x2e, 0x37, 0xa6, 0x49, 0xe5, 0x99, 0xf4, 0x60, 0x27, 0x5c, 0xba, 0xc8, 0xf8,
+	0x65, 0xe8, 0x8f, 0x19, 0x0f, 0x03, 0xb5, 0x32, 0x0d, 0xba, 0xe9, 0xb6, 0xe7, 0x60, 0x9e, 0xa2,
+	0x1b, 0xaf, 0x28, 0x4e, 0xc2, 0xc8, 0xbd, 0xbf, 0x72, 0x09, 0x94, 0x23, 0x9c, 0x26, 0xc5, 0xc8,
+	0xb3, 0x78, 0x31, 0x27, 0x61, 0x14, 0xc5, 0x2b, 0x8e, 0xae, 0x2c, 0xa7, 0x4e, 0x33, 0x87, 0x3d,
+	0x87, 0x6d, 0xd1, 0x01, 0x8f, 0x7b, 0x61, 0x70, 0xc5, 0x9c, 0x99, 0x7c, 0x61, 0x97, 0xde, 0x35,
+	0x9e, 0xac, 0x39, 0x26, 0x7c, 0x33, 0x87, 0x60, 0x1c, 0xc8, 0xef, 0xa6, 0x8c, 0xb5, 0x29, 0xb6,
+	0x9d, 0x27, 0x04, 0x58, 0xf2, 0x52, 0x64, 0x1e, 0xfb, 0x0c, 0x1a, 0xa3, 0x75, 0x30, 0x79, 0x17,
+	0x89, 0x67, 0x7c, 0x0f, 0xaa, 0x3e, 0xf2, 0x79, 0xe8, 0xea, 0x31, 0x69, 0xeb, 0x9e, 0xab, 0xf7,
+	0x14, 0x4c, 0x71, 0x15, 0x45, 0x16, 0x2f, 0x39, 0x13, 0xef, 0x08, 0xe3, 0x0e, 0x8f, 0x19, 0x2a,
+	0xf5, 0x54, 0x68, 0x6a, 0x8b, 0x69, 0x82, 0x9a, 0xe6, 0x65, 0x84, 0x48, 0x5e, 0x42, 0x6d, 0x1c,
+	0x4f, 0x16, 0x98, 0xea, 0xec, 0x91, 0xfa, 0x44, 0x96, 0xd2, 0x3f, 0x51, 0x71, 0x2d, 0x32, 0x9d,
+	0xdd, 0x19, 0x42, 0x33, 0x1f, 0x78, 0xd0, 0xfb, 0xfb, 0xdd, 0x80, 0x56, 0xda, 0x64, 0x59, 0xc6,
+	0x31, 0xd4, 0x99, 0xfc, 0x22, 0x6e, 0x6c, 0x72, 0x21, 0x4d, 0x57, 0x85, 0xba, 0x96, 0x14, 0xd2,
+	0x39, 0x87, 0x56, 0x21, 0x74, 0x47, 0x35, 0x4f, 0x8a, 0x92, 0x6f, 0x6f, 0xd2, 0xcc, 0xd5, 0x37,
+	0xae, 0xca, 0x7f, 0xf0, 0xf3, 0xdf, 0x03, 0x00, 0x2d, 0xa5, 0xb9, 0xfe, 0x93, 0x07, 0x00, 0x00,
 }
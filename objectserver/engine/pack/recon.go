@@ -0,0 +1,119 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common/middleware"
+)
+
+// Entries of the object recon cache are saved in the same format as Swift
+// object replicator and auditor, so that swift-recon works with pack
+// policies.
+
+func unixTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func (s *ReplicationStat) reconStats(start time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"start":       unixTime(start),
+		"attempted":   s.attempted,
+		"success":     s.success,
+		"failure":     s.failure,
+		"hashmatch":   s.hashmatch,
+		"handoff":     s.handoff,
+		"remove":      s.removed,
+		"suffix_hash": s.rehashed,
+		"replicated":  s.replicated,
+	}
+}
+
+// dumpRecon saves the stats of the replication pass started at start
+func (r *Replicator) dumpRecon(start time.Time) {
+	now := time.Now()
+	// Replication time is in minutes
+	elapsed := now.Sub(start).Minutes()
+	err := middleware.DumpReconCache(middleware.ReconCachePath, "object",
+		map[string]interface{}{
+			"object_replication_time": elapsed,
+			"object_replication_last": unixTime(now),
+			"replication_time":        elapsed,
+			"replication_last":        unixTime(now),
+			"replication_stats":       r.stat.reconStats(start),
+		})
+	if err != nil {
+		r.logger.Error("unable to dump replication stats", zap.Error(err))
+	}
+}
+
+// auditRecon collects the stats of the devices audited in a pass. A device
+// of several policies is reported once with the stats summed.
+type auditRecon struct {
+	sync.Mutex
+	devices map[string]map[string]interface{}
+}
+
+func newAuditRecon() *auditRecon {
+	return &auditRecon{devices: make(map[string]map[string]interface{})}
+}
+
+func (a *auditRecon) add(device string, start time.Time, stat *AuditStat) {
+	a.Lock()
+	defer a.Unlock()
+
+	s, ok := a.devices[device]
+	if !ok {
+		s = map[string]interface{}{
+			"start_time":      unixTime(start),
+			"audit_time":      float64(0),
+			"bytes_processed": int64(0),
+			"passes":          int64(0),
+			"quarantined":     int64(0),
+			"errors":          int64(0),
+		}
+		a.devices[device] = s
+	}
+
+	s["audit_time"] = s["audit_time"].(float64) + time.Since(start).Seconds()
+	s["bytes_processed"] = s["bytes_processed"].(int64) + stat.ProcessedBytes
+	// Quarantined objects are counted in processed files
+	s["passes"] = s["passes"].(int64) + stat.ProcessedFiles - stat.Quarantines
+	s["quarantined"] = s["quarantined"].(int64) + stat.Quarantines
+	s["errors"] = s["errors"].(int64) + stat.Errors
+	if st := unixTime(start); st < s["start_time"].(float64) {
+		s["start_time"] = st
+	}
+}
+
+func (a *Auditor) dumpRecon(recon *auditRecon) {
+	if len(recon.devices) == 0 {
+		return
+	}
+
+	stats := make(map[string]interface{})
+	for d, s := range recon.devices {
+		stats[d] = s
+	}
+	err := middleware.DumpReconCache(middleware.ReconCachePath, "object",
+		map[string]interface{}{"object_auditor_stats_ALL": stats})
+	if err != nil {
+		a.logger.Error("unable to dump audit stats", zap.Error(err))
+	}
+}
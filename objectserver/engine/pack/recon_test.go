@@ -0,0 +1,48 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditRecon(t *testing.T) {
+	recon := newAuditRecon()
+	start := time.Now().Add(-time.Minute)
+	recon.add(PACK_DEVICE, start, &AuditStat{
+		ProcessedBytes: SIZE_1M,
+		ProcessedFiles: 10,
+		Quarantines:    2,
+		Errors:         1,
+	})
+	// The same device of another policy
+	recon.add(PACK_DEVICE, start.Add(time.Second), &AuditStat{
+		ProcessedBytes: SIZE_1K,
+		ProcessedFiles: 5,
+	})
+	recon.add("sdb", start, &AuditStat{})
+
+	require.Len(t, recon.devices, 2)
+	s := recon.devices[PACK_DEVICE]
+	require.Equal(t, unixTime(start), s["start_time"])
+	require.True(t, s["audit_time"].(float64) >= 119)
+	require.Equal(t, int64(SIZE_1M+SIZE_1K), s["bytes_processed"])
+	require.Equal(t, int64(13), s["passes"])
+	require.Equal(t, int64(2), s["quarantined"])
+	require.Equal(t, int64(1), s["errors"])
+}
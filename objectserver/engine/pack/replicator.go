@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -36,16 +37,24 @@ import (
 	"github.com/iqiyi/auklet/common/pickle"
 	"github.com/iqiyi/auklet/common/ring"
 	"github.com/iqiyi/auklet/common/srv"
+	"github.com/iqiyi/auklet/objectserver/engine"
 )
 
+// Devices are replicated concurrently, so the counters must be updated
+// atomically.
 type ReplicationStat struct {
 	rehashed   int64
 	replicated int64
+	attempted  int64 // partitions
+	success    int64 // syncs to remotes
+	failure    int64
+	hashmatch  int64 // remotes which have the same suffix hashes
+	handoff    int64 // handoff partitions
+	removed    int64 // handoff partitions removed
 }
 
 func (s *ReplicationStat) reset() {
-	s.rehashed = 0
-	s.replicated = 0
+	*s = ReplicationStat{}
 }
 
 type Replicator struct {
@@ -57,6 +66,7 @@ type Replicator struct {
 	interval    int
 	rpcPort     int
 	srvPort     int
+	reclaimAge  int64
 
 	rings      map[int]ring.Ring
 	hashPrefix string
@@ -65,6 +75,9 @@ type Replicator struct {
 	devices   map[int][]*ring.Device
 	whitelist map[string]bool
 
+	policyFilter string
+	deviceFilter string
+
 	rpc  PackRpcServiceClient
 	http *http.Client
 }
@@ -97,9 +110,14 @@ func (r *Replicator) parseConf(cnf conf.Config) {
 	r.rpcPort = int(cnf.GetInt("object-replicator", "rpc_port", 60000))
 	r.concurrency = int(cnf.GetInt("object-replicator", "concurrency", 1))
 	r.interval = int(cnf.GetInt("object-replicator", "interval", 60*60*24))
+	r.reclaimAge = cnf.GetInt("object-replicator", "reclaim_age", ONE_WEEK)
 }
 
-func (r *Replicator) collectDevices(policyFilter, deviceFilter string) {
+// collectDevices reloads the rings whose files have changed, and lists the
+// local devices of each pack policy, so that ring pushes and new devices
+// are picked up at the beginning of each pass.
+func (r *Replicator) collectDevices() {
+	policyFilter, deviceFilter := r.policyFilter, r.deviceFilter
 	pf := map[int]bool{}
 	for _, p := range strings.Split(policyFilter, ",") {
 		if p == "" {
@@ -123,15 +141,14 @@ func (r *Replicator) collectDevices(policyFilter, deviceFilter string) {
 		}
 	}
 
-	r.rings = map[int]ring.Ring{}
+	rings := map[int]ring.Ring{}
+	devices := map[int][]*ring.Device{}
 	for _, p := range conf.LoadPolicies() {
 		if p.Type != NAME || (len(pf) > 0 && !pf[p.Index]) {
 			continue
 		}
 
-		var err error
-		r.rings[p.Index], err = ring.GetRing(
-			"object", r.hashPrefix, r.hashSuffix, p.Index)
+		rg, err := ring.GetRing("object", r.hashPrefix, r.hashSuffix, p.Index)
 		if err != nil {
 			r.logger.Error("unable to get ring",
 				zap.Int("policy", p.Index),
@@ -140,8 +157,21 @@ func (r *Replicator) collectDevices(policyFilter, deviceFilter string) {
 			continue
 		}
 
-		r.devices = map[int][]*ring.Device{}
-		devs, err := r.rings[p.Index].LocalDevices(r.srvPort)
+		if rl, ok := rg.(ring.Reloadable); ok {
+			reloaded, err := rl.Reload()
+			if err != nil {
+				r.logger.Error("unable to reload ring, use the loaded one",
+					zap.Int("policy", p.Index), zap.Error(err))
+			}
+			r.logger.Info("replicating with ring",
+				zap.Int("policy", p.Index),
+				zap.Int("version", rl.Version()),
+				zap.Time("mtime", rl.ModTime()),
+				zap.Bool("reloaded", reloaded))
+		}
+		rings[p.Index] = rg
+
+		devs, err := rg.LocalDevices(r.srvPort)
 		if err != nil {
 			r.logger.Error("unable to list local device",
 				zap.Int("policy", p.Index),
@@ -152,15 +182,18 @@ func (r *Replicator) collectDevices(policyFilter, deviceFilter string) {
 
 		for _, d := range devs {
 			if len(df) == 0 || df[d.Device] {
-				r.devices[p.Index] = append(r.devices[p.Index], d)
+				devices[p.Index] = append(devices[p.Index], d)
 			}
 		}
 
-		devices := r.devices[p.Index]
-		rand.Shuffle(len(devices), func(i, j int) {
-			devices[i], devices[j] = devices[j], devices[i]
+		devs = devices[p.Index]
+		rand.Shuffle(len(devs), func(i, j int) {
+			devs[i], devs[j] = devs[j], devs[i]
 		})
 	}
+
+	r.rings = rings
+	r.devices = devices
 }
 
 func (r *Replicator) listPartitions(policy int, device string) []string {
@@ -187,19 +220,23 @@ func (r *Replicator) listPartitions(policy int, device string) []string {
 	return partitions
 }
 
-func (r *Replicator) getLocalHash(
-	policy int, device, partition string, rehash []string) (int64, map[string]string) {
+// getLocalHash returns the local suffix hashes of the algorithm requested
+// and the algorithm actually used, which is the legacy one if the local
+// object server is of an older version.
+func (r *Replicator) getLocalHash(policy int, device, partition string,
+	rehash []string, algorithm string) (int64, map[string]string, string) {
 	// TODO: shall we need to add a timeout?
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	msg := &SuffixHashesMsg{
-		Device:      device,
-		Policy:      uint32(policy),
-		Partition:   partition,
-		ReclaimAge:  ONE_WEEK,
-		ListDir:     rand.Intn(10) == 0,
-		Recalculate: rehash,
+		Device:        device,
+		Policy:        uint32(policy),
+		Partition:     partition,
+		ReclaimAge:    uint64(r.reclaimAge),
+		ListDir:       rand.Intn(10) == 0,
+		Recalculate:   rehash,
+		HashAlgorithm: algorithm,
 	}
 	reply, err := r.rpc.GetHashes(ctx, msg)
 	if err != nil {
@@ -208,14 +245,18 @@ func (r *Replicator) getLocalHash(
 			zap.String("device", device),
 			zap.String("partition", partition),
 			zap.Error(err))
-		return 0, nil
+		return 0, nil, algorithm
 	}
 
-	return reply.Hashed, reply.Hashes
+	return reply.Hashed, reply.Hashes, reply.HashAlgorithm
 }
 
+// getRemoteHash returns the remote suffix hashes and their algorithm.
+// Remotes of older versions ignore the algorithm requested and answer the
+// legacy hashes.
 func (r *Replicator) getRemoteHash(policy int, node *ring.Device,
-	partition string, suffixes []string) (map[string]string, error) {
+	partition string, suffixes []string, algorithm string) (
+	map[string]string, string, error) {
 	url := fmt.Sprintf("http://%s:%d/%s/%s",
 		node.Ip, node.Port, node.Device, partition)
 
@@ -228,24 +269,27 @@ func (r *Replicator) getRemoteHash(policy int, node *ring.Device,
 		r.logger.Error("unable to create diff request",
 			zap.String("url", url),
 			zap.Error(err))
-		return nil, err
+		return nil, "", err
 	}
 	req.Header.Set(common.XBackendPolicyIndex, strconv.Itoa(policy))
+	if algorithm != "" {
+		req.Header.Set(common.XBackendSuffixHash, algorithm)
+	}
 
 	resp, err := r.http.Do(req)
 	if err != nil {
 		r.logger.Error("unable to get remote hash",
 			zap.String("url", url), zap.Error(err))
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusInsufficientStorage {
-		return nil, ErrRemoteDiskUnmounted
+		return nil, "", ErrRemoteDiskUnmounted
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, ErrRemoteHash
+		return nil, "", ErrRemoteHash
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -253,19 +297,19 @@ func (r *Replicator) getRemoteHash(policy int, node *ring.Device,
 		r.logger.Error("unable to read  replicate response body",
 			zap.String("url", url), zap.Error(err))
 
-		return nil, err
+		return nil, "", err
 	}
 
 	v, err := pickle.PickleLoads(body)
 	if err != nil {
 		r.logger.Error("unable to deserialize pickle data",
 			zap.String("url", url), zap.Error(err))
-		return nil, err
+		return nil, "", err
 	}
 
 	pickledHashes, ok := v.(map[interface{}]interface{})
 	if !ok {
-		return nil, ErrMalformedData
+		return nil, "", ErrMalformedData
 	}
 
 	hashes := make(map[string]string)
@@ -275,47 +319,86 @@ func (r *Replicator) getRemoteHash(policy int, node *ring.Device,
 		}
 	}
 
-	return hashes, nil
+	return hashes, resp.Header.Get(common.XBackendSuffixHash), nil
+}
+
+func diffHashes(local, remote map[string]string) []string {
+	var suffixes []string
+	for s, h := range local {
+		if remote[s] != h {
+			suffixes = append(suffixes, s)
+		}
+	}
+
+	return suffixes
+}
+
+// diffSuffixes returns the suffixes of the partition diverged between the
+// local device and the remote node, and the algorithm of the hashes
+// compared. Summary hashes are compared if both object servers support
+// them, otherwise legacy hashes are compared and the local ones of the
+// suffixes diverged are recalculated. Local hashes are cached in local by
+// algorithm, which is shared by all the nodes of the partition.
+func (r *Replicator) diffSuffixes(policy int, device, node *ring.Device,
+	partition string, local map[string]map[string]string) ([]string, string, error) {
+	remoteHash, algorithm, err := r.getRemoteHash(
+		policy, node, partition, nil, engine.SummarySuffixHash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	localHash, ok := local[algorithm]
+	if !ok {
+		rehashed, hashes, used := r.getLocalHash(
+			policy, device.Device, partition, nil, algorithm)
+		atomic.AddInt64(&r.stat.rehashed, rehashed)
+		if used != algorithm {
+			// The local object server doesn't support summary hashes
+			remoteHash, algorithm, err = r.getRemoteHash(
+				policy, node, partition, nil, used)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		localHash = hashes
+		local[used] = hashes
+	}
+
+	suffixes := diffHashes(localHash, remoteHash)
+	if len(suffixes) == 0 || algorithm == engine.SummarySuffixHash {
+		return suffixes, algorithm, nil
+	}
+
+	// Legacy hashes saved in hashes.pkl may be stale
+	rehashed, localHash, _ := r.getLocalHash(
+		policy, device.Device, partition, suffixes, algorithm)
+	atomic.AddInt64(&r.stat.rehashed, rehashed)
+
+	return diffHashes(localHash, remoteHash), algorithm, nil
 }
 
 func (r *Replicator) replicateLocal(
 	policy int, device *ring.Device, partition string, nodes *NodeChain) {
-	rehashed, localHash := r.getLocalHash(policy, device.Device, partition, nil)
-	r.stat.rehashed += rehashed
-
+	local := make(map[string]map[string]string)
 	attempts := int(r.rings[policy].ReplicaCount()) - 1
 	for node := nodes.Next(); node != nil && attempts > 0; node = nodes.Next() {
 		attempts--
 
-		remoteHash, err := r.getRemoteHash(policy, node, partition, nil)
+		suffixes, algorithm, err := r.diffSuffixes(
+			policy, device, node, partition, local)
 		if err != nil {
 			if err == ErrRemoteDiskUnmounted {
 				attempts++
 			}
+			atomic.AddInt64(&r.stat.failure, 1)
 
 			continue
 		}
 
-		var suffixes []string
-		for s, h := range localHash {
-			if remoteHash[s] != h {
-				suffixes = append(suffixes, s)
-			}
-		}
-
 		if len(suffixes) == 0 {
+			atomic.AddInt64(&r.stat.hashmatch, 1)
 			continue
 		}
-		rehashed, localHash := r.getLocalHash(
-			policy, device.Device, partition, suffixes)
-		r.stat.rehashed += rehashed
-
-		suffixes = nil
-		for s, h := range localHash {
-			if remoteHash[s] != h {
-				suffixes = append(suffixes, s)
-			}
-		}
 
 		msg := &SyncMsg{
 			LocalDevice: device.Device,
@@ -333,56 +416,46 @@ func (r *Replicator) replicateLocal(
 		if err != nil {
 			r.logger.Error("unable to finish sync job",
 				zap.Any("args", msg), zap.Error(err))
+			atomic.AddInt64(&r.stat.failure, 1)
 			continue
 		}
 
-		r.getRemoteHash(policy, node, partition, suffixes)
+		// Summary hashes are always up to date
+		if algorithm != engine.SummarySuffixHash {
+			r.getRemoteHash(policy, node, partition, suffixes, algorithm)
+		}
 
 		if reply.Success {
-			r.stat.replicated += int64(len(reply.Candidates))
+			atomic.AddInt64(&r.stat.success, 1)
+			atomic.AddInt64(&r.stat.replicated, int64(len(reply.Candidates)))
+		} else {
+			atomic.AddInt64(&r.stat.failure, 1)
 		}
 	}
 }
 
 func (r *Replicator) replicateHandoff(
 	policy int, device *ring.Device, partition string, nodes *NodeChain) {
-	rehashed, localHash := r.getLocalHash(policy, device.Device, partition, nil)
-	r.stat.rehashed += rehashed
-
+	local := make(map[string]map[string]string)
 	success := true
 	for node := nodes.Next(); node != nil; node = nodes.Next() {
-		remoteHash, err := r.getRemoteHash(policy, node, partition, nil)
+		suffixes, algorithm, err := r.diffSuffixes(
+			policy, device, node, partition, local)
 		if err != nil {
 			r.logger.Error("unable to get remote hash",
 				zap.Int("policy", policy),
 				zap.Any("node", node),
 				zap.Error(err))
+			atomic.AddInt64(&r.stat.failure, 1)
 			success = false
 			continue
 		}
 
-		var suffixes []string
-		for s, h := range localHash {
-			if remoteHash[s] != h {
-				suffixes = append(suffixes, s)
-			}
-		}
-
 		if len(suffixes) == 0 {
+			atomic.AddInt64(&r.stat.hashmatch, 1)
 			continue
 		}
 
-		rehashed, localHash := r.getLocalHash(
-			policy, device.Device, partition, suffixes)
-		r.stat.rehashed += rehashed
-
-		suffixes = nil
-		for s, h := range localHash {
-			if remoteHash[s] != h {
-				suffixes = append(suffixes, s)
-			}
-		}
-
 		msg := &SyncMsg{
 			LocalDevice: device.Device,
 			Host:        node.Ip,
@@ -399,14 +472,19 @@ func (r *Replicator) replicateHandoff(
 		if err != nil {
 			r.logger.Error("unable to finish sync job",
 				zap.Any("args", msg), zap.Error(err))
+			atomic.AddInt64(&r.stat.failure, 1)
 			success = false
 			continue
 		}
 
 		if reply.Success {
-			r.getRemoteHash(policy, node, partition, suffixes)
-			r.stat.replicated += int64(len(reply.Candidates))
+			if algorithm != engine.SummarySuffixHash {
+				r.getRemoteHash(policy, node, partition, suffixes, algorithm)
+			}
+			atomic.AddInt64(&r.stat.success, 1)
+			atomic.AddInt64(&r.stat.replicated, int64(len(reply.Candidates)))
 		} else {
+			atomic.AddInt64(&r.stat.failure, 1)
 			success = false
 		}
 	}
@@ -435,6 +513,7 @@ func (r *Replicator) replicateHandoff(
 			return
 		}
 
+		atomic.AddInt64(&r.stat.removed, 1)
 		r.logger.Info("handoff partition removed",
 			zap.Int("policy", policy),
 			zap.String("device", device.Device),
@@ -452,6 +531,19 @@ func (r *Replicator) replicateDevice(
 	r.logger.Info("begin to replicate device",
 		zap.String("device", device.Device), zap.Int("policy", policy))
 
+	mode, err := ReadDeviceMode(r.driveRoot, device.Device, policy)
+	if err != nil {
+		r.logger.Error("unable to read device mode",
+			zap.String("device", device.Device),
+			zap.Int("policy", policy),
+			zap.Error(err))
+	}
+	drain := mode == DeviceModeDrain
+	if drain {
+		r.logger.Info("draining device",
+			zap.String("device", device.Device), zap.Int("policy", policy))
+	}
+
 	for _, p := range r.listPartitions(policy, device.Device) {
 		pi, err := strconv.ParseUint(p, 10, 64)
 		if err != nil {
@@ -468,8 +560,19 @@ func (r *Replicator) replicateDevice(
 			begin:    0,
 		}
 
+		atomic.AddInt64(&r.stat.attempted, 1)
+		if handoff || drain {
+			atomic.AddInt64(&r.stat.handoff, 1)
+		}
 		if handoff {
 			r.replicateHandoff(policy, device, p, chain)
+		} else if drain {
+			// Besides the other primaries, the partition is pushed to the
+			// first handoff which takes the place of the device
+			if next := r.rings[policy].GetMoreNodes(pi).Next(); next != nil {
+				chain.primary = append(chain.primary, next)
+			}
+			r.replicateHandoff(policy, device, p, chain)
 		} else {
 			chain.handoffs = r.rings[policy].GetMoreNodes(pi)
 			r.replicateLocal(policy, device, p, chain)
@@ -478,6 +581,8 @@ func (r *Replicator) replicateDevice(
 }
 
 func (r *Replicator) replicate() {
+	r.collectDevices()
+
 	pool := make(chan bool, r.concurrency)
 	wg := &sync.WaitGroup{}
 
@@ -494,20 +599,24 @@ func (r *Replicator) replicate() {
 
 func (r *Replicator) Run() {
 	r.logger.Info("running pack replicator for once")
+	start := time.Now()
 	r.replicate()
 	r.logger.Info("replicated one pass",
 		zap.Int64("rehashed", r.stat.rehashed),
 		zap.Int64("replicated", r.stat.replicated))
+	r.dumpRecon(start)
 }
 
 func (r *Replicator) RunForever() {
 	r.logger.Info("running pack replicator forever")
 	for {
 		r.logger.Info("begin new replication pass")
+		start := time.Now()
 		r.replicate()
 		r.logger.Info("replication pass done",
 			zap.Int64("rehashed", r.stat.rehashed),
 			zap.Int64("replicated", r.stat.replicated))
+		r.dumpRecon(start)
 
 		r.stat.reset()
 		time.Sleep(time.Second * time.Duration(r.interval))
@@ -535,9 +644,9 @@ func InitReplicator(cnf conf.Config, flags *flag.FlagSet) (srv.Daemon, error) {
 	r.hashPrefix = prefix
 	r.hashSuffix = suffix
 
-	policyFilter := flags.Lookup("policies").Value.(flag.Getter).Get().(string)
-	deviceFilter := flags.Lookup("devices").Value.(flag.Getter).Get().(string)
-	r.collectDevices(policyFilter, deviceFilter)
+	// Devices are collected at the beginning of each pass
+	r.policyFilter = flags.Lookup("policies").Value.(flag.Getter).Get().(string)
+	r.deviceFilter = flags.Lookup("devices").Value.(flag.Getter).Get().(string)
 
 	pf := flags.Lookup("partitions").Value.(flag.Getter).Get().(string)
 	r.whitelist = map[string]bool{}
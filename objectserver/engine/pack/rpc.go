@@ -45,6 +45,8 @@ type PackRpcServer struct {
 	lock sync.RWMutex
 
 	client *http.Client
+
+	throttle *replicationThrottle
 }
 
 func NewRpcServer(port int) *PackRpcServer {
@@ -52,6 +54,8 @@ func NewRpcServer(port int) *PackRpcServer {
 		port:   port,
 		bdms:   make(map[int]*PackDeviceMgr),
 		client: &http.Client{Timeout: 5 * time.Minute},
+		// Created along with the first engine, so gconf is loaded
+		throttle: newReplicationThrottle(gconf),
 	}
 
 	return s
@@ -122,11 +126,54 @@ func (s *PackRpcServer) AuditPartition(
 	}
 
 	reply := &PartitionAuditionReply{
-		ProcessedBytes: stat.ProcessedBytes,
-		ProcessedFiles: stat.ProcessedFiles,
-		Errors:         stat.Errors,
-		Quarantines:    stat.Quarantines,
+		ProcessedBytes:   stat.ProcessedBytes,
+		ProcessedFiles:   stat.ProcessedFiles,
+		Errors:           stat.Errors,
+		Quarantines:      stat.Quarantines,
+		Orphans:          stat.Orphans,
+		ReclaimedBytes:   stat.ReclaimedBytes,
+		ReapedTombstones: stat.ReapedTombstones,
+	}
+
+	return reply, nil
+}
+
+func (s *PackRpcServer) Snapshot(
+	ctx context.Context, msg *SnapshotMsg) (*SnapshotReply, error) {
+	device, err := s.getDevice(int(msg.Policy), msg.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := device.Snapshot(msg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &SnapshotReply{
+		Path:      stat.Path,
+		Segments:  stat.Segments,
+		Reflinked: stat.Reflinked,
+		Files:     stat.Files,
 	}
 
 	return reply, nil
 }
+
+// DeviceMode changes the mode of the device if a mode is given, and replies
+// its current mode.
+func (s *PackRpcServer) DeviceMode(
+	ctx context.Context, msg *DeviceModeMsg) (*DeviceModeReply, error) {
+	device, err := s.getDevice(int(msg.Policy), msg.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Mode != "" {
+		if err = device.SetMode(msg.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DeviceModeReply{Mode: device.Mode()}, nil
+}
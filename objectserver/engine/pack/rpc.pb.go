@@ -81,12 +81,13 @@ func (m *PartitionSuffixesReply) GetSuffixes() []string {
 }
 
 type SuffixHashesMsg struct {
-	Device      string   `protobuf:"bytes,1,opt,name=device" json:"device,omitempty"`
-	Policy      uint32   `protobuf:"varint,2,opt,name=policy" json:"policy,omitempty"`
-	Partition   string   `protobuf:"bytes,3,opt,name=partition" json:"partition,omitempty"`
-	Recalculate []string `protobuf:"bytes,4,rep,name=recalculate" json:"recalculate,omitempty"`
-	ListDir     bool     `protobuf:"varint,5,opt,name=listDir" json:"listDir,omitempty"`
-	ReclaimAge  uint64   `protobuf:"varint,6,opt,name=reclaimAge" json:"reclaimAge,omitempty"`
+	Device        string   `protobuf:"bytes,1,opt,name=device" json:"device,omitempty"`
+	Policy        uint32   `protobuf:"varint,2,opt,name=policy" json:"policy,omitempty"`
+	Partition     string   `protobuf:"bytes,3,opt,name=partition" json:"partition,omitempty"`
+	Recalculate   []string `protobuf:"bytes,4,rep,name=recalculate" json:"recalculate,omitempty"`
+	ListDir       bool     `protobuf:"varint,5,opt,name=listDir" json:"listDir,omitempty"`
+	ReclaimAge    uint64   `protobuf:"varint,6,opt,name=reclaimAge" json:"reclaimAge,omitempty"`
+	HashAlgorithm string   `protobuf:"bytes,7,opt,name=hashAlgorithm" json:"hashAlgorithm,omitempty"`
 }
 
 func (m *SuffixHashesMsg) Reset()                    { *m = SuffixHashesMsg{} }
@@ -136,9 +137,17 @@ func (m *SuffixHashesMsg) GetReclaimAge() uint64 {
 	return 0
 }
 
+func (m *SuffixHashesMsg) GetHashAlgorithm() string {
+	if m != nil {
+		return m.HashAlgorithm
+	}
+	return ""
+}
+
 type SuffixHashesReply struct {
-	Hashed int64             `protobuf:"varint,1,opt,name=hashed" json:"hashed,omitempty"`
-	Hashes map[string]string `protobuf:"bytes,2,rep,name=hashes" json:"hashes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Hashed        int64             `protobuf:"varint,1,opt,name=hashed" json:"hashed,omitempty"`
+	Hashes        map[string]string `protobuf:"bytes,2,rep,name=hashes" json:"hashes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	HashAlgorithm string            `protobuf:"bytes,3,opt,name=hashAlgorithm" json:"hashAlgorithm,omitempty"`
 }
 
 func (m *SuffixHashesReply) Reset()                    { *m = SuffixHashesReply{} }
@@ -160,6 +169,13 @@ func (m *SuffixHashesReply) GetHashes() map[string]string {
 	return nil
 }
 
+func (m *SuffixHashesReply) GetHashAlgorithm() string {
+	if m != nil {
+		return m.HashAlgorithm
+	}
+	return ""
+}
+
 type SyncMsg struct {
 	LocalDevice string   `protobuf:"bytes,1,opt,name=localDevice" json:"localDevice,omitempty"`
 	Host        string   `protobuf:"bytes,2,opt,name=host" json:"host,omitempty"`
@@ -265,10 +281,13 @@ func (m *PartitionDeletionReply) GetSuccess() bool {
 }
 
 type PartitionAuditionReply struct {
-	ProcessedBytes int64 `protobuf:"varint,1,opt,name=processedBytes" json:"processedBytes,omitempty"`
-	ProcessedFiles int64 `protobuf:"varint,2,opt,name=processedFiles" json:"processedFiles,omitempty"`
-	Quarantines    int64 `protobuf:"varint,3,opt,name=quarantines" json:"quarantines,omitempty"`
-	Errors         int64 `protobuf:"varint,4,opt,name=errors" json:"errors,omitempty"`
+	ProcessedBytes   int64 `protobuf:"varint,1,opt,name=processedBytes" json:"processedBytes,omitempty"`
+	ProcessedFiles   int64 `protobuf:"varint,2,opt,name=processedFiles" json:"processedFiles,omitempty"`
+	Quarantines      int64 `protobuf:"varint,3,opt,name=quarantines" json:"quarantines,omitempty"`
+	Errors           int64 `protobuf:"varint,4,opt,name=errors" json:"errors,omitempty"`
+	Orphans          int64 `protobuf:"varint,5,opt,name=orphans" json:"orphans,omitempty"`
+	ReclaimedBytes   int64 `protobuf:"varint,6,opt,name=reclaimedBytes" json:"reclaimedBytes,omitempty"`
+	ReapedTombstones int64 `protobuf:"varint,7,opt,name=reapedTombstones" json:"reapedTombstones,omitempty"`
 }
 
 func (m *PartitionAuditionReply) Reset()                    { *m = PartitionAuditionReply{} }
@@ -304,6 +323,147 @@ func (m *PartitionAuditionReply) GetErrors() int64 {
 	return 0
 }
 
+func (m *PartitionAuditionReply) GetOrphans() int64 {
+	if m != nil {
+		return m.Orphans
+	}
+	return 0
+}
+
+func (m *PartitionAuditionReply) GetReclaimedBytes() int64 {
+	if m != nil {
+		return m.ReclaimedBytes
+	}
+	return 0
+}
+
+func (m *PartitionAuditionReply) GetReapedTombstones() int64 {
+	if m != nil {
+		return m.ReapedTombstones
+	}
+	return 0
+}
+
+type SnapshotMsg struct {
+	Device string `protobuf:"bytes,1,opt,name=device" json:"device,omitempty"`
+	Policy uint32 `protobuf:"varint,2,opt,name=policy" json:"policy,omitempty"`
+	Name   string `protobuf:"bytes,3,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *SnapshotMsg) Reset()                    { *m = SnapshotMsg{} }
+func (m *SnapshotMsg) String() string            { return proto.CompactTextString(m) }
+func (*SnapshotMsg) ProtoMessage()               {}
+func (*SnapshotMsg) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{8} }
+
+func (m *SnapshotMsg) GetDevice() string {
+	if m != nil {
+		return m.Device
+	}
+	return ""
+}
+
+func (m *SnapshotMsg) GetPolicy() uint32 {
+	if m != nil {
+		return m.Policy
+	}
+	return 0
+}
+
+func (m *SnapshotMsg) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+type SnapshotReply struct {
+	Path      string `protobuf:"bytes,1,opt,name=path" json:"path,omitempty"`
+	Segments  int64  `protobuf:"varint,2,opt,name=segments" json:"segments,omitempty"`
+	Reflinked int64  `protobuf:"varint,3,opt,name=reflinked" json:"reflinked,omitempty"`
+	Files     int64  `protobuf:"varint,4,opt,name=files" json:"files,omitempty"`
+}
+
+func (m *SnapshotReply) Reset()                    { *m = SnapshotReply{} }
+func (m *SnapshotReply) String() string            { return proto.CompactTextString(m) }
+func (*SnapshotReply) ProtoMessage()               {}
+func (*SnapshotReply) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{9} }
+
+func (m *SnapshotReply) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *SnapshotReply) GetSegments() int64 {
+	if m != nil {
+		return m.Segments
+	}
+	return 0
+}
+
+func (m *SnapshotReply) GetReflinked() int64 {
+	if m != nil {
+		return m.Reflinked
+	}
+	return 0
+}
+
+func (m *SnapshotReply) GetFiles() int64 {
+	if m != nil {
+		return m.Files
+	}
+	return 0
+}
+
+type DeviceModeMsg struct {
+	Device string `protobuf:"bytes,1,opt,name=device" json:"device,omitempty"`
+	Policy uint32 `protobuf:"varint,2,opt,name=policy" json:"policy,omitempty"`
+	Mode   string `protobuf:"bytes,3,opt,name=mode" json:"mode,omitempty"`
+}
+
+func (m *DeviceModeMsg) Reset()                    { *m = DeviceModeMsg{} }
+func (m *DeviceModeMsg) String() string            { return proto.CompactTextString(m) }
+func (*DeviceModeMsg) ProtoMessage()               {}
+func (*DeviceModeMsg) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{10} }
+
+func (m *DeviceModeMsg) GetDevice() string {
+	if m != nil {
+		return m.Device
+	}
+	return ""
+}
+
+func (m *DeviceModeMsg) GetPolicy() uint32 {
+	if m != nil {
+		return m.Policy
+	}
+	return 0
+}
+
+func (m *DeviceModeMsg) GetMode() string {
+	if m != nil {
+		return m.Mode
+	}
+	return ""
+}
+
+type DeviceModeReply struct {
+	Mode string `protobuf:"bytes,1,opt,name=mode" json:"mode,omitempty"`
+}
+
+func (m *DeviceModeReply) Reset()                    { *m = DeviceModeReply{} }
+func (m *DeviceModeReply) String() string            { return proto.CompactTextString(m) }
+func (*DeviceModeReply) ProtoMessage()               {}
+func (*DeviceModeReply) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{11} }
+
+func (m *DeviceModeReply) GetMode() string {
+	if m != nil {
+		return m.Mode
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Partition)(nil), "pack.Partition")
 	proto.RegisterType((*PartitionSuffixesReply)(nil), "pack.PartitionSuffixesReply")
@@ -313,6 +473,10 @@ func init() {
 	proto.RegisterType((*SyncReply)(nil), "pack.SyncReply")
 	proto.RegisterType((*PartitionDeletionReply)(nil), "pack.PartitionDeletionReply")
 	proto.RegisterType((*PartitionAuditionReply)(nil), "pack.PartitionAuditionReply")
+	proto.RegisterType((*SnapshotMsg)(nil), "pack.SnapshotMsg")
+	proto.RegisterType((*SnapshotReply)(nil), "pack.SnapshotReply")
+	proto.RegisterType((*DeviceModeMsg)(nil), "pack.DeviceModeMsg")
+	proto.RegisterType((*DeviceModeReply)(nil), "pack.DeviceModeReply")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -331,6 +495,8 @@ type PackRpcServiceClient interface {
 	Sync(ctx context.Context, in *SyncMsg, opts ...grpc.CallOption) (*SyncReply, error)
 	DeleteHandoff(ctx context.Context, in *Partition, opts ...grpc.CallOption) (*PartitionDeletionReply, error)
 	AuditPartition(ctx context.Context, in *Partition, opts ...grpc.CallOption) (*PartitionAuditionReply, error)
+	Snapshot(ctx context.Context, in *SnapshotMsg, opts ...grpc.CallOption) (*SnapshotReply, error)
+	DeviceMode(ctx context.Context, in *DeviceModeMsg, opts ...grpc.CallOption) (*DeviceModeReply, error)
 }
 
 type packRpcServiceClient struct {
@@ -386,6 +552,24 @@ func (c *packRpcServiceClient) AuditPartition(ctx context.Context, in *Partition
 	return out, nil
 }
 
+func (c *packRpcServiceClient) Snapshot(ctx context.Context, in *SnapshotMsg, opts ...grpc.CallOption) (*SnapshotReply, error) {
+	out := new(SnapshotReply)
+	err := grpc.Invoke(ctx, "/pack.PackRpcService/Snapshot", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *packRpcServiceClient) DeviceMode(ctx context.Context, in *DeviceModeMsg, opts ...grpc.CallOption) (*DeviceModeReply, error) {
+	out := new(DeviceModeReply)
+	err := grpc.Invoke(ctx, "/pack.PackRpcService/DeviceMode", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for PackRpcService service
 
 type PackRpcServiceServer interface {
@@ -394,6 +578,8 @@ type PackRpcServiceServer interface {
 	Sync(context.Context, *SyncMsg) (*SyncReply, error)
 	DeleteHandoff(context.Context, *Partition) (*PartitionDeletionReply, error)
 	AuditPartition(context.Context, *Partition) (*PartitionAuditionReply, error)
+	Snapshot(context.Context, *SnapshotMsg) (*SnapshotReply, error)
+	DeviceMode(context.Context, *DeviceModeMsg) (*DeviceModeReply, error)
 }
 
 func RegisterPackRpcServiceServer(s *grpc.Server, srv PackRpcServiceServer) {
@@ -490,6 +676,42 @@ func _PackRpcService_AuditPartition_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PackRpcService_Snapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotMsg)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PackRpcServiceServer).Snapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pack.PackRpcService/Snapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PackRpcServiceServer).Snapshot(ctx, req.(*SnapshotMsg))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PackRpcService_DeviceMode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceModeMsg)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PackRpcServiceServer).DeviceMode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pack.PackRpcService/DeviceMode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PackRpcServiceServer).DeviceMode(ctx, req.(*DeviceModeMsg))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _PackRpcService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "pack.PackRpcService",
 	HandlerType: (*PackRpcServiceServer)(nil),
@@ -514,6 +736,14 @@ var _PackRpcService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "AuditPartition",
 			Handler:    _PackRpcService_AuditPartition_Handler,
 		},
+		{
+			MethodName: "Snapshot",
+			Handler:    _PackRpcService_Snapshot_Handler,
+		},
+		{
+			MethodName: "DeviceMode",
+			Handler:    _PackRpcService_DeviceMode_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "rpc.proto",
@@ -522,43 +752,55 @@ var _PackRpcService_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("rpc.proto", fileDescriptor1) }
 
 var fileDescriptor1 = []byte{
-	// 596 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x94, 0x4f, 0x6f, 0xd3, 0x30,
-	0x18, 0xc6, 0xeb, 0x26, 0x6d, 0x97, 0xb7, 0xda, 0x0a, 0x16, 0x1b, 0x51, 0x35, 0x41, 0x14, 0x24,
-	0x94, 0x53, 0x0f, 0x83, 0x03, 0x7f, 0x34, 0xc1, 0x60, 0xc0, 0x0e, 0x4c, 0x9a, 0xbc, 0x13, 0x47,
-	0xe3, 0xb8, 0x9b, 0xb5, 0x90, 0x04, 0xdb, 0x99, 0xc8, 0xd7, 0x01, 0xf1, 0x29, 0x10, 0x77, 0x3e,
-	0x16, 0xb2, 0x93, 0xb6, 0x6e, 0xa6, 0xa9, 0x42, 0xe2, 0x54, 0x3f, 0x4f, 0xdf, 0xd7, 0x7a, 0xf3,
-	0xfc, 0x6c, 0x43, 0x20, 0x4b, 0x36, 0x2b, 0x65, 0xa1, 0x0b, 0xec, 0x97, 0x94, 0x5d, 0xc5, 0x9f,
-	0x20, 0x38, 0xa3, 0x52, 0x0b, 0x2d, 0x8a, 0x1c, 0xef, 0xc1, 0x30, 0xe5, 0xd7, 0x82, 0xf1, 0x10,
-	0x45, 0x28, 0x09, 0x48, 0xab, 0x8c, 0x5f, 0x16, 0x99, 0x60, 0x75, 0xd8, 0x8f, 0x50, 0xb2, 0x4d,
-	0x5a, 0x85, 0xf7, 0x21, 0x28, 0x17, 0xcd, 0xa1, 0x67, 0x5b, 0x56, 0x46, 0xfc, 0x14, 0xf6, 0x96,
-	0x5b, 0x9f, 0x57, 0xf3, 0xb9, 0xf8, 0xc6, 0x15, 0xe1, 0x65, 0x56, 0xe3, 0x29, 0x6c, 0xa9, 0xd6,
-	0x08, 0x51, 0xe4, 0x25, 0x01, 0x59, 0xea, 0xf8, 0x17, 0x82, 0x49, 0x53, 0x7d, 0x42, 0xd5, 0x25,
-	0x57, 0xa7, 0xea, 0xe2, 0xff, 0xce, 0x85, 0x23, 0x18, 0x4b, 0xce, 0x68, 0xc6, 0xaa, 0x8c, 0x6a,
-	0x1e, 0xfa, 0x76, 0x00, 0xd7, 0xc2, 0x21, 0x8c, 0x32, 0xa1, 0xf4, 0xb1, 0x90, 0xe1, 0x20, 0x42,
-	0xc9, 0x16, 0x59, 0x48, 0xfc, 0x00, 0x40, 0x72, 0x96, 0x51, 0xf1, 0xe5, 0xe8, 0x82, 0x87, 0xc3,
-	0x08, 0x25, 0x3e, 0x71, 0x9c, 0xf8, 0x07, 0x82, 0xbb, 0xee, 0xf4, 0xcd, 0xf7, 0xee, 0xc1, 0xf0,
-	0xd2, 0xc8, 0xd4, 0xce, 0xef, 0x91, 0x56, 0xe1, 0x97, 0xad, 0xaf, 0xc2, 0x7e, 0xe4, 0x25, 0xe3,
-	0x83, 0x47, 0x33, 0xc3, 0x64, 0x76, 0x63, 0x83, 0x59, 0xb3, 0x7e, 0x97, 0x6b, 0x59, 0xb7, 0xcd,
-	0x6a, 0xfa, 0x1c, 0xc6, 0x8e, 0x8d, 0xef, 0x80, 0x77, 0xc5, 0xeb, 0x36, 0x20, 0xb3, 0xc4, 0xf7,
-	0x60, 0x70, 0x4d, 0xb3, 0x8a, 0xdb, 0x70, 0x02, 0xd2, 0x88, 0x17, 0xfd, 0x67, 0x28, 0xfe, 0x8d,
-	0x60, 0x74, 0x5e, 0xe7, 0xcc, 0x64, 0x1b, 0xc1, 0x38, 0x2b, 0x18, 0xcd, 0x8e, 0xdd, 0x80, 0x5d,
-	0x0b, 0x63, 0xf0, 0x2f, 0x0b, 0xa5, 0xdb, 0x6d, 0xec, 0xda, 0x78, 0x65, 0x21, 0xb5, 0x0d, 0x77,
-	0x40, 0xec, 0xda, 0xa1, 0xe4, 0xdf, 0x42, 0x69, 0x70, 0x3b, 0xa5, 0x61, 0x97, 0x92, 0x7b, 0x46,
-	0x46, 0x9d, 0x33, 0xf2, 0x13, 0x41, 0x60, 0xe6, 0x6f, 0xd2, 0x0d, 0x61, 0xa4, 0x2a, 0xc6, 0xb8,
-	0x52, 0x76, 0xfa, 0x2d, 0xb2, 0x90, 0xf8, 0x15, 0x00, 0xa3, 0x79, 0x2a, 0x52, 0xaa, 0x97, 0x19,
-	0x3f, 0x6c, 0x33, 0x5e, 0xb4, 0xcf, 0xde, 0x2e, 0x2b, 0x9a, 0x7c, 0x9d, 0x96, 0xe9, 0x21, 0x4c,
-	0x3a, 0x7f, 0xff, 0x53, 0xce, 0x07, 0xce, 0x0d, 0x38, 0xe6, 0x19, 0x37, 0xbf, 0x1b, 0x66, 0x8e,
-	0xbf, 0x23, 0xa7, 0xe9, 0xa8, 0x4a, 0xc5, 0xaa, 0xe9, 0x31, 0xec, 0x94, 0xb2, 0x30, 0x55, 0x3c,
-	0x7d, 0x53, 0x6b, 0xae, 0xda, 0xe3, 0xd4, 0x71, 0xd7, 0xea, 0xde, 0x8b, 0xcc, 0x7e, 0xfa, 0x7a,
-	0x9d, 0x75, 0x0d, 0xfa, 0xaf, 0x15, 0x95, 0x34, 0xd7, 0x22, 0xe7, 0xca, 0xb2, 0xf4, 0x88, 0x6b,
-	0x19, 0x74, 0x5c, 0xca, 0x42, 0x2a, 0x8b, 0xd4, 0x23, 0xad, 0x3a, 0xf8, 0xd3, 0x87, 0x9d, 0x33,
-	0xca, 0xae, 0x48, 0xc9, 0xce, 0xb9, 0xb4, 0x94, 0x4f, 0x60, 0xf7, 0xa3, 0x50, 0xfa, 0xc6, 0x8d,
-	0xc7, 0x93, 0x26, 0xf0, 0xe5, 0x1f, 0xd3, 0xfd, 0x8e, 0xb1, 0xf6, 0x36, 0xc4, 0x3d, 0x7c, 0x08,
-	0xc1, 0x07, 0xae, 0x9b, 0xb3, 0x8d, 0x77, 0x6f, 0x5e, 0x89, 0x53, 0x75, 0x31, 0xbd, 0x7f, 0xcb,
-	0x4d, 0x89, 0x7b, 0x38, 0x01, 0xdf, 0xc0, 0xc5, 0xdb, 0x2b, 0xd0, 0xa6, 0x63, 0xd2, 0xe1, 0x1e,
-	0xf7, 0xf0, 0x6b, 0xd8, 0xb6, 0x54, 0xf8, 0x09, 0xcd, 0xd3, 0x62, 0x3e, 0xdf, 0x3c, 0xea, 0x1a,
-	0xc4, 0xb8, 0x87, 0x8f, 0x60, 0xc7, 0x22, 0x5a, 0x3d, 0xa1, 0x1b, 0xb7, 0x58, 0x43, 0x1a, 0xf7,
-	0x3e, 0x0f, 0xed, 0x6b, 0xfc, 0xe4, 0x6f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x09, 0xda, 0x5b, 0x6f,
-	0x9a, 0x05, 0x00, 0x00,
+	// 796 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0xcd, 0x6e, 0xdb, 0x38,
+	0x10, 0xb6, 0x2c, 0xff, 0x69, 0x0c, 0xc7, 0x09, 0x77, 0x93, 0x15, 0x8c, 0x60, 0x57, 0xd0, 0xfe,
+	0xc0, 0xd8, 0x83, 0x0f, 0xd9, 0x1c, 0x76, 0xb3, 0x08, 0x5a, 0xb7, 0x69, 0x9b, 0x43, 0x03, 0xa4,
+	0x72, 0x2f, 0x3d, 0x32, 0x12, 0x6d, 0x09, 0x96, 0x45, 0x95, 0xa4, 0x83, 0xfa, 0x2d, 0xfa, 0x12,
+	0x7d, 0x89, 0x02, 0x7d, 0x80, 0x3e, 0x46, 0xdf, 0xa4, 0x20, 0x45, 0xfd, 0xd9, 0x0d, 0x82, 0x06,
+	0x3d, 0x79, 0xe6, 0xf3, 0xcc, 0xf0, 0xe3, 0x7c, 0x33, 0x14, 0x58, 0x2c, 0xf5, 0x27, 0x29, 0xa3,
+	0x82, 0xa2, 0x56, 0x8a, 0xfd, 0xa5, 0xfb, 0x06, 0xac, 0x6b, 0xcc, 0x44, 0x24, 0x22, 0x9a, 0xa0,
+	0x23, 0xe8, 0x04, 0xe4, 0x36, 0xf2, 0x89, 0x6d, 0x38, 0xc6, 0xd8, 0xf2, 0xb4, 0x27, 0xf1, 0x94,
+	0xc6, 0x91, 0xbf, 0xb1, 0x9b, 0x8e, 0x31, 0x1e, 0x78, 0xda, 0x43, 0xc7, 0x60, 0xa5, 0x79, 0xb2,
+	0x6d, 0xaa, 0x94, 0x12, 0x70, 0x4f, 0xe1, 0xa8, 0x28, 0x3d, 0x5b, 0xcf, 0xe7, 0xd1, 0x3b, 0xc2,
+	0x3d, 0x92, 0xc6, 0x1b, 0x34, 0x82, 0x1e, 0xd7, 0x80, 0x6d, 0x38, 0xe6, 0xd8, 0xf2, 0x0a, 0xdf,
+	0xfd, 0x62, 0xc0, 0x30, 0x8b, 0xbe, 0xc4, 0x3c, 0x24, 0xfc, 0x8a, 0x2f, 0x7e, 0x2c, 0x2f, 0xe4,
+	0x40, 0x9f, 0x11, 0x1f, 0xc7, 0xfe, 0x3a, 0xc6, 0x82, 0xd8, 0x2d, 0x45, 0xa0, 0x0a, 0x21, 0x1b,
+	0xba, 0x71, 0xc4, 0xc5, 0x45, 0xc4, 0xec, 0xb6, 0x63, 0x8c, 0x7b, 0x5e, 0xee, 0xa2, 0x5f, 0x01,
+	0x18, 0xf1, 0x63, 0x1c, 0xad, 0xa6, 0x0b, 0x62, 0x77, 0x1c, 0x63, 0xdc, 0xf2, 0x2a, 0x08, 0xfa,
+	0x03, 0x06, 0x21, 0xe6, 0xe1, 0x34, 0x5e, 0x50, 0x16, 0x89, 0x70, 0x65, 0x77, 0xd5, 0xe9, 0x75,
+	0xd0, 0xfd, 0x6c, 0xc0, 0x41, 0xf5, 0x8e, 0x59, 0x57, 0x8e, 0xa0, 0x23, 0xc3, 0x48, 0xa0, 0x6e,
+	0x69, 0x7a, 0xda, 0x43, 0xff, 0x6b, 0x9c, 0xdb, 0x4d, 0xc7, 0x1c, 0xf7, 0x4f, 0x7e, 0x9f, 0x48,
+	0xe5, 0x26, 0x3b, 0x05, 0x26, 0x99, 0xfd, 0x2c, 0x11, 0x6c, 0xa3, 0x93, 0xf9, 0x2e, 0x21, 0xf3,
+	0x1b, 0x84, 0x46, 0xff, 0x41, 0xbf, 0x92, 0x8c, 0xf6, 0xc1, 0x5c, 0x92, 0x8d, 0x6e, 0xb6, 0x34,
+	0xd1, 0xcf, 0xd0, 0xbe, 0xc5, 0xf1, 0x9a, 0xa8, 0x46, 0x5b, 0x5e, 0xe6, 0x9c, 0x35, 0xff, 0x35,
+	0xdc, 0x4f, 0x06, 0x74, 0x67, 0x9b, 0xc4, 0x97, 0x3a, 0x39, 0xd0, 0x8f, 0xa9, 0x8f, 0xe3, 0x8b,
+	0xaa, 0x58, 0x55, 0x08, 0x21, 0x68, 0x85, 0x94, 0x0b, 0x5d, 0x46, 0xd9, 0x12, 0x4b, 0x29, 0x13,
+	0x8a, 0x59, 0xdb, 0x53, 0x76, 0x45, 0xf1, 0xd6, 0x1d, 0x8a, 0xb7, 0xef, 0x56, 0xbc, 0xb3, 0xad,
+	0x78, 0x75, 0xde, 0xba, 0x5b, 0xf3, 0xf6, 0xc1, 0x00, 0x4b, 0xf2, 0xcf, 0x34, 0xb0, 0xa1, 0xcb,
+	0xd7, 0xbe, 0x4f, 0x38, 0x57, 0xec, 0x7b, 0x5e, 0xee, 0xa2, 0x47, 0x00, 0x3e, 0x4e, 0x82, 0x28,
+	0xc0, 0xa2, 0x50, 0xe2, 0x37, 0xad, 0x44, 0x9e, 0x3e, 0x79, 0x5a, 0x44, 0x64, 0x2a, 0x54, 0x52,
+	0x46, 0xe7, 0x30, 0xdc, 0xfa, 0xfb, 0xbb, 0xfa, 0x7c, 0x52, 0xd9, 0xa6, 0x0b, 0x12, 0x13, 0xf9,
+	0x7b, 0x0f, 0x67, 0xf7, 0x7d, 0xb3, 0x92, 0x34, 0x5d, 0x07, 0x51, 0x99, 0xf4, 0x17, 0xec, 0xa5,
+	0x8c, 0xca, 0x28, 0x12, 0x3c, 0xd9, 0x08, 0xc2, 0xf5, 0xd0, 0x6d, 0xa1, 0xb5, 0xb8, 0xe7, 0x51,
+	0xac, 0xae, 0x5e, 0x8f, 0x53, 0xa8, 0x94, 0xfe, 0xed, 0x1a, 0x33, 0x9c, 0x88, 0x28, 0x21, 0x5c,
+	0x69, 0x69, 0x7a, 0x55, 0x48, 0x4a, 0x47, 0x18, 0xa3, 0x8c, 0x2b, 0x49, 0x4d, 0x4f, 0x7b, 0x92,
+	0x3e, 0x65, 0x69, 0x88, 0x13, 0xae, 0x34, 0x35, 0xbd, 0xdc, 0x95, 0x67, 0xeb, 0xd5, 0xca, 0x39,
+	0x76, 0xb2, 0xb3, 0xeb, 0x28, 0xfa, 0x1b, 0xf6, 0x19, 0xc1, 0x29, 0x09, 0x5e, 0xd3, 0xd5, 0x0d,
+	0x17, 0x34, 0x51, 0x32, 0xcb, 0xc8, 0x1d, 0xdc, 0x7d, 0x05, 0xfd, 0x59, 0x82, 0x53, 0x1e, 0x52,
+	0xf1, 0x90, 0x97, 0x05, 0x41, 0x2b, 0xc1, 0x2b, 0xa2, 0xb7, 0x48, 0xd9, 0x2e, 0x87, 0x41, 0x5e,
+	0x32, 0xeb, 0xad, 0x1c, 0x68, 0x2c, 0x42, 0x5d, 0x52, 0xd9, 0x6a, 0x04, 0xc9, 0x62, 0x45, 0x12,
+	0x91, 0x77, 0xb0, 0xf0, 0xe5, 0xf0, 0x32, 0x32, 0x8f, 0xa3, 0x64, 0x49, 0x02, 0xdd, 0xb9, 0x12,
+	0x90, 0x23, 0x31, 0x57, 0x8d, 0xcf, 0xda, 0x96, 0x39, 0xee, 0x0c, 0x06, 0xd9, 0x4a, 0x5d, 0xd1,
+	0x80, 0x3c, 0xf0, 0x26, 0x2b, 0x1a, 0x14, 0x37, 0x91, 0xb6, 0xfb, 0x27, 0x0c, 0xcb, 0xa2, 0xc5,
+	0x5d, 0x54, 0x98, 0x51, 0x86, 0x9d, 0x7c, 0x34, 0x61, 0xef, 0x1a, 0xfb, 0x4b, 0x2f, 0xf5, 0x67,
+	0x84, 0xa9, 0x53, 0x2e, 0xe1, 0xf0, 0x65, 0xc4, 0xc5, 0xce, 0x7b, 0x8f, 0x86, 0xd9, 0x8a, 0x14,
+	0x7f, 0x8c, 0x8e, 0xb7, 0x80, 0xda, 0x97, 0xc1, 0x6d, 0xa0, 0x73, 0xb0, 0x5e, 0x10, 0x91, 0xbd,
+	0x46, 0xe8, 0x70, 0xf7, 0xa9, 0xbb, 0xe2, 0x8b, 0xd1, 0x2f, 0x77, 0xbc, 0x80, 0x6e, 0x03, 0x8d,
+	0xa1, 0x25, 0xd7, 0x11, 0x0d, 0xca, 0xd5, 0x94, 0x19, 0xc3, 0xad, 0x4d, 0x75, 0x1b, 0xe8, 0xb1,
+	0xec, 0x60, 0x4c, 0x04, 0xb9, 0xc4, 0x49, 0x40, 0xe7, 0xf3, 0xfb, 0xa9, 0xd6, 0xd6, 0xce, 0x6d,
+	0xa0, 0x29, 0xec, 0xa9, 0xa5, 0x2a, 0x02, 0xee, 0x2f, 0x51, 0x5b, 0x42, 0xb7, 0x81, 0x4e, 0xa1,
+	0x97, 0xcf, 0x0e, 0x3a, 0xd0, 0x1c, 0xcb, 0xf1, 0x1c, 0xfd, 0x54, 0x87, 0xf2, 0xac, 0x33, 0x80,
+	0x52, 0x27, 0xa4, 0x83, 0x6a, 0xe3, 0x30, 0x3a, 0xdc, 0x06, 0x75, 0xee, 0x4d, 0x47, 0x7d, 0xfd,
+	0xff, 0xf9, 0x3a, 0x00, 0x94, 0x00, 0x7f, 0x4c, 0x0a, 0x08, 0x00, 0x00,
 }
@@ -22,12 +22,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"go.uber.org/zap"
 	context "golang.org/x/net/context"
 
 	"github.com/iqiyi/auklet/common"
+	"github.com/iqiyi/auklet/objectserver/engine"
 )
 
 func (s *PackRpcServer) GetHashes(
@@ -37,15 +39,26 @@ func (s *PackRpcServer) GetHashes(
 		return nil, err
 	}
 
-	hashed, hashes, err := device.GetHashes(
-		msg.Partition, msg.Recalculate, msg.ListDir, common.ONE_WEEK)
+	reclaimAge := int64(msg.ReclaimAge)
+	if reclaimAge == 0 {
+		reclaimAge = gconf.ReclaimAge
+	}
+	var hashed int64
+	var hashes map[string]string
+	if msg.HashAlgorithm == engine.SummarySuffixHash {
+		hashed, hashes, err = device.GetSummaryHashes(msg.Partition, reclaimAge)
+	} else {
+		hashed, hashes, err = device.GetHashes(
+			msg.Partition, msg.Recalculate, msg.ListDir, reclaimAge)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	reply := &SuffixHashesReply{
-		Hashed: hashed,
-		Hashes: hashes,
+		Hashed:        hashed,
+		Hashes:        hashes,
+		HashAlgorithm: msg.HashAlgorithm,
 	}
 
 	return reply, nil
@@ -102,6 +115,49 @@ func (s *PackRpcServer) diffObjects(timestamps map[string]*ObjectTimestamps,
 	return wanted.Objects, nil
 }
 
+// remoteTree fetches the bucket hashes of the suffixes from the remote
+func (s *PackRpcServer) remoteTree(msg *SyncMsg) (*PartitionTree, error) {
+	url := fmt.Sprintf("http://%s:%d/%s/%s/%s", msg.Host, msg.Port,
+		msg.Device, msg.Partition, strings.Join(msg.Suffixes, "-"))
+	req, err := http.NewRequest("TREE", url, nil)
+	if err != nil {
+		glogger.Error("unable to create tree request",
+			zap.String("url", url),
+			zap.Error(err))
+		return nil, err
+	}
+	req.Header.Set(common.XBackendPolicyIndex, strconv.Itoa(int(msg.Policy)))
+
+	resp, err := s.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		// Remote of older versions replies 405
+		glogger.Info("unable to get partition tree, diff all objects",
+			zap.String("url", url), zap.Error(err))
+		return nil, ErrPartitionTree
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glogger.Error("unable to read tree response body",
+			zap.String("url", url), zap.Error(err))
+		return nil, err
+	}
+
+	tree := new(PartitionTree)
+	if err = proto.Unmarshal(b, tree); err != nil {
+		glogger.Error("unable to unmarshal tree response",
+			zap.String("url", url),
+			zap.ByteString("body", b),
+			zap.Error(err))
+		return nil, err
+	}
+
+	return tree, nil
+}
+
 func (s *PackRpcServer) sendDelete(url string,
 	policy int, obj *PackObject) error {
 
@@ -146,7 +202,8 @@ func (s *PackRpcServer) syncData(url string, policy int, obj *PackObject) error
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPut, url, reader)
+	req, err := http.NewRequest(http.MethodPut, url,
+		s.throttle.reader(reader, obj.device.device))
 	if err != nil {
 		glogger.Error("unable to create PUT request",
 			zap.String("url", url),
@@ -230,59 +287,76 @@ func (s *PackRpcServer) syncObjects(wanted map[string]*WantedParts, msg *SyncMsg
 
 	candidates := make(map[string]string)
 	for h, w := range wanted {
-		obj := &PackObject{
-			key:       generateKeyFromHash(msg.Partition, h),
-			device:    device,
-			partition: msg.Partition,
-		}
-
-		err = device.LoadObjectMeta(obj)
+		ts, err := s.syncObject(device, msg, h, w)
 		if err != nil {
-			glogger.Error("unable to load metadata",
-				zap.String("object-key", obj.key),
-				zap.Error(err))
 			return nil, err
 		}
+		if ts != "" {
+			candidates[h] = ts
+		}
+	}
+
+	return candidates, nil
+}
+
+// syncObject replicates the wanted parts of an object and returns its
+// timestamp, or an empty string if nothing is replicated.
+func (s *PackRpcServer) syncObject(device *PackDevice, msg *SyncMsg,
+	h string, w *WantedParts) (string, error) {
+	obj := &PackObject{
+		key:       generateKeyFromHash(msg.Partition, h),
+		device:    device,
+		partition: msg.Partition,
+	}
+
+	err := device.LoadObjectMeta(obj)
+	if err != nil {
+		glogger.Error("unable to load metadata",
+			zap.String("object-key", obj.key),
+			zap.Error(err))
+		return "", err
+	}
+	defer obj.Close()
+	s.throttle.wait(device.device, 0, 1)
 
-		url := fmt.Sprintf("http://%s:%d/%s/%s%s",
-			msg.Host, msg.Port, msg.Device, msg.Partition, obj.meta.Name)
-
-		if w.Data && !obj.exists && obj.meta != nil {
-			err = s.sendDelete(url, int(msg.Policy), obj)
-			if err != nil {
-				glogger.Error("unable to replicate deleted object",
-					zap.String("object", obj.name),
-					zap.Error(err))
-				return nil, err
-			}
-			candidates[h] = obj.meta.Timestamp
-			continue
+	url := fmt.Sprintf("http://%s:%d/%s/%s%s",
+		msg.Host, msg.Port, msg.Device, msg.Partition, obj.meta.Name)
+
+	if w.Data && !obj.exists && obj.meta != nil {
+		err = s.sendDelete(url, int(msg.Policy), obj)
+		if err != nil {
+			glogger.Error("unable to replicate deleted object",
+				zap.String("object", obj.name),
+				zap.Error(err))
+			return "", err
 		}
+		return obj.meta.Timestamp, nil
+	}
 
-		if w.Data {
-			err = s.syncData(url, int(msg.Policy), obj)
-			if err != nil {
-				glogger.Error("unable to replicate data part",
-					zap.String("object", obj.name),
-					zap.Error(err))
-				return nil, err
-			}
-			candidates[h] = obj.meta.Timestamp
+	ts := ""
+	if w.Data {
+		err = s.syncData(url, int(msg.Policy), obj)
+		if err != nil {
+			glogger.Error("unable to replicate data part",
+				zap.String("object", obj.name),
+				zap.Error(err))
+			return "", err
 		}
+		ts = obj.meta.Timestamp
+	}
 
-		if w.Meta && obj.mMeta != nil {
-			err = s.syncMeta(url, int(msg.Policy), obj)
-			if err != nil {
-				glogger.Error("unable to replicate meta part",
-					zap.String("object", obj.name),
-					zap.Error(err))
-				return nil, err
-			}
-			candidates[h] = obj.meta.Timestamp
+	if w.Meta && obj.mMeta != nil {
+		err = s.syncMeta(url, int(msg.Policy), obj)
+		if err != nil {
+			glogger.Error("unable to replicate meta part",
+				zap.String("object", obj.name),
+				zap.Error(err))
+			return "", err
 		}
+		ts = obj.meta.Timestamp
 	}
 
-	return candidates, nil
+	return ts, nil
 }
 
 // A successful flag would cause handoff partition to be deleted,
@@ -301,6 +375,13 @@ func (s *PackRpcServer) Sync(ctx context.Context, msg *SyncMsg) (*SyncReply, err
 		return reply, nil
 	}
 
+	release := s.throttle.acquireHost(msg.Host)
+	defer release()
+
+	// Only the objects in the buckets diverged are diffed, or all of them
+	// if the tree of the remote is unavailable.
+	tree, _ := s.remoteTree(msg)
+
 	timestamps := make(map[string]*ObjectTimestamps)
 
 	for _, suffix := range msg.Suffixes {
@@ -313,7 +394,11 @@ func (s *PackRpcServer) Sync(ctx context.Context, msg *SyncMsg) (*SyncReply, err
 			return reply, nil
 		}
 
-		for h, ts := range tses {
+		var remote *SuffixTree
+		if tree != nil {
+			remote = tree.Suffixes[suffix]
+		}
+		for h, ts := range divergedTimestamps(tses, remote) {
 			timestamps[h] = ts
 		}
 	}
@@ -326,7 +411,11 @@ func (s *PackRpcServer) Sync(ctx context.Context, msg *SyncMsg) (*SyncReply, err
 		return reply, nil
 	}
 
-	reply.Candidates, err = s.syncObjects(wanted, msg)
+	reply.Candidates, err = s.streamObjects(wanted, msg)
+	if err == ErrSyncStreamUnsupported {
+		// Remote of older versions
+		reply.Candidates, err = s.syncObjects(wanted, msg)
+	}
 
 	if err == nil {
 		reply.Success = true
@@ -26,6 +26,7 @@ import (
 	context "golang.org/x/net/context"
 
 	"github.com/iqiyi/auklet/common/fs"
+	"github.com/iqiyi/auklet/objectserver/engine"
 )
 
 func TestRpcGetHashes(t *testing.T) {
@@ -71,6 +72,19 @@ func TestRpcGetHashes(t *testing.T) {
 
 	require.Equal(t, int64(1), reply.Hashed)
 	require.Equal(t, expected, reply.Hashes)
+	require.Equal(t, "", reply.HashAlgorithm)
+
+	// Summary hashes are answered only if requested
+	msg.HashAlgorithm = engine.SummarySuffixHash
+	reply, err = rpc.GetHashes(ctx, msg)
+	require.Nil(t, err)
+	require.Equal(t, engine.SummarySuffixHash, reply.HashAlgorithm)
+	require.Equal(t, map[string]string{
+		splitObjectKey(obj.key)[1]: expectedSuffixHash(map[string]string{
+			obj.key + "/data": obj.meta.Timestamp,
+			obj.key + "/meta": vo.meta.Timestamp,
+		}),
+	}, reply.Hashes)
 }
 
 func TestRpcDeleteHandoff(t *testing.T) {
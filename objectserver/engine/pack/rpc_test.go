@@ -97,3 +97,34 @@ func TestRpcAuditPartition(t *testing.T) {
 	require.Equal(t, int64(2), reply.ProcessedFiles)
 	require.Equal(t, so.dataSize+lo.dataSize, reply.ProcessedBytes)
 }
+
+func TestRpcDeviceMode(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	mgr := NewPackDeviceMgr(6000, root, PACK_POLICY_INDEX)
+	mgr.testMode = true
+	rpc := NewRpcServer(60000)
+	rpc.RegisterPackDeviceMgr(mgr)
+	engine := &PackEngine{deviceMgr: mgr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msg := &DeviceModeMsg{Device: PACK_DEVICE, Policy: PACK_POLICY_INDEX}
+	reply, err := rpc.DeviceMode(ctx, msg)
+	require.Nil(t, err)
+	require.Equal(t, DeviceModeNormal, reply.Mode)
+	require.False(t, engine.IsReadOnly(PACK_DEVICE))
+
+	msg.Mode = DeviceModeReadOnly
+	reply, err = rpc.DeviceMode(ctx, msg)
+	require.Nil(t, err)
+	require.Equal(t, DeviceModeReadOnly, reply.Mode)
+	require.True(t, engine.IsReadOnly(PACK_DEVICE))
+
+	msg.Mode = "unknown"
+	_, err = rpc.DeviceMode(ctx, msg)
+	require.Equal(t, ErrInvalidDeviceMode, err)
+}
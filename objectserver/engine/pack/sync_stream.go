@@ -0,0 +1,459 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"github.com/iqiyi/auklet/common"
+)
+
+// The objects wanted by a remote are sent in the body of one SYNC request
+// rather than a request per object. The body is a sequence of frames, each
+// of which is a big endian uint32 length followed by a SyncFrame. A PUT
+// frame is followed by the data of the object, whose size is the data size
+// of the frame meta. The remote replies with a status per frame, which is
+// the status of the request it stands for.
+const maxSyncFrameSize = 1 << 20
+
+func writeSyncFrame(w io.Writer, frame *SyncFrame) error {
+	b, err := proto.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	if _, err = w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// io.EOF is returned if the stream ends between frames
+func readSyncFrame(r io.Reader) (*SyncFrame, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	if size > maxSyncFrameSize {
+		return nil, ErrMalformedSyncFrame
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	frame := new(SyncFrame)
+	if err := proto.Unmarshal(b, frame); err != nil || frame.Meta == nil {
+		return nil, ErrMalformedSyncFrame
+	}
+
+	return frame, nil
+}
+
+// Same as the metadata of the request replicating the part in the past
+func frameMetadata(meta *ObjectMeta) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range meta.SystemMeta {
+		metadata[k] = v
+	}
+	for k, v := range meta.UserMeta {
+		metadata[k] = v
+	}
+	metadata["name"] = meta.Name
+	metadata[common.XTimestamp] = meta.Timestamp
+
+	return metadata
+}
+
+type sentFrame struct {
+	hash      string
+	method    string
+	timestamp string
+}
+
+func (f *sentFrame) synced(status int32) bool {
+	switch f.method {
+	case http.MethodPut:
+		return status == http.StatusCreated
+	case http.MethodPost:
+		return status == http.StatusAccepted
+	}
+
+	// Because we are replicating a deletion, if the status code is not 404,
+	// it should be considered as success.
+	return status == http.StatusNoContent || status == http.StatusNotFound
+}
+
+func writeObjectData(w io.Writer, obj *PackObject) error {
+	var err error
+	if obj.reader, err = obj.device.NewReader(obj); err != nil {
+		glogger.Error("unable to create object reader",
+			zap.String("object", obj.meta.Name),
+			zap.Error(err))
+		return err
+	}
+	defer obj.Close()
+
+	_, err = common.CopyN(obj.reader, obj.dMeta.DataSize, w)
+	return err
+}
+
+// writeObjectFrames writes the frames of the wanted objects to the stream
+// and returns them in order.
+func writeObjectFrames(w io.Writer, device *PackDevice, partition string,
+	wanted map[string]*WantedParts,
+	throttle *replicationThrottle) ([]*sentFrame, error) {
+	w = throttle.writer(w, device.device)
+	var sent []*sentFrame
+	for h, wp := range wanted {
+		obj := &PackObject{
+			key:       generateKeyFromHash(partition, h),
+			device:    device,
+			partition: partition,
+		}
+
+		if err := device.LoadObjectMeta(obj); err != nil {
+			glogger.Error("unable to load metadata",
+				zap.String("object-key", obj.key),
+				zap.Error(err))
+			return sent, err
+		}
+		if obj.meta == nil {
+			continue
+		}
+		throttle.wait(device.device, 0, 1)
+
+		var frames []*SyncFrame
+		if wp.Data && !obj.exists {
+			frames = append(frames,
+				&SyncFrame{Method: http.MethodDelete, Meta: obj.meta})
+		} else {
+			if wp.Data {
+				frames = append(frames,
+					&SyncFrame{Method: http.MethodPut, Meta: obj.dMeta})
+			}
+			if wp.Meta && obj.mMeta != nil {
+				frames = append(frames,
+					&SyncFrame{Method: http.MethodPost, Meta: obj.mMeta})
+			}
+		}
+
+		var err error
+		for _, frame := range frames {
+			if err = writeSyncFrame(w, frame); err != nil {
+				break
+			}
+			if frame.Method == http.MethodPut {
+				if err = writeObjectData(w, obj); err != nil {
+					break
+				}
+			}
+			sent = append(sent, &sentFrame{
+				hash:      h,
+				method:    frame.Method,
+				timestamp: obj.meta.Timestamp,
+			})
+		}
+		// Releases the bundle pinned if the data is not written
+		obj.pinBundle(nil)
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// streamObjects sends the wanted objects to the remote in one SYNC request.
+// Objects whose parts are all synced are returned as candidates, even if
+// others fail. ErrSyncStreamUnsupported is returned if the remote is not
+// able to receive the stream.
+func (s *PackRpcServer) streamObjects(
+	wanted map[string]*WantedParts, msg *SyncMsg) (map[string]string, error) {
+	candidates := make(map[string]string)
+	if len(wanted) == 0 {
+		return candidates, nil
+	}
+
+	device, err := s.getDevice(int(msg.Policy), msg.LocalDevice)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("http://%s:%d/%s/%s",
+		msg.Host, msg.Port, msg.Device, msg.Partition)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("SYNC", url, pr)
+	if err != nil {
+		glogger.Error("unable to create sync request",
+			zap.String("url", url),
+			zap.Error(err))
+		return nil, err
+	}
+	req.Header.Set(common.XBackendPolicyIndex, strconv.Itoa(int(msg.Policy)))
+
+	type writeResult struct {
+		sent []*sentFrame
+		err  error
+	}
+	written := make(chan writeResult, 1)
+	go func() {
+		sent, err := writeObjectFrames(
+			pw, device, msg.Partition, wanted, s.throttle)
+		pw.CloseWithError(err)
+		written <- writeResult{sent, err}
+	}()
+
+	resp, err := s.client.Do(req)
+	// Unblocks the writer if the remote stops reading the stream
+	pr.Close()
+	wr := <-written
+	if err != nil {
+		glogger.Error("unable to send sync request",
+			zap.String("url", url),
+			zap.Error(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusInsufficientStorage:
+		return nil, ErrRemoteDiskUnmounted
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, ErrSyncStreamUnsupported
+	default:
+		glogger.Error("unable to sync objects",
+			zap.String("url", url),
+			zap.String("status", resp.Status))
+		return nil, ErrObjectsNotSynced
+	}
+	if wr.err != nil {
+		glogger.Error("unable to write sync stream",
+			zap.String("url", url),
+			zap.Error(wr.err))
+		return nil, wr.err
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		glogger.Error("unable to read sync response body",
+			zap.String("url", url), zap.Error(err))
+		return nil, err
+	}
+	results := new(SyncResults)
+	if err = proto.Unmarshal(b, results); err != nil {
+		glogger.Error("unable to unmarshal sync response",
+			zap.String("url", url), zap.Error(err))
+		return nil, err
+	}
+
+	failed := make(map[string]bool)
+	for i, f := range wr.sent {
+		if i >= len(results.Statuses) || !f.synced(results.Statuses[i]) {
+			failed[f.hash] = true
+			continue
+		}
+		candidates[f.hash] = f.timestamp
+	}
+	for h := range failed {
+		delete(candidates, h)
+	}
+	if len(failed) > 0 {
+		glogger.Error("unable to sync some objects",
+			zap.String("url", url),
+			zap.Int("objects", len(failed)))
+		return candidates, ErrObjectsNotSynced
+	}
+
+	return candidates, nil
+}
+
+func (f *PackEngine) syncData(obj *PackObject, meta *ObjectMeta, data io.Reader) int32 {
+	if obj.Exists() && obj.Metadata()[common.XTimestamp] >= meta.Timestamp {
+		return http.StatusConflict
+	}
+
+	w, err := obj.SetData(meta.DataSize)
+	if err != nil {
+		glogger.Error("unable to create new object",
+			zap.String("object", obj.name), zap.Error(err))
+		return http.StatusInternalServerError
+	}
+
+	hash := md5.New()
+	size, err := common.Copy(data, w, hash)
+	if err != nil || size != meta.DataSize {
+		glogger.Error("incomplete data received",
+			zap.String("object", obj.name),
+			zap.Int64("expected", meta.DataSize),
+			zap.Int64("actual", size),
+			zap.Error(err))
+		return common.StatusClientClosedRequest
+	}
+
+	metadata := frameMetadata(meta)
+	if etag := metadata[common.HEtag]; etag != "" &&
+		etag != hex.EncodeToString(hash.Sum(nil)) {
+		return http.StatusUnprocessableEntity
+	}
+
+	if err = obj.Commit(metadata); err != nil {
+		glogger.Error("unable to commit object",
+			zap.String("object", obj.name), zap.Error(err))
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusCreated
+}
+
+func (f *PackEngine) syncMeta(obj *PackObject, meta *ObjectMeta) int32 {
+	if !obj.Exists() {
+		return http.StatusNotFound
+	}
+	orig := obj.Metadata()
+	if orig[common.XTimestamp] >= meta.Timestamp {
+		return http.StatusConflict
+	}
+
+	metadata := frameMetadata(meta)
+	if v, ok := orig[common.XStaticLargeObject]; ok {
+		metadata[common.XStaticLargeObject] = v
+	}
+	if err := obj.CommitMeta(metadata); err != nil {
+		glogger.Error("unable to commit object meta",
+			zap.String("object", obj.name), zap.Error(err))
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusAccepted
+}
+
+func (f *PackEngine) syncDeletion(obj *PackObject, meta *ObjectMeta) int32 {
+	status := int32(http.StatusNotFound)
+	if obj.Exists() {
+		if obj.Metadata()[common.XTimestamp] >= meta.Timestamp {
+			return http.StatusConflict
+		}
+		status = http.StatusNoContent
+	}
+
+	metadata := map[string]string{
+		"name":            meta.Name,
+		common.XTimestamp: meta.Timestamp,
+	}
+	if err := obj.Delete(metadata); err != nil {
+		glogger.Error("unable to delete object",
+			zap.String("object", obj.name), zap.Error(err))
+		return http.StatusInternalServerError
+	}
+
+	return status
+}
+
+// syncObject commits the object of the frame in the same way as the object
+// server handles the request the frame stands for.
+func (f *PackEngine) syncObject(
+	device, partition string, frame *SyncFrame, data io.Reader) int32 {
+	meta := frame.Meta
+	fields := strings.SplitN(strings.TrimPrefix(meta.Name, "/"), "/", 3)
+	if len(fields) != 3 || meta.Timestamp == "" {
+		return http.StatusBadRequest
+	}
+
+	vars := map[string]string{
+		"device":    device,
+		"partition": partition,
+		"account":   fields[0],
+		"container": fields[1],
+		"obj":       fields[2],
+	}
+	if frame.Method != http.MethodPut {
+		vars["quse-migration"] = "yes"
+	}
+	o, err := f.New(vars, false)
+	if err != nil {
+		glogger.Error("unable to open object",
+			zap.String("object", meta.Name), zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	obj := o.(*PackObject)
+	defer obj.Close()
+
+	switch frame.Method {
+	case http.MethodPut:
+		return f.syncData(obj, meta, data)
+	case http.MethodPost:
+		return f.syncMeta(obj, meta)
+	case http.MethodDelete:
+		return f.syncDeletion(obj, meta)
+	}
+
+	return http.StatusBadRequest
+}
+
+// SyncObjects commits the objects in the stream sent by streamObjects and
+// returns a status per frame. It stops at the first frame not able to be
+// read, with the statuses of the frames before it.
+func (f *PackEngine) SyncObjects(
+	device, partition string, stream io.Reader) ([]int32, error) {
+	if f.deviceMgr.GetPackDevice(device) == nil {
+		return nil, ErrPackDeviceNotFound
+	}
+
+	r := bufio.NewReader(stream)
+	var statuses []int32
+	for {
+		frame, err := readSyncFrame(r)
+		if err == io.EOF {
+			return statuses, nil
+		}
+		if err != nil {
+			glogger.Error("unable to read sync frame",
+				zap.String("device", device),
+				zap.String("partition", partition),
+				zap.Error(err))
+			return statuses, err
+		}
+
+		var size int64
+		if frame.Method == http.MethodPut {
+			size = frame.Meta.DataSize
+		}
+		data := io.LimitReader(r, size)
+		statuses = append(statuses, f.syncObject(device, partition, frame, data))
+
+		// Data not consumed, e.g. the object is in conflict, is skipped
+		if _, err = io.Copy(ioutil.Discard, data); err != nil {
+			return statuses, err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/iqiyi/auklet/common/conf"
+)
+
+func TestSyncStream(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dst)
+
+	sd := NewPackDevice(PACK_DEVICE, src, PACK_POLICY_INDEX)
+	defer sd.Close()
+	mgr := NewPackDeviceMgr(6000, dst, PACK_POLICY_INDEX)
+	mgr.testMode = true
+	defer mgr.Close()
+	prefix, suffix, err := conf.GetHashPrefixAndSuffix()
+	require.Nil(t, err)
+	engine := &PackEngine{
+		hashPrefix: prefix,
+		hashSuffix: suffix,
+		deviceMgr:  mgr,
+		asyncWG:    &sync.WaitGroup{},
+	}
+
+	// A SO with meta updated, a LO and a deleted SO
+	partition := "1"
+	so, lo, deleted := newPackSO(partition), newPackLO(partition), newPackSO(partition)
+	wanted := make(map[string]*WantedParts)
+	for _, obj := range []*PackObject{so, lo, deleted} {
+		require.Nil(t, feedObject(obj, sd))
+		require.Nil(t, sd.CommitWrite(obj))
+		obj.Close()
+		wanted[splitObjectKey(obj.key)[2]] = &WantedParts{Data: true, Meta: true}
+	}
+	vo := copyVanilla(so)
+	require.Nil(t, sd.LoadObjectMeta(vo))
+	vo.meta.UserMeta["X-Object-Meta-Tag"] = "dev"
+	vo.meta.Timestamp = incSeconds(so.meta.Timestamp, 1)
+	require.Nil(t, sd.CommitUpdate(vo))
+	vo = copyVanilla(deleted)
+	require.Nil(t, sd.LoadObjectMeta(vo))
+	vo.meta.Timestamp = incSeconds(deleted.meta.Timestamp, 1)
+	require.Nil(t, sd.CommitDeletion(vo))
+
+	stream := new(bytes.Buffer)
+	sent, err := writeObjectFrames(stream, sd, partition, wanted, nil)
+	require.Nil(t, err)
+	require.Len(t, sent, 4)
+	statuses, err := engine.SyncObjects(PACK_DEVICE, partition, stream)
+	require.Nil(t, err)
+	require.Len(t, statuses, len(sent))
+	for i, f := range sent {
+		require.True(t, f.synced(statuses[i]), "%s: %d", f.method, statuses[i])
+	}
+
+	dd := mgr.GetPackDevice(PACK_DEVICE)
+	for _, obj := range []*PackObject{so, lo, deleted} {
+		s := splitObjectKey(obj.key)[1]
+		expected, err := sd.ListSuffixTimestamps(partition, s)
+		require.Nil(t, err)
+		actual, err := dd.ListSuffixTimestamps(partition, s)
+		require.Nil(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	// Parts not newer than the remote ones are in conflict
+	stream.Reset()
+	sent, err = writeObjectFrames(stream, sd, partition, wanted, nil)
+	require.Nil(t, err)
+	statuses, err = engine.SyncObjects(PACK_DEVICE, partition, stream)
+	require.Nil(t, err)
+	for i, f := range sent {
+		if f.method == http.MethodDelete {
+			require.Equal(t, int32(http.StatusNotFound), statuses[i])
+		} else {
+			require.Equal(t, int32(http.StatusConflict), statuses[i])
+		}
+	}
+
+	// Frames before a broken one are committed
+	stream.Reset()
+	require.Nil(t, writeSyncFrame(stream, &SyncFrame{
+		Method: http.MethodDelete,
+		Meta:   &ObjectMeta{Name: so.name, Timestamp: incSeconds(so.meta.Timestamp, 2)},
+	}))
+	stream.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	statuses, err = engine.SyncObjects(PACK_DEVICE, partition, stream)
+	require.Equal(t, ErrMalformedSyncFrame, err)
+	require.Equal(t, []int32{http.StatusNoContent}, statuses)
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+// rateLimiter is a token bucket refilled at rate per second, which allows
+// bursts up to the rate. Tokens are taken in advance, and the caller sleeps
+// until the debt is paid back. A nil limiter is unlimited.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns the time to wait before using them
+func (l *rateLimiter) reserve(n int64) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// replicationThrottle limits the objects pushed to remotes by the RPC
+// server, shared by all the policies of the node. A nil throttle is
+// unlimited.
+type replicationThrottle struct {
+	sync.Mutex
+	nodeBytes *rateLimiter
+	objects   *rateLimiter
+	deviceBPS int64
+	devices   map[string]*rateLimiter
+	hostSyncs int64
+	hosts     map[string]chan struct{}
+
+	// Throttle state
+	activeSyncs  int64
+	waitingSyncs int64
+	sleeping     int64
+
+	activeGauge   tally.Gauge
+	waitingGauge  tally.Gauge
+	sleepingGauge tally.Gauge
+	throttled     tally.Counter
+}
+
+func newReplicationThrottle(cfg *PackConfig) *replicationThrottle {
+	t := &replicationThrottle{
+		nodeBytes: newRateLimiter(cfg.ReplicationNodeBPS),
+		objects:   newRateLimiter(cfg.ReplicationOPS),
+		deviceBPS: cfg.ReplicationDeviceBPS,
+		devices:   make(map[string]*rateLimiter),
+		hostSyncs: cfg.ReplicationHostSyncs,
+		hosts:     make(map[string]chan struct{}),
+	}
+	t.setMetricsScope(tally.NoopScope)
+
+	return t
+}
+
+func (t *replicationThrottle) setMetricsScope(scope tally.Scope) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.activeGauge = scope.Gauge("replication_active_syncs")
+	t.waitingGauge = scope.Gauge("replication_waiting_syncs")
+	t.sleepingGauge = scope.Gauge("replication_throttled_transfers")
+	t.throttled = scope.Counter("replication_throttled_ms")
+	t.report()
+}
+
+// Must be called with the lock held
+func (t *replicationThrottle) report() {
+	t.activeGauge.Update(float64(t.activeSyncs))
+	t.waitingGauge.Update(float64(t.waitingSyncs))
+	t.sleepingGauge.Update(float64(t.sleeping))
+}
+
+// acquireHost blocks until there is a free sync slot of the remote host.
+// The returned function releases the slot.
+func (t *replicationThrottle) acquireHost(host string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.Lock()
+	var slots chan struct{}
+	if t.hostSyncs > 0 {
+		slots = t.hosts[host]
+		if slots == nil {
+			slots = make(chan struct{}, t.hostSyncs)
+			t.hosts[host] = slots
+		}
+	}
+	t.waitingSyncs++
+	t.report()
+	t.Unlock()
+
+	if slots != nil {
+		slots <- struct{}{}
+	}
+
+	t.Lock()
+	t.waitingSyncs--
+	t.activeSyncs++
+	t.report()
+	t.Unlock()
+
+	return func() {
+		if slots != nil {
+			<-slots
+		}
+		t.Lock()
+		t.activeSyncs--
+		t.report()
+		t.Unlock()
+	}
+}
+
+func (t *replicationThrottle) deviceLimiter(device string) *rateLimiter {
+	if t.deviceBPS <= 0 {
+		return nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	l, ok := t.devices[device]
+	if !ok {
+		l = newRateLimiter(t.deviceBPS)
+		t.devices[device] = l
+	}
+
+	return l
+}
+
+// wait sleeps until the bytes and objects sent from the device are allowed
+// by all the limits.
+func (t *replicationThrottle) wait(device string, bytes, objects int64) {
+	if t == nil {
+		return
+	}
+
+	var delay time.Duration
+	if bytes > 0 {
+		for _, l := range []*rateLimiter{t.nodeBytes, t.deviceLimiter(device)} {
+			if d := l.reserve(bytes); d > delay {
+				delay = d
+			}
+		}
+	}
+	if objects > 0 {
+		if d := t.objects.reserve(objects); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return
+	}
+
+	t.Lock()
+	t.sleeping++
+	t.throttled.Inc(int64(delay / time.Millisecond))
+	t.report()
+	t.Unlock()
+
+	time.Sleep(delay)
+
+	t.Lock()
+	t.sleeping--
+	t.report()
+	t.Unlock()
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	device   string
+	throttle *replicationThrottle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	w.throttle.wait(w.device, int64(len(p)), 0)
+	return w.w.Write(p)
+}
+
+// Readers and writers are wrapped only if bytes are limited, so that
+// sendfile of data readers is still used otherwise.
+func (t *replicationThrottle) limitsBytes() bool {
+	return t != nil && (t.nodeBytes != nil || t.deviceBPS > 0)
+}
+
+func (t *replicationThrottle) writer(w io.Writer, device string) io.Writer {
+	if !t.limitsBytes() {
+		return w
+	}
+
+	return &throttledWriter{w: w, device: device, throttle: t}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	device   string
+	throttle *replicationThrottle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.throttle.wait(r.device, int64(n), 0)
+	return n, err
+}
+
+func (t *replicationThrottle) reader(
+	r io.ReadCloser, device string) io.ReadCloser {
+	if !t.limitsBytes() {
+		return r
+	}
+
+	return &throttledReader{ReadCloser: r, device: device, throttle: t}
+}
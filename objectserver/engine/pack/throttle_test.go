@@ -0,0 +1,77 @@
+// Copyright (c) 2016-2018 iQIYI.com.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	require.Nil(t, newRateLimiter(0))
+	require.Equal(t, time.Duration(0), unlimited.reserve(SIZE_1M))
+
+	// Burst of one second is allowed, then the debt is paid back
+	l := newRateLimiter(SIZE_1K)
+	require.Equal(t, time.Duration(0), l.reserve(SIZE_1K))
+	d := l.reserve(SIZE_1K / 2)
+	require.True(t, d > 400*time.Millisecond && d <= 500*time.Millisecond, d)
+}
+
+func TestReplicationThrottle(t *testing.T) {
+	var unlimited *replicationThrottle
+	unlimited.acquireHost("127.0.0.1")()
+	unlimited.wait(PACK_DEVICE, SIZE_1M, 1)
+	buf := new(bytes.Buffer)
+	require.Equal(t, buf, unlimited.writer(buf, PACK_DEVICE))
+
+	throttle := newReplicationThrottle(&PackConfig{
+		ReplicationDeviceBPS: 4 * SIZE_1K,
+		ReplicationHostSyncs: 1,
+	})
+
+	// Syncs to the same host wait for the slot
+	release := throttle.acquireHost("127.0.0.1")
+	acquired := make(chan func())
+	go func() { acquired <- throttle.acquireHost("127.0.0.1") }()
+	throttle.acquireHost("127.0.0.2")()
+	select {
+	case <-acquired:
+		t.Fatal("sync slot of the host is not limited")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	(<-acquired)()
+	require.Equal(t, int64(0), throttle.activeSyncs)
+	require.Equal(t, int64(0), throttle.waitingSyncs)
+
+	// Bytes beyond the burst of the device are delayed
+	w := throttle.writer(buf, PACK_DEVICE)
+	start := time.Now()
+	_, err := w.Write(make([]byte, 6*SIZE_1K))
+	require.Nil(t, err)
+	require.True(t, time.Since(start) >= 400*time.Millisecond)
+	require.Equal(t, 6*SIZE_1K, buf.Len())
+
+	// Other devices are not affected
+	start = time.Now()
+	_, err = throttle.writer(buf, "sdb").Write(make([]byte, 4*SIZE_1K))
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
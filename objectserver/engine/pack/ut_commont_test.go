@@ -19,6 +19,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -192,6 +193,20 @@ func feedObject(obj *PackObject, device *PackDevice) error {
 	return err
 }
 
+// Creates a bundle of version 1 for the partition
+func formatBundleFileV1(d *PackDevice, partition string) error {
+	bp := filepath.Join(d.objectsDir, partition, BundleFileName)
+	if err := os.MkdirAll(filepath.Dir(bp), 0755); err != nil {
+		return err
+	}
+
+	sb := &SuperBlock{Version: BundleVersion1}
+	header := make([]byte, SuperBlockDiskSize)
+	copy(header, sb.Bytes())
+
+	return ioutil.WriteFile(bp, header, BundleFileMode)
+}
+
 func fileSize(filePath string) int64 {
 	info, err := os.Stat(filePath)
 	if err != nil {
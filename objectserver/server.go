@@ -104,6 +104,11 @@ func (s *ObjectServer) buildHandler(config conf.Config) http.Handler {
 			CachedReporter: reporter,
 			Separator:      promreporter.DefaultSeparator,
 		}, time.Second)
+	for _, e := range s.objEngines {
+		if r, ok := e.(engine.MetricsReporter); ok {
+			r.SetMetricsScope(metricsScope)
+		}
+	}
 
 	wares := alice.New(
 		s.RequestLogger,
@@ -139,6 +144,10 @@ func (s *ObjectServer) buildHandler(config conf.Config) http.Handler {
 			p.Index, http.HandlerFunc(s.ReplicateHandler))
 		router.HandlePolicy("DIFF", "/:device/:partition",
 			p.Index, http.HandlerFunc(s.DiffReplicasHandler))
+		router.HandlePolicy("SYNC", "/:device/:partition",
+			p.Index, http.HandlerFunc(s.SyncObjectsHandler))
+		router.HandlePolicy("TREE", "/:device/:partition/:suffixes",
+			p.Index, http.HandlerFunc(s.PartitionTreeHandler))
 	}
 
 	router.NotFoundHandler = http.HandlerFunc(
@@ -57,6 +57,20 @@ func (s *ObjectServer) newObject(req *http.Request,
 	return engine.New(vars, needData)
 }
 
+// Updates to a read-only device are rejected as if the device is
+// unmounted, so that proxy server and replicators turn to handoffs.
+func (s *ObjectServer) isReadOnly(req *http.Request, device string) bool {
+	p := 0
+	if pi := req.Header.Get(common.XBackendPolicyIndex); pi != "" {
+		var err error
+		if p, err = strconv.Atoi(pi); err != nil {
+			return false
+		}
+	}
+	c, ok := s.objEngines[p].(engine.ReadOnlyChecker)
+	return ok && c.IsReadOnly(device)
+}
+
 func resolveEtag(req *http.Request, metadata map[string]string) string {
 	etag := metadata["ETag"]
 	for _, ph := range strings.Split(
@@ -233,6 +247,12 @@ func (s *ObjectServer) ObjGetHandler(w http.ResponseWriter, req *http.Request) {
 
 func (s *ObjectServer) ObjPutHandler(w http.ResponseWriter, req *http.Request) {
 	vars := srv.GetVars(req)
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
 	outHeaders := w.Header()
 
 	timestamp, err := common.StandardizeTimestamp(
@@ -368,6 +388,12 @@ func (s *ObjectServer) ObjPutHandler(w http.ResponseWriter, req *http.Request) {
 func (s *ObjectServer) ObjPostHandler(
 	w http.ResponseWriter, req *http.Request) {
 	vars := srv.GetVars(req)
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
 	// Simple solution to indicate that we need to migrate a object
 	vars["quse-migration"] = "yes"
 
@@ -466,6 +492,12 @@ func (s *ObjectServer) ObjPostHandler(
 func (s *ObjectServer) ObjDeleteHandler(
 	w http.ResponseWriter, req *http.Request) {
 	vars := srv.GetVars(req)
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
 	// Simple solution to indicate that we need to migrate a object
 	vars["quse-migration"] = "yes"
 	headers := w.Header()
@@ -584,6 +616,12 @@ func (s *ObjectServer) ReplicateHandler(
 		}
 	}
 
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
 	var recalculate []string
 	if len(vars["suffixes"]) > 0 {
 		recalculate = strings.Split(vars["suffixes"], "-")
@@ -600,14 +638,21 @@ func (s *ObjectServer) ReplicateHandler(
 		policy = 0
 	}
 
-	engine, ok := s.objEngines[policy]
+	eng, ok := s.objEngines[policy]
 	if !ok {
 		common.CustomResponse(w, http.StatusBadRequest, ReqPolicyNotFound)
 		return
 	}
 
-	hashes, err := engine.GetHashes(
-		vars["device"], vars["partition"], recalculate)
+	var hashes map[string]string
+	hasher, ok := eng.(engine.SummaryHasher)
+	if ok && req.Header.Get(common.XBackendSuffixHash) == engine.SummarySuffixHash {
+		w.Header().Set(common.XBackendSuffixHash, engine.SummarySuffixHash)
+		hashes, err = hasher.GetSummaryHashes(vars["device"], vars["partition"])
+	} else {
+		hashes, err = eng.GetHashes(
+			vars["device"], vars["partition"], recalculate)
+	}
 
 	if err != nil {
 		s.logger.Error("unable to get hashes",
@@ -634,6 +679,12 @@ func (s *ObjectServer) DiffReplicasHandler(
 		}
 	}
 
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
 	var err error
 
 	policy := 0
@@ -694,3 +745,141 @@ func (s *ObjectServer) DiffReplicasHandler(
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
+
+func (s *ObjectServer) SyncObjectsHandler(
+	w http.ResponseWriter, req *http.Request) {
+	vars := srv.GetVars(req)
+
+	if s.checkMounts {
+		devPath := filepath.Join(s.driveRoot, vars["device"])
+		if mounted, err := fs.IsMount(devPath); err != nil || mounted != true {
+			vars["Method"] = req.Method
+			common.StandardResponse(w, http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
+	var err error
+
+	policy := 0
+	pi := req.Header.Get(common.XBackendPolicyIndex)
+	if pi != "" {
+		if policy, err = strconv.Atoi(pi); err != nil {
+			common.StandardResponse(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	eng, ok := s.objEngines[policy]
+	if !ok {
+		common.CustomResponse(w, http.StatusBadRequest, ReqPolicyNotFound)
+		return
+	}
+
+	engine, ok := eng.(*pack.PackEngine)
+	if !ok {
+		common.CustomResponse(w, http.StatusBadRequest, ReqNotPackEngine)
+		return
+	}
+
+	// Frames committed before a broken one are still replied, so that the
+	// sender learns which objects are synced.
+	statuses, err := engine.SyncObjects(
+		vars["device"], vars["partition"], req.Body)
+	if err == pack.ErrPackDeviceNotFound {
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		s.logger.Error("unable to receive sync stream", zap.Error(err))
+	}
+
+	b, err := proto.Marshal(&pack.SyncResults{Statuses: statuses})
+	if err != nil {
+		s.logger.Error("unable to serialize response body", zap.Error(err))
+		common.StandardResponse(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func (s *ObjectServer) PartitionTreeHandler(
+	w http.ResponseWriter, req *http.Request) {
+	vars := srv.GetVars(req)
+
+	if s.checkMounts {
+		devPath := filepath.Join(s.driveRoot, vars["device"])
+		if mounted, err := fs.IsMount(devPath); err != nil || mounted != true {
+			vars["Method"] = req.Method
+			common.StandardResponse(w, http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	if s.isReadOnly(req, vars["device"]) {
+		vars["Method"] = req.Method
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+
+	var suffixes []string
+	if len(vars["suffixes"]) > 0 {
+		suffixes = strings.Split(vars["suffixes"], "-")
+	}
+
+	var err error
+
+	policy := 0
+	pi := req.Header.Get(common.XBackendPolicyIndex)
+	if pi != "" {
+		if policy, err = strconv.Atoi(pi); err != nil {
+			common.StandardResponse(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	eng, ok := s.objEngines[policy]
+	if !ok {
+		common.CustomResponse(w, http.StatusBadRequest, ReqPolicyNotFound)
+		return
+	}
+
+	engine, ok := eng.(*pack.PackEngine)
+	if !ok {
+		common.CustomResponse(w, http.StatusBadRequest, ReqNotPackEngine)
+		return
+	}
+
+	tree, err := engine.PartitionTree(
+		vars["device"], vars["partition"], suffixes)
+	if err == pack.ErrPackDeviceNotFound {
+		common.StandardResponse(w, http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		s.logger.Error("unable to build partition tree",
+			zap.String("device", vars["device"]),
+			zap.String("partition", vars["partition"]),
+			zap.Error(err))
+		common.StandardResponse(w, http.StatusInternalServerError)
+		return
+	}
+
+	b, err := proto.Marshal(tree)
+	if err != nil {
+		s.logger.Error("unable to serialize response body", zap.Error(err))
+		common.StandardResponse(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}